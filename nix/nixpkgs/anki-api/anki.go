@@ -3,14 +3,30 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"sync/atomic"
+)
 
-	_ "github.com/mattn/go-sqlite3"
+var (
+	// ErrNotFound is wrapped by errors for notes, cards and decks that do
+	// not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDeckNotFound is the ErrNotFound for a deck name.
+	ErrDeckNotFound = fmt.Errorf("%w", ErrNotFound)
 )
 
 type AnkiDB struct {
-	db *sql.DB
+	db       *sql.DB
+	path     string
+	schema   collectionSchema
+	version  int
+	writable bool
+	index    *searchIndex
+	// committed is the collection's files as the last write left them.
+	committed atomic.Pointer[diskState]
 }
 
 type Deck struct {
@@ -19,10 +35,11 @@ type Deck struct {
 }
 
 type Note struct {
-	ID     int64             `json:"id"`
-	Model  string            `json:"model"`
-	Fields map[string]string `json:"fields"`
-	Tags   string            `json:"tags"`
+	ID      int64             `json:"id"`
+	Model   string            `json:"model"`
+	Fields  map[string]string `json:"fields"`
+	Tags    string            `json:"tags"`
+	Snippet string            `json:"snippet,omitempty"`
 }
 
 type Model struct {
@@ -32,20 +49,42 @@ type Model struct {
 }
 
 type Stats struct {
-	Notes  int `json:"notes"`
-	Cards  int `json:"cards"`
-	Decks  int `json:"decks"`
-	Models int `json:"models"`
+	Notes         int `json:"notes"`
+	Cards         int `json:"cards"`
+	Decks         int `json:"decks"`
+	Models        int `json:"models"`
+	SchemaVersion int `json:"schema_version"`
 }
 
 type noteType struct {
-	ID     int64
-	Name   string
-	Fields []string
+	ID        int64
+	Name      string
+	Fields    []string
+	Cloze     bool
+	SortField int
+	Templates []cardTemplate
+	CSS       string
+}
+
+type cardTemplate struct {
+	Name string
+	Ord  int
+	QFmt string
+	AFmt string
 }
 
-func OpenAnkiDB(path string) (*AnkiDB, error) {
-	db, err := sql.Open("sqlite3", path+"?_busy_timeout=30000&mode=ro")
+// OpenAnkiDB opens the collection at path. Unless writable is set the
+// handle is opened read-only; writable handles begin transactions with
+// BEGIN IMMEDIATE and give up sooner when another process holds the lock.
+func OpenAnkiDB(path string, writable bool) (*AnkiDB, error) {
+	// mode is only honoured for file: URIs.
+	dsn := "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	if writable {
+		dsn += "?_busy_timeout=5000&_txlock=immediate&mode=rw"
+	} else {
+		dsn += "?_busy_timeout=30000&mode=ro"
+	}
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("opening sqlite: %w", err)
 	}
@@ -55,107 +94,72 @@ func OpenAnkiDB(path string) (*AnkiDB, error) {
 		_ = db.Close()
 		return nil, fmt.Errorf("pinging sqlite: %w", err)
 	}
-	return &AnkiDB{db: db}, nil
+	version, schema, err := detectSchema(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &AnkiDB{db: db, path: path, schema: schema, version: version, writable: writable}, nil
+}
+
+// Reopen opens the collection afresh, picking up a replaced file or an
+// upgraded schema. The search index moves to the new handle; the caller
+// must stop using a once the new handle is in service, and close it.
+func (a *AnkiDB) Reopen() (*AnkiDB, error) {
+	next, err := OpenAnkiDB(a.path, a.writable)
+	if err != nil {
+		return nil, err
+	}
+	next.index = a.index
+	return next, nil
 }
 
 func (a *AnkiDB) Close() error {
+	if a.index != nil {
+		_ = a.index.Close()
+	}
 	return a.db.Close()
 }
 
 func (a *AnkiDB) ListDecks() ([]Deck, error) {
-	row := a.db.QueryRow("SELECT decks FROM col")
-	var decksJSON string
-	if err := row.Scan(&decksJSON); err != nil {
-		return nil, fmt.Errorf("reading decks: %w", err)
-	}
-
-	var raw map[string]json.RawMessage
-	if err := json.Unmarshal([]byte(decksJSON), &raw); err != nil {
-		return nil, fmt.Errorf("parsing decks JSON: %w", err)
-	}
-
-	decks := make([]Deck, 0, len(raw))
-	for idStr, v := range raw {
-		var d struct {
-			Name string `json:"name"`
-		}
-		if err := json.Unmarshal(v, &d); err != nil {
-			continue
-		}
-		var id int64
-		_, _ = fmt.Sscanf(idStr, "%d", &id)
-		decks = append(decks, Deck{ID: id, Name: d.Name})
-	}
-	return decks, nil
+	return a.schema.decks(a.db)
 }
 
-func (a *AnkiDB) ListNotes(deckName string) ([]Note, error) {
+// deckFilter returns a condition on cards c matching the deck named
+// deckName and, if recursive, its subdecks. A recursive name need not be a
+// deck itself, so "A" covers "A::B" and "A::C" even with no deck "A".
+func (a *AnkiDB) deckFilter(deckName string, recursive bool) (string, any, error) {
 	decks, err := a.ListDecks()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-
-	var deckID int64
+	var ids []int64
 	for _, d := range decks {
-		if d.Name == deckName {
-			deckID = d.ID
-			break
+		if d.Name == deckName || recursive && strings.HasPrefix(d.Name, deckName+"::") {
+			ids = append(ids, d.ID)
 		}
 	}
-	if deckID == 0 {
-		return nil, fmt.Errorf("deck %q not found", deckName)
+	if len(ids) == 0 {
+		return "", nil, fmt.Errorf("deck %q %w", deckName, ErrDeckNotFound)
 	}
-
-	models, err := a.getNoteTypes()
-	if err != nil {
-		return nil, err
+	if len(ids) == 1 {
+		return "c.did = ?", ids[0], nil
 	}
-	modelsByID := make(map[int64]noteType, len(models))
-	for _, m := range models {
-		modelsByID[m.ID] = m
-	}
-
-	rows, err := a.db.Query(`
-		SELECT n.id, n.mid, n.flds, n.tags
-		FROM notes n
-		JOIN cards c ON c.nid = n.id
-		WHERE c.did = ?
-		GROUP BY n.id
-	`, deckID)
+	idsJSON, err := json.Marshal(ids)
 	if err != nil {
-		return nil, fmt.Errorf("querying notes: %w", err)
+		return "", nil, err
 	}
-	defer func() { _ = rows.Close() }()
-
-	var notes []Note
-	for rows.Next() {
-		var id, mid int64
-		var flds, tags string
-		if err := rows.Scan(&id, &mid, &flds, &tags); err != nil {
-			return nil, err
-		}
-
-		fields := make(map[string]string)
-		parts := strings.Split(flds, "\x1f")
-		if m, ok := modelsByID[mid]; ok {
-			for i, name := range m.Fields {
-				if i < len(parts) {
-					fields[name] = parts[i]
-				}
-			}
-		}
+	return "c.did IN (SELECT value FROM json_each(?))", string(idsJSON), nil
+}
 
-		notes = append(notes, Note{
-			ID:     id,
-			Model:  modelsByID[mid].Name,
-			Fields: fields,
-			Tags:   strings.TrimSpace(tags),
-		})
-	}
-	if notes == nil {
-		notes = []Note{}
+// ListNotes returns a page of the notes with a card in deckName, or if
+// recursive in it or its subdecks, and the total number of such notes.
+func (a *AnkiDB) ListNotes(deckName string, recursive bool, opts ListOptions) ([]Note, int, error) {
+	where, arg, err := a.deckFilter(deckName, recursive)
+	if err != nil {
+		return nil, 0, err
 	}
-	return notes, rows.Err()
+	return a.queryNotes(where, []any{arg}, opts, nil)
 }
 
 func (a *AnkiDB) GetNote(id int64) (*Note, error) {
@@ -172,7 +176,7 @@ func (a *AnkiDB) GetNote(id int64) (*Note, error) {
 	var flds, tags string
 	err = a.db.QueryRow("SELECT mid, flds, tags FROM notes WHERE id = ?", id).Scan(&mid, &flds, &tags)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("note %d not found", id)
+		return nil, fmt.Errorf("note %d %w", id, ErrNotFound)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("querying note: %w", err)
@@ -196,82 +200,57 @@ func (a *AnkiDB) GetNote(id int64) (*Note, error) {
 	}, nil
 }
 
-func (a *AnkiDB) SearchNotes(query string, deckName string) ([]Note, error) {
-	models, err := a.getNoteTypes()
+// SearchNotes returns a page of the notes matching query, in Anki's search
+// syntax, optionally restricted to notes with a card in deckName (and its
+// subdecks, if recursive), and the total number of matches. With the
+// full-text index enabled, searches for text are narrowed by the index
+// first, ordered by relevance unless opts.Sort is set, and carry a
+// highlighted snippet.
+func (a *AnkiDB) SearchNotes(query string, deckName string, recursive bool, opts ListOptions) ([]Note, int, error) {
+	return a.SearchNotesWithin(query, "", deckName, recursive, opts)
+}
+
+// SearchNotesWithin is SearchNotes limited to the notes matching scope, if
+// set. The two queries are parsed apart and joined as separate nodes, so
+// nothing in query can escape scope.
+func (a *AnkiDB) SearchNotesWithin(query, scope, deckName string, recursive bool, opts ListOptions) ([]Note, int, error) {
+	node, err := parseSearch(query)
 	if err != nil {
-		return nil, err
-	}
-	modelsByID := make(map[int64]noteType, len(models))
-	for _, m := range models {
-		modelsByID[m.ID] = m
+		return nil, 0, err
 	}
-
-	likeParam := "%" + query + "%"
-	var rows *sql.Rows
-
-	if deckName != "" {
-		decks, err := a.ListDecks()
+	compiled := node
+	if scope != "" {
+		scopeNode, err := parseSearch(scope)
 		if err != nil {
-			return nil, err
-		}
-		var deckID int64
-		for _, d := range decks {
-			if d.Name == deckName {
-				deckID = d.ID
-				break
-			}
+			return nil, 0, err
 		}
-		if deckID == 0 {
-			return nil, fmt.Errorf("deck %q not found", deckName)
-		}
-		rows, err = a.db.Query(`
-			SELECT n.id, n.mid, n.flds, n.tags
-			FROM notes n
-			JOIN cards c ON c.nid = n.id
-			WHERE (n.flds LIKE ? OR n.tags LIKE ?) AND c.did = ?
-			GROUP BY n.id
-		`, likeParam, likeParam, deckID)
-		if err != nil {
-			return nil, fmt.Errorf("searching notes: %w", err)
-		}
-	} else {
-		rows, err = a.db.Query(`
-			SELECT id, mid, flds, tags FROM notes
-			WHERE flds LIKE ? OR tags LIKE ?
-		`, likeParam, likeParam)
+		compiled = searchAnd{node, scopeNode}
+	}
+	where, args, err := a.compileSearch(compiled)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rank *noteRank
+	if phrases := indexPhrases(node); a.index != nil && len(phrases) > 0 {
+		rank, err = a.indexLookup(phrases)
 		if err != nil {
-			return nil, fmt.Errorf("searching notes: %w", err)
+			log.Printf("search index unavailable, scanning: %v", err)
+		} else {
+			where = "(" + where + ") AND n.id IN (SELECT value FROM json_each(?))"
+			args = append(args, rank.ids)
 		}
 	}
-	defer func() { _ = rows.Close() }()
 
-	var notes []Note
-	for rows.Next() {
-		var nid, mid int64
-		var flds, tags string
-		if err := rows.Scan(&nid, &mid, &flds, &tags); err != nil {
-			return nil, err
-		}
-		fields := make(map[string]string)
-		parts := strings.Split(flds, "\x1f")
-		if m, ok := modelsByID[mid]; ok {
-			for i, name := range m.Fields {
-				if i < len(parts) {
-					fields[name] = parts[i]
-				}
-			}
+	if deckName != "" {
+		deckWhere, arg, err := a.deckFilter(deckName, recursive)
+		if err != nil {
+			return nil, 0, err
 		}
-		notes = append(notes, Note{
-			ID:     nid,
-			Model:  modelsByID[mid].Name,
-			Fields: fields,
-			Tags:   strings.TrimSpace(tags),
-		})
-	}
-	if notes == nil {
-		notes = []Note{}
+		where = "(" + where + ") AND " + deckWhere
+		args = append(args, arg)
 	}
-	return notes, rows.Err()
+	return a.queryNotes(where, args, opts, rank)
 }
 
 func (a *AnkiDB) GetNoteTypes() ([]Model, error) {
@@ -281,7 +260,7 @@ func (a *AnkiDB) GetNoteTypes() ([]Model, error) {
 	}
 	models := make([]Model, len(types))
 	for i, t := range types {
-		models[i] = Model(t)
+		models[i] = Model{ID: t.ID, Name: t.Name, Fields: t.Fields}
 	}
 	return models, nil
 }
@@ -295,18 +274,13 @@ func (a *AnkiDB) GetStats() (*Stats, error) {
 		return nil, fmt.Errorf("counting cards: %w", err)
 	}
 
-	var decksJSON, modelsJSON string
-	if err := a.db.QueryRow("SELECT decks, models FROM col").Scan(&decksJSON, &modelsJSON); err != nil {
-		return nil, fmt.Errorf("reading col: %w", err)
-	}
-
-	var decks map[string]json.RawMessage
-	if err := json.Unmarshal([]byte(decksJSON), &decks); err != nil {
-		return nil, fmt.Errorf("parsing decks: %w", err)
+	decks, err := a.ListDecks()
+	if err != nil {
+		return nil, err
 	}
-	var models map[string]json.RawMessage
-	if err := json.Unmarshal([]byte(modelsJSON), &models); err != nil {
-		return nil, fmt.Errorf("parsing models: %w", err)
+	models, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
 	}
 
 	return &Stats{
@@ -314,45 +288,11 @@ func (a *AnkiDB) GetStats() (*Stats, error) {
 		Cards:  cardCount,
 		Decks:  len(decks),
 		Models: len(models),
+
+		SchemaVersion: a.version,
 	}, nil
 }
 
 func (a *AnkiDB) getNoteTypes() ([]noteType, error) {
-	row := a.db.QueryRow("SELECT models FROM col")
-	var modelsJSON string
-	if err := row.Scan(&modelsJSON); err != nil {
-		return nil, fmt.Errorf("reading models: %w", err)
-	}
-
-	var raw map[string]json.RawMessage
-	if err := json.Unmarshal([]byte(modelsJSON), &raw); err != nil {
-		return nil, fmt.Errorf("parsing models JSON: %w", err)
-	}
-
-	var types []noteType
-	for _, v := range raw {
-		var m struct {
-			ID   int64  `json:"id"`
-			Name string `json:"name"`
-			Flds []struct {
-				Name string `json:"name"`
-				Ord  int    `json:"ord"`
-			} `json:"flds"`
-		}
-		if err := json.Unmarshal(v, &m); err != nil {
-			continue
-		}
-		fields := make([]string, len(m.Flds))
-		for _, f := range m.Flds {
-			if f.Ord < len(fields) {
-				fields[f.Ord] = f.Name
-			}
-		}
-		types = append(types, noteType{
-			ID:     m.ID,
-			Name:   m.Name,
-			Fields: fields,
-		})
-	}
-	return types, nil
+	return a.schema.noteTypes(a.db)
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const fixtureSharedDDL = legacyTablesDDL + `
+INSERT INTO notes VALUES (100, 'guid100', 10, 0, 0, ' go ', 'chan' || char(31) || 'typed pipe', 'typed pipe', 0, 0, '');
+INSERT INTO cards VALUES (1000, 100, 5, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, '');
+`
+
+const fixtureLegacyDDL = legacyColDDL + `
+INSERT INTO col VALUES (1, 0, 0, 0, 11, 0, 0, 0, '{}', '{
+	"10": {"id": 10, "name": "Basic (and reversed)", "type": 0, "sortf": 1,
+		"flds": [{"name": "Front", "ord": 0}, {"name": "Back", "ord": 1}],
+		"tmpls": [{"name": "Card 1", "ord": 0, "qfmt": "{{Front}}"}, {"name": "Card 2", "ord": 1, "qfmt": "{{#Back}}{{text:Back}}{{/Back}}"}]},
+	"20": {"id": 20, "name": "Cloze", "type": 1, "sortf": 0,
+		"flds": [{"name": "Text", "ord": 0}, {"name": "Extra", "ord": 1}],
+		"tmpls": [{"name": "Cloze", "ord": 0, "qfmt": "{{cloze:Text}}"}]}
+}', '{"1": {"id": 1, "name": "Default"}, "5": {"id": 5, "name": "Lang::Go"}}', '{}', '{}');
+`
+
+const fixtureModernDDL = `
+CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null, scm integer not null, ver integer not null, dty integer not null, usn integer not null, ls integer not null, conf text not null, models text not null, decks text not null, dconf text not null, tags text not null);
+CREATE TABLE graves (oid integer NOT NULL, type integer NOT NULL, usn integer NOT NULL, PRIMARY KEY (oid, type)) WITHOUT ROWID;
+CREATE TABLE notetypes (id integer NOT NULL PRIMARY KEY, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, config blob NOT NULL);
+CREATE UNIQUE INDEX idx_notetypes_name ON notetypes (name);
+CREATE TABLE fields (ntid integer NOT NULL, ord integer NOT NULL, name text NOT NULL COLLATE unicase, config blob NOT NULL, PRIMARY KEY (ntid, ord)) WITHOUT ROWID;
+CREATE UNIQUE INDEX idx_fields_name_ntid ON fields (name, ntid);
+CREATE TABLE templates (ntid integer NOT NULL, ord integer NOT NULL, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, config blob NOT NULL, PRIMARY KEY (ntid, ord)) WITHOUT ROWID;
+CREATE UNIQUE INDEX idx_templates_name_ntid ON templates (name, ntid);
+CREATE TABLE decks (id integer PRIMARY KEY NOT NULL, name text NOT NULL COLLATE unicase, mtime_secs integer NOT NULL, usn integer NOT NULL, common blob NOT NULL, kind blob NOT NULL);
+CREATE UNIQUE INDEX idx_decks_name ON decks (name);
+CREATE TABLE tags (tag text NOT NULL PRIMARY KEY COLLATE unicase, usn integer NOT NULL, collapsed boolean NOT NULL, config blob NULL) WITHOUT ROWID;
+INSERT INTO col VALUES (1, 0, 0, 0, 18, 0, 0, 0, '', '', '', '', '');
+INSERT INTO decks VALUES (1, 'Default', 0, 0, x'', x''), (5, 'Lang' || char(31) || 'Go', 0, 0, x'', x'');
+INSERT INTO fields VALUES (10, 0, 'Front', x''), (10, 1, 'Back', x''), (20, 0, 'Text', x''), (20, 1, 'Extra', x'');
+`
+
+// newCollection writes a fixture collection with the given layout: decks
+// Default and Lang::Go, note types "Basic (and reversed)" (sorting on Back)
+// and Cloze, and one Basic note in Lang::Go.
+func newCollection(t *testing.T, modern bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "collection.anki2")
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ddl := fixtureLegacyDDL
+	if modern {
+		ddl = fixtureModernDDL
+	}
+	if _, err := db.Exec(ddl + fixtureSharedDDL); err != nil {
+		t.Fatalf("creating fixture: %v", err)
+	}
+	if !modern {
+		return path
+	}
+
+	notetypes := []struct {
+		id        int64
+		name      string
+		config    []byte
+		templates map[string]string
+	}{
+		{10, "Basic (and reversed)", protoVarint(2, 1), map[string]string{"Card 1": "{{Front}}", "Card 2": "{{#Back}}{{text:Back}}{{/Back}}"}},
+		{20, "Cloze", protoVarint(1, 1), map[string]string{"Cloze": "{{cloze:Text}}"}},
+	}
+	for _, nt := range notetypes {
+		if _, err := db.Exec("INSERT INTO notetypes VALUES (?, ?, 0, 0, ?)", nt.id, nt.name, nt.config); err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(nt.templates))
+		for name := range nt.templates {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for ord, name := range names {
+			config := protoBytes(1, nt.templates[name])
+			if _, err := db.Exec("INSERT INTO templates VALUES (?, ?, ?, 0, 0, ?)", nt.id, ord, name, config); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return path
+}
+
+func protoVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field)<<3), v)
+}
+
+func protoBytes(field int, s string) []byte {
+	b := binary.AppendUvarint(nil, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+var fixtureLayouts = []struct {
+	name    string
+	modern  bool
+	version int
+}{
+	{"legacy", false, 11},
+	{"modern", true, 18},
+}
+
+func openFixture(t *testing.T, modern, writable bool) *AnkiDB {
+	t.Helper()
+	db, err := OpenAnkiDB(newCollection(t, modern), writable)
+	if err != nil {
+		t.Fatalf("OpenAnkiDB() error = %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// execCollection modifies the collection behind a read-only AnkiDB, as
+// Anki desktop would while the server is running.
+func execCollection(t *testing.T, db *AnkiDB, query string) {
+	t.Helper()
+	var seq int
+	var name, path string
+	if err := db.db.QueryRow("PRAGMA database_list").Scan(&seq, &name, &path); err != nil {
+		t.Fatal(err)
+	}
+	execCollectionPath(t, path, query)
+}
+
+func execCollectionPath(t *testing.T, path, query string) {
+	t.Helper()
+	rw, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rw.Close() }()
+	if _, err := rw.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchemaLayouts(t *testing.T) {
+	for _, layout := range fixtureLayouts {
+		t.Run(layout.name, func(t *testing.T) {
+			db := openFixture(t, layout.modern, false)
+
+			decks, err := db.ListDecks()
+			if err != nil {
+				t.Fatalf("ListDecks() error = %v", err)
+			}
+			var names []string
+			for _, d := range decks {
+				names = append(names, d.Name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, []string{"Default", "Lang::Go"}) {
+				t.Errorf("decks = %v", names)
+			}
+
+			types, err := db.getNoteTypes()
+			if err != nil {
+				t.Fatalf("getNoteTypes() error = %v", err)
+			}
+			byName := map[string]noteType{}
+			for _, nt := range types {
+				byName[nt.Name] = nt
+			}
+			basic, cloze := byName["Basic (and reversed)"], byName["Cloze"]
+			if !slices.Equal(basic.Fields, []string{"Front", "Back"}) || basic.SortField != 1 || basic.Cloze {
+				t.Errorf("basic = %+v", basic)
+			}
+			if len(basic.Templates) != 2 || basic.Templates[1].QFmt != "{{#Back}}{{text:Back}}{{/Back}}" {
+				t.Errorf("basic templates = %+v", basic.Templates)
+			}
+			if !cloze.Cloze || !slices.Equal(cloze.Fields, []string{"Text", "Extra"}) {
+				t.Errorf("cloze = %+v", cloze)
+			}
+
+			notes, _, err := db.ListNotes("Lang::Go", false, ListOptions{})
+			if err != nil {
+				t.Fatalf("ListNotes() error = %v", err)
+			}
+			if len(notes) != 1 || notes[0].Fields["Back"] != "typed pipe" || notes[0].Tags != "go" {
+				t.Errorf("notes = %+v", notes)
+			}
+
+			stats, err := db.GetStats()
+			if err != nil {
+				t.Fatalf("GetStats() error = %v", err)
+			}
+			want := Stats{Notes: 1, Cards: 1, Decks: 2, Models: 2, SchemaVersion: layout.version}
+			if *stats != want {
+				t.Errorf("stats = %+v, want %+v", *stats, want)
+			}
+		})
+	}
+}
+
+func TestParseProto(t *testing.T) {
+	b := append(protoVarint(1, 1), protoBytes(3, "css")...)
+	b = append(b, protoVarint(2, 300)...)
+	m, err := parseProto(b)
+	if err != nil {
+		t.Fatalf("parseProto() error = %v", err)
+	}
+	if m.varint(1) != 1 || m.varint(2) != 300 || m.str(3) != "css" || m.varint(4) != 0 {
+		t.Errorf("got %+v", m)
+	}
+	if _, err := parseProto(protoBytes(1, "truncated")[:4]); err == nil {
+		t.Error("truncated message: want error")
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyTablesDDL creates the tables every collection schema shares.
+const legacyTablesDDL = `
+CREATE TABLE notes (id integer primary key, guid text not null, mid integer not null, mod integer not null, usn integer not null, tags text not null, flds text not null, sfld integer not null, csum integer not null, flags integer not null, data text not null);
+CREATE TABLE cards (id integer primary key, nid integer not null, did integer not null, ord integer not null, mod integer not null, usn integer not null, type integer not null, queue integer not null, due integer not null, ivl integer not null, factor integer not null, reps integer not null, lapses integer not null, left integer not null, odue integer not null, odid integer not null, flags integer not null, data text not null);
+CREATE TABLE revlog (id integer primary key, cid integer not null, usn integer not null, ease integer not null, ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null, type integer not null);
+CREATE INDEX ix_notes_usn ON notes (usn);
+CREATE INDEX ix_cards_usn ON cards (usn);
+CREATE INDEX ix_revlog_usn ON revlog (usn);
+CREATE INDEX ix_cards_nid ON cards (nid);
+CREATE INDEX ix_cards_sched ON cards (did, queue, due);
+CREATE INDEX ix_revlog_cid ON revlog (cid);
+CREATE INDEX ix_notes_csum ON notes (csum);
+`
+
+// legacyColDDL creates the schema 11 col and graves tables. Together with
+// legacyTablesDDL it is the layout .apkg packages use, which every Anki
+// version can import.
+const legacyColDDL = `
+CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null, scm integer not null, ver integer not null, dty integer not null, usn integer not null, ls integer not null, conf text not null, models text not null, decks text not null, dconf text not null, tags text not null);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+`
+
+const (
+	defaultLatexPre  = "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n"
+	defaultLatexPost = "\\end{document}"
+)
+
+// WriteApkg writes the export as an Anki package: a zip of a schema 11
+// collection holding the notes as new cards, plus the media they reference
+// from mediaDir and the manifest naming them.
+func (e *DeckExport) WriteApkg(w io.Writer, mediaDir string) error {
+	dir, err := os.MkdirTemp("", "anki-export-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "collection.anki2")
+	if err := e.writeCollection(path); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	if err := addZipFile(zw, "collection.anki2", path); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, n := range e.Notes {
+		for _, value := range e.fieldValues(n) {
+			for _, name := range mediaRefs(value) {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	manifest := map[string]string{}
+	for _, name := range names {
+		src, _, err := statMedia(mediaDir, name)
+		if err != nil {
+			continue
+		}
+		key := strconv.Itoa(len(manifest))
+		if err := addZipFile(zw, key, src); err != nil {
+			return err
+		}
+		manifest[key] = name
+	}
+	mw, err := zw.Create("media")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(mw).Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	dst, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// writeCollection creates a schema 11 collection at path holding the export.
+func (e *DeckExport) writeCollection(path string) error {
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		return fmt.Errorf("creating package collection: %w", err)
+	}
+	defer func() { _ = db.Close() }()
+	db.SetMaxOpenConns(1)
+
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(legacyColDDL + legacyTablesDDL); err != nil {
+		return fmt.Errorf("creating package collection: %w", err)
+	}
+
+	models, err := json.Marshal(e.legacyModels(now))
+	if err != nil {
+		return err
+	}
+	decks, err := json.Marshal(e.legacyDecks(now))
+	if err != nil {
+		return err
+	}
+	conf := `{"nextPos": ` + strconv.Itoa(len(e.cards)+1) + `, "activeDecks": [1], "curDeck": 1, "sortType": "noteFld", "sortBackwards": false, "addToCur": true, "newSpread": 0, "collapseTime": 1200, "timeLim": 0, "estTimes": true, "dueCounts": true}`
+	if _, err := tx.Exec(`
+		INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')
+	`, now.Unix(), now.UnixMilli(), now.UnixMilli(), conf, string(models), string(decks), legacyDeckConf); err != nil {
+		return fmt.Errorf("writing package col: %w", err)
+	}
+
+	for _, n := range e.Notes {
+		var nt noteType
+		for _, t := range e.types {
+			if t.ID == e.mids[n.ID] {
+				nt = t
+			}
+		}
+		fields := e.fieldValues(n)
+		sfld, csum := sortFieldAndChecksum(nt, fields)
+		if _, err := tx.Exec(`
+			INSERT INTO notes VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?, 0, '')
+		`, n.ID, n.GUID, nt.ID, now.Unix(), normaliseTags(n.Tags), strings.Join(fields, "\x1f"), sfld, csum); err != nil {
+			return fmt.Errorf("writing package note %d: %w", n.ID, err)
+		}
+	}
+	for i, c := range e.cards {
+		if _, err := tx.Exec(`
+			INSERT INTO cards VALUES (?, ?, ?, ?, ?, 0, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')
+		`, c.ID, c.NoteID, c.DeckID, c.Ord, now.Unix(), i+1); err != nil {
+			return fmt.Errorf("writing package card %d: %w", c.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// legacyModels renders the export's note types as schema 11 model JSON.
+func (e *DeckExport) legacyModels(now time.Time) map[string]any {
+	models := map[string]any{}
+	for _, nt := range e.types {
+		kind := 0
+		if nt.Cloze {
+			kind = 1
+		}
+		flds := make([]map[string]any, len(nt.Fields))
+		for i, name := range nt.Fields {
+			flds[i] = map[string]any{"name": name, "ord": i, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{}}
+		}
+		tmpls := make([]map[string]any, len(nt.Templates))
+		for i, t := range nt.Templates {
+			tmpls[i] = map[string]any{"name": t.Name, "ord": t.Ord, "qfmt": t.QFmt, "afmt": t.AFmt, "bqfmt": "", "bafmt": "", "did": nil}
+		}
+		models[strconv.FormatInt(nt.ID, 10)] = map[string]any{
+			"id": nt.ID, "name": nt.Name, "type": kind, "mod": now.Unix(), "usn": 0,
+			"sortf": nt.SortField, "did": 1, "flds": flds, "tmpls": tmpls, "css": nt.CSS,
+			"latexPre": defaultLatexPre, "latexPost": defaultLatexPost, "latexsvg": false,
+			"req": []any{}, "tags": []string{}, "vers": []any{},
+		}
+	}
+	return models
+}
+
+// legacyDecks renders the exported decks, and the Default deck every
+// collection has, as schema 11 deck JSON.
+func (e *DeckExport) legacyDecks(now time.Time) map[string]any {
+	decks := map[string]any{}
+	add := func(d Deck) {
+		decks[strconv.FormatInt(d.ID, 10)] = map[string]any{
+			"id": d.ID, "name": d.Name, "mod": now.Unix(), "usn": 0, "desc": "", "dyn": 0, "conf": 1,
+			"collapsed": false, "browserCollapsed": false, "extendNew": 0, "extendRev": 0,
+			"newToday": []int{0, 0}, "revToday": []int{0, 0}, "lrnToday": []int{0, 0}, "timeToday": []int{0, 0},
+		}
+	}
+	add(Deck{ID: 1, Name: "Default"})
+	for _, d := range e.decks {
+		add(d)
+	}
+	return decks
+}
+
+// legacyDeckConf is Anki's default deck options group in schema 11 form.
+const legacyDeckConf = `{"1": {"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60, "autoplay": true, "timer": 0, "replayq": true, "dyn": false,
+	"new": {"delays": [1, 10], "ints": [1, 4, 0], "initialFactor": 2500, "order": 1, "perDay": 20, "bury": false},
+	"rev": {"perDay": 200, "ease4": 1.3, "ivlFct": 1, "maxIvl": 36500, "hardFactor": 1.2, "bury": false},
+	"lapse": {"delays": [10], "mult": 0, "minInt": 1, "leechFails": 8, "leechAction": 1}}}`
+
+// ImportApkg adds the notes in an Anki package to deckName, skipping notes
+// whose guid the collection already has, and copies the package's media
+// into mediaDir. Note types are matched by name and fields by name, so
+// the collection must already have the package's note types.
+func (a *AnkiDB) ImportApkg(r io.ReaderAt, size int64, deckName, mediaDir string) (*ImportResult, error) {
+	if !a.writable {
+		return nil, ErrReadOnly
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: not a zip archive", ErrInvalidImport)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	// Packages for Anki 2.1 carry collection.anki21, with a placeholder
+	// collection.anki2 for older versions. collection.anki21b is zstd
+	// compressed, which needs a newer Anki to convert.
+	col := files["collection.anki21"]
+	if col == nil {
+		col = files["collection.anki2"]
+	}
+	if col == nil {
+		if files["collection.anki21b"] != nil {
+			return nil, fmt.Errorf("%w: package uses the latest format; export it with \"Support older Anki versions\"", ErrInvalidImport)
+		}
+		return nil, fmt.Errorf("%w: package has no collection", ErrInvalidImport)
+	}
+
+	dir, err := os.MkdirTemp("", "anki-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "collection.anki2")
+	if err := extractZipFile(col, path); err != nil {
+		return nil, err
+	}
+
+	notes, err := readPackageNotes(path, deckName)
+	if err != nil {
+		return nil, err
+	}
+	result, err := a.importNotes(notes, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if f := files["media"]; f != nil {
+		if err := importMedia(files, f, mediaDir, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Limits on what a package unpacks to, as the upload limit only bounds its
+// compressed size.
+const (
+	maxPackageCollection = 1 << 30
+	maxPackageMediaFile  = 100 << 20
+	maxPackageMedia      = 2 << 30
+	maxPackageManifest   = 16 << 20
+)
+
+// openZipFile opens a package entry, refusing entries whose size in the zip
+// directory is over limit. Callers read through io.LimitReader too, in case
+// that size is false.
+func openZipFile(f *zip.File, limit int64) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, fmt.Errorf("%w: %s unpacks to more than %d bytes", ErrInvalidImport, f.Name, limit)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading %s: %v", ErrInvalidImport, f.Name, err)
+	}
+	return rc, nil
+}
+
+func extractZipFile(f *zip.File, path string) error {
+	src, err := openZipFile(f, maxPackageCollection)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, maxPackageCollection+1))
+	if err == nil && n > maxPackageCollection {
+		err = fmt.Errorf("more than %d bytes", maxPackageCollection)
+	}
+	if err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("%w: reading %s: %v", ErrInvalidImport, f.Name, err)
+	}
+	return dst.Close()
+}
+
+// readPackageNotes reads every note in a package's collection, for deckName.
+func readPackageNotes(path, deckName string) ([]importNote, error) {
+	pkg, err := OpenAnkiDB(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	defer func() { _ = pkg.Close() }()
+
+	types, err := pkg.getNoteTypes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	typesByID := make(map[int64]noteType, len(types))
+	for _, t := range types {
+		typesByID[t.ID] = t
+	}
+
+	rows, err := pkg.db.Query("SELECT guid, mid, flds, tags FROM notes ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	defer func() { _ = rows.Close() }()
+	var notes []importNote
+	for rows.Next() {
+		var n importNote
+		var mid int64
+		var flds string
+		if err := rows.Scan(&n.guid, &mid, &flds, &n.tags); err != nil {
+			return nil, err
+		}
+		nt := typesByID[mid]
+		n.model = nt.Name
+		n.deck = deckName
+		n.fields = map[string]string{}
+		parts := strings.Split(flds, "\x1f")
+		for i, name := range nt.Fields {
+			if i < len(parts) {
+				n.fields[name] = parts[i]
+			}
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// importMedia copies the files named in a package's media manifest into
+// mediaDir. Files already present with the same content are skipped; a
+// different file under the same name is kept and reported.
+func importMedia(files map[string]*zip.File, manifest *zip.File, mediaDir string, result *ImportResult) error {
+	rc, err := openZipFile(manifest, maxPackageManifest)
+	if err != nil {
+		return err
+	}
+	var names map[string]string
+	err = json.NewDecoder(io.LimitReader(rc, maxPackageManifest)).Decode(&names)
+	_ = rc.Close()
+	if err != nil {
+		return fmt.Errorf("%w: parsing media manifest: %v", ErrInvalidImport, err)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(mediaDir, 0o755); err != nil {
+		return fmt.Errorf("creating media folder: %w", err)
+	}
+
+	keys := make([]string, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var total uint64
+	for _, key := range keys {
+		name := names[key]
+		f := files[key]
+		if f == nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("media %q: missing from package", name))
+			continue
+		}
+		dst, err := mediaPath(mediaDir, name)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("media %q: %v", name, err))
+			continue
+		}
+		if total += f.UncompressedSize64; total > maxPackageMedia {
+			return fmt.Errorf("%w: media unpacks to more than %d bytes", ErrInvalidImport, maxPackageMedia)
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		if existing, err := os.ReadFile(dst); err == nil {
+			if !bytes.Equal(existing, data) {
+				result.Errors = append(result.Errors, fmt.Sprintf("media %q: a different file with this name exists", name))
+			}
+			continue
+		}
+		if err := os.WriteFile(dst, data, 0o644); err != nil {
+			return fmt.Errorf("writing media %q: %w", name, err)
+		}
+		result.Media++
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := openZipFile(f, maxPackageMediaFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	data, err := io.ReadAll(io.LimitReader(rc, maxPackageMediaFile+1))
+	if err == nil && len(data) > maxPackageMediaFile {
+		err = fmt.Errorf("more than %d bytes", maxPackageMediaFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading %s: %v", ErrInvalidImport, f.Name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+
+	defaultRate  = 10
+	defaultBurst = 20
+)
+
+// apiKey is one entry of the key file. Read covers GET requests and write
+// everything else. Decks, if set, limits the key to those decks and their
+// subdecks. Rate is in requests per second.
+type apiKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+	Decks  []string `json:"decks"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+}
+
+// parseKeys reads a key file: {"keys": [...]}. A file that is not JSON
+// holds a single key with every scope, the format before keys were named.
+func parseKeys(data []byte) ([]*apiKey, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("key file is empty")
+	}
+	if data[0] != '{' {
+		return []*apiKey{{
+			Name:   "default",
+			Key:    string(data),
+			Scopes: []string{scopeRead, scopeWrite},
+			Rate:   defaultRate,
+			Burst:  defaultBurst,
+		}}, nil
+	}
+
+	var file struct {
+		Keys []*apiKey `json:"keys"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("parsing key file: %w", err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("key file has no keys")
+	}
+	names, secrets := map[string]bool{}, map[string]bool{}
+	for i, k := range file.Keys {
+		switch {
+		case k.Name == "":
+			return nil, fmt.Errorf("key %d: name is required", i+1)
+		case names[k.Name]:
+			return nil, fmt.Errorf("key %q: duplicate name", k.Name)
+		case k.Key == "":
+			return nil, fmt.Errorf("key %q: key is required", k.Name)
+		case secrets[k.Key]:
+			return nil, fmt.Errorf("key %q: duplicate key", k.Name)
+		case k.Rate < 0 || k.Burst < 0:
+			return nil, fmt.Errorf("key %q: rate and burst must not be negative", k.Name)
+		}
+		names[k.Name], secrets[k.Key] = true, true
+		if len(k.Scopes) == 0 {
+			k.Scopes = []string{scopeRead}
+		}
+		for _, s := range k.Scopes {
+			if s != scopeRead && s != scopeWrite {
+				return nil, fmt.Errorf("key %q: unknown scope %q", k.Name, s)
+			}
+		}
+		if k.Rate == 0 {
+			k.Rate = defaultRate
+		}
+		if k.Burst == 0 {
+			k.Burst = max(defaultBurst, int(math.Ceil(k.Rate)))
+		}
+	}
+	return file.Keys, nil
+}
+
+func (k *apiKey) can(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// restricted reports whether the key is limited to some decks. A nil key,
+// as in requests that bypass authentication, is not.
+func (k *apiKey) restricted() bool {
+	return k != nil && len(k.Decks) > 0
+}
+
+// allowsDeck reports whether the key may use the named deck: one of its
+// decks or a subdeck of one. Deck names are case-insensitive, as in Anki.
+func (k *apiKey) allowsDeck(name string) bool {
+	if !k.restricted() {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, d := range k.Decks {
+		d = strings.ToLower(d)
+		if name == d || strings.HasPrefix(name, d+"::") {
+			return true
+		}
+	}
+	return false
+}
+
+// deckSearch is a search term matching the key's decks and their subdecks.
+func (k *apiKey) deckSearch() string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `_`, `\_`)
+	terms := make([]string, len(k.Decks))
+	for i, d := range k.Decks {
+		terms[i] = `"deck:` + escape.Replace(d) + `"`
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// tokenBucket limits a key to rate requests per second, with bursts of up
+// to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if one is available, or reports how long until one
+// will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// keyring holds the keys from the key file and their rate limits, which
+// survive reloads for keys that keep their name.
+type keyring struct {
+	path string
+	// secret signs media URLs; see signMedia.
+	secret []byte
+
+	mu      sync.RWMutex
+	keys    []*apiKey
+	buckets map[string]*tokenBucket
+}
+
+func loadKeyring(path string) (*keyring, error) {
+	k := &keyring{path: path, secret: make([]byte, 32), buckets: map[string]*tokenBucket{}}
+	if _, err := rand.Read(k.secret); err != nil {
+		return nil, fmt.Errorf("generating media URL secret: %w", err)
+	}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// reload rereads the key file. On error the current keys stay in force.
+func (k *keyring) reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("reading key file: %w", err)
+	}
+	keys, err := parseKeys(data)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	buckets := make(map[string]*tokenBucket, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		b, ok := k.buckets[key.Name]
+		if !ok {
+			b = &tokenBucket{tokens: float64(key.Burst), last: now}
+		}
+		b.mu.Lock()
+		b.rate, b.burst = key.Rate, float64(key.Burst)
+		b.tokens = min(b.tokens, b.burst)
+		b.mu.Unlock()
+		buckets[key.Name] = b
+	}
+	k.keys, k.buckets = keys, buckets
+	return nil
+}
+
+// lookup returns the key matching secret, comparing against every key in
+// constant time.
+func (k *keyring) lookup(secret string) (*apiKey, *tokenBucket) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var found *apiKey
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(key.Key)) == 1 {
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	return found, k.buckets[found.Name]
+}
+
+// mediaURLLifetime is how long a signed media URL stays valid.
+const mediaURLLifetime = time.Hour
+
+// signMedia returns query parameters that let a request for media file
+// name stand in for key until exp. Browsers rendering a note cannot send
+// X-API-Key, so rewritten media references carry these instead. The secret
+// is made afresh each time the server starts, which invalidates old URLs.
+func (k *keyring) signMedia(key *apiKey, name string, exp time.Time) url.Values {
+	expires := strconv.FormatInt(exp.Unix(), 10)
+	return url.Values{
+		"key_name":  {key.Name},
+		"expires":   {expires},
+		"signature": {k.mediaSignature(key.Name, name, expires)},
+	}
+}
+
+func (k *keyring) mediaSignature(keyName, name, expires string) string {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(keyName + "\x00" + name + "\x00" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mediaKey returns the key a signed media request stands in for, or nil if
+// r is not one or its signature is invalid or expired. The key must still
+// exist, so removing it from the key file also revokes its URLs.
+func (k *keyring) mediaKey(r *http.Request, now time.Time) (*apiKey, *tokenBucket) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/api/media/")
+	q := r.URL.Query()
+	if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) || q.Get("signature") == "" {
+		return nil, nil
+	}
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > exp {
+		return nil, nil
+	}
+	want := k.mediaSignature(q.Get("key_name"), name, q.Get("expires"))
+	if !hmac.Equal([]byte(want), []byte(q.Get("signature"))) {
+		return nil, nil
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Name == q.Get("key_name") {
+			return key, k.buckets[key.Name]
+		}
+	}
+	return nil, nil
+}
+
+type apiKeyContext struct{}
+
+// requestKey returns the key that authenticated r, or nil if none did.
+func requestKey(r *http.Request) *apiKey {
+	key, _ := r.Context().Value(apiKeyContext{}).(*apiKey)
+	return key
+}
+
+// authMiddleware authenticates the X-API-Key header, or a signed media
+// URL, enforces the key's scope and rate limit, and records the key for
+// handlers and the access log. The health check and API description are
+// open.
+func (h *Handler) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/health" || r.URL.Path == "/api/openapi.json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, bucket := h.keys.lookup(r.Header.Get("X-API-Key"))
+		if key == nil {
+			key, bucket = h.keys.mediaKey(r, time.Now())
+		}
+		if key == nil {
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if rec, ok := w.(*accessRecorder); ok {
+			rec.key = key.Name
+		}
+
+		if ok, wait := bucket.take(time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			httpError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		scope := scopeWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			scope = scopeRead
+		}
+		if !key.can(scope) {
+			httpError(w, http.StatusForbidden, "key lacks "+scope+" scope")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	})
+}
+
+// deckAllowed reports whether the request's key may use deck, writing a
+// 403 response if not.
+func deckAllowed(w http.ResponseWriter, r *http.Request, deck string) bool {
+	if requestKey(r).allowsDeck(deck) {
+		return true
+	}
+	httpError(w, http.StatusForbidden, "key is not permitted to use this deck")
+	return false
+}
+
+// unrestricted reports whether the request's key may use every deck,
+// writing a 403 response if not. Collection-wide endpoints need it.
+func unrestricted(w http.ResponseWriter, r *http.Request) bool {
+	if !requestKey(r).restricted() {
+		return true
+	}
+	httpError(w, http.StatusForbidden, "key is restricted to some decks")
+	return false
+}
+
+// noteAllowed reports whether the request's key may use note id, whose
+// cards must all be in its decks, writing a 403 response if not. Unknown
+// notes are left for the handler to report.
+func (h *Handler) noteAllowed(w http.ResponseWriter, r *http.Request, id int64) bool {
+	key := requestKey(r)
+	if !key.restricted() {
+		return true
+	}
+	cards, err := h.dbFor(r).NoteCards(id)
+	if err != nil {
+		return true
+	}
+	for _, c := range cards {
+		if !key.allowsDeck(c.Deck) {
+			httpError(w, http.StatusForbidden, "key is not permitted to use this note")
+			return false
+		}
+	}
+	return true
+}
+
+// accessRecorder captures what the access log reports about a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	key    string
+}
+
+func (rec *accessRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *accessRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// credentialParams are query parameters that authenticate a request, kept
+// out of the access log so it cannot be used to replay them.
+var credentialParams = []string{"signature"}
+
+// redactQuery masks the values of credentialParams in a raw query.
+func redactQuery(raw string) string {
+	q, _ := url.ParseQuery(raw)
+	redacted := false
+	for _, name := range credentialParams {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return raw
+	}
+	return q.Encode()
+}
+
+// accessLog writes one structured record per request to logger.
+func accessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.Info("request",
+			"key", rec.key,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", redactQuery(r.URL.RawQuery),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
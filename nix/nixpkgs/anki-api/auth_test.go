@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := parseKeys([]byte("  secret\n"))
+	if err != nil || len(keys) != 1 || keys[0].Key != "secret" || !keys[0].can(scopeWrite) || keys[0].restricted() {
+		t.Errorf("plain key file = %+v, %v", keys, err)
+	}
+
+	keys, err = parseKeys([]byte(`{"keys": [
+		{"name": "phone", "key": "k1", "decks": ["Lang"]},
+		{"name": "sync", "key": "k2", "scopes": ["read", "write"], "rate": 50}
+	]}`))
+	if err != nil {
+		t.Fatalf("parseKeys() error = %v", err)
+	}
+	if !keys[0].can(scopeRead) || keys[0].can(scopeWrite) || keys[0].Rate != defaultRate || keys[0].Burst != defaultBurst {
+		t.Errorf("phone = %+v", keys[0])
+	}
+	if !keys[1].can(scopeWrite) || keys[1].Burst != 50 {
+		t.Errorf("sync = %+v", keys[1])
+	}
+
+	for _, bad := range []string{
+		"",
+		`{"keys": []}`,
+		`{"keys": [{"key": "k"}]}`,
+		`{"keys": [{"name": "a"}]}`,
+		`{"keys": [{"name": "a", "key": "k"}, {"name": "a", "key": "j"}]}`,
+		`{"keys": [{"name": "a", "key": "k"}, {"name": "b", "key": "k"}]}`,
+		`{"keys": [{"name": "a", "key": "k", "scopes": ["admin"]}]}`,
+		`{"keys": [{"name": "a", "key": "k", "rate": -1}]}`,
+		`{"keys": [{"name": "a", "key": "k", "deck": ["typo"]}]}`,
+	} {
+		if _, err := parseKeys([]byte(bad)); err == nil {
+			t.Errorf("parseKeys(%q): want error", bad)
+		}
+	}
+}
+
+func TestAllowsDeck(t *testing.T) {
+	key := &apiKey{Decks: []string{"Lang::Go", "Misc"}}
+	for deck, want := range map[string]bool{
+		"Lang::Go": true, "lang::go::Advanced": true, "Misc": true,
+		"Lang": false, "Lang::Gopher": false, "Default": false,
+	} {
+		if got := key.allowsDeck(deck); got != want {
+			t.Errorf("allowsDeck(%q) = %v, want %v", deck, got, want)
+		}
+	}
+	var none *apiKey
+	if !none.allowsDeck("Default") || !(&apiKey{}).allowsDeck("Default") {
+		t.Error("unrestricted key denied a deck")
+	}
+	if got := (&apiKey{Decks: []string{`My "*_" Deck`}}).deckSearch(); got != `("deck:My \"\*\_\" Deck")` {
+		t.Errorf("deckSearch() = %s", got)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{rate: 2, burst: 2, tokens: 2, last: now}
+	for i := range 2 {
+		if ok, _ := b.take(now); !ok {
+			t.Fatalf("take %d refused within burst", i)
+		}
+	}
+	if ok, wait := b.take(now); ok || wait != 500*time.Millisecond {
+		t.Errorf("take beyond burst = %v, wait %v", ok, wait)
+	}
+	if ok, _ := b.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("take after refill refused")
+	}
+}
+
+func writeKeyFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(t, keyPath, `{"keys": [
+		{"name": "admin", "key": "admin-key", "scopes": ["read", "write"]},
+		{"name": "go", "key": "go-key", "decks": ["Lang::Go"]},
+		{"name": "slow", "key": "slow-key", "rate": 1, "burst": 1}
+	]}`)
+	keys, err := loadKeyring(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openSearchFixture(t)
+	var goroutine int64
+	_ = db.db.QueryRow("SELECT id FROM notes WHERE guid = 'g101'").Scan(&goroutine)
+	var rust int64
+	_ = db.db.QueryRow("SELECT id FROM notes WHERE guid = 'g102'").Scan(&rust)
+
+	h := &Handler{db: db, keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health", h.Health)
+	mux.HandleFunc("GET /api/decks", h.ListDecks)
+	mux.HandleFunc("GET /api/notes/search", h.SearchNotes)
+	mux.HandleFunc("GET /api/notes/{id}", h.GetNote)
+	mux.HandleFunc("DELETE /api/notes/{id}", h.DeleteNote)
+	mux.HandleFunc("GET /api/stats", h.Stats)
+	var logBuf bytes.Buffer
+	server := accessLog(slog.New(slog.NewJSONHandler(&logBuf, nil)), h.authMiddleware(mux))
+
+	do := func(method, url, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		method, url, key string
+		wantStatus       int
+		wantBody         string
+	}{
+		{http.MethodGet, "/api/health", "", http.StatusOK, ""},
+		{http.MethodGet, "/api/decks", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/api/decks", "wrong", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/api/decks", "admin-key", http.StatusOK, "Default"},
+		{http.MethodGet, "/api/stats", "admin-key", http.StatusOK, ""},
+		{http.MethodDelete, "/api/notes/1", "go-key", http.StatusForbidden, "write scope"},
+		{http.MethodGet, "/api/stats", "go-key", http.StatusForbidden, ""},
+		{http.MethodGet, fmt.Sprintf("/api/notes/%d", goroutine), "go-key", http.StatusOK, "goroutine"},
+		{http.MethodGet, fmt.Sprintf("/api/notes/%d", rust), "go-key", http.StatusForbidden, ""},
+		{http.MethodGet, "/api/notes/search?q=tag:go", "go-key", http.StatusOK, "goroutine"},
+		{http.MethodGet, "/api/notes/search?q=rust", "go-key", http.StatusOK, "[]"},
+		// Unbalanced parentheses cannot close the key's deck scope early.
+		{http.MethodGet, "/api/notes/search?q=" + url.QueryEscape("rust) or (rust"), "go-key", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/notes/search?q=" + url.QueryEscape("(rust"), "go-key", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/notes/search?q=rust&deck=Default", "go-key", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url+" "+tt.key, func(t *testing.T) {
+			rec := do(tt.method, tt.url, tt.key)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+
+	// Restricted keys only see their decks.
+	var decks []Deck
+	_ = json.Unmarshal(do(http.MethodGet, "/api/decks", "go-key").Body.Bytes(), &decks)
+	if len(decks) != 2 || decks[0].Name != "Lang::Go" || decks[1].Name != "Lang::Go::Advanced" {
+		t.Errorf("restricted decks = %+v", decks)
+	}
+
+	if rec := do(http.MethodGet, "/api/decks", "slow-key"); rec.Code != http.StatusOK {
+		t.Fatalf("first slow request = %d", rec.Code)
+	}
+	rec := do(http.MethodGet, "/api/decks", "slow-key")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("rate limited request = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	var entry map[string]any
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("access log line: %v: %s", err, lines[len(lines)-1])
+	}
+	if entry["key"] != "slow" || entry["status"] != float64(http.StatusTooManyRequests) || entry["path"] != "/api/decks" {
+		t.Errorf("access log entry = %v", entry)
+	}
+	if len(lines) != len(tests)+3 {
+		t.Errorf("access log has %d lines, want %d", len(lines), len(tests)+3)
+	}
+
+	// A bad edit keeps the previous keys; a good one takes effect.
+	writeKeyFile(t, keyPath, `{"keys": [`)
+	if err := keys.reload(); err == nil {
+		t.Error("reload of malformed file: want error")
+	}
+	if rec := do(http.MethodGet, "/api/decks", "admin-key"); rec.Code != http.StatusOK {
+		t.Errorf("after bad reload status = %d", rec.Code)
+	}
+	writeKeyFile(t, keyPath, "rotated-key")
+	if err := keys.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	if rec := do(http.MethodGet, "/api/decks", "admin-key"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("rotated-out key status = %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/decks", "rotated-key"); rec.Code != http.StatusOK {
+		t.Errorf("rotated-in key status = %d", rec.Code)
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	for raw, want := range map[string]string{
+		"key_name=reader&expires=1700000000&signature=abc": "expires=1700000000&key_name=reader&signature=REDACTED",
+		"q=tag%3Ago&limit=5": "q=tag%3Ago&limit=5",
+		"":                   "",
+	} {
+		if got := redactQuery(raw); got != want {
+			t.Errorf("redactQuery(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
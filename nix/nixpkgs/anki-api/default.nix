@@ -8,6 +8,8 @@ pkgs.buildGoModule {
 
   vendorHash = "sha256-WA7PLEaT7lpBkIQHXbRSrQO7mfip4mRS7xMck6lVAFs=";
 
+  tags = [ "sqlite_fts5" ];
+
   env.CGO_ENABLED = 1;
   buildInputs = [ pkgs.sqlite ];
 
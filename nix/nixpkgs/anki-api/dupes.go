@@ -0,0 +1,447 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Duplicate is a note that resembles a candidate. Score is the text
+// similarity from 0 to 1; EmbeddingScore is the cosine similarity of their
+// embeddings, when those were asked for and the note has one yet.
+type Duplicate struct {
+	Note
+	Deck           string   `json:"deck"`
+	Score          float64  `json:"score"`
+	EmbeddingScore *float64 `json:"embedding_score,omitempty"`
+}
+
+// DuplicateCluster is a group of notes linked by pairwise similarity. Each
+// note's Score is its best match within the cluster, and the cluster's is
+// the best of those.
+type DuplicateCluster struct {
+	Score float64     `json:"score"`
+	Notes []Duplicate `json:"notes"`
+}
+
+// DuplicateOptions scopes and tunes duplicate detection. Deck limits the
+// notes compared to a deck and its subdecks, and AllowDeck, if set, to the
+// decks it accepts. With an Embedder, notes whose embeddings are at least
+// EmbeddingThreshold alike are reported whatever their text score.
+type DuplicateOptions struct {
+	Deck               string
+	Threshold          float64
+	Limit              int
+	AllowDeck          func(string) bool
+	Embedder           *Embedder
+	EmbeddingThreshold float64
+}
+
+const (
+	// minDuplicateThreshold keeps thresholds where the front text still
+	// has to match in part, which clustering relies on to prune pairs.
+	minDuplicateThreshold     = 0.5
+	defaultDuplicateThreshold = 0.7
+	defaultEmbeddingThreshold = 0.9
+	defaultDuplicateLimit     = 20
+)
+
+var (
+	dupClozeRe = regexp.MustCompile(`\{\{c\d+::(.*?)(?:::[^}]*)?\}\}`)
+	nonWordRe  = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+// normaliseText reduces field HTML to lower-case words, dropping markup,
+// cloze syntax and sound tags so notes that differ only in formatting
+// compare equal.
+func normaliseText(s string) string {
+	s = soundRe.ReplaceAllString(s, " ")
+	s = dupClozeRe.ReplaceAllString(s, "$1")
+	s = strings.ToLower(stripHTML(s))
+	return strings.TrimSpace(nonWordRe.ReplaceAllString(s, " "))
+}
+
+// noteText splits a note's fields into its first field, which holds the
+// question in stock models, and the rest.
+func noteText(nt noteType, flds string) (front, back string) {
+	parts := strings.Split(flds, "\x1f")
+	if len(nt.Fields) > 0 && len(parts) > len(nt.Fields) {
+		parts = parts[:len(nt.Fields)]
+	}
+	return parts[0], strings.Join(parts[1:], " ")
+}
+
+// dupNote is a note as duplicate detection sees it.
+type dupNote struct {
+	Duplicate
+	front, back string
+	// frontGrams and backGrams are sorted, distinct trigram ids.
+	frontGrams, backGrams []int32
+}
+
+// trigrams interns the character trigrams of normalised text.
+type trigrams map[string]int32
+
+func (t trigrams) of(s string) []int32 {
+	if s == "" {
+		return nil
+	}
+	runes := []rune(" " + s + " ")
+	ids := make([]int32, 0, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		g := string(runes[i : i+3])
+		id, ok := t[g]
+		if !ok {
+			id = int32(len(t))
+			t[g] = id
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// dice is the Dice coefficient of two sorted sets.
+func dice(a, b []int32) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	return 2 * float64(overlap(a, b)) / float64(len(a)+len(b))
+}
+
+func overlap(a, b []int32) int {
+	n := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			n++
+			i++
+			j++
+		}
+	}
+	return n
+}
+
+// similarity scores two notes by their fronts, with the backs counting for
+// a third when both have one: the same question is a duplicate even if
+// answered differently.
+func similarity(a, b *dupNote) float64 {
+	f := dice(a.frontGrams, b.frontGrams)
+	if len(a.backGrams) == 0 || len(b.backGrams) == 0 {
+		return f
+	}
+	return (2*f + dice(a.backGrams, b.backGrams)) / 3
+}
+
+// duplicateCorpus loads the notes in scope, each placed in the home deck of
+// its first card.
+func (a *AnkiDB) duplicateCorpus(deckName string, allow func(string) bool) ([]*dupNote, trigrams, error) {
+	decks, err := a.ListDecks()
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make(map[int64]string, len(decks))
+	found := deckName == ""
+	for _, d := range decks {
+		names[d.ID] = d.Name
+		found = found || d.Name == deckName || strings.HasPrefix(d.Name, deckName+"::")
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("deck %q %w", deckName, ErrDeckNotFound)
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	typesByID := make(map[int64]noteType, len(types))
+	for _, t := range types {
+		typesByID[t.ID] = t
+	}
+
+	rows, err := a.db.Query(`
+		SELECT n.id, n.mid, n.flds, n.tags,
+			COALESCE((SELECT CASE WHEN c.odid != 0 THEN c.odid ELSE c.did END
+				FROM cards c WHERE c.nid = n.id ORDER BY c.ord LIMIT 1), 0)
+		FROM notes n ORDER BY n.id
+	`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("querying notes: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	grams := trigrams{}
+	var notes []*dupNote
+	for rows.Next() {
+		var id, mid, did int64
+		var flds, tags string
+		if err := rows.Scan(&id, &mid, &flds, &tags, &did); err != nil {
+			return nil, nil, err
+		}
+		deck := names[did]
+		if deckName != "" && deck != deckName && !strings.HasPrefix(deck, deckName+"::") {
+			continue
+		}
+		if allow != nil && !allow(deck) {
+			continue
+		}
+		nt := typesByID[mid]
+		parts := strings.Split(flds, "\x1f")
+		fields := make(map[string]string, len(nt.Fields))
+		for i, name := range nt.Fields {
+			if i < len(parts) {
+				fields[name] = parts[i]
+			}
+		}
+		n := &dupNote{Duplicate: Duplicate{
+			Note: Note{ID: id, Model: nt.Name, Fields: fields, Tags: strings.TrimSpace(tags)},
+			Deck: deck,
+		}}
+		front, back := noteText(nt, flds)
+		n.front, n.back = normaliseText(front), normaliseText(back)
+		n.frontGrams, n.backGrams = grams.of(n.front), grams.of(n.back)
+		notes = append(notes, n)
+	}
+	return notes, grams, rows.Err()
+}
+
+// FindDuplicates returns the notes resembling a candidate front and back,
+// best match first, leaving out the note exclude.
+func (a *AnkiDB) FindDuplicates(ctx context.Context, front, back string, exclude int64, opts DuplicateOptions) ([]Duplicate, error) {
+	notes, grams, err := a.duplicateCorpus(opts.Deck, opts.AllowDeck)
+	if err != nil {
+		return nil, err
+	}
+	notes = slices.DeleteFunc(notes, func(n *dupNote) bool { return n.ID == exclude })
+	candidate := &dupNote{front: normaliseText(front), back: normaliseText(back)}
+	candidate.frontGrams, candidate.backGrams = grams.of(candidate.front), grams.of(candidate.back)
+
+	scores := make([]float64, len(notes))
+	for i, n := range notes {
+		scores[i] = round(similarity(candidate, n))
+	}
+	var vectors [][]float32
+	if opts.Embedder != nil {
+		if vectors, err = candidateEmbeddings(ctx, opts.Embedder, candidate, notes, scores); err != nil {
+			return nil, err
+		}
+	}
+
+	found := []Duplicate{}
+	for i, n := range notes {
+		d := n.Duplicate
+		d.Score = scores[i]
+		match := d.Score >= opts.Threshold
+		if vectors != nil && vectors[i+1] != nil {
+			s := round(cosine(vectors[0], vectors[i+1]))
+			d.EmbeddingScore = &s
+			match = match || s >= opts.EmbeddingThreshold
+		}
+		if match {
+			found = append(found, d)
+		}
+	}
+	slices.SortStableFunc(found, func(a, b Duplicate) int { return cmp.Compare(bestScore(b), bestScore(a)) })
+	if opts.Limit > 0 && len(found) > opts.Limit {
+		found = found[:opts.Limit]
+	}
+	return found, nil
+}
+
+// candidateEmbeddings returns the embeddings of the candidate, first, and
+// of notes. Notes embedNotes has not reached are embedded only up to
+// maxRequestEmbeds, best text score first, and otherwise left nil, so a
+// check on a cold cache costs one request rather than the collection.
+func candidateEmbeddings(ctx context.Context, e *Embedder, candidate *dupNote, notes []*dupNote, scores []float64) ([][]float32, error) {
+	texts := make([]string, len(notes)+1)
+	texts[0] = strings.TrimSpace(candidate.front + " " + candidate.back)
+	for i, n := range notes {
+		texts[i+1] = strings.TrimSpace(n.front + " " + n.back)
+	}
+	vectors, missing := e.cached(texts)
+	slices.SortStableFunc(missing, func(a, b int) int {
+		if a == 0 || b == 0 {
+			return cmp.Compare(a, b)
+		}
+		return cmp.Compare(scores[b-1], scores[a-1])
+	})
+	missing = missing[:min(len(missing), maxRequestEmbeds+1)]
+	input := make([]string, len(missing))
+	for j, i := range missing {
+		input[j] = texts[i]
+	}
+	got, err := e.Embed(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range missing {
+		vectors[i] = got[j]
+	}
+	return vectors, nil
+}
+
+// noteTexts returns the text of every note as duplicate detection embeds
+// it.
+func (a *AnkiDB) noteTexts() ([]string, error) {
+	notes, _, err := a.duplicateCorpus("", nil)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(notes))
+	for i, n := range notes {
+		texts[i] = strings.TrimSpace(n.front + " " + n.back)
+	}
+	return texts, nil
+}
+
+// NoteDuplicates returns the notes resembling note id.
+func (a *AnkiDB) NoteDuplicates(ctx context.Context, id int64, opts DuplicateOptions) ([]Duplicate, error) {
+	var mid int64
+	var flds string
+	err := a.db.QueryRow("SELECT mid, flds FROM notes WHERE id = ?", id).Scan(&mid, &flds)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("note %d %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying note: %w", err)
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+	var nt noteType
+	for _, t := range types {
+		if t.ID == mid {
+			nt = t
+		}
+	}
+	front, back := noteText(nt, flds)
+	return a.FindDuplicates(ctx, front, back, id, opts)
+}
+
+// DeckDuplicates groups the notes in a deck and its subdecks, or the whole
+// collection if deckName is empty, into clusters of near-duplicates,
+// largest first, returning at most limit clusters if it is positive. Pairs
+// are found with a prefix filter: ordering trigrams rarest first, two
+// fronts alike enough to matter must share one of the first few trigrams
+// of each, so only notes sharing a rare trigram are compared.
+func (a *AnkiDB) DeckDuplicates(deckName string, threshold float64, limit int) ([]DuplicateCluster, error) {
+	notes, grams, err := a.duplicateCorpus(deckName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Renumber trigrams by how many fronts use them, rarest first.
+	freq := make([]int, len(grams))
+	for _, n := range notes {
+		for _, g := range n.frontGrams {
+			freq[g]++
+		}
+	}
+	order := make([]int32, len(grams))
+	for i := range order {
+		order[i] = int32(i)
+	}
+	slices.SortFunc(order, func(a, b int32) int { return cmp.Or(cmp.Compare(freq[a], freq[b]), cmp.Compare(a, b)) })
+	rank := make([]int32, len(grams))
+	for r, g := range order {
+		rank[g] = int32(r)
+	}
+	fronts := make([][]int32, len(notes))
+	for i, n := range notes {
+		fronts[i] = make([]int32, len(n.frontGrams))
+		for j, g := range n.frontGrams {
+			fronts[i][j] = rank[g]
+		}
+		slices.Sort(fronts[i])
+	}
+
+	// A pair scoring threshold has front Dice of at least minFront, so
+	// front Jaccard of at least jaccard.
+	minFront := max((3*threshold-1)/2, 0.01)
+	jaccard := minFront / (2 - minFront)
+
+	parent := make([]int, len(notes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	best := make([]float64, len(notes))
+	postings := map[int32][]int{}
+	for i := range notes {
+		prefix := len(fronts[i]) - int(math.Ceil(jaccard*float64(len(fronts[i])))) + 1
+		prefix = min(max(prefix, 0), len(fronts[i]))
+		seen := map[int]bool{}
+		for _, g := range fronts[i][:prefix] {
+			for _, j := range postings[g] {
+				if seen[j] {
+					continue
+				}
+				seen[j] = true
+				s := round(similarity(notes[i], notes[j]))
+				if s < threshold {
+					continue
+				}
+				best[i], best[j] = max(best[i], s), max(best[j], s)
+				parent[find(i)] = find(j)
+			}
+			postings[g] = append(postings[g], i)
+		}
+	}
+
+	groups := map[int]*DuplicateCluster{}
+	var clusters []*DuplicateCluster
+	for i, n := range notes {
+		if best[i] == 0 {
+			continue
+		}
+		root := find(i)
+		c, ok := groups[root]
+		if !ok {
+			c = &DuplicateCluster{}
+			groups[root] = c
+			clusters = append(clusters, c)
+		}
+		d := n.Duplicate
+		d.Score = best[i]
+		c.Notes = append(c.Notes, d)
+		c.Score = max(c.Score, d.Score)
+	}
+	slices.SortStableFunc(clusters, func(a, b *DuplicateCluster) int {
+		return cmp.Or(cmp.Compare(len(b.Notes), len(a.Notes)), cmp.Compare(b.Score, a.Score))
+	})
+	if limit > 0 && len(clusters) > limit {
+		clusters = clusters[:limit]
+	}
+	result := make([]DuplicateCluster, len(clusters))
+	for i, c := range clusters {
+		result[i] = *c
+	}
+	return result, nil
+}
+
+func bestScore(d Duplicate) float64 {
+	if d.EmbeddingScore != nil {
+		return max(d.Score, *d.EmbeddingScore)
+	}
+	return d.Score
+}
+
+// round keeps scores to three places, which is all they are good for.
+func round(f float64) float64 {
+	return math.Round(f*1000) / 1000
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// openDuplicatesFixture adds near-duplicate notes to the search fixture:
+//
+//	200 Basic, Lang::Go, "What is a <b>channel</b> in Go?" / "A typed pipe"
+//	201 Basic, Lang::Go, "what is a channel in go" / "typed conduit between goroutines"
+//	202 Basic, Default, "What is a channel in Go?" / "A typed pipe."
+func openDuplicatesFixture(t *testing.T) *AnkiDB {
+	t.Helper()
+	db := openSearchFixture(t)
+	execCollection(t, db, `
+		INSERT INTO notes VALUES
+			(200, 'g200', 10, 0, 0, '', 'What is a <b>channel</b> in Go?' || char(31) || 'A typed pipe', '', 0, 0, ''),
+			(201, 'g201', 10, 0, 0, '', 'what is a channel in go' || char(31) || 'typed conduit between goroutines', '', 0, 0, ''),
+			(202, 'g202', 10, 0, 0, '', 'What is a channel in Go?' || char(31) || 'A typed pipe.', '', 0, 0, '');
+		INSERT INTO cards VALUES
+			(2000, 200, 5, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, ''),
+			(2010, 201, 5, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, ''),
+			(2020, 202, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, '');
+	`)
+	return db
+}
+
+func duplicateIDs(dupes []Duplicate) []int64 {
+	ids := make([]int64, len(dupes))
+	for i, d := range dupes {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestNormaliseText(t *testing.T) {
+	for in, want := range map[string]string{
+		"What is a <b>channel</b>&nbsp;in Go?":            "what is a channel in go",
+		"{{c1::Rust}} has a {{c2::borrow checker::tool}}": "rust has a borrow checker",
+		"Listen [sound:word.mp3] <br>again":               "listen again",
+		"Ünïcode — stays":                                 "ünïcode stays",
+	} {
+		if got := normaliseText(in); got != want {
+			t.Errorf("normaliseText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	db := openDuplicatesFixture(t)
+	ctx := context.Background()
+	opts := DuplicateOptions{Threshold: 0.6}
+
+	dupes, err := db.FindDuplicates(ctx, "What's a channel in Go", "a typed pipe", 0, opts)
+	if err != nil {
+		t.Fatalf("FindDuplicates() error = %v", err)
+	}
+	if ids := duplicateIDs(dupes); len(ids) != 3 || !slices.Contains(ids[:2], 200) || !slices.Contains(ids[:2], 202) || ids[2] != 201 {
+		t.Fatalf("duplicates = %v, want 200 and 202 then 201", ids)
+	}
+	if d := dupes[0]; d.Score < 0.9 || d.Fields["Front"] == "" || d.Deck == "" {
+		t.Errorf("best duplicate = %+v", d)
+	}
+
+	opts.Deck = "Lang::Go"
+	opts.Limit = 1
+	if dupes, _ := db.FindDuplicates(ctx, "What's a channel in Go", "a typed pipe", 0, opts); !slices.Equal(duplicateIDs(dupes), []int64{200}) {
+		t.Errorf("in Lang::Go, limit 1 = %v", duplicateIDs(dupes))
+	}
+	opts = DuplicateOptions{Threshold: defaultDuplicateThreshold, AllowDeck: (&apiKey{Decks: []string{"Default"}}).allowsDeck}
+	if dupes, _ := db.FindDuplicates(ctx, "What's a channel in Go", "", 0, opts); !slices.Equal(duplicateIDs(dupes), []int64{202}) {
+		t.Errorf("restricted to Default = %v", duplicateIDs(dupes))
+	}
+	if dupes, _ := db.FindDuplicates(ctx, "tokio runtime", "", 0, DuplicateOptions{Threshold: 0.5}); dupes == nil || len(dupes) != 0 {
+		t.Errorf("unrelated candidate = %#v, want empty", dupes)
+	}
+	if _, err := db.FindDuplicates(ctx, "x", "", 0, DuplicateOptions{Deck: "Nope"}); !errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("unknown deck: error = %v", err)
+	}
+
+	dupes, err = db.NoteDuplicates(ctx, 201, DuplicateOptions{Threshold: defaultDuplicateThreshold})
+	if err != nil {
+		t.Fatalf("NoteDuplicates() error = %v", err)
+	}
+	if ids := duplicateIDs(dupes); slices.Contains(ids, 201) || !slices.Contains(ids, 200) {
+		t.Errorf("duplicates of 201 = %v", ids)
+	}
+	if _, err := db.NoteDuplicates(ctx, 1, opts); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing note: error = %v", err)
+	}
+}
+
+func TestFindDuplicatesEmbeddings(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var in struct {
+			Model string
+			Input []string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || r.URL.Path != "/v1/embeddings" ||
+			in.Model != "test-model" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// Texts about pipes point one way, everything else the other.
+		type datum struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		}
+		var data []datum
+		for i, text := range in.Input {
+			v := []float32{0, 1}
+			if strings.Contains(text, "pipe") {
+				v = []float32{1, 0}
+			}
+			data = append(data, datum{i, v})
+		}
+		slices.Reverse(data)
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	defer server.Close()
+
+	db := openDuplicatesFixture(t)
+	embedder := &Embedder{URL: server.URL + "/v1/", Model: "test-model", Key: "secret"}
+	opts := DuplicateOptions{Threshold: defaultDuplicateThreshold, Embedder: embedder, EmbeddingThreshold: 0.95}
+	dupes, err := db.FindDuplicates(context.Background(), "stream of values", "unbuffered pipe", 0, opts)
+	if err != nil {
+		t.Fatalf("FindDuplicates() error = %v", err)
+	}
+	// Note 100 ("chan" / "typed pipe") shares no wording but matches in
+	// meaning.
+	i := slices.IndexFunc(dupes, func(d Duplicate) bool { return d.ID == 100 })
+	if i < 0 || dupes[i].EmbeddingScore == nil || *dupes[i].EmbeddingScore != 1 || dupes[i].Score >= opts.Threshold {
+		t.Fatalf("duplicates = %+v, want note 100 by embedding", dupes)
+	}
+	if slices.Contains(duplicateIDs(dupes), 201) {
+		t.Errorf("note 201 matched, but neither its text nor embedding is close")
+	}
+
+	before := requests.Load()
+	if _, err := db.FindDuplicates(context.Background(), "stream of values", "unbuffered pipe", 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != before {
+		t.Error("embeddings were requested again instead of cached")
+	}
+
+	embedder.Key = "wrong"
+	embedder.cache = nil
+	if _, err := db.FindDuplicates(context.Background(), "x", "", 0, opts); !errors.Is(err, ErrEmbedding) {
+		t.Errorf("failing endpoint: error = %v", err)
+	}
+}
+
+func TestFindDuplicatesEmbeddings_Cold(t *testing.T) {
+	var inputs atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ Input []string }
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		inputs.Add(int32(len(in.Input)))
+		data := make([]map[string]any, len(in.Input))
+		for i := range in.Input {
+			data[i] = map[string]any{"index": i, "embedding": []float32{1, 0}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	defer server.Close()
+
+	db := openDuplicatesFixture(t)
+	execCollection(t, db, `
+		WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < 100)
+		INSERT INTO notes SELECT 1000 + i, 'bulk' || i, 10, 0, 0, '', 'filler note ' || i || char(31) || '', '', 0, 0, '' FROM seq;
+	`)
+	embedder := &Embedder{URL: server.URL}
+	opts := DuplicateOptions{Threshold: defaultDuplicateThreshold, Embedder: embedder, EmbeddingThreshold: 0.95}
+
+	// A cold check embeds the candidate and the best text matches only.
+	if _, err := db.FindDuplicates(context.Background(), "what is a channel", "", 0, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := inputs.Load(); got != maxRequestEmbeds+1 {
+		t.Errorf("cold check embedded %d texts, want %d", got, maxRequestEmbeds+1)
+	}
+
+	// Once the notes are embedded, a check embeds its candidate alone and
+	// compares it with every note.
+	h := &Handler{db: db, embedder: embedder}
+	h.embedNotes(context.Background())
+	before := inputs.Load()
+	dupes, err := db.FindDuplicates(context.Background(), "something else", "", 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inputs.Load() - before; got != 1 {
+		t.Errorf("warm check embedded %d texts, want 1", got)
+	}
+	if len(dupes) < 100 {
+		t.Errorf("warm check found %d notes by embedding, want all", len(dupes))
+	}
+}
+
+func TestDeckDuplicates(t *testing.T) {
+	db := openDuplicatesFixture(t)
+	clusters, err := db.DeckDuplicates("Lang", defaultDuplicateThreshold, 0)
+	if err != nil {
+		t.Fatalf("DeckDuplicates() error = %v", err)
+	}
+	if len(clusters) != 1 || !slices.Equal(duplicateIDs(clusters[0].Notes), []int64{200, 201}) || clusters[0].Score < defaultDuplicateThreshold {
+		t.Fatalf("clusters = %+v, want 200 and 201", clusters)
+	}
+
+	// Across the collection 202 joins them, and a strict threshold leaves
+	// only the pair that differs in punctuation.
+	clusters, _ = db.DeckDuplicates("", defaultDuplicateThreshold, 0)
+	if len(clusters) != 1 || !slices.Equal(duplicateIDs(clusters[0].Notes), []int64{200, 201, 202}) {
+		t.Errorf("collection clusters = %+v", clusters)
+	}
+	clusters, _ = db.DeckDuplicates("", 1, 0)
+	if len(clusters) != 1 || !slices.Equal(duplicateIDs(clusters[0].Notes), []int64{200, 202}) || clusters[0].Score != 1 {
+		t.Errorf("exact clusters = %+v", clusters)
+	}
+	if _, err := db.DeckDuplicates("Nope", defaultDuplicateThreshold, 0); !errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("unknown deck: error = %v", err)
+	}
+
+	// A second, smaller cluster is cut by the limit.
+	execCollection(t, db, `
+		INSERT INTO notes VALUES
+			(203, 'g203', 10, 0, 0, '', 'What is a slice in Rust?' || char(31) || '', '', 0, 0, ''),
+			(204, 'g204', 10, 0, 0, '', 'what is a slice in rust' || char(31) || '', '', 0, 0, '');
+		INSERT INTO cards VALUES
+			(2030, 203, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, ''),
+			(2040, 204, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, '');
+	`)
+	if clusters, _ = db.DeckDuplicates("", defaultDuplicateThreshold, 0); len(clusters) != 2 {
+		t.Fatalf("clusters = %+v, want 2", clusters)
+	}
+	clusters, _ = db.DeckDuplicates("", defaultDuplicateThreshold, 1)
+	if len(clusters) != 1 || len(clusters[0].Notes) != 3 {
+		t.Errorf("limited clusters = %+v, want the largest", clusters)
+	}
+}
+
+func TestDuplicateHandlers(t *testing.T) {
+	h := &Handler{db: openDuplicatesFixture(t)}
+	mux := http.NewServeMux()
+	for pattern, handler := range h.routes() {
+		mux.HandleFunc(pattern, handler)
+	}
+	for url, want := range map[string]int{
+		"/api/notes/duplicates?front=channel+in+go":     http.StatusOK,
+		"/api/notes/duplicates":                         http.StatusBadRequest,
+		"/api/notes/duplicates?front=x&threshold=0.2":   http.StatusBadRequest,
+		"/api/notes/duplicates?front=x&limit=0":         http.StatusBadRequest,
+		"/api/notes/duplicates?front=x&embeddings=true": http.StatusBadRequest,
+		"/api/notes/duplicates?front=x&deck=Nope":       http.StatusNotFound,
+		"/api/notes/200/duplicates?threshold=0.9":       http.StatusOK,
+		"/api/notes/1/duplicates":                       http.StatusNotFound,
+		"/api/decks/Lang/duplicates":                    http.StatusOK,
+		"/api/decks/Nope/duplicates":                    http.StatusNotFound,
+		"/api/decks/Lang/duplicates?limit=1":            http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d: %s", url, rec.Code, want, rec.Body)
+		}
+	}
+
+	// Clusters are found by text alone, even with embeddings configured.
+	h.embedder = &Embedder{URL: "http://127.0.0.1:0"}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/decks/Lang/duplicates?embeddings=true", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("deck duplicates with embeddings = %d, want 400", rec.Code)
+	}
+}
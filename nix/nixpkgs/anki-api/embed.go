@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrEmbedding is returned when the embeddings endpoint cannot be reached
+// or fails.
+var ErrEmbedding = errors.New("embedding request failed")
+
+const (
+	// embedBatch is how many texts go in one embeddings request.
+	embedBatch = 64
+	// maxRequestEmbeds bounds the notes a duplicate check embeds itself;
+	// the rest wait for embedNotes to reach them.
+	maxRequestEmbeds = embedBatch
+	// maxEmbedCache bounds the cache; past it the cache starts over.
+	maxEmbedCache = 100_000
+)
+
+// Embedder fetches text embeddings from an OpenAI-compatible API (OpenAI,
+// Ollama, llama.cpp and the like) and caches them by text, so each note is
+// embedded once until it is edited.
+type Embedder struct {
+	// URL is the API base, e.g. https://api.openai.com/v1; requests go to
+	// URL/embeddings.
+	URL    string
+	Model  string
+	Key    string
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string][]float32
+}
+
+// Embed returns an embedding for each text. Empty texts get none.
+func (e *Embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors, missing := e.cached(texts)
+
+	for start := 0; start < len(missing); start += embedBatch {
+		batch := missing[start:min(start+embedBatch, len(missing))]
+		input := make([]string, len(batch))
+		for j, i := range batch {
+			input[j] = texts[i]
+		}
+		got, err := e.request(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		e.mu.Lock()
+		if e.cache == nil || len(e.cache)+len(batch) > maxEmbedCache {
+			e.cache = map[string][]float32{}
+		}
+		for j, i := range batch {
+			vectors[i] = got[j]
+			e.cache[texts[i]] = got[j]
+		}
+		e.mu.Unlock()
+	}
+	return vectors, nil
+}
+
+// cached returns the cached embedding for each text, and the indexes of the
+// non-empty texts that have none.
+func (e *Embedder) cached(texts []string) ([][]float32, []int) {
+	vectors := make([][]float32, len(texts))
+	var missing []int
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, t := range texts {
+		if v, ok := e.cache[t]; ok {
+			vectors[i] = v
+		} else if t != "" {
+			missing = append(missing, i)
+		}
+	}
+	return vectors, missing
+}
+
+func (e *Embedder) request(ctx context.Context, input []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]any{"model": e.Model, "input": input})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.URL, "/")+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEmbedding, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+e.Key)
+	}
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEmbedding, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%w: %s: %s", ErrEmbedding, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%w: decoding response: %v", ErrEmbedding, err)
+	}
+	vectors := make([][]float32, len(input))
+	for _, d := range out.Data {
+		if d.Index < 0 || d.Index >= len(input) {
+			return nil, fmt.Errorf("%w: response index %d out of range", ErrEmbedding, d.Index)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	for i, v := range vectors {
+		if v == nil {
+			return nil, fmt.Errorf("%w: no embedding for input %d", ErrEmbedding, i)
+		}
+	}
+	return vectors, nil
+}
+
+// cosine is the cosine similarity of two vectors, or 0 if either is
+// missing or they differ in length.
+func cosine(a, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
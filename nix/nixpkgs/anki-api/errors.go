@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// apiError is the body of every error response:
+// {"error": {"code": "not_found", "message": "note 1 not found"}}. Code is
+// stable for clients to match on; message is for people.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorKinds maps the errors clients can act on to a status and code,
+// most specific first. Those marked terse report only the sentinel's
+// message, leaving driver detail to the server log.
+var errorKinds = []struct {
+	err    error
+	status int
+	code   string
+	terse  bool
+}{
+	{ErrInvalidNote, http.StatusBadRequest, "invalid_note", false},
+	{ErrInvalidSearch, http.StatusBadRequest, "invalid_search", false},
+	{ErrInvalidImport, http.StatusBadRequest, "invalid_import", false},
+	{ErrInvalidMediaName, http.StatusBadRequest, "invalid_media_name", false},
+	{ErrDeckNotFound, http.StatusNotFound, "deck_not_found", false},
+	{ErrNotFound, http.StatusNotFound, "not_found", false},
+	{ErrReadOnly, http.StatusForbidden, "read_only", true},
+	{ErrCollectionLocked, http.StatusLocked, "collection_locked", true},
+	{ErrEmbedding, http.StatusBadGateway, "embedding_failed", false},
+}
+
+// statusCodes is the code for errors the handlers raise themselves, by
+// status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+}
+
+// httpError writes an error response with the status's generic code.
+func httpError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]apiError{"error": {statusCodes[status], message}})
+}
+
+// writeError reports errors the client can act on, and treats anything
+// else as a server error.
+func writeError(w http.ResponseWriter, context string, err error) {
+	for _, k := range errorKinds {
+		if !errors.Is(err, k.err) {
+			continue
+		}
+		message := err.Error()
+		if k.terse {
+			message = k.err.Error()
+		}
+		writeJSON(w, k.status, map[string]apiError{"error": {k.code, message}})
+		return
+	}
+	serverError(w, context, err)
+}
+
+func serverError(w http.ResponseWriter, context string, err error) {
+	log.Printf("error %s: %v", context, err)
+	httpError(w, http.StatusInternalServerError, "internal server error")
+}
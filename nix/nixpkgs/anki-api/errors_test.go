@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	db := openSearchFixture(t)
+	_, noteErr := db.GetNote(1)
+	_, _, deckErr := db.ListNotes("Nope", false, ListOptions{})
+	_, createErr := db.CreateNote(NoteInput{Deck: "Nope", Model: "Basic"})
+
+	tests := []struct {
+		name        string
+		err         error
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		{"note", noteErr, http.StatusNotFound, "not_found", "note 1 not found"},
+		{"deck", deckErr, http.StatusNotFound, "deck_not_found", `deck "Nope" not found`},
+		{"note body deck", createErr, http.StatusNotFound, "deck_not_found", `deck "Nope" not found`},
+		{"locked", fmt.Errorf("%w: database is locked", ErrCollectionLocked), http.StatusLocked, "collection_locked", ErrCollectionLocked.Error()},
+		{"other", errors.New("disk on fire"), http.StatusInternalServerError, "internal", "internal server error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeError(rec, "testing", tt.err)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decoding %s: %v", rec.Body, err)
+			}
+			if got := body["error"]; got.Code != tt.wantCode || got.Message != tt.wantMessage {
+				t.Errorf("error = %+v, want {%s %s}", got, tt.wantCode, tt.wantMessage)
+			}
+		})
+	}
+
+	if !errors.Is(deckErr, ErrNotFound) {
+		t.Error("ErrDeckNotFound does not match ErrNotFound")
+	}
+	if !errors.Is(createErr, ErrDeckNotFound) {
+		t.Error("missing deck in note body does not match ErrDeckNotFound")
+	}
+}
+
+func TestCreateNote_UnknownDeck(t *testing.T) {
+	h := &Handler{db: openFixture(t, false, true)}
+	rec := httptest.NewRecorder()
+	h.CreateNote(rec, httptest.NewRequest(http.MethodPost, "/api/notes", strings.NewReader(`{"deck": "Nope", "model": "Cloze", "fields": {"Text": "{{c1::x}}"}}`)))
+	var body map[string]apiError
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusNotFound || body["error"].Code != "deck_not_found" {
+		t.Errorf("status = %d, error = %+v; want 404 deck_not_found", rec.Code, body["error"])
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExportedNote is a note as exported: its guid lets an importer recognise
+// notes it already has, and Deck is where its first card lives.
+type ExportedNote struct {
+	Note
+	GUID string `json:"guid"`
+	Deck string `json:"deck"`
+}
+
+// DeckExport is the notes in a deck and its subdecks, with the models they
+// use.
+type DeckExport struct {
+	Deck   string         `json:"deck"`
+	Models []Model        `json:"models"`
+	Notes  []ExportedNote `json:"notes"`
+
+	decks []Deck
+	types []noteType
+	cards []exportedCard
+	mids  map[int64]int64
+}
+
+// exportedCard is a card's identity and placement; scheduling is not
+// exported, so cards arrive as new.
+type exportedCard struct {
+	ID, NoteID, DeckID int64
+	Ord                int
+}
+
+// ExportDeck collects the notes with a card in deckName or its subdecks.
+func (a *AnkiDB) ExportDeck(deckName string) (*DeckExport, error) {
+	all, err := a.ListDecks()
+	if err != nil {
+		return nil, err
+	}
+	e := &DeckExport{Deck: deckName, Notes: []ExportedNote{}, mids: map[int64]int64{}}
+	names := map[int64]string{}
+	var ids []int64
+	for _, d := range all {
+		if d.Name == deckName || strings.HasPrefix(d.Name, deckName+"::") {
+			e.decks = append(e.decks, d)
+			names[d.ID] = d.Name
+			ids = append(ids, d.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("deck %q %w", deckName, ErrDeckNotFound)
+	}
+
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+	typesByID := make(map[int64]noteType, len(types))
+	for _, t := range types {
+		typesByID[t.ID] = t
+	}
+
+	idsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	// Cards in a filtered deck are exported from their home deck.
+	rows, err := a.db.Query(`
+		SELECT c.id, c.ord, CASE WHEN c.odid != 0 THEN c.odid ELSE c.did END AS home,
+			n.id, n.guid, n.mid, n.flds, n.tags
+		FROM cards c
+		JOIN notes n ON n.id = c.nid
+		WHERE home IN (SELECT value FROM json_each(?))
+		ORDER BY n.id, c.ord
+	`, string(idsJSON))
+	if err != nil {
+		return nil, fmt.Errorf("querying notes: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	used := map[int64]bool{}
+	for rows.Next() {
+		var c exportedCard
+		var mid int64
+		var guid, flds, tags string
+		if err := rows.Scan(&c.ID, &c.Ord, &c.DeckID, &c.NoteID, &guid, &mid, &flds, &tags); err != nil {
+			return nil, err
+		}
+		e.cards = append(e.cards, c)
+		if n := len(e.Notes); n > 0 && e.Notes[n-1].ID == c.NoteID {
+			continue
+		}
+
+		nt, ok := typesByID[mid]
+		if !ok {
+			return nil, fmt.Errorf("note %d has unknown model %d", c.NoteID, mid)
+		}
+		fields := make(map[string]string, len(nt.Fields))
+		parts := strings.Split(flds, "\x1f")
+		for i, name := range nt.Fields {
+			if i < len(parts) {
+				fields[name] = parts[i]
+			}
+		}
+		if !used[mid] {
+			used[mid] = true
+			e.types = append(e.types, nt)
+			e.Models = append(e.Models, Model{ID: nt.ID, Name: nt.Name, Fields: nt.Fields})
+		}
+		e.mids[c.NoteID] = mid
+		e.Notes = append(e.Notes, ExportedNote{
+			Note: Note{ID: c.NoteID, Model: nt.Name, Fields: fields, Tags: strings.TrimSpace(tags)},
+			GUID: guid,
+			Deck: names[c.DeckID],
+		})
+	}
+	if e.Models == nil {
+		e.Models = []Model{}
+	}
+	return e, rows.Err()
+}
+
+// fieldValues returns a note's fields in its model's order.
+func (e *DeckExport) fieldValues(n ExportedNote) []string {
+	for _, t := range e.types {
+		if t.ID == e.mids[n.ID] {
+			values := make([]string, len(t.Fields))
+			for i, name := range t.Fields {
+				values[i] = n.Fields[name]
+			}
+			return values
+		}
+	}
+	return nil
+}
+
+// csvColumns are the leading columns of a CSV export, named as in Anki's
+// "#<name> column:<n>" headers.
+var csvColumns = []string{"guid", "notetype", "deck", "tags"}
+
+// WriteCSV writes the export in Anki's text format: header lines naming
+// the separator and the guid, note type, deck and tags columns, then one
+// row per note with its fields in model order. Anki can import it as is.
+func (e *DeckExport) WriteCSV(w io.Writer) error {
+	header := "#separator:Comma\n#html:true\n"
+	for i, name := range csvColumns {
+		header += fmt.Sprintf("#%s column:%d\n", name, i+1)
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	for _, n := range e.Notes {
+		record := append([]string{n.GUID, n.Model, n.Deck, n.Tags}, e.fieldValues(n)...)
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExportDeck(t *testing.T) {
+	db := openSearchFixture(t)
+	e, err := db.ExportDeck("Lang::Go")
+	if err != nil {
+		t.Fatalf("ExportDeck() error = %v", err)
+	}
+	if len(e.Notes) != 2 || e.Notes[0].GUID != "guid100" || e.Notes[0].Deck != "Lang::Go" ||
+		e.Notes[1].GUID != "g101" || e.Notes[1].Deck != "Lang::Go::Advanced" {
+		t.Errorf("notes = %+v", e.Notes)
+	}
+	if len(e.Models) != 1 || e.Models[0].Name != "Basic (and reversed)" {
+		t.Errorf("models = %+v", e.Models)
+	}
+	if len(e.cards) != 3 {
+		t.Errorf("cards = %+v, want 3", e.cards)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"guid":"guid100","deck":"Lang::Go"`) {
+		t.Errorf("json = %s", b)
+	}
+
+	if _, err := db.ExportDeck("Nope"); err == nil || err.Error() != `deck "Nope" not found` {
+		t.Errorf("unknown deck error = %v", err)
+	}
+}
+
+func TestDeckExport_CSVRoundTrip(t *testing.T) {
+	e, err := openSearchFixture(t).ExportDeck("Lang::Go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+	want := "#separator:Comma\n#html:true\n#guid column:1\n#notetype column:2\n#deck column:3\n#tags column:4\n" +
+		"guid100,Basic (and reversed),Lang::Go,go,chan,typed pipe\n"
+	if !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("csv =\n%s", buf.String())
+	}
+
+	// guid100 is already in the target collection; Lang::Go::Advanced is not.
+	db := openFixture(t, false, true)
+	buf.WriteString(",Cloze,Lang::Go,new,{{c1::fresh}},\n")
+	result, err := db.ImportCSV(&buf, "Default", "", nil)
+	if err != nil {
+		t.Fatalf("ImportCSV() error = %v", err)
+	}
+	if result.Created != 1 || result.Duplicates != 1 || len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "Lang::Go::Advanced") {
+		t.Errorf("result = %+v", result)
+	}
+	notes, _, err := db.SearchNotes("fresh", "", false, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Model != "Cloze" || notes[0].Tags != "new" {
+		t.Errorf("imported = %+v", notes)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	notes, err := parseCSV(strings.NewReader("#separator:Semicolon\n#html:false\n#tags column:3\na<b;c;x y\n"), "Default", "Basic (and reversed)")
+	if err != nil {
+		t.Fatalf("parseCSV() error = %v", err)
+	}
+	if len(notes) != 1 || !slices.Equal(notes[0].values, []string{"a&lt;b", "c"}) || notes[0].tags != "x y" || notes[0].deck != "Default" {
+		t.Errorf("notes = %+v", notes)
+	}
+
+	notes, err = parseCSV(strings.NewReader("front\tback, with comma\n"), "Default", "Basic (and reversed)")
+	if err != nil || len(notes) != 1 || !slices.Equal(notes[0].values, []string{"front", "back, with comma"}) {
+		t.Errorf("tab-separated: %+v, %v", notes, err)
+	}
+
+	for _, in := range []string{"a,b\n", "#separator:wavy\n", "#notetype column:x\n"} {
+		model := ""
+		if strings.HasPrefix(in, "#") {
+			model = "Basic (and reversed)"
+		}
+		if _, err := parseCSV(strings.NewReader(in), "Default", model); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("parseCSV(%q) error = %v, want ErrInvalidImport", in, err)
+		}
+	}
+}
+
+func TestApkgRoundTrip(t *testing.T) {
+	src := openSearchFixture(t)
+	execCollection(t, src, `UPDATE notes SET flds = '<img src="cat.png">' || char(31) || 'typed pipe' WHERE id = 100`)
+	srcMedia := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcMedia, "cat.png"), []byte("meow"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := src.ExportDeck("Lang::Go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.WriteApkg(&buf, srcMedia); err != nil {
+		t.Fatalf("WriteApkg() error = %v", err)
+	}
+
+	// The package is a zip of a collection Anki's legacy importer accepts.
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !slices.Equal(names, []string{"collection.anki2", "0", "media"}) {
+		t.Fatalf("package entries = %v", names)
+	}
+	dir := t.TempDir()
+	colPath := filepath.Join(dir, "collection.anki2")
+	if err := extractZipFile(zr.File[0], colPath); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := OpenAnkiDB(colPath, false)
+	if err != nil {
+		t.Fatalf("opening package collection: %v", err)
+	}
+	stats, err := pkg.GetStats()
+	_ = pkg.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Notes: 2, Cards: 3, Decks: 3, Models: 1, SchemaVersion: 11}); *stats != want {
+		t.Errorf("package stats = %+v, want %+v", *stats, want)
+	}
+
+	dst := openFixture(t, false, true)
+	dstMedia := filepath.Join(t.TempDir(), "collection.media")
+	result, err := dst.ImportApkg(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "Default", dstMedia)
+	if err != nil {
+		t.Fatalf("ImportApkg() error = %v", err)
+	}
+	if result.Created != 1 || result.Duplicates != 1 || result.Media != 1 || len(result.Errors) != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	if data, err := os.ReadFile(filepath.Join(dstMedia, "cat.png")); err != nil || string(data) != "meow" {
+		t.Errorf("imported media = %q, %v", data, err)
+	}
+	notes, _, err := dst.SearchNotes("goroutine", "Default", false, ListOptions{})
+	if err != nil || len(notes) != 1 || notes[0].Tags != "go::runtime perf" {
+		t.Errorf("imported notes = %+v, %v", notes, err)
+	}
+
+	result, err = dst.ImportApkg(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "Default", dstMedia)
+	if err != nil {
+		t.Fatalf("second ImportApkg() error = %v", err)
+	}
+	if result.Created != 0 || result.Duplicates != 2 || result.Media != 0 {
+		t.Errorf("second import = %+v", result)
+	}
+
+	if _, err := openSearchFixture(t).ImportApkg(bytes.NewReader(buf.Bytes()), int64(buf.Len()), "Default", dstMedia); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only import error = %v", err)
+	}
+	if _, err := dst.ImportApkg(strings.NewReader("not a zip"), 9, "Default", dstMedia); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("bad package error = %v", err)
+	}
+
+	// An entry claiming to unpack past the limit is refused before reading.
+	var bomb bytes.Buffer
+	zw := zip.NewWriter(&bomb)
+	if _, err := zw.CreateRaw(&zip.FileHeader{Name: "collection.anki2", Method: zip.Store, UncompressedSize64: maxPackageCollection + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.ImportApkg(bytes.NewReader(bomb.Bytes()), int64(bomb.Len()), "Default", dstMedia); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("oversized package error = %v", err)
+	}
+}
+
+func TestExportImport_Handlers(t *testing.T) {
+	h := &Handler{db: openSearchFixture(t), mediaDir: t.TempDir()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/decks/{name}/export", h.ExportDeck)
+	mux.HandleFunc("POST /api/decks/{name}/import", h.ImportDeck)
+	tests := []struct {
+		method, url string
+		body        io.Reader
+		wantStatus  int
+		contentType string
+	}{
+		{http.MethodGet, "/api/decks/Lang::Go/export", nil, http.StatusOK, "application/zip"},
+		{http.MethodGet, "/api/decks/Lang::Go/export?format=csv", nil, http.StatusOK, "text/csv; charset=utf-8"},
+		{http.MethodGet, "/api/decks/Lang::Go/export?format=json", nil, http.StatusOK, "application/json"},
+		{http.MethodGet, "/api/decks/Lang::Go/export?format=xml", nil, http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/decks/Nope/export", nil, http.StatusNotFound, ""},
+		{http.MethodPost, "/api/decks/Default/import?format=csv&model=Cloze", strings.NewReader("{{c1::x}}\n"), http.StatusForbidden, ""},
+		{http.MethodPost, "/api/decks/Default/import?format=csv", strings.NewReader("x\n"), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.url, tt.body))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.contentType != "" && rec.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrFTSUnavailable is returned when SQLite was built without FTS5. Build
+// with -tags sqlite_fts5 to enable the search index.
+var ErrFTSUnavailable = errors.New("sqlite built without FTS5")
+
+// searchIndex is a full-text index of HTML-stripped note fields kept in a
+// separate database, so the collection is never written. The trigram
+// tokenizer gives substring matching, which lets it prefilter Anki's
+// substring searches without changing their results.
+type searchIndex struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// signature summarises the notes table when the index was last
+	// refreshed; a change means notes were added, edited or deleted.
+	signature string
+}
+
+// ftsHit is one index match, in rank order.
+type ftsHit struct {
+	NoteID  int64
+	Snippet string
+}
+
+const searchIndexDDL = `
+CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(text, tokenize = 'trigram');
+CREATE TABLE IF NOT EXISTS indexed (nid INTEGER PRIMARY KEY, mod INTEGER NOT NULL);
+`
+
+func openSearchIndex(path string) (*searchIndex, error) {
+	db, err := sql.Open(driverName, path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("opening index: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(searchIndexDDL); err != nil {
+		_ = db.Close()
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil, ErrFTSUnavailable
+		}
+		return nil, fmt.Errorf("creating index: %w", err)
+	}
+	return &searchIndex{db: db}, nil
+}
+
+// EnableIndex maintains a full-text index at path and uses it to speed up
+// searches. The index is brought up to date before returning.
+func (a *AnkiDB) EnableIndex(path string) error {
+	idx, err := openSearchIndex(path)
+	if err != nil {
+		return err
+	}
+	if err := idx.refresh(a.db); err != nil {
+		_ = idx.Close()
+		return err
+	}
+	a.index = idx
+	return nil
+}
+
+func (s *searchIndex) Close() error {
+	return s.db.Close()
+}
+
+// refresh reindexes notes whose mod time differs from when they were last
+// indexed and drops deleted notes. A cheap summary of the notes table
+// short-circuits the comparison when nothing has changed.
+func (s *searchIndex) refresh(col *sql.DB) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count, modSum, maxID int64
+	if err := col.QueryRow("SELECT COUNT(*), COALESCE(SUM(mod), 0), COALESCE(MAX(id), 0) FROM notes").
+		Scan(&count, &modSum, &maxID); err != nil {
+		return fmt.Errorf("summarising notes: %w", err)
+	}
+	signature := fmt.Sprintf("%d/%d/%d", count, modSum, maxID)
+	if signature == s.signature {
+		return nil
+	}
+
+	current, err := queryMods(col, "SELECT id, mod FROM notes")
+	if err != nil {
+		return fmt.Errorf("reading note mod times: %w", err)
+	}
+	indexed, err := queryMods(s.db, "SELECT nid, mod FROM indexed")
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+
+	var stale, deleted []int64
+	for id, mod := range current {
+		if m, ok := indexed[id]; !ok || m != mod {
+			stale = append(stale, id)
+		}
+	}
+	for id := range indexed {
+		if _, ok := current[id]; !ok {
+			deleted = append(deleted, id)
+		}
+	}
+
+	type doc struct {
+		id, mod int64
+		text    string
+	}
+	var docs []doc
+	if len(stale) > 0 {
+		ids, _ := json.Marshal(stale)
+		rows, err := col.Query("SELECT id, mod, flds FROM notes WHERE id IN (SELECT value FROM json_each(?))", string(ids))
+		if err != nil {
+			return fmt.Errorf("reading notes: %w", err)
+		}
+		for rows.Next() {
+			var d doc
+			var flds string
+			if err := rows.Scan(&d.id, &d.mod, &flds); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			// Stripped field by field as the search scan strips it, so
+			// the index holds the text a plain-text term is matched
+			// against, with a line break for each field separator.
+			d.text = strings.ReplaceAll(stripFields(flds), "\x1f", "\n")
+			docs = append(docs, d)
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, id := range deleted {
+		if _, err := tx.Exec("DELETE FROM notes_fts WHERE rowid = ?", id); err != nil {
+			return fmt.Errorf("removing note %d: %w", id, err)
+		}
+		if _, err := tx.Exec("DELETE FROM indexed WHERE nid = ?", id); err != nil {
+			return fmt.Errorf("removing note %d: %w", id, err)
+		}
+	}
+	for _, d := range docs {
+		if _, err := tx.Exec("DELETE FROM notes_fts WHERE rowid = ?", d.id); err != nil {
+			return fmt.Errorf("indexing note %d: %w", d.id, err)
+		}
+		if _, err := tx.Exec("INSERT INTO notes_fts (rowid, text) VALUES (?, ?)", d.id, d.text); err != nil {
+			return fmt.Errorf("indexing note %d: %w", d.id, err)
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO indexed (nid, mod) VALUES (?, ?)", d.id, d.mod); err != nil {
+			return fmt.Errorf("indexing note %d: %w", d.id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(docs)+len(deleted) > 0 {
+		log.Printf("search index: %d notes updated, %d removed", len(docs), len(deleted))
+	}
+	s.signature = signature
+	return nil
+}
+
+func queryMods(db *sql.DB, query string) (map[int64]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	mods := map[int64]int64{}
+	for rows.Next() {
+		var id, mod int64
+		if err := rows.Scan(&id, &mod); err != nil {
+			return nil, err
+		}
+		mods[id] = mod
+	}
+	return mods, rows.Err()
+}
+
+// match returns the notes containing every phrase, best first, with a
+// snippet of the surrounding text marked up with <mark>.
+func (s *searchIndex) match(phrases []string) ([]ftsHit, error) {
+	quoted := make([]string, len(phrases))
+	for i, p := range phrases {
+		quoted[i] = `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+	}
+	rows, err := s.db.Query(`
+		SELECT rowid, snippet(notes_fts, 0, '<mark>', '</mark>', '…', 64)
+		FROM notes_fts
+		WHERE notes_fts MATCH ?
+		ORDER BY rank
+	`, strings.Join(quoted, " AND "))
+	if err != nil {
+		return nil, fmt.Errorf("querying index: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var hits []ftsHit
+	for rows.Next() {
+		var h ftsHit
+		if err := rows.Scan(&h.NoteID, &h.Snippet); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// indexPhrases returns the literal runs of at least three characters in the
+// plain-text terms a search requires, which every match must contain. Terms
+// under OR or negation are not required, so they are skipped.
+func indexPhrases(node searchNode) []string {
+	switch n := node.(type) {
+	case searchAnd:
+		var phrases []string
+		for _, child := range n {
+			phrases = append(phrases, indexPhrases(child)...)
+		}
+		return phrases
+	case searchTerm:
+		if n.key != "" {
+			return nil
+		}
+		var phrases []string
+		var run []rune
+		flush := func() {
+			// Trigrams cannot match anything shorter.
+			if len(run) >= 3 {
+				phrases = append(phrases, string(run))
+			}
+			run = run[:0]
+		}
+		runes := []rune(n.value)
+		for i := 0; i < len(runes); i++ {
+			switch r := runes[i]; {
+			case r == '\\' && i+1 < len(runes):
+				i++
+				run = append(run, runes[i])
+			case r == '*' || r == '_':
+				flush()
+			default:
+				run = append(run, r)
+			}
+		}
+		flush()
+		return phrases
+	}
+	return nil
+}
+
+// noteRank carries index matches into a note query: ids as a JSON array
+// for filtering, order as ",id1,id2,...," so rows can be ordered by instr
+// position, and snippets by note id.
+type noteRank struct {
+	ids      string
+	order    string
+	snippets map[int64]string
+}
+
+// indexLookup brings the index up to date and finds the notes containing
+// every phrase.
+func (a *AnkiDB) indexLookup(phrases []string) (*noteRank, error) {
+	if err := a.index.refresh(a.db); err != nil {
+		return nil, err
+	}
+	hits, err := a.index.match(phrases)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(hits))
+	var order strings.Builder
+	order.WriteString(",")
+	snippets := make(map[int64]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.NoteID
+		order.WriteString(strconv.FormatInt(h.NoteID, 10) + ",")
+		snippets[h.NoteID] = h.Snippet
+	}
+	idsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	return &noteRank{ids: string(idsJSON), order: order.String(), snippets: snippets}, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func openIndexedFixture(t *testing.T) *AnkiDB {
+	t.Helper()
+	db := openSearchFixture(t)
+	err := db.EnableIndex(filepath.Join(t.TempDir(), "index.db"))
+	if errors.Is(err, ErrFTSUnavailable) {
+		t.Skip("sqlite built without FTS5; run with -tags sqlite_fts5")
+	}
+	if err != nil {
+		t.Fatalf("EnableIndex() error = %v", err)
+	}
+	return db
+}
+
+func TestIndexPhrases(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"goroutine", []string{"goroutine"}},
+		{`"typed pipe" chan`, []string{"typed pipe", "chan"}},
+		{"go*ine", []string{"ine"}},
+		{`typed\_pipe`, []string{"typed_pipe"}},
+		{"ab", nil},
+		{"chan or rust", nil},
+		{"-chan pipe", []string{"pipe"}},
+		{"tag:go front:chan", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			node, err := parseSearch(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := indexPhrases(node); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchNotes_Index(t *testing.T) {
+	db := openIndexedFixture(t)
+	index := db.index
+
+	for _, q := range []string{"chan", "goroutine", "threads", "&amp;", "b>go", `"typed pipe"`, "pipe chan", "go*ine", "chan*pipe", "-chan borrow", "tag:go goroutine"} {
+		t.Run(q, func(t *testing.T) {
+			db.index = nil
+			want, _, err := db.SearchNotes(q, "", false, ListOptions{Sort: "id"})
+			db.index = index
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := db.SearchNotes(q, "", false, ListOptions{Sort: "id"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d notes, want %d", len(got), len(want))
+			}
+			for i := range got {
+				if got[i].ID != want[i].ID {
+					t.Errorf("note %d = %d, want %d", i, got[i].ID, want[i].ID)
+				}
+			}
+		})
+	}
+
+	notes, _, err := db.SearchNotes("goroutine", "", false, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].Snippet != "<mark>goroutine</mark> scheduling\nM:N & threads" {
+		t.Errorf("notes = %+v", notes)
+	}
+}
+
+func TestSearchNotes_IndexRank(t *testing.T) {
+	db := openIndexedFixture(t)
+	execCollection(t, db, `
+		INSERT INTO notes VALUES (103, 'g103', 10, 0, 0, '', 'pipe pipe pipe' || char(31) || 'pipe', 'pipe', 0, 0, '');
+		INSERT INTO cards VALUES (1030, 103, 1, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, '');
+	`)
+
+	notes, total, err := db.SearchNotes("pipe", "", false, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(notes) != 2 || notes[0].ID != 103 || notes[1].ID != 100 {
+		t.Fatalf("notes = %+v, want 103 then 100", notes)
+	}
+	if !strings.Contains(notes[1].Snippet, "<mark>pipe</mark>") {
+		t.Errorf("snippet = %q", notes[1].Snippet)
+	}
+
+	notes, _, err = db.SearchNotes("pipe", "", false, ListOptions{Sort: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[0].ID != 100 {
+		t.Errorf("explicit sort: notes = %+v", notes)
+	}
+}
+
+func TestSearchNotes_IndexFieldsStrippedApart(t *testing.T) {
+	db := openIndexedFixture(t)
+	// A "<" in one field and ">" in the next are not a tag, for the index
+	// as for the scan.
+	execCollection(t, db, `
+		INSERT INTO notes VALUES (104, 'g104', 10, 0, 0, '', 'x < zebra' || char(31) || '2 > 1', '', 0, 0, '');
+		INSERT INTO cards VALUES (1040, 104, 1, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, '');
+	`)
+	notes, _, err := db.SearchNotes("zebra", "", false, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || notes[0].ID != 104 {
+		t.Errorf("notes = %+v, want 104", notes)
+	}
+}
+
+func TestSearchIndex_Refresh(t *testing.T) {
+	db := openIndexedFixture(t)
+	count := func() int {
+		var n int
+		if err := db.index.db.QueryRow("SELECT COUNT(*) FROM indexed").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if got := count(); got != 3 {
+		t.Fatalf("indexed %d notes, want 3", got)
+	}
+
+	execCollection(t, db, `
+		UPDATE notes SET flds = 'select' || char(31) || 'multiplex', mod = 1 WHERE id = 100;
+		DELETE FROM notes WHERE guid = 'g102';
+	`)
+	if err := db.index.refresh(db.db); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if got := count(); got != 2 {
+		t.Errorf("indexed %d notes after delete, want 2", got)
+	}
+
+	for phrase, want := range map[string]int{"chan": 0, "multiplex": 1, "borrow": 0, "goroutine": 1} {
+		hits, err := db.index.match([]string{phrase})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != want {
+			t.Errorf("match(%q) = %d hits, want %d", phrase, len(hits), want)
+		}
+	}
+}
@@ -1,96 +1,531 @@
 package main
 
 import (
-	"crypto/subtle"
+	"bytes"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Handler struct {
-	db     *AnkiDB
-	apiKey string
+	db       *AnkiDB
+	keys     *keyring
+	mediaDir string
+	embedder *Embedder
+
+	// mu guards db, the requests using it and lastReload against a
+	// reload; see holdDB.
+	mu         sync.RWMutex
+	users      *sync.WaitGroup
+	lastReload time.Time
 }
 
-func (h *Handler) authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/health" {
-			next.ServeHTTP(w, r)
-			return
-		}
-		key := r.Header.Get("X-API-Key")
-		if subtle.ConstantTimeCompare([]byte(key), []byte(h.apiKey)) != 1 {
-			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
+func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	lastReload := h.lastReload
+	h.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":      "ok",
+		"last_reload": lastReload.UTC().Format(time.RFC3339),
 	})
 }
 
-func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI serves the API's OpenAPI description.
+func (h *Handler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
 }
 
+// ListDecks lists decks, or with tree=1 nests them under their parents.
 func (h *Handler) ListDecks(w http.ResponseWriter, r *http.Request) {
-	decks, err := h.db.ListDecks()
+	opts, ok := listOptions(w, r, deckSorts)
+	if !ok {
+		return
+	}
+	tree, ok := boolParam(w, r, "tree")
+	if !ok {
+		return
+	}
+	decks, err := h.dbFor(r).ListDecks()
+	if err != nil {
+		serverError(w, "listing decks", err)
+		return
+	}
+	key := requestKey(r)
+	decks = slices.DeleteFunc(decks, func(d Deck) bool { return !key.allowsDeck(d.Name) })
+	total := len(decks)
+	if tree {
+		if r.URL.Query().Has("limit") || opts.Offset != 0 {
+			httpError(w, http.StatusBadRequest, "limit and offset do not apply to a deck tree")
+			return
+		}
+		opts.Limit = 0
+	}
+	decks, err = PageDecks(decks, opts)
 	if err != nil {
 		serverError(w, "listing decks", err)
 		return
 	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if tree {
+		writeJSON(w, http.StatusOK, DeckTree(decks))
+		return
+	}
 	writeJSON(w, http.StatusOK, decks)
 }
 
+// ExportDeck downloads a deck and its subdecks as an Anki package (the
+// default), Anki's CSV text format, or JSON.
+func (h *Handler) ExportDeck(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "apkg"
+	}
+	if format != "apkg" && format != "csv" && format != "json" {
+		httpError(w, http.StatusBadRequest, "format must be one of apkg, csv, json")
+		return
+	}
+	if !deckAllowed(w, r, name) {
+		return
+	}
+	export, err := h.dbFor(r).ExportDeck(name)
+	if err != nil {
+		writeError(w, "exporting deck", err)
+		return
+	}
+	if format == "json" {
+		writeJSON(w, http.StatusOK, export)
+		return
+	}
+
+	// Build the file before sending anything, so a failure can still be
+	// reported with a status code.
+	var buf bytes.Buffer
+	contentType := "text/csv; charset=utf-8"
+	if format == "apkg" {
+		contentType = "application/zip"
+		err = export.WriteApkg(&buf, h.mediaDir)
+	} else {
+		err = export.WriteCSV(&buf)
+	}
+	if err != nil {
+		serverError(w, "exporting deck", err)
+		return
+	}
+	filename := strings.NewReplacer("::", "-", "/", "-", `"`, "").Replace(name) + "." + format
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// ImportDeck adds the notes in an uploaded Anki package or CSV file to a
+// deck. CSV rows without a note type column need the model parameter.
+func (h *Handler) ImportDeck(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "apkg"
+	}
+	if format != "apkg" && format != "csv" {
+		httpError(w, http.StatusBadRequest, "format must be one of apkg, csv")
+		return
+	}
+	if !deckAllowed(w, r, name) {
+		return
+	}
+
+	var result *ImportResult
+	var err error
+	if format == "csv" {
+		result, err = h.dbFor(r).ImportCSV(http.MaxBytesReader(w, r.Body, maxImportBody), name, q.Get("model"), requestKey(r).allowsDeck)
+	} else {
+		// Zip archives need random access, so the upload is spooled to disk.
+		var f *os.File
+		f, err = os.CreateTemp("", "anki-import-*.apkg")
+		if err != nil {
+			serverError(w, "importing deck", err)
+			return
+		}
+		defer func() { _ = os.Remove(f.Name()) }()
+		defer func() { _ = f.Close() }()
+		size, copyErr := io.Copy(f, http.MaxBytesReader(w, r.Body, maxImportBody))
+		if copyErr != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(copyErr, &tooLarge) {
+				httpError(w, http.StatusRequestEntityTooLarge, "upload too large")
+				return
+			}
+			serverError(w, "importing deck", copyErr)
+			return
+		}
+		result, err = h.dbFor(r).ImportApkg(f, size, name, h.mediaDir)
+	}
+	if err != nil {
+		writeError(w, "importing deck", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
 func (h *Handler) ListNotes(w http.ResponseWriter, r *http.Request) {
 	deck := r.URL.Query().Get("deck")
 	if deck == "" {
-		http.Error(w, `{"error":"deck query parameter is required"}`, http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, "deck query parameter is required")
+		return
+	}
+	if !deckAllowed(w, r, deck) {
+		return
+	}
+	opts, ok := listOptions(w, r, noteSorts)
+	if !ok {
+		return
+	}
+	rewrite, ok := boolParam(w, r, "rewrite_media")
+	if !ok {
+		return
+	}
+	recursive, ok := boolParam(w, r, "recursive")
+	if !ok {
 		return
 	}
-	notes, err := h.db.ListNotes(deck)
+	notes, total, err := h.dbFor(r).ListNotes(deck, recursive, opts)
 	if err != nil {
-		serverError(w, "listing notes", err)
+		writeError(w, "listing notes", err)
 		return
 	}
+	if rewrite {
+		for i := range notes {
+			h.rewriteNoteMedia(r, &notes[i])
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	writeJSON(w, http.StatusOK, notes)
 }
 
 func (h *Handler) GetNote(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 	if err != nil {
-		http.Error(w, `{"error":"invalid note id"}`, http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
 		return
 	}
-	note, err := h.db.GetNote(id)
+	rewrite, ok := boolParam(w, r, "rewrite_media")
+	if !ok {
+		return
+	}
+	note, err := h.dbFor(r).GetNote(id)
 	if err != nil {
-		if err.Error() == fmt.Sprintf("note %d not found", id) {
-			http.Error(w, `{"error":"note not found"}`, http.StatusNotFound)
-			return
-		}
-		serverError(w, "getting note", err)
+		writeError(w, "getting note", err)
+		return
+	}
+	if rewrite {
+		h.rewriteNoteMedia(r, note)
+	}
+	writeJSON(w, http.StatusOK, note)
+}
+
+func (h *Handler) CreateNote(w http.ResponseWriter, r *http.Request) {
+	var in NoteInput
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBody)).Decode(&in); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if !deckAllowed(w, r, in.Deck) {
+		return
+	}
+	note, err := h.dbFor(r).CreateNote(in)
+	if err != nil {
+		writeError(w, "creating note", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, note)
+}
+
+func (h *Handler) UpdateNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
+		return
+	}
+	var in NoteInput
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBody)).Decode(&in); err != nil {
+		httpError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	note, err := h.dbFor(r).UpdateNote(id, in)
+	if err != nil {
+		writeError(w, "updating note", err)
 		return
 	}
 	writeJSON(w, http.StatusOK, note)
 }
 
+func (h *Handler) DeleteNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
+		return
+	}
+	if err := h.dbFor(r).DeleteNote(id); err != nil {
+		writeError(w, "deleting note", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) SearchNotes(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query().Get("q")
 	if q == "" {
-		http.Error(w, `{"error":"q query parameter is required"}`, http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, "q query parameter is required")
+		return
+	}
+	opts, ok := listOptions(w, r, noteSorts)
+	if !ok {
+		return
+	}
+	rewrite, ok := boolParam(w, r, "rewrite_media")
+	if !ok {
 		return
 	}
 	deck := r.URL.Query().Get("deck")
-	notes, err := h.db.SearchNotes(q, deck)
+	if deck != "" && !deckAllowed(w, r, deck) {
+		return
+	}
+	var scope string
+	if key := requestKey(r); key.restricted() {
+		scope = key.deckSearch()
+	}
+	recursive, ok := boolParam(w, r, "recursive")
+	if !ok {
+		return
+	}
+	notes, total, err := h.dbFor(r).SearchNotesWithin(q, scope, deck, recursive, opts)
 	if err != nil {
-		serverError(w, "searching notes", err)
+		writeError(w, "searching notes", err)
 		return
 	}
+	if rewrite {
+		for i := range notes {
+			h.rewriteNoteMedia(r, &notes[i])
+		}
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	writeJSON(w, http.StatusOK, notes)
 }
 
+// FindDuplicates lists the notes that resemble a candidate front and back,
+// for checking before a note is added.
+func (h *Handler) FindDuplicates(w http.ResponseWriter, r *http.Request) {
+	front := r.URL.Query().Get("front")
+	if strings.TrimSpace(front) == "" {
+		httpError(w, http.StatusBadRequest, "front query parameter is required")
+		return
+	}
+	opts, ok := h.duplicateOptions(w, r)
+	if !ok {
+		return
+	}
+	dupes, err := h.dbFor(r).FindDuplicates(r.Context(), front, r.URL.Query().Get("back"), 0, opts)
+	if err != nil {
+		writeError(w, "finding duplicates", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dupes)
+}
+
+func (h *Handler) NoteDuplicates(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
+		return
+	}
+	opts, ok := h.duplicateOptions(w, r)
+	if !ok {
+		return
+	}
+	dupes, err := h.dbFor(r).NoteDuplicates(r.Context(), id, opts)
+	if err != nil {
+		writeError(w, "finding duplicates", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dupes)
+}
+
+// DeckDuplicates reports the clusters of near-duplicate notes in a deck and
+// its subdecks.
+func (h *Handler) DeckDuplicates(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !deckAllowed(w, r, name) {
+		return
+	}
+	opts, ok := h.duplicateOptions(w, r)
+	if !ok {
+		return
+	}
+	if opts.Embedder != nil {
+		httpError(w, http.StatusBadRequest, "embeddings are not supported when clustering a deck")
+		return
+	}
+	clusters, err := h.dbFor(r).DeckDuplicates(name, opts.Threshold, opts.Limit)
+	if err != nil {
+		writeError(w, "finding duplicates", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, clusters)
+}
+
+func (h *Handler) NoteCards(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
+		return
+	}
+	cards, err := h.dbFor(r).NoteCards(id)
+	if err != nil {
+		writeError(w, "listing cards", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cards)
+}
+
+func (h *Handler) GetCard(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid card id")
+		return
+	}
+	card, err := h.dbFor(r).GetCard(id)
+	if err != nil {
+		writeError(w, "getting card", err)
+		return
+	}
+	if !deckAllowed(w, r, card.Deck) {
+		return
+	}
+	writeJSON(w, http.StatusOK, card)
+}
+
+func (h *Handler) NoteMedia(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "invalid note id")
+		return
+	}
+	if !h.noteAllowed(w, r, id) {
+		return
+	}
+	files, err := h.dbFor(r).NoteMedia(id, h.mediaDir)
+	if err != nil {
+		writeError(w, "listing note media", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// GetMedia serves a file from the media folder. Media is untrusted content,
+// so it is served with a sandboxing CSP and without content sniffing.
+func (h *Handler) GetMedia(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	// Restricted keys only get media a note in their decks references.
+	if key := requestKey(r); key.restricted() {
+		ok, err := h.dbFor(r).MediaReferenced(name, key.deckSearch())
+		if err != nil {
+			serverError(w, "getting media", err)
+			return
+		}
+		if !ok {
+			httpError(w, http.StatusForbidden, "key is not permitted to use this media file")
+			return
+		}
+	}
+	path, info, err := statMedia(h.mediaDir, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("media file %q %w", name, ErrNotFound)
+		}
+		writeError(w, "getting media", err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		serverError(w, "getting media", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	w.Header().Set("Content-Type", mediaType(name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (h *Handler) DueCounts(w http.ResponseWriter, r *http.Request) {
+	counts, err := h.dbFor(r).DueCounts()
+	if err != nil {
+		serverError(w, "counting due cards", err)
+		return
+	}
+	key := requestKey(r)
+	counts = slices.DeleteFunc(counts, func(d DeckDue) bool { return !key.allowsDeck(d.Deck) })
+	writeJSON(w, http.StatusOK, counts)
+}
+
+func (h *Handler) ReviewStats(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3650 {
+			httpError(w, http.StatusBadRequest, "days must be between 1 and 3650")
+			return
+		}
+		days = n
+	}
+	deck := r.URL.Query().Get("deck")
+	if deck == "" && !unrestricted(w, r) || deck != "" && !deckAllowed(w, r, deck) {
+		return
+	}
+	stats, err := h.dbFor(r).ReviewStats(days, deck)
+	if err != nil {
+		writeError(w, "getting review stats", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
 func (h *Handler) ListModels(w http.ResponseWriter, r *http.Request) {
-	models, err := h.db.GetNoteTypes()
+	models, err := h.dbFor(r).GetNoteTypes()
 	if err != nil {
 		serverError(w, "listing models", err)
 		return
@@ -99,7 +534,10 @@ func (h *Handler) ListModels(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.db.GetStats()
+	if !unrestricted(w, r) {
+		return
+	}
+	stats, err := h.dbFor(r).GetStats()
 	if err != nil {
 		serverError(w, "getting stats", err)
 		return
@@ -107,13 +545,145 @@ func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, stats)
 }
 
+// listOptions parses limit, offset, sort and fields query parameters,
+// writing a 400 response and returning false if any is invalid. sorts is
+// the endpoint's table of sort keys. Without a limit a page holds
+// defaultPageSize items; limit=all returns every item.
+func listOptions[T any](w http.ResponseWriter, r *http.Request, sorts map[string]T) (ListOptions, bool) {
+	q := r.URL.Query()
+	opts := ListOptions{Limit: defaultPageSize}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return opts, false
+		}
+		opts.Offset = n
+	}
+	switch v := q.Get("limit"); v {
+	case "":
+	case "all":
+		opts.Limit = 0
+	default:
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("limit must be all or from 1 to %d", maxPageSize))
+			return opts, false
+		}
+		opts.Limit = n
+	}
+
+	opts.Sort = q.Get("sort")
+	if opts.Sort != "" {
+		key, _ := sortKey(opts.Sort, "")
+		if _, ok := sorts[key]; !ok {
+			keys := make([]string, 0, len(sorts))
+			for k := range sorts {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			httpError(w, http.StatusBadRequest, "sort must be one of "+strings.Join(keys, ", ")+", optionally prefixed with -")
+			return opts, false
+		}
+	}
+
+	if v := q.Get("fields"); v != "" {
+		opts.Fields = strings.Split(v, ",")
+	}
+	return opts, true
+}
+
+// duplicateOptions parses the deck, threshold, embedding_threshold, limit
+// and embeddings query parameters, writing an error response and returning
+// false if any is invalid or names a deck the key may not use.
+func (h *Handler) duplicateOptions(w http.ResponseWriter, r *http.Request) (DuplicateOptions, bool) {
+	q := r.URL.Query()
+	opts := DuplicateOptions{
+		Deck:               q.Get("deck"),
+		Threshold:          defaultDuplicateThreshold,
+		Limit:              defaultDuplicateLimit,
+		AllowDeck:          requestKey(r).allowsDeck,
+		EmbeddingThreshold: defaultEmbeddingThreshold,
+	}
+	if opts.Deck != "" && !deckAllowed(w, r, opts.Deck) {
+		return opts, false
+	}
+	for _, p := range []struct {
+		name string
+		dst  *float64
+		min  float64
+	}{{"threshold", &opts.Threshold, minDuplicateThreshold}, {"embedding_threshold", &opts.EmbeddingThreshold, 0}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < p.min || f > 1 {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("%s must be between %g and 1", p.name, p.min))
+			return opts, false
+		}
+		*p.dst = f
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			httpError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return opts, false
+		}
+		opts.Limit = n
+	}
+	use, ok := boolParam(w, r, "embeddings")
+	if !ok {
+		return opts, false
+	}
+	if use && h.embedder == nil {
+		httpError(w, http.StatusBadRequest, "embeddings are not configured; start with -embed-url")
+		return opts, false
+	}
+	if use {
+		opts.Embedder = h.embedder
+	}
+	return opts, true
+}
+
+// boolParam parses a boolean query parameter, false if absent, writing a
+// 400 response and returning false if it is invalid.
+func boolParam(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, true
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, name+" must be a boolean")
+		return false, false
+	}
+	return b, true
+}
+
+// rewriteNoteMedia points a note's media references at GET /api/media. The
+// URLs are signed for the request's key, as a browser loading them cannot
+// send X-API-Key.
+func (h *Handler) rewriteNoteMedia(r *http.Request, n *Note) {
+	mediaURL := func(name string) string { return "/api/media/" + url.PathEscape(name) }
+	if key := requestKey(r); key != nil && h.keys != nil {
+		exp := time.Now().Add(mediaURLLifetime)
+		mediaURL = func(name string) string {
+			return "/api/media/" + url.PathEscape(name) + "?" + h.keys.signMedia(key, name, exp).Encode()
+		}
+	}
+	for name, value := range n.Fields {
+		n.Fields[name] = rewriteMedia(value, mediaURL)
+	}
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func serverError(w http.ResponseWriter, context string, err error) {
-	log.Printf("error %s: %v", context, err)
-	http.Error(w, `{"error":"internal server error"}`, http.StatusInternalServerError)
-}
+const (
+	maxNoteBody   = 1 << 20
+	maxImportBody = 512 << 20
+)
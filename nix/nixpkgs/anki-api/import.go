@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportResult summarises an import. Notes that could not be imported are
+// listed in Errors; the rest are imported regardless.
+type ImportResult struct {
+	Created    int      `json:"created"`
+	Duplicates int      `json:"duplicates"`
+	Media      int      `json:"media"`
+	Errors     []string `json:"errors"`
+}
+
+// importNote is a note read from an import file. Fields are either named,
+// or positional in the model's field order.
+type importNote struct {
+	guid   string
+	model  string
+	deck   string
+	tags   string
+	fields map[string]string
+	values []string
+}
+
+// importNotes adds notes in one transaction. Notes whose guid is already
+// in the collection are counted as duplicates and left alone, and notes
+// for decks allowDeck rejects, if set, are reported as errors.
+func (a *AnkiDB) importNotes(notes []importNote, allowDeck func(string) bool) (*ImportResult, error) {
+	if !a.writable {
+		return nil, ErrReadOnly
+	}
+	decks, err := a.ListDecks()
+	if err != nil {
+		return nil, err
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := a.guids()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{Errors: []string{}}
+	type pending struct {
+		guid string
+		note preparedNote
+	}
+	var batch []pending
+	for i, n := range notes {
+		if allowDeck != nil && !allowDeck(n.deck) {
+			result.Errors = append(result.Errors, fmt.Sprintf("note %d: deck %q is not permitted", i+1, n.deck))
+			continue
+		}
+		if n.guid != "" && existing[n.guid] {
+			result.Duplicates++
+			continue
+		}
+		in := NoteInput{Deck: n.deck, Model: n.model, Fields: n.fields, Tags: &n.tags}
+		if n.fields == nil {
+			in.Fields, err = positionalFields(n, types)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("note %d: %v", i+1, err))
+				continue
+			}
+		}
+		p, err := prepareNote(in, decks, types)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("note %d: %v", i+1, err))
+			continue
+		}
+		if n.guid != "" {
+			existing[n.guid] = true
+		}
+		batch = append(batch, pending{n.guid, p})
+	}
+	if len(batch) == 0 {
+		return result, nil
+	}
+
+	err = a.write(func(tx *sql.Tx, now time.Time) error {
+		for _, p := range batch {
+			if _, err := a.insertNote(tx, p.note, p.guid, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Created = len(batch)
+	return result, nil
+}
+
+func (a *AnkiDB) guids() (map[string]bool, error) {
+	rows, err := a.db.Query("SELECT guid FROM notes")
+	if err != nil {
+		return nil, fmt.Errorf("reading guids: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	guids := map[string]bool{}
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			return nil, err
+		}
+		guids[guid] = true
+	}
+	return guids, rows.Err()
+}
+
+// positionalFields names a note's values after its model's fields.
+func positionalFields(n importNote, types []noteType) (map[string]string, error) {
+	for _, t := range types {
+		if t.Name != n.model {
+			continue
+		}
+		if len(n.values) > len(t.Fields) {
+			return nil, fmt.Errorf("%w: %d fields given but model %q has %d", ErrInvalidNote, len(n.values), t.Name, len(t.Fields))
+		}
+		fields := make(map[string]string, len(n.values))
+		for i, v := range n.values {
+			fields[t.Fields[i]] = v
+		}
+		return fields, nil
+	}
+	return nil, fmt.Errorf("%w: model %q not found", ErrInvalidNote, n.model)
+}
+
+// ImportCSV adds the notes in a file in Anki's text format, as written by
+// WriteCSV. Rows without a deck or note type column go to deckName with
+// model. Rows for decks allowDeck rejects are reported as errors; a nil
+// allowDeck accepts every deck.
+func (a *AnkiDB) ImportCSV(r io.Reader, deckName, model string, allowDeck func(string) bool) (*ImportResult, error) {
+	notes, err := parseCSV(r, deckName, model)
+	if err != nil {
+		return nil, err
+	}
+	return a.importNotes(notes, allowDeck)
+}
+
+// csvSeparators are the names Anki's "#separator:" header accepts.
+var csvSeparators = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+	"space":     ' ',
+	"pipe":      '|',
+	"colon":     ':',
+}
+
+// parseCSV reads Anki's text format: optional "#key:value" header lines,
+// then one note per row. Columns not claimed by a header are the note's
+// fields, in order.
+func parseCSV(r io.Reader, deckName, model string) ([]importNote, error) {
+	br := bufio.NewReader(r)
+	separator := rune(0)
+	escapeHTML := false
+	columns := map[string]int{}
+	for {
+		peek, _ := br.Peek(1)
+		if len(peek) == 0 || peek[0] != '#' {
+			break
+		}
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(line[1:]), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch {
+		case key == "separator":
+			if sep, ok := csvSeparators[strings.ToLower(value)]; ok {
+				separator = sep
+			} else if utf8.RuneCountInString(value) == 1 {
+				separator, _ = utf8.DecodeRuneInString(value)
+			} else {
+				return nil, fmt.Errorf("%w: unknown separator %q", ErrInvalidImport, value)
+			}
+		case key == "html":
+			escapeHTML = value == "false"
+		case strings.HasSuffix(key, " column"):
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: invalid %s %q", ErrInvalidImport, key, value)
+			}
+			columns[strings.TrimSuffix(key, " column")] = n - 1
+		}
+	}
+	if separator == 0 {
+		// Without a header, tab-separated files are recognised by their
+		// first line.
+		separator = ','
+		if line, _ := br.Peek(4096); strings.Contains(strings.SplitN(string(line), "\n", 2)[0], "\t") {
+			separator = '\t'
+		}
+	}
+	if _, ok := columns["notetype"]; !ok && model == "" {
+		return nil, fmt.Errorf("%w: model is required when the file has no note type column", ErrInvalidImport)
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comma = separator
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	var notes []importNote
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+		}
+		n := importNote{model: model, deck: deckName}
+		for i, v := range record {
+			switch i {
+			case columnIndex(columns, "guid"):
+				n.guid = v
+			case columnIndex(columns, "notetype"):
+				n.model = v
+			case columnIndex(columns, "deck"):
+				n.deck = v
+			case columnIndex(columns, "tags"):
+				n.tags = v
+			default:
+				if escapeHTML {
+					v = html.EscapeString(v)
+				}
+				n.values = append(n.values, v)
+			}
+		}
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+// columnIndex returns the column a header assigned to name, or -1.
+func columnIndex(columns map[string]int, name string) int {
+	if i, ok := columns[name]; ok {
+		return i
+	}
+	return -1
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultPageSize is the page size of list endpoints when the request has
+// no limit, and maxPageSize caps the limit it may ask for, so one request
+// cannot fetch an entire large collection unless it asks with limit=all.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// ListOptions pages, orders and projects list results. A zero Limit returns
+// every result. Sort names a key from the endpoint's sort table, prefixed
+// with "-" for descending order. Fields, if set, limits each note's fields
+// to those named; it does not apply to decks.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Sort   string
+	Fields []string
+}
+
+// noteSorts maps note sort keys to columns. "field" is the note type's sort
+// field, stored HTML-stripped in sfld.
+var noteSorts = map[string]string{
+	"id":    "n.id",
+	"mod":   "n.mod",
+	"field": "n.sfld COLLATE NOCASE",
+}
+
+var deckSorts = map[string]func(a, b Deck) int{
+	"id":   func(a, b Deck) int { return cmp.Compare(a.ID, b.ID) },
+	"name": func(a, b Deck) int { return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)) },
+}
+
+// sortKey splits a sort parameter into its key and direction, defaulting
+// to def ascending.
+func sortKey(sort, def string) (key string, desc bool) {
+	if sort == "" {
+		return def, false
+	}
+	if key, ok := strings.CutPrefix(sort, "-"); ok {
+		return key, true
+	}
+	return sort, false
+}
+
+// queryNotes runs a note query over "notes n JOIN cards c" restricted by
+// where, returning the requested page and the total number of notes. If
+// rank is set, notes are ordered by it unless opts.Sort says otherwise.
+func (a *AnkiDB) queryNotes(where string, args []any, opts ListOptions, rank *noteRank) ([]Note, int, error) {
+	key, desc := sortKey(opts.Sort, "id")
+	column, ok := noteSorts[key]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort %q", opts.Sort)
+	}
+	order := column
+	if desc {
+		order += " DESC"
+	}
+	var orderArgs []any
+	if rank != nil && opts.Sort == "" {
+		order = "instr(?, ',' || n.id || ',')"
+		orderArgs = []any{rank.order}
+	}
+
+	models, err := a.getNoteTypes()
+	if err != nil {
+		return nil, 0, err
+	}
+	modelsByID := make(map[int64]noteType, len(models))
+	for _, m := range models {
+		modelsByID[m.ID] = m
+	}
+
+	var total int
+	if err := a.db.QueryRow(`
+		SELECT COUNT(DISTINCT n.id)
+		FROM notes n
+		JOIN cards c ON c.nid = n.id
+		WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("counting notes: %w", err)
+	}
+
+	query := `
+		SELECT n.id, n.mid, n.flds, n.tags
+		FROM notes n
+		JOIN cards c ON c.nid = n.id
+		WHERE ` + where + `
+		GROUP BY n.id
+		ORDER BY ` + order + `, n.id`
+	args = append(slices.Clone(args), orderArgs...)
+	if opts.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, opts.Limit, opts.Offset)
+	} else if opts.Offset > 0 {
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying notes: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	notes := []Note{}
+	for rows.Next() {
+		var id, mid int64
+		var flds, tags string
+		if err := rows.Scan(&id, &mid, &flds, &tags); err != nil {
+			return nil, 0, err
+		}
+
+		fields := make(map[string]string)
+		parts := strings.Split(flds, "\x1f")
+		if m, ok := modelsByID[mid]; ok {
+			for i, name := range m.Fields {
+				if i < len(parts) && (opts.Fields == nil || slices.Contains(opts.Fields, name)) {
+					fields[name] = parts[i]
+				}
+			}
+		}
+
+		note := Note{
+			ID:     id,
+			Model:  modelsByID[mid].Name,
+			Fields: fields,
+			Tags:   strings.TrimSpace(tags),
+		}
+		if rank != nil {
+			note.Snippet = rank.snippets[id]
+		}
+		notes = append(notes, note)
+	}
+	return notes, total, rows.Err()
+}
+
+// PageDecks sorts decks and returns the requested page.
+func PageDecks(decks []Deck, opts ListOptions) ([]Deck, error) {
+	key, desc := sortKey(opts.Sort, "name")
+	compare, ok := deckSorts[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", opts.Sort)
+	}
+	slices.SortFunc(decks, func(a, b Deck) int {
+		if desc {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+
+	start := min(opts.Offset, len(decks))
+	end := len(decks)
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, end)
+	}
+	return decks[start:end], nil
+}
+
+// DeckNode is a deck in the deck tree. Label is the last part of its name.
+// Parents that exist only as a prefix of their subdecks' names have no ID.
+type DeckNode struct {
+	ID       int64       `json:"id,omitempty"`
+	Name     string      `json:"name"`
+	Label    string      `json:"label"`
+	Children []*DeckNode `json:"children"`
+}
+
+// DeckTree nests decks under their parents, keeping the order of decks
+// among siblings.
+func DeckTree(decks []Deck) []*DeckNode {
+	roots := []*DeckNode{}
+	nodes := map[string]*DeckNode{}
+	var node func(name string) *DeckNode
+	node = func(name string) *DeckNode {
+		if n, ok := nodes[name]; ok {
+			return n
+		}
+		n := &DeckNode{Name: name, Label: name, Children: []*DeckNode{}}
+		nodes[name] = n
+		if i := strings.LastIndex(name, "::"); i >= 0 {
+			n.Label = name[i+2:]
+			parent := node(name[:i])
+			parent.Children = append(parent.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+		return n
+	}
+	for _, d := range decks {
+		node(d.Name).ID = d.ID
+	}
+	return roots
+}
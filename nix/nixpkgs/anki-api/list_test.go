@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestListNotes_Options(t *testing.T) {
+	db := openSearchFixture(t)
+
+	tests := []struct {
+		name      string
+		opts      ListOptions
+		wantCount int
+		wantFirst string // Front of the first note
+		wantField bool   // Back is present
+	}{
+		{"all", ListOptions{}, 2, "chan", true},
+		{"limit", ListOptions{Limit: 1}, 1, "chan", true},
+		{"offset", ListOptions{Offset: 1}, 1, "<b>goroutine</b> scheduling", true},
+		{"past end", ListOptions{Limit: 5, Offset: 5}, 0, "", true},
+		{"descending", ListOptions{Sort: "-id"}, 2, "<b>goroutine</b> scheduling", true},
+		// The sort field is Back: "M:N & threads" < "typed pipe".
+		{"sort field", ListOptions{Sort: "field"}, 2, "<b>goroutine</b> scheduling", true},
+		{"projection", ListOptions{Fields: []string{"Front"}}, 2, "chan", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes, total, err := db.SearchNotes("deck:Lang::Go", "", false, tt.opts)
+			if err != nil {
+				t.Fatalf("SearchNotes() error = %v", err)
+			}
+			if total != 2 {
+				t.Errorf("total = %d, want 2", total)
+			}
+			if len(notes) != tt.wantCount {
+				t.Fatalf("got %d notes, want %d", len(notes), tt.wantCount)
+			}
+			if len(notes) == 0 {
+				return
+			}
+			if got := notes[0].Fields["Front"]; got != tt.wantFirst {
+				t.Errorf("first note Front = %q, want %q", got, tt.wantFirst)
+			}
+			if _, ok := notes[0].Fields["Back"]; ok != tt.wantField {
+				t.Errorf("Back present = %v, want %v", ok, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestPageDecks(t *testing.T) {
+	decks := []Deck{{ID: 3, Name: "b"}, {ID: 1, Name: "C"}, {ID: 2, Name: "a"}}
+	got, err := PageDecks(slices.Clone(decks), ListOptions{Limit: 2})
+	if err != nil || len(got) != 2 || got[0].Name != "a" || got[1].Name != "b" {
+		t.Errorf("by name = %+v, %v", got, err)
+	}
+	got, _ = PageDecks(slices.Clone(decks), ListOptions{Sort: "-id", Offset: 1})
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 1 {
+		t.Errorf("by -id = %+v", got)
+	}
+}
+
+func TestDeckTree(t *testing.T) {
+	decks := []Deck{{ID: 1, Name: "Default"}, {ID: 5, Name: "Lang::Go"}, {ID: 6, Name: "Lang::Go::Advanced"}, {ID: 7, Name: "Lang::Rust"}}
+	tree := DeckTree(decks)
+	if len(tree) != 2 || tree[0].Name != "Default" || len(tree[0].Children) != 0 {
+		t.Fatalf("roots = %+v", tree)
+	}
+	lang := tree[1]
+	if lang.ID != 0 || lang.Name != "Lang" || lang.Label != "Lang" || len(lang.Children) != 2 {
+		t.Fatalf("Lang = %+v", lang)
+	}
+	golang := lang.Children[0]
+	if golang.ID != 5 || golang.Label != "Go" || len(golang.Children) != 1 ||
+		golang.Children[0].Name != "Lang::Go::Advanced" || golang.Children[0].Label != "Advanced" || lang.Children[1].Label != "Rust" {
+		t.Errorf("Lang children = %+v, %+v", golang, lang.Children[1])
+	}
+}
+
+func TestListOptions_Handler(t *testing.T) {
+	h := &Handler{db: openSearchFixture(t)}
+	tests := []struct {
+		url        string
+		wantStatus int
+		wantTotal  string
+	}{
+		{"/api/decks?limit=1", http.StatusOK, "3"},
+		{"/api/notes?deck=Lang::Go&limit=1&sort=-mod", http.StatusOK, "1"},
+		{"/api/notes/search?q=tag:go&fields=Front", http.StatusOK, "2"},
+		{"/api/decks?sort=size", http.StatusBadRequest, ""},
+		{"/api/notes?deck=Lang::Go&limit=-1", http.StatusBadRequest, ""},
+		{"/api/notes/search?q=go&limit=5000", http.StatusBadRequest, ""},
+		{"/api/notes/search?q=go&limit=0", http.StatusBadRequest, ""},
+		{"/api/decks?limit=all", http.StatusOK, "3"},
+		{"/api/decks?tree=1&sort=-name", http.StatusOK, "3"},
+		{"/api/decks?tree=1&limit=1", http.StatusBadRequest, ""},
+		{"/api/decks?tree=maybe", http.StatusBadRequest, ""},
+		{"/api/notes?deck=Lang&recursive=true", http.StatusOK, "2"},
+		{"/api/notes/search?q=tag:go&deck=Lang::Go&recursive=1", http.StatusOK, "2"},
+		{"/api/notes?deck=Lang", http.StatusNotFound, ""},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/decks", h.ListDecks)
+	mux.HandleFunc("GET /api/notes", h.ListNotes)
+	mux.HandleFunc("GET /api/notes/search", h.SearchNotes)
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("X-Total-Count"); got != tt.wantTotal {
+				t.Errorf("X-Total-Count = %q, want %q", got, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestListOptions_DefaultLimit(t *testing.T) {
+	for url, want := range map[string]int{
+		"/api/decks":           defaultPageSize,
+		"/api/decks?limit=5":   5,
+		"/api/decks?limit=all": 0,
+	} {
+		opts, ok := listOptions(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil), deckSorts)
+		if !ok || opts.Limit != want {
+			t.Errorf("%s: Limit = %d, %v; want %d", url, opts.Limit, ok, want)
+		}
+	}
+}
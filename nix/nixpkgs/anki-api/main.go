@@ -1,50 +1,186 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 func main() {
 	dbPath := flag.String("db", "", "path to Anki collection.anki2 database")
 	port := flag.Int("port", 27702, "HTTP listen port")
-	apiKeyFile := flag.String("api-key-file", "", "path to file containing API key")
+	apiKeyFile := flag.String("api-key-file", "", "path to file containing an API key, or JSON with named, scoped keys")
+	accessLogPath := flag.String("access-log", "", "append a JSON access log of every request to this file (default: stderr)")
+	writable := flag.Bool("writable", false, "allow note create/update/delete (close Anki desktop first)")
+	indexPath := flag.String("index", "", "path to full-text search index (default: in the user cache directory)")
+	noIndex := flag.Bool("no-index", false, "search without a full-text index")
+	noWatch := flag.Bool("no-watch", false, "do not reopen the collection when it changes on disk")
+	mediaDir := flag.String("media", "", "path to the collection's media folder (default: collection.media beside -db)")
+	embedURL := flag.String("embed-url", "", "OpenAI-compatible API base URL for embedding-based duplicate detection, e.g. https://api.openai.com/v1")
+	embedModel := flag.String("embed-model", "text-embedding-3-small", "embedding model name")
+	embedKeyFile := flag.String("embed-key-file", "", "path to file containing the embeddings API key")
+	mcp := flag.Bool("mcp", false, "serve read-only MCP tools on stdin/stdout instead of HTTP")
 	flag.Parse()
 
 	if *dbPath == "" {
 		log.Fatal("-db flag is required")
 	}
-	if *apiKeyFile == "" {
+	if *apiKeyFile == "" && !*mcp {
 		log.Fatal("-api-key-file flag is required")
 	}
 
-	keyBytes, err := os.ReadFile(*apiKeyFile)
+	db, err := OpenAnkiDB(*dbPath, *writable)
 	if err != nil {
-		log.Fatalf("reading API key file: %v", err)
+		log.Fatalf("opening database: %v", err)
+	}
+
+	if !*noIndex {
+		path := *indexPath
+		if path == "" {
+			path, err = defaultIndexPath(*dbPath)
+		}
+		if err == nil {
+			err = db.EnableIndex(path)
+		}
+		if err != nil {
+			log.Printf("full-text index disabled: %v", err)
+		}
+	}
+
+	if *mediaDir == "" {
+		*mediaDir = MediaDir(*dbPath)
+	}
+
+	h := &Handler{db: db, mediaDir: *mediaDir, lastReload: time.Now()}
+	if *embedURL != "" {
+		h.embedder = &Embedder{URL: *embedURL, Model: *embedModel}
+		if *embedKeyFile != "" {
+			key, err := os.ReadFile(*embedKeyFile)
+			if err != nil {
+				log.Fatalf("reading embeddings API key: %v", err)
+			}
+			h.embedder.Key = strings.TrimSpace(string(key))
+		}
+	}
+	defer func() { _ = h.db.Close() }()
+	if h.embedder != nil {
+		go h.embedNotes(context.Background())
+	}
+
+	if !*noWatch {
+		err := watchFile(context.Background(), *dbPath, func() {
+			if !h.ChangedOnDisk() {
+				return
+			}
+			if err := h.Reload(); err != nil {
+				log.Printf("reloading collection: %v", err)
+				return
+			}
+			log.Printf("collection changed on disk, reloaded")
+			if h.embedder != nil {
+				go h.embedNotes(context.Background())
+			}
+		})
+		if err != nil {
+			log.Printf("watching collection disabled: %v", err)
+		}
 	}
-	apiKey := strings.TrimSpace(string(keyBytes))
 
-	db, err := OpenAnkiDB(*dbPath)
+	if *mcp {
+		if err := serveMCP(context.Background(), os.Stdin, os.Stdout, h); err != nil {
+			log.Printf("serving MCP: %v", err)
+		}
+		return
+	}
+
+	h.keys, err = loadKeyring(*apiKeyFile)
 	if err != nil {
-		log.Fatalf("opening database: %v", err)
+		log.Fatalf("loading API keys: %v", err)
+	}
+	err = watchFile(context.Background(), *apiKeyFile, func() {
+		if err := h.keys.reload(); err != nil {
+			log.Printf("reloading API keys, keeping previous keys: %v", err)
+			return
+		}
+		log.Printf("API keys reloaded")
+	})
+	if err != nil {
+		log.Printf("watching API key file disabled: %v", err)
+	}
+
+	accessOut := os.Stderr
+	if *accessLogPath != "" {
+		accessOut, err = os.OpenFile(*accessLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Fatalf("opening access log: %v", err)
+		}
+		defer func() { _ = accessOut.Close() }()
 	}
-	defer func() { _ = db.Close() }()
+	accessLogger := slog.New(slog.NewJSONHandler(accessOut, nil))
 
-	h := &Handler{db: db, apiKey: apiKey}
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /api/health", h.Health)
-	mux.HandleFunc("GET /api/decks", h.ListDecks)
-	mux.HandleFunc("GET /api/notes/search", h.SearchNotes)
-	mux.HandleFunc("GET /api/notes/{id}", h.GetNote)
-	mux.HandleFunc("GET /api/notes", h.ListNotes)
-	mux.HandleFunc("GET /api/models", h.ListModels)
-	mux.HandleFunc("GET /api/stats", h.Stats)
+	for pattern, handler := range h.routes() {
+		mux.HandleFunc(pattern, handler)
+	}
 
 	addr := fmt.Sprintf("127.0.0.1:%d", *port)
 	log.Printf("listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, h.authMiddleware(mux)))
+	log.Fatal(http.ListenAndServe(addr, accessLog(accessLogger, h.authMiddleware(h.holdDB(mux)))))
+}
+
+// routes maps each endpoint's ServeMux pattern to its handler. openapi.json
+// describes the same set, which main_test.go checks.
+func (h *Handler) routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"GET /api/health":                  h.Health,
+		"GET /api/openapi.json":            h.OpenAPI,
+		"GET /api/decks":                   h.ListDecks,
+		"GET /api/decks/due":               h.DueCounts,
+		"GET /api/decks/{name}/duplicates": h.DeckDuplicates,
+		"GET /api/decks/{name}/export":     h.ExportDeck,
+		"POST /api/decks/{name}/import":    h.ImportDeck,
+		"GET /api/notes/duplicates":        h.FindDuplicates,
+		"GET /api/notes/search":            h.SearchNotes,
+		"GET /api/notes/{id}":              h.GetNote,
+		"GET /api/notes/{id}/duplicates":   h.NoteDuplicates,
+		"GET /api/notes/{id}/cards":        h.NoteCards,
+		"GET /api/notes/{id}/media":        h.NoteMedia,
+		"GET /api/notes":                   h.ListNotes,
+		"POST /api/notes":                  h.CreateNote,
+		"PUT /api/notes/{id}":              h.UpdateNote,
+		"DELETE /api/notes/{id}":           h.DeleteNote,
+		"GET /api/models":                  h.ListModels,
+		"GET /api/cards/{id}":              h.GetCard,
+		"GET /api/media/{name}":            h.GetMedia,
+		"GET /api/stats":                   h.Stats,
+		"GET /api/stats/reviews":           h.ReviewStats,
+	}
+}
+
+// defaultIndexPath places the search index for a collection in the user
+// cache directory, keyed by the collection's absolute path.
+func defaultIndexPath(dbPath string) (string, error) {
+	abs, err := filepath.Abs(dbPath)
+	if err != nil {
+		return "", err
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cache, "anki-api")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".fts.db"), nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+				Ref  string `json:"$ref"`
+			} `json:"parameters"`
+			Responses map[string]json.RawMessage `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Parameters map[string]struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("parsing openapi.json: %v", err)
+	}
+
+	documented := map[string]bool{}
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			pattern := strings.ToUpper(method) + " " + path
+			documented[pattern] = true
+			if len(op.Responses) == 0 {
+				t.Errorf("%s: no responses", pattern)
+			}
+
+			var pathParams []string
+			for _, p := range op.Parameters {
+				if p.Ref != "" {
+					c, ok := spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+					if !ok {
+						t.Errorf("%s: unknown parameter %s", pattern, p.Ref)
+					}
+					p.Name, p.In = c.Name, c.In
+				}
+				if p.In == "path" {
+					pathParams = append(pathParams, p.Name)
+				}
+			}
+			var wildcards []string
+			for _, m := range regexp.MustCompile(`\{(\w+)\}`).FindAllStringSubmatch(path, -1) {
+				wildcards = append(wildcards, m[1])
+			}
+			if !slices.Equal(pathParams, wildcards) {
+				t.Errorf("%s: path parameters %v, want %v", pattern, pathParams, wildcards)
+			}
+		}
+	}
+
+	routes := (&Handler{}).routes()
+	for pattern := range routes {
+		if !documented[pattern] {
+			t.Errorf("route %s is missing from openapi.json", pattern)
+		}
+	}
+	for pattern := range documented {
+		if _, ok := routes[pattern]; !ok {
+			t.Errorf("openapi.json documents %s, which is not routed", pattern)
+		}
+	}
+}
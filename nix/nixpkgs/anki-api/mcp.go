@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// mcpProtocolVersion is the newest Model Context Protocol revision served;
+// clients asking for an older one listed in mcpProtocolVersions get it.
+const mcpProtocolVersion = "2025-06-18"
+
+var mcpProtocolVersions = []string{"2024-11-05", "2025-03-26", mcpProtocolVersion}
+
+// mcpSearchLimit is the page size search_notes uses when none is given, so
+// an agent's context is not flooded by a broad search.
+const mcpSearchLimit = 20
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// mcpTool is a read-only tool served over MCP. Each is a request to one of
+// the HTTP endpoints, so tools and the API share validation, paging and
+// errors.
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+
+	// request returns the API path and query for the tool's arguments.
+	request func(args json.RawMessage) (string, error) `json:"-"`
+}
+
+var mcpTools = []mcpTool{
+	{
+		Name:        "list_decks",
+		Description: "List the decks in the Anki collection. Subdecks are separated by ::.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"limit": {"type": "integer", "minimum": 1, "maximum": 1000, "default": 100},
+			"offset": {"type": "integer", "minimum": 0},
+			"sort": {"type": "string", "enum": ["id", "-id", "name", "-name"]}
+		}}`),
+		request: func(args json.RawMessage) (string, error) {
+			var in struct {
+				Limit  int    `json:"limit"`
+				Offset int    `json:"offset"`
+				Sort   string `json:"sort"`
+			}
+			if err := decodeArgs(args, &in); err != nil {
+				return "", err
+			}
+			return "/api/decks?" + pageQuery(url.Values{}, in.Limit, in.Offset, in.Sort).Encode(), nil
+		},
+	},
+	{
+		Name: "search_notes",
+		Description: "Search notes with Anki search syntax, e.g. `goroutine`, `deck:Lang::Go tag:runtime`, " +
+			"`front:chan*` or `\"exact phrase\"`. Use it to check for existing cards before creating new ones.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"query": {"type": "string", "description": "Anki search query"},
+			"deck": {"type": "string", "description": "Limit the search to notes with a card in this deck or its subdecks"},
+			"limit": {"type": "integer", "minimum": 1, "default": 20},
+			"offset": {"type": "integer", "minimum": 0},
+			"sort": {"type": "string", "enum": ["id", "-id", "mod", "-mod", "field", "-field"]}
+		}, "required": ["query"]}`),
+		request: func(args json.RawMessage) (string, error) {
+			var in struct {
+				Query  string `json:"query"`
+				Deck   string `json:"deck"`
+				Limit  int    `json:"limit"`
+				Offset int    `json:"offset"`
+				Sort   string `json:"sort"`
+			}
+			if err := decodeArgs(args, &in); err != nil {
+				return "", err
+			}
+			if in.Limit == 0 {
+				in.Limit = mcpSearchLimit
+			}
+			q := url.Values{"q": {in.Query}}
+			if in.Deck != "" {
+				q.Set("deck", in.Deck)
+				q.Set("recursive", "true")
+			}
+			return "/api/notes/search?" + pageQuery(q, in.Limit, in.Offset, in.Sort).Encode(), nil
+		},
+	},
+	{
+		Name: "find_duplicates",
+		Description: "Find existing notes that resemble a candidate card, by normalised text similarity. " +
+			"Call it before creating a note to avoid adding one that already exists in other words.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"front": {"type": "string", "description": "The candidate's question or first field"},
+			"back": {"type": "string", "description": "The candidate's answer or remaining fields"},
+			"deck": {"type": "string", "description": "Only compare with notes in this deck and its subdecks"},
+			"threshold": {"type": "number", "minimum": 0.5, "maximum": 1, "default": 0.7},
+			"limit": {"type": "integer", "minimum": 1, "default": 20}
+		}, "required": ["front"]}`),
+		request: func(args json.RawMessage) (string, error) {
+			var in struct {
+				Front     string  `json:"front"`
+				Back      string  `json:"back"`
+				Deck      string  `json:"deck"`
+				Threshold float64 `json:"threshold"`
+				Limit     int     `json:"limit"`
+			}
+			if err := decodeArgs(args, &in); err != nil {
+				return "", err
+			}
+			q := url.Values{"front": {in.Front}}
+			for name, v := range map[string]string{"back": in.Back, "deck": in.Deck} {
+				if v != "" {
+					q.Set(name, v)
+				}
+			}
+			if in.Threshold != 0 {
+				q.Set("threshold", strconv.FormatFloat(in.Threshold, 'g', -1, 64))
+			}
+			if in.Limit != 0 {
+				q.Set("limit", strconv.Itoa(in.Limit))
+			}
+			return "/api/notes/duplicates?" + q.Encode(), nil
+		},
+	},
+	{
+		Name:        "get_note",
+		Description: "Get a note's model, fields and tags by id.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {
+			"id": {"type": "integer"}
+		}, "required": ["id"]}`),
+		request: func(args json.RawMessage) (string, error) {
+			var in struct {
+				ID *int64 `json:"id"`
+			}
+			if err := decodeArgs(args, &in); err != nil {
+				return "", err
+			}
+			if in.ID == nil {
+				return "", fmt.Errorf("id is required")
+			}
+			return "/api/notes/" + strconv.FormatInt(*in.ID, 10), nil
+		},
+	},
+	{
+		Name:        "stats",
+		Description: "Count the notes, cards, decks and models in the collection.",
+		InputSchema: json.RawMessage(`{"type": "object", "properties": {}}`),
+		request: func(args json.RawMessage) (string, error) {
+			return "/api/stats", decodeArgs(args, &struct{}{})
+		},
+	},
+}
+
+// decodeArgs decodes tool arguments, rejecting unknown ones so a misspelt
+// argument is not silently ignored.
+func decodeArgs(args json.RawMessage, v any) error {
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+	dec := json.NewDecoder(bytes.NewReader(args))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+// pageQuery adds the list parameters that are set to q.
+func pageQuery(q url.Values, limit, offset int, sort string) url.Values {
+	if limit != 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset != 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+	if sort != "" {
+		q.Set("sort", sort)
+	}
+	return q
+}
+
+// mcpResponse collects an API response for a tool result.
+type mcpResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *mcpResponse) Header() http.Header { return r.header }
+
+func (r *mcpResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *mcpResponse) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// serveMCP serves the Model Context Protocol over newline-delimited
+// JSON-RPC on in and out until in is closed. Tools run without an API key:
+// whoever can start the process can read the collection anyway.
+func serveMCP(ctx context.Context, in io.Reader, out io.Writer, h *Handler) error {
+	mux := http.NewServeMux()
+	for pattern, handler := range h.routes() {
+		mux.HandleFunc(pattern, handler)
+	}
+	api := h.holdDB(mux)
+
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// The stream cannot be resynchronised after malformed JSON.
+			_ = enc.Encode(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			return fmt.Errorf("reading request: %w", err)
+		}
+
+		var req rpcRequest
+		if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+			if err := enc.Encode(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{rpcInvalidRequest, "invalid request"}}); err != nil {
+				return err
+			}
+			continue
+		}
+		result, rpcErr := handleMCP(ctx, api, req)
+		if req.ID == nil {
+			continue // notifications get no response
+		}
+		resp := rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr}
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func handleMCP(ctx context.Context, api http.Handler, req rpcRequest) (any, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := mcpProtocolVersion
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]string{"name": "anki-api", "version": "0.1.0"},
+		}, nil
+	case "ping", "notifications/initialized", "notifications/cancelled":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{rpcInvalidParams, "invalid params"}
+		}
+		i := slices.IndexFunc(mcpTools, func(t mcpTool) bool { return t.Name == params.Name })
+		if i < 0 {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("unknown tool %q", params.Name)}
+		}
+		return callTool(ctx, api, mcpTools[i], params.Arguments), nil
+	default:
+		return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %q not found", req.Method)}
+	}
+}
+
+// callTool makes the tool's API request. Failures, including API errors,
+// are tool results with isError set, which the model sees and can act on.
+func callTool(ctx context.Context, api http.Handler, tool mcpTool, args json.RawMessage) map[string]any {
+	result := func(text string, isError bool) map[string]any {
+		return map[string]any{
+			"content": []map[string]string{{"type": "text", "text": text}},
+			"isError": isError,
+		}
+	}
+	path, err := tool.request(args)
+	if err != nil {
+		return result(err.Error(), true)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return result(err.Error(), true)
+	}
+	resp := &mcpResponse{header: http.Header{}}
+	api.ServeHTTP(resp, req)
+
+	if resp.status >= http.StatusBadRequest {
+		var body map[string]apiError
+		if err := json.Unmarshal(resp.body.Bytes(), &body); err == nil {
+			return result(body["error"].Message, true)
+		}
+		return result(http.StatusText(resp.status), true)
+	}
+	// Paged results say how many there are in all, so the model knows
+	// whether to ask for more.
+	if total := resp.header.Get("X-Total-Count"); total != "" {
+		text, _ := json.Marshal(map[string]json.RawMessage{
+			"total": json.RawMessage(total),
+			"items": bytes.TrimSpace(resp.body.Bytes()),
+		})
+		return result(string(text), false)
+	}
+	return result(string(bytes.TrimSpace(resp.body.Bytes())), false)
+}
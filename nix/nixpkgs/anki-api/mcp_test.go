@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestServeMCP(t *testing.T) {
+	h := &Handler{db: openSearchFixture(t)}
+	in := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {"protocolVersion": "2025-03-26", "capabilities": {}}}`,
+		`{"jsonrpc": "2.0", "method": "notifications/initialized"}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "tools/list"}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "tools/call", "params": {"name": "search_notes", "arguments": {"query": "goroutine"}}}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "tools/call", "params": {"name": "list_decks", "arguments": {"sort": "-name", "limit": 1}}}`,
+		`{"jsonrpc": "2.0", "id": 5, "method": "tools/call", "params": {"name": "get_note", "arguments": {"id": 100}}}`,
+		`{"jsonrpc": "2.0", "id": 6, "method": "tools/call", "params": {"name": "get_note", "arguments": {"id": 1}}}`,
+		`{"jsonrpc": "2.0", "id": 7, "method": "tools/call", "params": {"name": "search_notes", "arguments": {"query": "(unclosed"}}}`,
+		`{"jsonrpc": "2.0", "id": 8, "method": "tools/call", "params": {"name": "stats", "arguments": {"verbose": true}}}`,
+		`{"jsonrpc": "2.0", "id": 9, "method": "tools/call", "params": {"name": "delete_note", "arguments": {}}}`,
+		`{"jsonrpc": "2.0", "id": 10, "method": "resources/list"}`,
+		`{"jsonrpc": "2.0", "id": 11, "method": "tools/call", "params": {"name": "stats"}}`,
+		`{"jsonrpc": "2.0", "id": 12, "method": "tools/call", "params": {"name": "search_notes", "arguments": {"query": "tag:go", "deck": "Lang::Go"}}}`,
+	}, "\n")
+	var out strings.Builder
+	if err := serveMCP(context.Background(), strings.NewReader(in), &out, h); err != nil {
+		t.Fatalf("serveMCP() error = %v", err)
+	}
+
+	type toolResult struct {
+		Content []struct{ Text string } `json:"content"`
+		IsError bool                    `json:"isError"`
+	}
+	responses := map[int]struct {
+		Result json.RawMessage
+		Error  *rpcError
+	}{}
+	scanner := bufio.NewScanner(strings.NewReader(out.String()))
+	for scanner.Scan() {
+		var resp struct {
+			ID     int
+			Result json.RawMessage
+			Error  *rpcError
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding %s: %v", scanner.Text(), err)
+		}
+		responses[resp.ID] = struct {
+			Result json.RawMessage
+			Error  *rpcError
+		}{resp.Result, resp.Error}
+	}
+	if len(responses) != 12 {
+		t.Fatalf("got %d responses, want 12 (none for the notification):\n%s", len(responses), out.String())
+	}
+
+	var initialized struct {
+		ProtocolVersion string         `json:"protocolVersion"`
+		Capabilities    map[string]any `json:"capabilities"`
+	}
+	_ = json.Unmarshal(responses[1].Result, &initialized)
+	if initialized.ProtocolVersion != "2025-03-26" || initialized.Capabilities["tools"] == nil {
+		t.Errorf("initialize = %s", responses[1].Result)
+	}
+
+	var listed struct{ Tools []mcpTool }
+	_ = json.Unmarshal(responses[2].Result, &listed)
+	var names []string
+	for _, tool := range listed.Tools {
+		names = append(names, tool.Name)
+		if !json.Valid(tool.InputSchema) {
+			t.Errorf("%s: invalid input schema", tool.Name)
+		}
+	}
+	if strings.Join(names, ",") != "list_decks,search_notes,find_duplicates,get_note,stats" {
+		t.Errorf("tools = %v", names)
+	}
+
+	call := func(id int) toolResult {
+		t.Helper()
+		if responses[id].Error != nil {
+			t.Fatalf("call %d: error %+v", id, responses[id].Error)
+		}
+		var r toolResult
+		if err := json.Unmarshal(responses[id].Result, &r); err != nil || len(r.Content) != 1 {
+			t.Fatalf("call %d: result %s", id, responses[id].Result)
+		}
+		return r
+	}
+
+	var search struct {
+		Total int
+		Items []Note
+	}
+	if r := call(3); r.IsError || json.Unmarshal([]byte(r.Content[0].Text), &search) != nil ||
+		search.Total != 1 || len(search.Items) != 1 || !strings.Contains(search.Items[0].Fields["Front"], "goroutine") {
+		t.Errorf("search_notes = %+v", r)
+	}
+	// The deck argument covers subdecks: the goroutine note is in
+	// Lang::Go::Advanced.
+	if r := call(12); r.IsError || json.Unmarshal([]byte(r.Content[0].Text), &search) != nil || search.Total != 2 {
+		t.Errorf("search_notes in deck = %+v", r)
+	}
+	var decks struct {
+		Total int
+		Items []Deck
+	}
+	if r := call(4); r.IsError || json.Unmarshal([]byte(r.Content[0].Text), &decks) != nil ||
+		decks.Total != 3 || len(decks.Items) != 1 || decks.Items[0].Name != "Lang::Go::Advanced" {
+		t.Errorf("list_decks = %+v", r)
+	}
+	var note Note
+	if r := call(5); r.IsError || json.Unmarshal([]byte(r.Content[0].Text), &note) != nil || note.Fields["Front"] != "chan" {
+		t.Errorf("get_note = %+v", r)
+	}
+	for id, want := range map[int]string{6: "note 1 not found", 7: "invalid search", 8: "unknown field"} {
+		if r := call(id); !r.IsError || !strings.Contains(r.Content[0].Text, want) {
+			t.Errorf("call %d = %+v, want error containing %q", id, r, want)
+		}
+	}
+	if r := call(11); r.IsError || !strings.Contains(r.Content[0].Text, `"notes":3`) {
+		t.Errorf("stats = %+v", r)
+	}
+
+	if e := responses[9].Error; e == nil || e.Code != rpcInvalidParams {
+		t.Errorf("unknown tool: error = %+v", e)
+	}
+	if e := responses[10].Error; e == nil || e.Code != rpcMethodNotFound {
+		t.Errorf("unknown method: error = %+v", e)
+	}
+}
+
+func TestServeMCPMalformed(t *testing.T) {
+	var out strings.Builder
+	in := `{"jsonrpc": "2.0", "id": 1, "method": "ping"}` + "\n" + `[1, 2]` + "\n" + `{not json`
+	if err := serveMCP(context.Background(), strings.NewReader(in), &out, &Handler{}); err == nil {
+		t.Error("serveMCP() on malformed JSON: want error")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"result":{}`) ||
+		!strings.Contains(lines[1], "-32600") || !strings.Contains(lines[2], "-32700") {
+		t.Errorf("responses = %q", lines)
+	}
+}
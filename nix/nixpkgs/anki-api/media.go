@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidMediaName is returned for media names that are not a plain file
+// name inside the media folder.
+var ErrInvalidMediaName = errors.New("invalid media file name")
+
+// MediaFile is a media file referenced by a note.
+type MediaFile struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Missing     bool   `json:"missing,omitempty"`
+}
+
+var (
+	// mediaSrcRe matches the src attribute of elements that embed media,
+	// capturing everything up to the value so it can be rewritten in place.
+	mediaSrcRe = regexp.MustCompile(`(?i)(<(?:img|audio|video|source)\b[^>]*?\ssrc=)(?:"([^"]*)"|'([^']*)'|([^"'>\s]+))`)
+	soundRe    = regexp.MustCompile(`\[sound:([^\]]+)\]`)
+)
+
+// MediaDir returns the media folder Anki keeps beside a collection:
+// collection.media for collection.anki2.
+func MediaDir(dbPath string) string {
+	return strings.TrimSuffix(dbPath, filepath.Ext(dbPath)) + ".media"
+}
+
+// mediaRefs returns the media file names a field references, embedded
+// elements before sound tags. Remote URLs and data URIs are not media files.
+func mediaRefs(field string) []string {
+	var names []string
+	add := func(name string) {
+		if name != "" && !strings.Contains(name, ":") && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, m := range mediaSrcRe.FindAllStringSubmatch(field, -1) {
+		add(mediaName(m[2] + m[3] + m[4]))
+	}
+	for _, m := range soundRe.FindAllStringSubmatch(field, -1) {
+		add(html.UnescapeString(m[1]))
+	}
+	return names
+}
+
+// mediaName decodes a src attribute value to a file name. Anki escapes HTML
+// entities in attributes and newer versions also percent-encode them.
+func mediaName(src string) string {
+	src = html.UnescapeString(src)
+	if name, err := url.PathUnescape(src); err == nil {
+		return name
+	}
+	return src
+}
+
+// rewriteMedia points the media a field references at the URLs mediaURL
+// returns for their names, so clients can load it through the API. Sound
+// tags become audio elements.
+func rewriteMedia(field string, mediaURL func(name string) string) string {
+	field = mediaSrcRe.ReplaceAllStringFunc(field, func(s string) string {
+		m := mediaSrcRe.FindStringSubmatch(s)
+		name := mediaName(m[2] + m[3] + m[4])
+		if name == "" || strings.Contains(name, ":") {
+			return s
+		}
+		return m[1] + `"` + html.EscapeString(mediaURL(name)) + `"`
+	})
+	return soundRe.ReplaceAllStringFunc(field, func(s string) string {
+		name := html.UnescapeString(soundRe.FindStringSubmatch(s)[1])
+		return `<audio controls src="` + html.EscapeString(mediaURL(name)) + `"></audio>`
+	})
+}
+
+// mediaPath resolves name inside dir, refusing anything but a plain file
+// name so requests cannot reach outside the media folder.
+func mediaPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") || filepath.Base(name) != name {
+		return "", ErrInvalidMediaName
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// statMedia returns the regular file name resolves to in dir. Symlinks are
+// refused, as they could point anywhere.
+func statMedia(dir, name string) (string, os.FileInfo, error) {
+	path, err := mediaPath(dir, name)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return path, info, nil
+}
+
+// mediaTypes covers the audio and video formats Anki records or imports,
+// which Go's built-in MIME table lacks when there is no system one.
+var mediaTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+}
+
+// mediaType returns the content type for a media file name, falling back
+// to application/octet-stream for unknown extensions.
+func mediaType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := mediaTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// NoteMedia lists the media files note id references, looked up in dir.
+func (a *AnkiDB) NoteMedia(id int64, dir string) ([]MediaFile, error) {
+	note, err := a.GetNote(id)
+	if err != nil {
+		return nil, err
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fields in note type order, so media is listed as it appears.
+	var order []string
+	for _, t := range types {
+		if t.Name == note.Model {
+			order = t.Fields
+			break
+		}
+	}
+	var names []string
+	for _, field := range order {
+		for _, name := range mediaRefs(note.Fields[field]) {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	files := []MediaFile{}
+	for _, name := range names {
+		f := MediaFile{Name: name, ContentType: mediaType(name)}
+		if _, info, err := statMedia(dir, name); err == nil {
+			f.Size = info.Size()
+		} else {
+			f.Missing = true
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// MediaReferenced reports whether a note matching query, in Anki's search
+// syntax, references the media file name.
+func (a *AnkiDB) MediaReferenced(name, query string) (bool, error) {
+	notes, _, err := a.SearchNotes(query, "", false, ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, n := range notes {
+		for _, field := range n.Fields {
+			if slices.Contains(mediaRefs(field), name) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMediaRefs(t *testing.T) {
+	field := `<img src="cat.png"> <IMG alt=x SRC='dog%201.jpg'> <img src=cat.png>` +
+		` <img src="https://example.com/x.png"> [sound:hello &amp; bye.mp3] <audio src="a.ogg"></audio>`
+	want := []string{"cat.png", "dog 1.jpg", "a.ogg", "hello & bye.mp3"}
+	if got := mediaRefs(field); !slices.Equal(got, want) {
+		t.Errorf("mediaRefs() = %q, want %q", got, want)
+	}
+}
+
+func TestRewriteMedia(t *testing.T) {
+	got := rewriteMedia(`<img class="x" src="dog%201.jpg"> <img src="data:image/png;base64,AA"> [sound:a&b.mp3]`, func(name string) string {
+		return "/api/media/" + url.PathEscape(name)
+	})
+	want := `<img class="x" src="/api/media/dog%201.jpg"> <img src="data:image/png;base64,AA"> <audio controls src="/api/media/a&amp;b.mp3"></audio>`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestMediaPath(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../collection.anki2", "sub/file.png", `..\x`, "a\x00b"} {
+		if _, err := mediaPath("/media", name); !errors.Is(err, ErrInvalidMediaName) {
+			t.Errorf("mediaPath(%q) error = %v, want ErrInvalidMediaName", name, err)
+		}
+	}
+	if got, err := mediaPath("/media", "..cat.png"); err != nil || got != "/media/..cat.png" {
+		t.Errorf("mediaPath(..cat.png) = %q, %v", got, err)
+	}
+}
+
+func TestMediaHandlers(t *testing.T) {
+	db := openSearchFixture(t)
+	dir := t.TempDir()
+	for name, body := range map[string]string{"cat.png": "\x89PNG\r\n\x1a\n", "song.mp3": "ID3"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	execCollection(t, db, `UPDATE notes SET flds = '<img src="cat.png">' || char(31) || '[sound:song.mp3] <img src="gone.gif">' WHERE id = 100`)
+
+	h := &Handler{db: db, mediaDir: dir}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/media/{name}", h.GetMedia)
+	mux.HandleFunc("GET /api/notes/{id}", h.GetNote)
+	mux.HandleFunc("GET /api/notes/{id}/media", h.NoteMedia)
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	tests := []struct {
+		url         string
+		wantStatus  int
+		contentType string
+	}{
+		{"/api/media/cat.png", http.StatusOK, "image/png"},
+		{"/api/media/song.mp3", http.StatusOK, "audio/mpeg"},
+		{"/api/media/missing.png", http.StatusNotFound, ""},
+		{"/api/media/link.txt", http.StatusNotFound, ""},
+		{"/api/media/..%2Fsecret.txt", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			rec := get(tt.url)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.contentType != "" {
+				if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+					t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+				}
+				if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+					t.Error("missing nosniff")
+				}
+			}
+		})
+	}
+
+	rec := get("/api/notes/100/media")
+	want := `[{"name":"cat.png","content_type":"image/png","size":8},{"name":"gone.gif","content_type":"image/gif","size":0,"missing":true},{"name":"song.mp3","content_type":"audio/mpeg","size":3}]` + "\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("note media = %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/api/notes/999/media"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing note status = %d", rec.Code)
+	}
+
+	rec = get("/api/notes/100?rewrite_media=1")
+	var note Note
+	if err := json.Unmarshal(rec.Body.Bytes(), &note); err != nil {
+		t.Fatalf("rewritten note: %v: %s", err, rec.Body)
+	}
+	if note.Fields["Front"] != `<img src="/api/media/cat.png">` ||
+		note.Fields["Back"] != `<audio controls src="/api/media/song.mp3"></audio> <img src="/api/media/gone.gif">` {
+		t.Errorf("rewritten fields = %q", note.Fields)
+	}
+	if rec := get("/api/notes/100?rewrite_media=maybe"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid rewrite_media status = %d", rec.Code)
+	}
+}
+
+func TestSignedMediaURL(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(t, keyPath, `{"keys": [
+		{"name": "reader", "key": "reader-key"},
+		{"name": "go", "key": "go-key", "decks": ["Lang::Go"]},
+		{"name": "rust", "key": "rust-key", "decks": ["Default"]}
+	]}`)
+	keys, err := loadKeyring(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openSearchFixture(t)
+	dir := t.TempDir()
+	for _, name := range []string{"cat 1.png", "dog.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("\x89PNG\r\n\x1a\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	execCollection(t, db, `UPDATE notes SET flds = '<img src="cat%201.png">' || char(31) || '' WHERE id = 100`)
+
+	h := &Handler{db: db, keys: keys, mediaDir: dir}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/media/{name}", h.GetMedia)
+	mux.HandleFunc("GET /api/notes/{id}", h.GetNote)
+	server := h.authMiddleware(mux)
+	get := func(url, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var note Note
+	_ = json.Unmarshal(get("/api/notes/100?rewrite_media=1", "reader-key").Body.Bytes(), &note)
+	m := mediaSrcRe.FindStringSubmatch(note.Fields["Front"])
+	if m == nil {
+		t.Fatalf("rewritten front = %q", note.Fields["Front"])
+	}
+	src := html.UnescapeString(m[2])
+	if rec := get(src, ""); rec.Code != http.StatusOK {
+		t.Fatalf("signed URL %s: status %d: %s", src, rec.Code, rec.Body)
+	}
+
+	u, _ := url.Parse(src)
+	q := u.Query()
+	for name, tamper := range map[string]func(url.Values){
+		"other file": func(url.Values) { u.Path = "/api/media/dog.png" },
+		"other key":  func(q url.Values) { q.Set("key_name", "admin") },
+		"extended":   func(q url.Values) { q.Set("expires", "99999999999") },
+	} {
+		u, _ = url.Parse(src)
+		q = u.Query()
+		tamper(q)
+		u.RawQuery = q.Encode()
+		if rec := get(u.String(), ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", name, rec.Code)
+		}
+	}
+
+	// Restricted keys only get media their decks' notes reference.
+	for _, tt := range []struct {
+		url, key string
+		want     int
+	}{
+		{"/api/media/cat%201.png", "go-key", http.StatusOK},
+		{"/api/media/cat%201.png", "rust-key", http.StatusForbidden},
+		{"/api/media/dog.png", "go-key", http.StatusForbidden},
+		{"/api/media/dog.png", "reader-key", http.StatusOK},
+	} {
+		if rec := get(tt.url, tt.key); rec.Code != tt.want {
+			t.Errorf("%s with %s: status = %d, want %d", tt.url, tt.key, rec.Code, tt.want)
+		}
+	}
+
+	expired := "/api/media/x.png?" + keys.signMedia(keys.keys[0], "x.png", time.Now().Add(-time.Minute)).Encode()
+	if rec := get(expired, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired URL status = %d", rec.Code)
+	}
+}
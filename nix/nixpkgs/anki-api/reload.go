@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadSettle is how long a watched file must go without changes before
+// it is reloaded, so a sync or checkpoint is picked up once, when done.
+const reloadSettle = 500 * time.Millisecond
+
+// Reload reopens the collection and swaps it in. New requests use the new
+// handle at once; the old one is closed when the requests using it have
+// finished. On error the current handle stays in service.
+func (h *Handler) Reload() error {
+	h.mu.RLock()
+	current := h.db
+	h.mu.RUnlock()
+
+	next, err := current.Reopen()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	old, users := h.db, h.users
+	h.db, h.users = next, &sync.WaitGroup{}
+	h.lastReload = time.Now()
+	h.mu.Unlock()
+
+	if users != nil {
+		users.Wait()
+	}
+	old.index = nil
+	return old.Close()
+}
+
+// ChangedOnDisk reports whether the collection's files differ from how the
+// current handle's last commit left them, so that the watcher can skip the
+// reload the server's own writes set off.
+func (h *Handler) ChangedOnDisk() bool {
+	h.mu.RLock()
+	db := h.db
+	h.mu.RUnlock()
+	committed := db.committed.Load()
+	return committed == nil || !committed.equal(statCollection(db.path))
+}
+
+type dbContext struct{}
+
+// holdDB gives each request the collection handle current when it starts,
+// which a reload leaves open until the request has finished. No lock is
+// held while the request runs, so a slow response never delays a reload
+// or the requests after it.
+func (h *Handler) holdDB(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		if h.users == nil {
+			h.users = &sync.WaitGroup{}
+		}
+		db, users := h.db, h.users
+		users.Add(1)
+		h.mu.Unlock()
+		defer users.Done()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), dbContext{}, db)))
+	})
+}
+
+// embedNotes embeds every note in the current collection, so duplicate
+// checks with embeddings only need to embed their candidate. The handle is
+// held only while the notes are read, not for the requests to the API.
+func (h *Handler) embedNotes(ctx context.Context) {
+	h.mu.Lock()
+	if h.users == nil {
+		h.users = &sync.WaitGroup{}
+	}
+	db, users := h.db, h.users
+	users.Add(1)
+	h.mu.Unlock()
+	texts, err := db.noteTexts()
+	users.Done()
+	if err == nil {
+		_, err = h.embedder.Embed(ctx, texts)
+	}
+	if err != nil {
+		log.Printf("embedding notes: %v", err)
+	}
+}
+
+// dbFor returns the collection handle holdDB gave r, or the current one for
+// requests served without it.
+func (h *Handler) dbFor(r *http.Request) *AnkiDB {
+	if db, ok := r.Context().Value(dbContext{}).(*AnkiDB); ok {
+		return db
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.db
+}
+
+// diskState is a collection file and its write-ahead log as last seen on
+// disk; a missing file is nil.
+type diskState [2]os.FileInfo
+
+func statCollection(path string) *diskState {
+	var s diskState
+	for i, p := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(p); err == nil {
+			s[i] = info
+		}
+	}
+	return &s
+}
+
+func (s *diskState) equal(o *diskState) bool {
+	for i := range s {
+		a, b := s[i], o[i]
+		if a == nil || b == nil {
+			if a != b {
+				return false
+			}
+			continue
+		}
+		if !os.SameFile(a, b) || a.Size() != b.Size() || !a.ModTime().Equal(b.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchFile calls onChange after the file at path, or its SQLite
+// write-ahead log, is modified or replaced and then left alone for
+// reloadSettle. It stops when ctx is done.
+func watchFile(ctx context.Context, path string, onChange func()) error {
+	events, err := fileEvents(ctx, path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		var settled <-chan time.Time
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+				settled = time.After(reloadSettle)
+			case <-settled:
+				settled = nil
+				onChange()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHandlerReload(t *testing.T) {
+	path := newCollection(t, false)
+	db, err := OpenAnkiDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now().Add(-time.Hour)
+	h := &Handler{db: db, lastReload: started}
+	t.Cleanup(func() { _ = h.db.Close() })
+
+	// Anki rewrites the collection in the newer schema, replacing the file.
+	if err := os.Rename(newCollection(t, true), path); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if h.db == db {
+		t.Fatal("handle not swapped")
+	}
+	stats, err := h.db.GetStats()
+	if err != nil {
+		t.Fatalf("GetStats() error = %v", err)
+	}
+	if stats.SchemaVersion != 18 {
+		t.Errorf("schema version = %d, want 18", stats.SchemaVersion)
+	}
+
+	rec := httptest.NewRecorder()
+	h.holdDB(http.HandlerFunc(h.Health)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	var health map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	last, err := time.Parse(time.RFC3339, health["last_reload"])
+	if err != nil || !last.After(started) {
+		t.Errorf("last_reload = %q", health["last_reload"])
+	}
+
+	// A collection that cannot be opened leaves the current handle alone.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	current := h.db
+	if err := h.Reload(); err == nil {
+		t.Error("Reload() of missing collection: want error")
+	}
+	if h.db != current {
+		t.Error("handle swapped after failed reload")
+	}
+}
+
+func TestWatchCollection(t *testing.T) {
+	path := newCollection(t, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{}, 10)
+	if err := watchFile(ctx, path, func() { changes <- struct{}{} }); err != nil {
+		t.Fatalf("watchFile() error = %v", err)
+	}
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported after %s", what)
+		}
+	}
+
+	execCollectionPath(t, path, "UPDATE notes SET mod = 1")
+	wait("write")
+
+	if err := os.Rename(newCollection(t, true), path); err != nil {
+		t.Fatal(err)
+	}
+	wait("replace")
+
+	// Several writes in quick succession are reported once.
+	for i := range 5 {
+		execCollectionPath(t, path, "UPDATE notes SET mod = "+strconv.Itoa(i+2))
+	}
+	wait("burst")
+	select {
+	case <-changes:
+		t.Error("burst of writes reported more than once")
+	case <-time.After(2 * reloadSettle):
+	}
+}
+
+func TestHoldDB_SlowRequest(t *testing.T) {
+	path := newCollection(t, false)
+	db, err := OpenAnkiDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{db: db}
+	t.Cleanup(func() { _ = h.db.Close() })
+
+	// A slow response keeps its handle open without holding up a reload or
+	// the requests that follow it.
+	started, finish := make(chan struct{}), make(chan struct{})
+	slow := h.holdDB(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		if _, err := h.dbFor(r).GetStats(); err != nil {
+			t.Errorf("old handle closed mid-request: %v", err)
+		}
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/media/x", nil))
+	}()
+	<-started
+
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- h.Reload() }()
+	var next *AnkiDB
+	for deadline := time.Now().Add(5 * time.Second); next == nil || next == db; {
+		if time.Now().After(deadline) {
+			t.Fatal("reload did not swap the handle while a request was in flight")
+		}
+		h.holdDB(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { next = h.dbFor(r) })).
+			ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+	}
+	select {
+	case <-reloaded:
+		t.Fatal("old handle closed before its request finished")
+	default:
+	}
+
+	close(finish)
+	<-done
+	if err := <-reloaded; err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+}
+
+func TestChangedOnDisk(t *testing.T) {
+	path := newCollection(t, false)
+	db, err := OpenAnkiDB(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{db: db}
+	t.Cleanup(func() { _ = h.db.Close() })
+
+	if !h.ChangedOnDisk() {
+		t.Error("before any write: ChangedOnDisk() = false")
+	}
+	if err := db.DeleteNote(100); err != nil {
+		t.Fatal(err)
+	}
+	if h.ChangedOnDisk() {
+		t.Error("after our own write: ChangedOnDisk() = true")
+	}
+	time.Sleep(10 * time.Millisecond)
+	execCollectionPath(t, path, "UPDATE col SET mod = 1")
+	if !h.ChangedOnDisk() {
+		t.Error("after another process's write: ChangedOnDisk() = false")
+	}
+}
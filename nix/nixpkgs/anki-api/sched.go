@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Card is a card's scheduling state. Due is the raw column, whose meaning
+// depends on the queue; DueAt interprets it as a time where that makes sense.
+type Card struct {
+	ID       int64   `json:"id"`
+	NoteID   int64   `json:"note_id"`
+	DeckID   int64   `json:"deck_id"`
+	Deck     string  `json:"deck"`
+	Ord      int     `json:"ord"`
+	Type     string  `json:"type"`
+	Queue    string  `json:"queue"`
+	Due      int64   `json:"due"`
+	DueAt    string  `json:"due_at,omitempty"`
+	Interval int     `json:"interval"`
+	Ease     float64 `json:"ease"`
+	Reps     int     `json:"reps"`
+	Lapses   int     `json:"lapses"`
+}
+
+// DeckDue counts the cards of one deck that are ready to study now. Counts
+// are not capped by the deck's daily limits and exclude subdecks.
+type DeckDue struct {
+	DeckID   int64  `json:"deck_id"`
+	Deck     string `json:"deck"`
+	New      int    `json:"new"`
+	Learning int    `json:"learning"`
+	Review   int    `json:"review"`
+}
+
+// ReviewStats summarises the review log over the last Days days.
+type ReviewStats struct {
+	Days        int         `json:"days"`
+	Reviews     int         `json:"reviews"`
+	TimeSeconds float64     `json:"time_seconds"`
+	Retention   float64     `json:"retention"`
+	PerDay      []DayReview `json:"per_day"`
+}
+
+type DayReview struct {
+	Date        string  `json:"date"`
+	Reviews     int     `json:"reviews"`
+	Correct     int     `json:"correct"`
+	TimeSeconds float64 `json:"time_seconds"`
+}
+
+var (
+	cardTypeNames = map[int]string{0: "new", 1: "learning", 2: "review", 3: "relearning"}
+	queueNames    = map[int]string{
+		-3: "manually_buried",
+		-2: "sibling_buried",
+		-1: "suspended",
+		0:  "new",
+		1:  "learning",
+		2:  "review",
+		3:  "day_learning",
+		4:  "preview",
+	}
+)
+
+// learnAhead matches Anki's default: learning cards due within this window
+// count as due now.
+const learnAhead = 20 * time.Minute
+
+const cardColumns = "id, nid, did, ord, type, queue, due, ivl, factor, reps, lapses"
+
+// NoteCards returns the cards of note id ordered by template.
+func (a *AnkiDB) NoteCards(id int64) ([]Card, error) {
+	if _, err := a.GetNote(id); err != nil {
+		return nil, err
+	}
+	return a.queryCards("SELECT "+cardColumns+" FROM cards WHERE nid = ? ORDER BY ord", id)
+}
+
+func (a *AnkiDB) GetCard(id int64) (*Card, error) {
+	cards, err := a.queryCards("SELECT "+cardColumns+" FROM cards WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("card %d %w", id, ErrNotFound)
+	}
+	return &cards[0], nil
+}
+
+func (a *AnkiDB) queryCards(query string, args ...any) ([]Card, error) {
+	crt, err := a.collectionCreated()
+	if err != nil {
+		return nil, err
+	}
+	deckNames, err := a.deckNames()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying cards: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	cards := []Card{}
+	for rows.Next() {
+		var c Card
+		var cardType, queue, factor int
+		if err := rows.Scan(&c.ID, &c.NoteID, &c.DeckID, &c.Ord, &cardType, &queue, &c.Due, &c.Interval, &factor, &c.Reps, &c.Lapses); err != nil {
+			return nil, err
+		}
+		c.Deck = deckNames[c.DeckID]
+		c.Type = cardTypeNames[cardType]
+		c.Queue = queueNames[queue]
+		c.Ease = float64(factor) / 1000
+		switch queue {
+		case 1, 4:
+			// Intraday learning: due is a unix timestamp.
+			c.DueAt = time.Unix(c.Due, 0).Format(time.RFC3339)
+		case 2, 3:
+			// Reviews and interday learning: due is a day number.
+			c.DueAt = crt.AddDate(0, 0, int(c.Due)).Format(time.DateOnly)
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
+
+// DueCounts returns per-deck counts of new cards and of learning and review
+// cards due now, for every deck with cards.
+func (a *AnkiDB) DueCounts() ([]DeckDue, error) {
+	crt, err := a.collectionCreated()
+	if err != nil {
+		return nil, err
+	}
+	deckNames, err := a.deckNames()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	rows, err := a.db.Query(`
+		SELECT did,
+			SUM(queue = 0),
+			SUM((queue IN (1, 4) AND due <= ?) OR (queue = 3 AND due <= ?)),
+			SUM(queue = 2 AND due <= ?)
+		FROM cards
+		GROUP BY did
+	`, now.Add(learnAhead).Unix(), daysSince(crt, now), daysSince(crt, now))
+	if err != nil {
+		return nil, fmt.Errorf("counting due cards: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	counts := []DeckDue{}
+	for rows.Next() {
+		var d DeckDue
+		if err := rows.Scan(&d.DeckID, &d.New, &d.Learning, &d.Review); err != nil {
+			return nil, err
+		}
+		d.Deck = deckNames[d.DeckID]
+		counts = append(counts, d)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Deck < counts[j].Deck })
+	return counts, rows.Err()
+}
+
+// ReviewStats summarises reviews logged in the last days days, optionally
+// restricted to cards currently in deckName. Retention is the fraction of
+// review (not learning) answers other than Again. Days are local dates.
+func (a *AnkiDB) ReviewStats(days int, deckName string) (*ReviewStats, error) {
+	since := time.Now().AddDate(0, 0, -days+1)
+	since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.Local)
+
+	// Type 4 entries record manual rescheduling, not answers.
+	query := `
+		SELECT strftime('%Y-%m-%d', r.id / 1000, 'unixepoch', 'localtime') AS day,
+			COUNT(*),
+			SUM(r.ease > 1),
+			SUM(r.type = 1),
+			SUM(r.type = 1 AND r.ease > 1),
+			SUM(r.time)
+		FROM revlog r
+	`
+	args := []any{since.UnixMilli()}
+	where := "WHERE r.id >= ? AND r.type != 4"
+	if deckName != "" {
+		deckID, err := a.findDeckID(deckName)
+		if err != nil {
+			return nil, err
+		}
+		query += "JOIN cards c ON c.id = r.cid "
+		where += " AND c.did = ?"
+		args = append(args, deckID)
+	}
+	rows, err := a.db.Query(query+where+" GROUP BY day ORDER BY day", args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying revlog: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	stats := &ReviewStats{Days: days, PerDay: []DayReview{}}
+	var reviewAnswers, reviewCorrect int
+	for rows.Next() {
+		var d DayReview
+		var answers, correct int
+		var ms int64
+		if err := rows.Scan(&d.Date, &d.Reviews, &d.Correct, &answers, &correct, &ms); err != nil {
+			return nil, err
+		}
+		d.TimeSeconds = float64(ms) / 1000
+		stats.Reviews += d.Reviews
+		stats.TimeSeconds += d.TimeSeconds
+		reviewAnswers += answers
+		reviewCorrect += correct
+		stats.PerDay = append(stats.PerDay, d)
+	}
+	if reviewAnswers > 0 {
+		stats.Retention = float64(reviewCorrect) / float64(reviewAnswers)
+	}
+	return stats, rows.Err()
+}
+
+// collectionCreated returns col.crt, the origin of review due day numbers.
+func (a *AnkiDB) collectionCreated() (time.Time, error) {
+	var crt int64
+	if err := a.db.QueryRow("SELECT crt FROM col").Scan(&crt); err != nil && err != sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("reading collection creation time: %w", err)
+	}
+	return time.Unix(crt, 0), nil
+}
+
+func (a *AnkiDB) deckNames() (map[int64]string, error) {
+	decks, err := a.ListDecks()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string, len(decks))
+	for _, d := range decks {
+		names[d.ID] = d.Name
+	}
+	return names, nil
+}
+
+// daysSince returns the scheduler's day number for now: whole days elapsed
+// since the collection was created.
+func daysSince(crt, now time.Time) int64 {
+	return int64(now.Sub(crt) / (24 * time.Hour))
+}
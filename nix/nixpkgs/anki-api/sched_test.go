@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+)
+
+// openScheduledFixture seeds the legacy fixture with cards in each queue and
+// a review log, relative to a collection created 100 days ago.
+func openScheduledFixture(t *testing.T) *AnkiDB {
+	t.Helper()
+	path := newCollection(t, false)
+	seed, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	crt := now.Add(-100*24*time.Hour - time.Hour).Unix()
+	nowMs := now.UnixMilli()
+	_, err = seed.Exec(`
+		UPDATE col SET crt = ?;
+		INSERT INTO cards VALUES
+			(1001, 100, 5, 1, 0, 0, 2, 2, 99, 10, 2500, 5, 1, 0, 0, 0, 0, ''),
+			(1002, 100, 5, 2, 0, 0, 2, 2, 105, 10, 2500, 5, 0, 0, 0, 0, 0, ''),
+			(1003, 100, 5, 3, 0, 0, 1, 1, ?, 0, 0, 1, 0, 0, 0, 0, 0, ''),
+			(1004, 100, 5, 4, 0, 0, 2, -1, 90, 3, 2300, 2, 0, 0, 0, 0, 0, ''),
+			(1005, 100, 1, 5, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, '');
+		INSERT INTO revlog VALUES
+			(?, 1001, 0, 3, 10, 5, 2500, 8000, 1),
+			(?, 1002, 0, 1, 1, 5, 2300, 12000, 1),
+			(?, 1003, 0, 1, -60, 0, 0, 4000, 0),
+			(?, 1004, 0, 0, 3, 3, 2300, 0, 4),
+			(?, 1001, 0, 4, 5, 2, 2500, 6000, 1);
+	`, crt, now.Add(-time.Minute).Unix(),
+		nowMs-3000, nowMs-2000, nowMs-1000, nowMs, nowMs-10*24*3600*1000)
+	_ = seed.Close()
+	if err != nil {
+		t.Fatalf("seeding fixture: %v", err)
+	}
+
+	db, err := OpenAnkiDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestNoteCards(t *testing.T) {
+	db := openScheduledFixture(t)
+	cards, err := db.NoteCards(100)
+	if err != nil {
+		t.Fatalf("NoteCards() error = %v", err)
+	}
+	if len(cards) != 6 {
+		t.Fatalf("got %d cards, want 6", len(cards))
+	}
+	review := cards[1]
+	wantDue := time.Now().Add(-time.Hour).AddDate(0, 0, -1).Format(time.DateOnly)
+	if review.Queue != "review" || review.Ease != 2.5 || review.Interval != 10 || review.DueAt != wantDue || review.Deck != "Lang::Go" {
+		t.Errorf("review card = %+v, want due %s", review, wantDue)
+	}
+	if cards[3].Type != "learning" || cards[3].DueAt == "" {
+		t.Errorf("learning card = %+v", cards[3])
+	}
+	if cards[4].Queue != "suspended" {
+		t.Errorf("suspended card = %+v", cards[4])
+	}
+
+	if _, err := db.NoteCards(999); err == nil {
+		t.Error("missing note: want error")
+	}
+}
+
+func TestDueCounts(t *testing.T) {
+	db := openScheduledFixture(t)
+	counts, err := db.DueCounts()
+	if err != nil {
+		t.Fatalf("DueCounts() error = %v", err)
+	}
+	want := []DeckDue{
+		{DeckID: 1, Deck: "Default", New: 1},
+		{DeckID: 5, Deck: "Lang::Go", New: 1, Learning: 1, Review: 1},
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("counts = %+v, want %+v", counts, want)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Errorf("counts[%d] = %+v, want %+v", i, counts[i], want[i])
+		}
+	}
+}
+
+func TestReviewStats(t *testing.T) {
+	db := openScheduledFixture(t)
+
+	stats, err := db.ReviewStats(7, "")
+	if err != nil {
+		t.Fatalf("ReviewStats() error = %v", err)
+	}
+	// Three answers in the window; the rescheduling entry and the review
+	// from ten days ago are excluded. One of two review answers passed.
+	if stats.Reviews != 3 || stats.TimeSeconds != 24 || stats.Retention != 0.5 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if len(stats.PerDay) == 0 || stats.PerDay[len(stats.PerDay)-1].Date != time.Now().Format(time.DateOnly) {
+		t.Errorf("per day = %+v", stats.PerDay)
+	}
+
+	month, _ := db.ReviewStats(30, "Lang::Go")
+	if month.Reviews != 4 || math.Abs(month.Retention-2.0/3) > 1e-9 {
+		t.Errorf("30 day stats = %+v", month)
+	}
+	if _, err := db.ReviewStats(7, "Nope"); err == nil {
+		t.Error("unknown deck: want error")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is go-sqlite3 with the "unicase" collation Anki declares on
+// name columns of the modern schema, without which any query that compares
+// or sorts those columns fails, and the functions search SQL relies on.
+const driverName = "sqlite3_anki"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterCollation("unicase", func(a, b string) int {
+				return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+			})
+			if err != nil {
+				return err
+			}
+			for name, fn := range searchFuncs {
+				if err := conn.RegisterFunc(name, fn, true); err != nil {
+					return fmt.Errorf("registering %s: %w", name, err)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// modernSchemaVersion is the first col.ver that keeps decks, note types,
+// fields and templates in their own tables instead of JSON in col.
+const modernSchemaVersion = 15
+
+// collectionSchema reads the parts of a collection whose layout differs
+// between schema versions. Notes, cards and revlog are shared.
+type collectionSchema interface {
+	decks(db *sql.DB) ([]Deck, error)
+	noteTypes(db *sql.DB) ([]noteType, error)
+	// registerTags adds tags not yet in the collection's tag list, which
+	// Anki's browser and tag completion read instead of scanning notes.
+	registerTags(tx *sql.Tx, tags []string) error
+}
+
+func detectSchema(db *sql.DB) (int, collectionSchema, error) {
+	var ver int
+	if err := db.QueryRow("SELECT ver FROM col").Scan(&ver); err != nil {
+		return 0, nil, fmt.Errorf("reading schema version: %w", err)
+	}
+	if ver >= modernSchemaVersion {
+		return ver, modernSchema{}, nil
+	}
+	return ver, legacySchema{}, nil
+}
+
+// legacySchema reads schema 11 collections, where decks and models are
+// JSON objects keyed by id in the col row.
+type legacySchema struct{}
+
+func (legacySchema) decks(db *sql.DB) ([]Deck, error) {
+	row := db.QueryRow("SELECT decks FROM col")
+	var decksJSON string
+	if err := row.Scan(&decksJSON); err != nil {
+		return nil, fmt.Errorf("reading decks: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(decksJSON), &raw); err != nil {
+		return nil, fmt.Errorf("parsing decks JSON: %w", err)
+	}
+
+	decks := make([]Deck, 0, len(raw))
+	for idStr, v := range raw {
+		var d struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(v, &d); err != nil {
+			continue
+		}
+		var id int64
+		_, _ = fmt.Sscanf(idStr, "%d", &id)
+		decks = append(decks, Deck{ID: id, Name: d.Name})
+	}
+	return decks, nil
+}
+
+func (legacySchema) noteTypes(db *sql.DB) ([]noteType, error) {
+	row := db.QueryRow("SELECT models FROM col")
+	var modelsJSON string
+	if err := row.Scan(&modelsJSON); err != nil {
+		return nil, fmt.Errorf("reading models: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(modelsJSON), &raw); err != nil {
+		return nil, fmt.Errorf("parsing models JSON: %w", err)
+	}
+
+	var types []noteType
+	for _, v := range raw {
+		var m struct {
+			ID    int64  `json:"id"`
+			Name  string `json:"name"`
+			Type  int    `json:"type"`
+			Sortf int    `json:"sortf"`
+			CSS   string `json:"css"`
+			Flds  []struct {
+				Name string `json:"name"`
+				Ord  int    `json:"ord"`
+			} `json:"flds"`
+			Tmpls []struct {
+				Name string `json:"name"`
+				Ord  int    `json:"ord"`
+				Qfmt string `json:"qfmt"`
+				Afmt string `json:"afmt"`
+			} `json:"tmpls"`
+		}
+		if err := json.Unmarshal(v, &m); err != nil {
+			continue
+		}
+		fields := make([]string, len(m.Flds))
+		for _, f := range m.Flds {
+			if f.Ord < len(fields) {
+				fields[f.Ord] = f.Name
+			}
+		}
+		templates := make([]cardTemplate, len(m.Tmpls))
+		for i, t := range m.Tmpls {
+			templates[i] = cardTemplate{Name: t.Name, Ord: t.Ord, QFmt: t.Qfmt, AFmt: t.Afmt}
+		}
+		types = append(types, noteType{
+			ID:        m.ID,
+			Name:      m.Name,
+			Fields:    fields,
+			Cloze:     m.Type == 1,
+			SortField: m.Sortf,
+			Templates: templates,
+			CSS:       m.CSS,
+		})
+	}
+	return types, nil
+}
+
+// registerTags adds the tags to the JSON object of tag to usn in col.tags.
+func (legacySchema) registerTags(tx *sql.Tx, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var tagsJSON string
+	if err := tx.QueryRow("SELECT tags FROM col").Scan(&tagsJSON); err != nil {
+		return fmt.Errorf("reading tags: %w", err)
+	}
+	registered := map[string]int{}
+	if tagsJSON != "" {
+		if err := json.Unmarshal([]byte(tagsJSON), &registered); err != nil {
+			return fmt.Errorf("parsing tags JSON: %w", err)
+		}
+	}
+	added := false
+	for _, tag := range tags {
+		if _, ok := registered[tag]; !ok {
+			registered[tag] = -1
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	b, err := json.Marshal(registered)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE col SET tags = ?", string(b)); err != nil {
+		return fmt.Errorf("updating tags: %w", err)
+	}
+	return nil
+}
+
+// modernSchema reads collections from schema 15 on, which store decks,
+// notetypes, fields and templates in tables with protobuf config blobs.
+type modernSchema struct{}
+
+func (modernSchema) decks(db *sql.DB) ([]Deck, error) {
+	rows, err := db.Query("SELECT id, name FROM decks")
+	if err != nil {
+		return nil, fmt.Errorf("reading decks: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	decks := []Deck{}
+	for rows.Next() {
+		var d Deck
+		if err := rows.Scan(&d.ID, &d.Name); err != nil {
+			return nil, err
+		}
+		// Nested deck names are stored with \x1f rather than "::".
+		d.Name = strings.ReplaceAll(d.Name, "\x1f", "::")
+		decks = append(decks, d)
+	}
+	return decks, rows.Err()
+}
+
+func (modernSchema) noteTypes(db *sql.DB) ([]noteType, error) {
+	rows, err := db.Query("SELECT id, name, config FROM notetypes")
+	if err != nil {
+		return nil, fmt.Errorf("reading notetypes: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	byID := map[int64]*noteType{}
+	var ids []int64
+	for rows.Next() {
+		var nt noteType
+		var config []byte
+		if err := rows.Scan(&nt.ID, &nt.Name, &config); err != nil {
+			return nil, err
+		}
+		// Notetype config: kind = 1 (0 normal, 1 cloze), sort_field_idx = 2,
+		// css = 3.
+		msg, err := parseProto(config)
+		if err != nil {
+			return nil, fmt.Errorf("parsing notetype %d config: %w", nt.ID, err)
+		}
+		nt.Cloze = msg.varint(1) == 1
+		nt.SortField = int(msg.varint(2))
+		nt.CSS = msg.str(3)
+		byID[nt.ID] = &nt
+		ids = append(ids, nt.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The pool has a single connection, so each result set must be closed
+	// before the next query.
+	_ = rows.Close()
+
+	fieldRows, err := db.Query("SELECT ntid, ord, name FROM fields ORDER BY ntid, ord")
+	if err != nil {
+		return nil, fmt.Errorf("reading fields: %w", err)
+	}
+	defer func() { _ = fieldRows.Close() }()
+	for fieldRows.Next() {
+		var ntid int64
+		var ord int
+		var name string
+		if err := fieldRows.Scan(&ntid, &ord, &name); err != nil {
+			return nil, err
+		}
+		if nt, ok := byID[ntid]; ok {
+			for len(nt.Fields) <= ord {
+				nt.Fields = append(nt.Fields, "")
+			}
+			nt.Fields[ord] = name
+		}
+	}
+	if err := fieldRows.Err(); err != nil {
+		return nil, err
+	}
+	_ = fieldRows.Close()
+
+	templateRows, err := db.Query("SELECT ntid, ord, name, config FROM templates ORDER BY ntid, ord")
+	if err != nil {
+		return nil, fmt.Errorf("reading templates: %w", err)
+	}
+	defer func() { _ = templateRows.Close() }()
+	for templateRows.Next() {
+		var ntid int64
+		var t cardTemplate
+		var config []byte
+		if err := templateRows.Scan(&ntid, &t.Ord, &t.Name, &config); err != nil {
+			return nil, err
+		}
+		// Template config: q_format = 1, a_format = 2.
+		msg, err := parseProto(config)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %q config: %w", t.Name, err)
+		}
+		t.QFmt = msg.str(1)
+		t.AFmt = msg.str(2)
+		if nt, ok := byID[ntid]; ok {
+			nt.Templates = append(nt.Templates, t)
+		}
+	}
+	if err := templateRows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	types := make([]noteType, len(ids))
+	for i, id := range ids {
+		types[i] = *byID[id]
+	}
+	return types, nil
+}
+
+// registerTags adds the tags and their parents ("a" for "a::b") to the
+// tags table, as Anki does when a note is saved.
+func (modernSchema) registerTags(tx *sql.Tx, tags []string) error {
+	for _, tag := range tags {
+		parts := strings.Split(tag, "::")
+		for i := range parts {
+			name := strings.Join(parts[:i+1], "::")
+			if _, err := tx.Exec(`
+				INSERT OR IGNORE INTO tags (tag, usn, collapsed, config) VALUES (?, -1, 0, NULL)
+			`, name); err != nil {
+				return fmt.Errorf("registering tag %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// protoMessage holds the top-level scalar and length-delimited fields of a
+// protobuf message. Anki's config blobs are only read a few fields deep, so
+// this avoids depending on generated code.
+type protoMessage struct {
+	varints map[int]uint64
+	bytes   map[int][]byte
+}
+
+func (m protoMessage) varint(field int) uint64 { return m.varints[field] }
+func (m protoMessage) str(field int) string    { return string(m.bytes[field]) }
+
+var errMalformedProto = errors.New("malformed protobuf")
+
+func parseProto(b []byte) (protoMessage, error) {
+	m := protoMessage{varints: map[int]uint64{}, bytes: map[int][]byte{}}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return m, errMalformedProto
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return m, errMalformedProto
+			}
+			m.varints[field] = v
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return m, errMalformedProto
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return m, errMalformedProto
+			}
+			m.bytes[field] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return m, errMalformedProto
+			}
+			b = b[4:]
+		default:
+			return m, fmt.Errorf("%w: wire type %d", errMalformedProto, wireType)
+		}
+	}
+	return m, nil
+}
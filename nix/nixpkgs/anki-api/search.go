@@ -0,0 +1,489 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var ErrInvalidSearch = errors.New("invalid search")
+
+// The search compiler targets rows of "notes n JOIN cards c ON c.nid = n.id",
+// so card conditions apply per card as in Anki, and uses these functions,
+// registered on every connection:
+//
+//	strip_html(s)            stripHTML
+//	strip_fields(flds)       stripHTML on each field of a note
+//	field_at(flds, ord)      the ord'th field of a note
+//	search_glob(s, glob, w)  case-insensitive glob match, whole string if w
+//	search_tags(tags, glob)  a tag, or an ancestor of one, matches glob
+var searchFuncs = map[string]any{
+	"strip_html":   stripHTML,
+	"strip_fields": stripFields,
+	"field_at": func(flds string, ord int) string {
+		parts := strings.Split(flds, "\x1f")
+		if ord < 0 || ord >= len(parts) {
+			return ""
+		}
+		return parts[ord]
+	},
+	"search_glob": func(s, glob string, whole bool) bool {
+		return globRegexp(glob, whole).MatchString(s)
+	},
+	"search_tags": func(tags, glob string) bool {
+		re := globRegexp(glob, true)
+		for _, tag := range strings.Fields(tags) {
+			if matchesHierarchy(re, tag) {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// stripFields applies stripHTML to each field of a note's flds. Fields are
+// stripped one by one so that a stray "<" in one field and ">" in the next
+// are not taken for a tag spanning the separator.
+func stripFields(flds string) string {
+	parts := strings.Split(flds, "\x1f")
+	for i, p := range parts {
+		parts[i] = stripHTML(p)
+	}
+	return strings.Join(parts, "\x1f")
+}
+
+// searchNode is a parsed search: searchAnd, searchOr, searchNot or
+// searchTerm.
+type searchNode interface{}
+
+type (
+	searchAnd  []searchNode
+	searchOr   []searchNode
+	searchNot  struct{ node searchNode }
+	searchTerm struct{ key, value string }
+)
+
+type searchToken struct {
+	text   string
+	quoted bool
+	op     byte // '(', ')' or '-'; 0 for words
+}
+
+// tokenizeSearch splits a query into words, parentheses and negations.
+// Double quotes group words containing spaces or parentheses, and may
+// appear mid-word (deck:"My Deck"). Backslash escapes are kept in the word
+// text so the glob compiler can tell \* from *.
+func tokenizeSearch(q string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(' || r == ')':
+			tokens = append(tokens, searchToken{op: byte(r)})
+			i++
+			continue
+		case r == '-':
+			if i+1 >= len(runes) || unicode.IsSpace(runes[i+1]) || runes[i+1] == ')' {
+				return nil, fmt.Errorf("%w: nothing to negate after -", ErrInvalidSearch)
+			}
+			tokens = append(tokens, searchToken{op: '-'})
+			i++
+			continue
+		}
+
+		var b strings.Builder
+		quoted, inQuote := false, false
+		for ; i < len(runes); i++ {
+			r := runes[i]
+			if r == '\\' && i+1 < len(runes) {
+				b.WriteRune(r)
+				b.WriteRune(runes[i+1])
+				i++
+				continue
+			}
+			if r == '"' {
+				inQuote = !inQuote
+				quoted = true
+				continue
+			}
+			if !inQuote && (unicode.IsSpace(r) || r == '(' || r == ')') {
+				break
+			}
+			b.WriteRune(r)
+		}
+		if inQuote {
+			return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidSearch)
+		}
+		tokens = append(tokens, searchToken{text: b.String(), quoted: quoted})
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+// parseSearch parses Anki's search grammar: terms are ANDed by adjacency
+// or "and", "or" binds more loosely, "-" negates and parentheses group.
+func parseSearch(q string) (searchNode, error) {
+	tokens, err := tokenizeSearch(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty search", ErrInvalidSearch)
+	}
+	p := &searchParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected )", ErrInvalidSearch)
+	}
+	return node, nil
+}
+
+func (p *searchParser) peek() (searchToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return searchToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *searchParser) isKeyword(t searchToken, kw string) bool {
+	return t.op == 0 && !t.quoted && strings.EqualFold(t.text, kw)
+}
+
+func (p *searchParser) parseOr() (searchNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := searchOr{first}
+	for {
+		t, ok := p.peek()
+		if !ok || !p.isKeyword(t, "or") {
+			break
+		}
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, next)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseAnd() (searchNode, error) {
+	var nodes searchAnd
+	for {
+		t, ok := p.peek()
+		if !ok || t.op == ')' || p.isKeyword(t, "or") {
+			break
+		}
+		if p.isKeyword(t, "and") {
+			p.pos++
+			continue
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, fmt.Errorf("%w: expected a search term", ErrInvalidSearch)
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseUnary() (searchNode, error) {
+	t, _ := p.peek()
+	p.pos++
+	switch t.op {
+	case '-':
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return searchNot{node}, nil
+	case '(':
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.op != ')' {
+			return nil, fmt.Errorf("%w: missing )", ErrInvalidSearch)
+		}
+		p.pos++
+		return node, nil
+	case ')':
+		return nil, fmt.Errorf("%w: unexpected )", ErrInvalidSearch)
+	}
+
+	// key:value, splitting on the first unescaped colon.
+	for i := 0; i < len(t.text); i++ {
+		if t.text[i] == '\\' {
+			i++
+			continue
+		}
+		if t.text[i] == ':' && i > 0 {
+			return searchTerm{key: t.text[:i], value: t.text[i+1:]}, nil
+		}
+	}
+	return searchTerm{value: t.text}, nil
+}
+
+// searchCompiler turns a parsed search into a parameterised SQL condition.
+// Names of decks, note types and fields are resolved up front so the SQL
+// only compares ids and ordinals.
+type searchCompiler struct {
+	decks []Deck
+	types []noteType
+	now   time.Time
+	today int64
+	args  []any
+}
+
+func (a *AnkiDB) compileSearch(node searchNode) (string, []any, error) {
+	decks, err := a.ListDecks()
+	if err != nil {
+		return "", nil, err
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return "", nil, err
+	}
+	crt, err := a.collectionCreated()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	c := &searchCompiler{decks: decks, types: types, now: now, today: daysSince(crt, now)}
+	where, err := c.compile(node)
+	if err != nil {
+		return "", nil, err
+	}
+	return where, c.args, nil
+}
+
+func (c *searchCompiler) compile(node searchNode) (string, error) {
+	switch n := node.(type) {
+	case searchAnd:
+		return c.compileAll(n, " AND ")
+	case searchOr:
+		return c.compileAll(n, " OR ")
+	case searchNot:
+		inner, err := c.compile(n.node)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + inner + ")", nil
+	case searchTerm:
+		return c.compileTerm(n)
+	}
+	return "", fmt.Errorf("%w: unknown node %T", ErrInvalidSearch, node)
+}
+
+func (c *searchCompiler) compileAll(nodes []searchNode, sep string) (string, error) {
+	parts := make([]string, len(nodes))
+	for i, n := range nodes {
+		sql, err := c.compile(n)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = sql
+	}
+	return "(" + strings.Join(parts, sep) + ")", nil
+}
+
+func (c *searchCompiler) compileTerm(t searchTerm) (string, error) {
+	key := strings.ToLower(t.key)
+	if t.value == "" {
+		// An empty value is only meaningful for fields: front: finds notes
+		// whose Front is empty.
+		switch key {
+		case "deck", "tag", "note", "is", "added":
+			return "", fmt.Errorf("%w: %s: needs a value", ErrInvalidSearch, key)
+		}
+	}
+
+	switch key {
+	case "":
+		c.args = append(c.args, t.value)
+		return "search_glob(strip_fields(n.flds), ?, 0)", nil
+
+	case "tag":
+		c.args = append(c.args, t.value)
+		return "search_tags(n.tags, ?)", nil
+
+	case "deck":
+		re := globRegexp(t.value, true)
+		var ids []int64
+		for _, d := range c.decks {
+			if matchesHierarchy(re, d.Name) {
+				ids = append(ids, d.ID)
+			}
+		}
+		// Cards in filtered decks still belong to their original deck.
+		return "(c.did IN " + c.inList(ids) + " OR c.odid IN " + c.inList(ids) + ")", nil
+
+	case "note":
+		re := globRegexp(t.value, true)
+		var ids []int64
+		for _, nt := range c.types {
+			if re.MatchString(nt.Name) {
+				ids = append(ids, nt.ID)
+			}
+		}
+		return "n.mid IN " + c.inList(ids), nil
+
+	case "is":
+		switch strings.ToLower(t.value) {
+		case "due":
+			c.args = append(c.args, c.today, c.now.Add(learnAhead).Unix())
+			return "((c.queue IN (2, 3) AND c.due <= ?) OR (c.queue IN (1, 4) AND c.due <= ?))", nil
+		case "new":
+			return "c.type = 0", nil
+		case "learn":
+			return "c.queue IN (1, 3, 4)", nil
+		case "review":
+			return "c.type IN (2, 3)", nil
+		case "suspended":
+			return "c.queue = -1", nil
+		case "buried":
+			return "c.queue IN (-2, -3)", nil
+		}
+		return "", fmt.Errorf("%w: unknown is:%s", ErrInvalidSearch, t.value)
+
+	case "added":
+		days, err := strconv.Atoi(t.value)
+		if err != nil || days < 1 {
+			return "", fmt.Errorf("%w: added: needs a positive number of days", ErrInvalidSearch)
+		}
+		// added:1 is today, counted from local midnight.
+		start := time.Date(c.now.Year(), c.now.Month(), c.now.Day()-(days-1), 0, 0, 0, 0, time.Local)
+		c.args = append(c.args, start.UnixMilli())
+		return "n.id >= ?", nil
+	}
+
+	// Anything else is a field name, which may itself be a glob. The value
+	// must match the whole field.
+	re := globRegexp(t.key, true)
+	var clauses []string
+	for _, nt := range c.types {
+		for ord, name := range nt.Fields {
+			if re.MatchString(name) {
+				clauses = append(clauses, "(n.mid = ? AND search_glob(strip_html(field_at(n.flds, ?)), ?, 1))")
+				c.args = append(c.args, nt.ID, ord, t.value)
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return "0", nil
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", nil
+}
+
+// inList returns a parameterised "(?, ?)" list. SQLite accepts an empty
+// list, which matches nothing (and, unlike NULL, negates cleanly).
+func (c *searchCompiler) inList(ids []int64) string {
+	if len(ids) == 0 {
+		return "()"
+	}
+	for _, id := range ids {
+		c.args = append(c.args, id)
+	}
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ") + ")"
+}
+
+// matchesHierarchy reports whether re matches name or one of its "::"
+// ancestors, so deck:Lang also finds Lang::Go.
+func matchesHierarchy(re *regexp.Regexp, name string) bool {
+	parts := strings.Split(name, "::")
+	for i := len(parts); i > 0; i-- {
+		if re.MatchString(strings.Join(parts[:i], "::")) {
+			return true
+		}
+	}
+	return false
+}
+
+// globCacheSize bounds the compiled globs kept between queries. A query's
+// globs are matched against every row, so they must outlive one call, but
+// the patterns come from clients and cannot be kept forever.
+const globCacheSize = 256
+
+// globCache is a least recently used cache of compiled globs.
+var globCache = struct {
+	sync.Mutex
+	order   *list.List // of *globEntry, most recent first
+	entries map[string]*list.Element
+}{order: list.New(), entries: map[string]*list.Element{}}
+
+type globEntry struct {
+	key string
+	re  *regexp.Regexp
+}
+
+// globRegexp compiles an Anki search glob: * matches any run of characters
+// and _ any single character, neither crossing a field separator, and a
+// backslash makes the next character literal. Matching ignores case.
+func globRegexp(glob string, whole bool) *regexp.Regexp {
+	key := strconv.FormatBool(whole) + glob
+	globCache.Lock()
+	defer globCache.Unlock()
+	if e, ok := globCache.entries[key]; ok {
+		globCache.order.MoveToFront(e)
+		return e.Value.(*globEntry).re
+	}
+
+	var b strings.Builder
+	b.WriteString("(?is)")
+	if whole {
+		b.WriteString("^")
+	}
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case r == '*':
+			b.WriteString("[^\x1f]*")
+		case r == '_':
+			b.WriteString("[^\x1f]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if whole {
+		b.WriteString("$")
+	}
+	re := regexp.MustCompile(b.String())
+	globCache.entries[key] = globCache.order.PushFront(&globEntry{key, re})
+	if globCache.order.Len() > globCacheSize {
+		oldest := globCache.order.Remove(globCache.order.Back()).(*globEntry)
+		delete(globCache.entries, oldest.key)
+	}
+	return re
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// openSearchFixture extends the legacy fixture with a subdeck and two more
+// notes:
+//
+//	100 Basic, Lang::Go, tags "go", Front "chan", Back "typed pipe", new card
+//	101 Basic, Lang::Go::Advanced, tags "go::runtime perf", added today,
+//	    HTML fields, one due review card and one suspended card
+//	102 Cloze, Default, tags "rust", added three days ago, review card due
+//	    in the future
+func openSearchFixture(t *testing.T) *AnkiDB {
+	t.Helper()
+	path := newCollection(t, false)
+	seed, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, err = seed.Exec(`
+		UPDATE col SET crt = ?, decks = json_set(decks, '$."6"', json('{"id": 6, "name": "Lang::Go::Advanced"}'));
+		INSERT INTO notes VALUES
+			(?, 'g101', 10, 0, 0, ' go::runtime perf ', '<b>goroutine</b> scheduling' || char(31) || 'M:N &amp; threads', 'M:N & threads', 0, 0, ''),
+			(?, 'g102', 20, 0, 0, ' rust ', '{{c1::Rust}} borrow checker' || char(31) || '', '{{c1::Rust}} borrow checker', 0, 0, '');
+		INSERT INTO cards VALUES
+			(1011, ?, 6, 0, 0, 0, 2, 2, 99, 5, 2500, 3, 0, 0, 0, 0, 0, ''),
+			(1012, ?, 6, 1, 0, 0, 2, -1, 99, 5, 2500, 3, 0, 0, 0, 0, 0, ''),
+			(1021, ?, 1, 0, 0, 0, 2, 2, 200, 50, 2500, 3, 0, 0, 0, 0, 0, '');
+	`, now.Add(-100*24*time.Hour-time.Hour).Unix(),
+		now.UnixMilli(), now.Add(-3*24*time.Hour).UnixMilli(),
+		now.UnixMilli(), now.UnixMilli(), now.Add(-3*24*time.Hour).UnixMilli())
+	_ = seed.Close()
+	if err != nil {
+		t.Fatalf("seeding fixture: %v", err)
+	}
+
+	db, err := OpenAnkiDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestSearchNotes(t *testing.T) {
+	db := openSearchFixture(t)
+	var goroutine, rust int64
+	_ = db.db.QueryRow("SELECT id FROM notes WHERE guid = 'g101'").Scan(&goroutine)
+	_ = db.db.QueryRow("SELECT id FROM notes WHERE guid = 'g102'").Scan(&rust)
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		// Plain text matches HTML-stripped fields, ignoring case.
+		{"chan", []int64{100}},
+		{"CHAN", []int64{100}},
+		{"goroutine", []int64{goroutine}},
+		{"b>go", nil},
+		{"threads", []int64{goroutine}},
+		{"&amp;", nil},
+		{`"typed pipe"`, []int64{100}},
+		{"pipe chan", []int64{100}},
+		{"pipe and chan", []int64{100}},
+
+		// Wildcards do not cross field boundaries.
+		{"go*ine", []int64{goroutine}},
+		{"_han", []int64{100}},
+		{"chan*pipe", nil},
+		{`typed\_pipe`, nil},
+
+		// Boolean operators and grouping.
+		{"chan or rust", []int64{100, rust}},
+		{"chan OR rust", []int64{100, rust}},
+		{"-chan", []int64{goroutine, rust}},
+		{"(chan or goroutine) tag:go", []int64{100, goroutine}},
+		{"-(chan or goroutine)", []int64{rust}},
+		{"chan or rust -borrow", []int64{100}},
+
+		// Tags match whole tags, including children.
+		{"tag:go", []int64{100, goroutine}},
+		{"tag:GO", []int64{100, goroutine}},
+		{"tag:runtime", nil},
+		{"tag:go::runtime", []int64{goroutine}},
+		{"tag:p*", []int64{goroutine}},
+		{"-tag:go", []int64{rust}},
+
+		// Decks include subdecks.
+		{"deck:Lang::Go", []int64{100, goroutine}},
+		{"deck:Lang::Go -deck:Lang::Go::Advanced", []int64{100}},
+		{"deck:lang::go::adv*", []int64{goroutine}},
+		{`"deck:Default"`, []int64{rust}},
+		{"deck:Nope", nil},
+		{"-deck:Nope", []int64{100, goroutine, rust}},
+
+		// Note types and fields.
+		{"note:Cloze", []int64{rust}},
+		{"note:basic*", []int64{100, goroutine}},
+		{"front:chan", []int64{100}},
+		{"front:cha", nil},
+		{"front:cha*", []int64{100}},
+		{`back:"typed pipe"`, []int64{100}},
+		{"text:*rust*", []int64{rust}},
+		{"extra:", []int64{rust}},
+		{"f*:goroutine*", []int64{goroutine}},
+		{"nosuchfield:x", nil},
+
+		// Card state and dates.
+		{"is:due", []int64{goroutine}},
+		{"is:new", []int64{100}},
+		{"is:review", []int64{goroutine, rust}},
+		{"is:suspended", []int64{goroutine}},
+		{"tag:go -is:suspended", []int64{100, goroutine}},
+		{"added:1", []int64{goroutine}},
+		{"added:7", []int64{goroutine, rust}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			notes, _, err := db.SearchNotes(tt.query, "", false, ListOptions{})
+			if err != nil {
+				t.Fatalf("SearchNotes() error = %v", err)
+			}
+			var got []int64
+			for _, n := range notes {
+				got = append(got, n.ID)
+			}
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSearchNotes_Deck(t *testing.T) {
+	db := openSearchFixture(t)
+	notes, _, err := db.SearchNotes("tag:go", "Lang::Go", false, ListOptions{})
+	if err != nil {
+		t.Fatalf("SearchNotes() error = %v", err)
+	}
+	if len(notes) != 1 || notes[0].ID != 100 {
+		t.Errorf("got %+v, want only note 100 (deck excludes subdecks)", notes)
+	}
+}
+
+func TestSearchNotes_Recursive(t *testing.T) {
+	db := openSearchFixture(t)
+	for _, deck := range []string{"Lang::Go", "Lang"} {
+		notes, _, err := db.SearchNotes("tag:go", deck, true, ListOptions{})
+		if err != nil {
+			t.Fatalf("SearchNotes(%q) error = %v", deck, err)
+		}
+		if len(notes) != 2 {
+			t.Errorf("in %s = %+v, want notes in Lang::Go and its subdeck", deck, notes)
+		}
+	}
+	if _, _, err := db.SearchNotes("tag:go", "Lang", false, ListOptions{}); !errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("parent-only deck without recursive: err = %v", err)
+	}
+
+	notes, total, err := db.ListNotes("Lang", true, ListOptions{})
+	if err != nil || total != 2 || len(notes) != 2 {
+		t.Errorf("ListNotes(Lang, recursive) = %+v, %d, %v", notes, total, err)
+	}
+	if _, _, err := db.ListNotes("La", true, ListOptions{}); !errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("name prefix that is not a parent: err = %v", err)
+	}
+}
+
+func TestSearchNotes_Invalid(t *testing.T) {
+	db := openSearchFixture(t)
+	for _, q := range []string{"", "   ", "(chan", "chan)", "()", "chan or", `"open`, "-", "- chan", "is:bogus", "is:", "deck:", "added:x", "added:0"} {
+		t.Run(q, func(t *testing.T) {
+			if _, _, err := db.SearchNotes(q, "", false, ListOptions{}); !errors.Is(err, ErrInvalidSearch) {
+				t.Errorf("err = %v, want ErrInvalidSearch", err)
+			}
+		})
+	}
+}
+
+func TestGlobRegexp_CacheBounded(t *testing.T) {
+	first := globRegexp("first*", false)
+	for i := range globCacheSize + 10 {
+		globRegexp(strconv.Itoa(i), false)
+	}
+	globCache.Lock()
+	size := globCache.order.Len()
+	globCache.Unlock()
+	if size > globCacheSize {
+		t.Errorf("cache holds %d globs, want at most %d", size, globCacheSize)
+	}
+	if again := globRegexp("first*", false); again == first || !again.MatchString("firstly") {
+		t.Error("evicted glob was not recompiled")
+	}
+}
+
+func TestStripFields(t *testing.T) {
+	strip := searchFuncs["strip_fields"].(func(string) string)
+	if got, want := strip("a <b\x1fc> <i>d</i>"), "a <b\x1fc> d"; got != want {
+		t.Errorf("strip_fields = %q, want %q", got, want)
+	}
+}
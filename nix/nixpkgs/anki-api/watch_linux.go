@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// fileEvents watches the file's directory with inotify, which sees files
+// being renamed over it as well as writes to it. The channel is closed
+// once ctx is done.
+func fileEvents(ctx context.Context, path string) (<-chan struct{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, base := filepath.Split(abs)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	const mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE
+	wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("watching %s: %w", dir, err)
+	}
+
+	// Removing the watch queues IN_IGNORED, which wakes the reader below.
+	go func() {
+		<-ctx.Done()
+		_, _ = syscall.InotifyRmWatch(fd, uint32(wd))
+	}()
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		defer func() { _ = syscall.Close(fd) }()
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				eventMask := binary.NativeEndian.Uint32(buf[off+4:])
+				nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+				start := off + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[start:start+nameLen]), "\x00")
+				off = start + nameLen
+
+				if eventMask&syscall.IN_IGNORED != 0 {
+					return
+				}
+				if name == base || name == base+"-wal" {
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
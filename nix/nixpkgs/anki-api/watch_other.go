@@ -0,0 +1,64 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// filePoll is how often watched files are checked for changes where
+// inotify is unavailable.
+const filePoll = time.Second
+
+// fileEvents polls the file and its write-ahead log, reporting
+// a change when either is resized, touched or replaced. The channel is
+// closed once ctx is done.
+func fileEvents(ctx context.Context, path string) (<-chan struct{}, error) {
+	files := []string{path, path + "-wal"}
+	stat := func() []os.FileInfo {
+		infos := make([]os.FileInfo, len(files))
+		for i, f := range files {
+			infos[i], _ = os.Stat(f)
+		}
+		return infos
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		last := stat()
+		ticker := time.NewTicker(filePoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current := stat()
+			for i := range files {
+				if changed(last[i], current[i]) {
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+					break
+				}
+			}
+			last = current
+		}
+	}()
+	return events, nil
+}
+
+func changed(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	return !os.SameFile(a, b) || !a.ModTime().Equal(b.ModTime()) || a.Size() != b.Size()
+}
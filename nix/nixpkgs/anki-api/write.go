@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrReadOnly         = errors.New("collection opened read-only; restart with -writable")
+	ErrCollectionLocked = errors.New("collection is locked by another process (is Anki open?)")
+	ErrInvalidNote      = errors.New("invalid note")
+)
+
+// NoteInput is the body of note create and update requests. On update Deck
+// and Model are ignored, omitted fields keep their values and a nil Tags
+// leaves the tags unchanged.
+type NoteInput struct {
+	Deck   string            `json:"deck"`
+	Model  string            `json:"model"`
+	Fields map[string]string `json:"fields"`
+	Tags   *string           `json:"tags"`
+}
+
+// CreateNote adds a note of the named model with one new card per template
+// (or cloze number) that the fields generate, placed in the named deck.
+func (a *AnkiDB) CreateNote(in NoteInput) (*Note, error) {
+	decks, err := a.ListDecks()
+	if err != nil {
+		return nil, err
+	}
+	types, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+	p, err := prepareNote(in, decks, types)
+	if err != nil {
+		return nil, err
+	}
+
+	var nid int64
+	err = a.write(func(tx *sql.Tx, now time.Time) error {
+		nid, err = a.insertNote(tx, p, "", now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.GetNote(nid)
+}
+
+// preparedNote is a validated NoteInput, ready to insert.
+type preparedNote struct {
+	deckID int64
+	nt     noteType
+	fields []string
+	ords   []int
+	tags   string
+}
+
+// prepareNote validates in against the collection's decks and note types.
+func prepareNote(in NoteInput, decks []Deck, types []noteType) (preparedNote, error) {
+	if in.Deck == "" || in.Model == "" {
+		return preparedNote{}, fmt.Errorf("%w: deck and model are required", ErrInvalidNote)
+	}
+	deckID := int64(0)
+	for _, d := range decks {
+		if d.Name == in.Deck {
+			deckID = d.ID
+		}
+	}
+	if deckID == 0 {
+		return preparedNote{}, fmt.Errorf("deck %q %w", in.Deck, ErrDeckNotFound)
+	}
+	var nt noteType
+	for _, t := range types {
+		if t.Name == in.Model {
+			nt = t
+		}
+	}
+	if nt.ID == 0 {
+		return preparedNote{}, fmt.Errorf("%w: model %q not found", ErrInvalidNote, in.Model)
+	}
+
+	fields := make([]string, len(nt.Fields))
+	if err := applyFields(nt, fields, in.Fields); err != nil {
+		return preparedNote{}, err
+	}
+	ords := cardOrds(nt, fields)
+	if len(ords) == 0 {
+		return preparedNote{}, fmt.Errorf("%w: fields would not generate any cards", ErrInvalidNote)
+	}
+	tags := ""
+	if in.Tags != nil {
+		tags = *in.Tags
+	}
+	return preparedNote{deckID: deckID, nt: nt, fields: fields, ords: ords, tags: tags}, nil
+}
+
+// insertNote adds a prepared note and its cards, returning the note id. An
+// empty guid generates a new one.
+func (a *AnkiDB) insertNote(tx *sql.Tx, p preparedNote, guid string, now time.Time) (int64, error) {
+	nid, err := nextID(tx, "notes", now)
+	if err != nil {
+		return 0, err
+	}
+	if guid == "" {
+		if guid, err = newGUID(); err != nil {
+			return 0, err
+		}
+	}
+	sfld, csum := sortFieldAndChecksum(p.nt, p.fields)
+	if _, err := tx.Exec(`
+		INSERT INTO notes (id, guid, mid, mod, usn, tags, flds, sfld, csum, flags, data)
+		VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')
+	`, nid, guid, p.nt.ID, now.Unix(), normaliseTags(p.tags), strings.Join(p.fields, "\x1f"), sfld, csum); err != nil {
+		return 0, fmt.Errorf("inserting note: %w", err)
+	}
+	if err := a.schema.registerTags(tx, strings.Fields(p.tags)); err != nil {
+		return 0, err
+	}
+	return nid, addCards(tx, nid, p.deckID, p.ords, now)
+}
+
+// UpdateNote replaces the given fields and tags of note id, adding cards for
+// any templates or cloze numbers the new fields generate. Existing cards are
+// never removed, matching Anki's behaviour when editing.
+func (a *AnkiDB) UpdateNote(id int64, in NoteInput) (*Note, error) {
+	models, err := a.getNoteTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.write(func(tx *sql.Tx, now time.Time) error {
+		var mid int64
+		var flds, tags string
+		err := tx.QueryRow("SELECT mid, flds, tags FROM notes WHERE id = ?", id).Scan(&mid, &flds, &tags)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("note %d %w", id, ErrNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("querying note: %w", err)
+		}
+		var nt noteType
+		for _, m := range models {
+			if m.ID == mid {
+				nt = m
+			}
+		}
+		if nt.ID == 0 {
+			return fmt.Errorf("note %d has unknown model %d", id, mid)
+		}
+
+		fields := make([]string, len(nt.Fields))
+		copy(fields, strings.Split(flds, "\x1f"))
+		if err := applyFields(nt, fields, in.Fields); err != nil {
+			return err
+		}
+		if in.Tags != nil {
+			tags = normaliseTags(*in.Tags)
+			if err := a.schema.registerTags(tx, strings.Fields(tags)); err != nil {
+				return err
+			}
+		}
+
+		sfld, csum := sortFieldAndChecksum(nt, fields)
+		if _, err := tx.Exec(`
+			UPDATE notes SET mod = ?, usn = -1, tags = ?, flds = ?, sfld = ?, csum = ?
+			WHERE id = ?
+		`, now.Unix(), tags, strings.Join(fields, "\x1f"), sfld, csum, id); err != nil {
+			return fmt.Errorf("updating note: %w", err)
+		}
+
+		// New cards go to the deck of the note's first existing card.
+		var deckID int64
+		existing := map[int]bool{}
+		rows, err := tx.Query("SELECT ord, did FROM cards WHERE nid = ? ORDER BY ord", id)
+		if err != nil {
+			return fmt.Errorf("querying cards: %w", err)
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var ord int
+			var did int64
+			if err := rows.Scan(&ord, &did); err != nil {
+				return err
+			}
+			if deckID == 0 {
+				deckID = did
+			}
+			existing[ord] = true
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if deckID == 0 {
+			deckID = 1
+		}
+
+		var missing []int
+		for _, ord := range cardOrds(nt, fields) {
+			if !existing[ord] {
+				missing = append(missing, ord)
+			}
+		}
+		return addCards(tx, id, deckID, missing, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.GetNote(id)
+}
+
+// DeleteNote removes note id and its cards, recording graves so that the
+// deletion propagates on the next sync.
+func (a *AnkiDB) DeleteNote(id int64) error {
+	return a.write(func(tx *sql.Tx, now time.Time) error {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM notes WHERE id = ?", id).Scan(&exists); err != nil {
+			return fmt.Errorf("querying note: %w", err)
+		}
+		if exists == 0 {
+			return fmt.Errorf("note %d %w", id, ErrNotFound)
+		}
+
+		// Grave types: 0 card, 1 note, 2 deck.
+		if _, err := tx.Exec(`
+			INSERT INTO graves (usn, oid, type) SELECT -1, id, 0 FROM cards WHERE nid = ?
+		`, id); err != nil {
+			return fmt.Errorf("recording card graves: %w", err)
+		}
+		if _, err := tx.Exec("INSERT INTO graves (usn, oid, type) VALUES (-1, ?, 1)", id); err != nil {
+			return fmt.Errorf("recording note grave: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM cards WHERE nid = ?", id); err != nil {
+			return fmt.Errorf("deleting cards: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM notes WHERE id = ?", id); err != nil {
+			return fmt.Errorf("deleting note: %w", err)
+		}
+		return nil
+	})
+}
+
+// write runs fn in an immediate transaction and bumps the collection's
+// modification time so Anki and AnkiWeb notice the change.
+func (a *AnkiDB) write(fn func(tx *sql.Tx, now time.Time) error) error {
+	if !a.writable {
+		return ErrReadOnly
+	}
+	tx, err := a.db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return lockError(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now()
+	if err := fn(tx, now); err != nil {
+		return lockError(err)
+	}
+	if _, err := tx.Exec("UPDATE col SET mod = ?", now.UnixMilli()); err != nil {
+		return lockError(fmt.Errorf("updating collection: %w", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return lockError(err)
+	}
+	a.committed.Store(statCollection(a.path))
+	return nil
+}
+
+// lockError maps SQLite busy/locked errors, which Anki desktop's exclusive
+// lock produces, onto ErrCollectionLocked.
+func lockError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return fmt.Errorf("%w: %v", ErrCollectionLocked, err)
+	}
+	return err
+}
+
+func (a *AnkiDB) findDeckID(name string) (int64, error) {
+	decks, err := a.ListDecks()
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range decks {
+		if d.Name == name {
+			return d.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("deck %q %w", name, ErrDeckNotFound)
+}
+
+// applyFields copies named values into fields, ordered as nt.Fields.
+func applyFields(nt noteType, fields []string, values map[string]string) error {
+	for name, value := range values {
+		idx := -1
+		for i, f := range nt.Fields {
+			if f == name {
+				idx = i
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("%w: model %q has no field %q", ErrInvalidNote, nt.Name, name)
+		}
+		if strings.Contains(value, "\x1f") {
+			return fmt.Errorf("%w: field %q contains the field separator", ErrInvalidNote, name)
+		}
+		fields[idx] = value
+	}
+	return nil
+}
+
+var (
+	templateFieldRe = regexp.MustCompile(`\{\{([^}]+)\}\}`)
+	clozeRe         = regexp.MustCompile(`\{\{c(\d+)::`)
+)
+
+// cardOrds returns the card ordinals a note with these fields generates.
+// Standard models get a card for each template whose front references a
+// non-empty field; cloze models get one per cloze number.
+func cardOrds(nt noteType, fields []string) []int {
+	var ords []int
+	if nt.Cloze {
+		seen := map[int]bool{}
+		for _, f := range fields {
+			for _, m := range clozeRe.FindAllStringSubmatch(f, -1) {
+				n, _ := strconv.Atoi(m[1])
+				if n > 0 && !seen[n-1] {
+					seen[n-1] = true
+					ords = append(ords, n-1)
+				}
+			}
+		}
+		sort.Ints(ords)
+		return ords
+	}
+
+	for _, t := range nt.Templates {
+		for _, m := range templateFieldRe.FindAllStringSubmatch(t.QFmt, -1) {
+			ref := strings.TrimSpace(m[1])
+			if ref == "" || strings.ContainsAny(ref[:1], "#^/!") {
+				continue
+			}
+			// Strip filters such as {{text:Front}}.
+			if i := strings.LastIndex(ref, ":"); i >= 0 {
+				ref = ref[i+1:]
+			}
+			idx := -1
+			for i, f := range nt.Fields {
+				if f == ref {
+					idx = i
+				}
+			}
+			if idx >= 0 && strings.TrimSpace(stripHTML(fields[idx])) != "" {
+				ords = append(ords, t.Ord)
+				break
+			}
+		}
+	}
+	return ords
+}
+
+func addCards(tx *sql.Tx, nid, deckID int64, ords []int, now time.Time) error {
+	if len(ords) == 0 {
+		return nil
+	}
+	// New cards are queued after every existing new card.
+	var due int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(due), 0) + 1 FROM cards WHERE type = 0").Scan(&due); err != nil {
+		return fmt.Errorf("finding next position: %w", err)
+	}
+	for _, ord := range ords {
+		cid, err := nextID(tx, "cards", now)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO cards (id, nid, did, ord, mod, usn, type, queue, due, ivl, factor, reps, lapses, left, odue, odid, flags, data)
+			VALUES (?, ?, ?, ?, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')
+		`, cid, nid, deckID, ord, now.Unix(), due); err != nil {
+			return fmt.Errorf("inserting card: %w", err)
+		}
+	}
+	return nil
+}
+
+// nextID returns a millisecond timestamp id unused in table, as Anki does.
+func nextID(tx *sql.Tx, table string, now time.Time) (int64, error) {
+	var maxID int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM " + table).Scan(&maxID); err != nil {
+		return 0, fmt.Errorf("finding next %s id: %w", table, err)
+	}
+	return max(now.UnixMilli(), maxID+1), nil
+}
+
+const guidChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&()*+,-./:;<=>?@[]^_`{|}~"
+
+// newGUID returns a random 64-bit value in Anki's base91 guid encoding.
+func newGUID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("generating guid: %w", err)
+	}
+	n := binary.BigEndian.Uint64(b[:])
+	var out []byte
+	for n > 0 {
+		out = append(out, guidChars[n%uint64(len(guidChars))])
+		n /= uint64(len(guidChars))
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out), nil
+}
+
+// sortFieldAndChecksum computes the sfld and csum columns: the stripped sort
+// field, and the first 8 hex digits of the SHA-1 of the stripped first field.
+func sortFieldAndChecksum(nt noteType, fields []string) (string, int64) {
+	first := stripHTML(fields[0])
+	sum := sha1.Sum([]byte(first))
+	csum, _ := strconv.ParseInt(hex.EncodeToString(sum[:4]), 16, 64)
+	sfld := first
+	if nt.SortField > 0 && nt.SortField < len(fields) {
+		sfld = stripHTML(fields[nt.SortField])
+	}
+	return sfld, csum
+}
+
+var (
+	imgSrcRe = regexp.MustCompile(`(?i)<img[^>]*\ssrc=["']?([^"'>\s]+)["']?[^>]*>`)
+	tagRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// stripHTML removes tags and decodes entities, keeping image filenames as
+// Anki does when computing sort fields and checksums.
+func stripHTML(s string) string {
+	s = imgSrcRe.ReplaceAllString(s, " $1 ")
+	s = tagRe.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// normaliseTags returns tags in Anki's stored form: space separated with a
+// leading and trailing space.
+func normaliseTags(tags string) string {
+	fields := strings.Fields(tags)
+	if len(fields) == 0 {
+		return ""
+	}
+	return " " + strings.Join(fields, " ") + " "
+}
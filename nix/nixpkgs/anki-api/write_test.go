@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestNoteWrites(t *testing.T) {
+	for _, layout := range fixtureLayouts {
+		t.Run(layout.name, func(t *testing.T) {
+			db := openFixture(t, layout.modern, true)
+
+			tags := "rust  ownership"
+			note, err := db.CreateNote(NoteInput{
+				Deck:   "Lang::Go",
+				Model:  "Basic (and reversed)",
+				Fields: map[string]string{"Front": "<b>Borrow</b> &amp; move"},
+				Tags:   &tags,
+			})
+			if err != nil {
+				t.Fatalf("CreateNote() error = %v", err)
+			}
+			if note.Tags != "rust ownership" {
+				t.Errorf("tags = %q", note.Tags)
+			}
+
+			var guid, storedTags string
+			var usn int
+			var csum int64
+			if err := db.db.QueryRow("SELECT guid, usn, tags, csum FROM notes WHERE id = ?", note.ID).
+				Scan(&guid, &usn, &storedTags, &csum); err != nil {
+				t.Fatal(err)
+			}
+			// sha1("Borrow & move") = 20631fc0...
+			if guid == "" || usn != -1 || storedTags != " rust ownership " || csum != 0x20631fc0 {
+				t.Errorf("note row: guid=%q usn=%d tags=%q csum=%x", guid, usn, storedTags, csum)
+			}
+			if got := cardRows(t, db, note.ID); !slices.Equal(got, []int{0}) {
+				t.Errorf("cards = %v, want [0] (Back is empty)", got)
+			}
+			if got := registeredTags(t, db, layout.modern); !slices.Equal(got, []string{"ownership", "rust"}) {
+				t.Errorf("registered tags = %v", got)
+			}
+
+			back := "Ownership"
+			if _, err := db.UpdateNote(note.ID, NoteInput{Fields: map[string]string{"Back": back}}); err != nil {
+				t.Fatalf("UpdateNote() error = %v", err)
+			}
+			var sfld string
+			_ = db.db.QueryRow("SELECT sfld FROM notes WHERE id = ?", note.ID).Scan(&sfld)
+			if sfld != back {
+				t.Errorf("sfld = %q, want the Back field", sfld)
+			}
+			if got := cardRows(t, db, note.ID); !slices.Equal(got, []int{0, 1}) {
+				t.Errorf("cards after update = %v, want [0 1]", got)
+			}
+
+			cloze, err := db.CreateNote(NoteInput{
+				Deck:   "Default",
+				Model:  "Cloze",
+				Fields: map[string]string{"Text": "{{c1::Go}} has {{c3::goroutines}} and {{c1::channels}}"},
+			})
+			if err != nil {
+				t.Fatalf("CreateNote(cloze) error = %v", err)
+			}
+			if got := cardRows(t, db, cloze.ID); !slices.Equal(got, []int{0, 2}) {
+				t.Errorf("cloze cards = %v, want [0 2]", got)
+			}
+
+			if err := db.DeleteNote(note.ID); err != nil {
+				t.Fatalf("DeleteNote() error = %v", err)
+			}
+			var graves int
+			_ = db.db.QueryRow("SELECT COUNT(*) FROM graves WHERE usn = -1").Scan(&graves)
+			if graves != 3 {
+				t.Errorf("graves = %d, want 3 (two cards and the note)", graves)
+			}
+			if _, err := db.GetNote(note.ID); err == nil {
+				t.Error("deleted note is still readable")
+			}
+		})
+	}
+}
+
+func TestNoteWrites_Rejected(t *testing.T) {
+	db := openFixture(t, false, true)
+	tests := []struct {
+		name string
+		in   NoteInput
+	}{
+		{"missing deck", NoteInput{Model: "Cloze", Fields: map[string]string{"Text": "{{c1::x}}"}}},
+		{"unknown deck", NoteInput{Deck: "Nope", Model: "Cloze", Fields: map[string]string{"Text": "{{c1::x}}"}}},
+		{"unknown model", NoteInput{Deck: "Default", Model: "Nope"}},
+		{"unknown field", NoteInput{Deck: "Default", Model: "Cloze", Fields: map[string]string{"Nope": "x"}}},
+		{"separator", NoteInput{Deck: "Default", Model: "Cloze", Fields: map[string]string{"Text": "a\x1fb"}}},
+		{"no cards", NoteInput{Deck: "Default", Model: "Cloze", Fields: map[string]string{"Text": "no deletions"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := ErrInvalidNote
+			if tt.in.Deck == "Nope" {
+				want = ErrDeckNotFound
+			}
+			if _, err := db.CreateNote(tt.in); !errors.Is(err, want) {
+				t.Errorf("err = %v, want %v", err, want)
+			}
+		})
+	}
+
+	readOnly := openFixture(t, false, false)
+	if err := readOnly.DeleteNote(100); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only delete: err = %v, want ErrReadOnly", err)
+	}
+}
+
+func cardRows(t *testing.T, db *AnkiDB, nid int64) []int {
+	t.Helper()
+	rows, err := db.db.Query("SELECT ord FROM cards WHERE nid = ? AND usn = -1 ORDER BY ord", nid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rows.Close() }()
+	var ords []int
+	for rows.Next() {
+		var ord int
+		_ = rows.Scan(&ord)
+		ords = append(ords, ord)
+	}
+	return ords
+}
+
+// registeredTags is the collection's tag list: the tags table in the modern
+// schema, or the keys of col.tags in the legacy one.
+func registeredTags(t *testing.T, db *AnkiDB, modern bool) []string {
+	t.Helper()
+	var tags []string
+	if modern {
+		rows, err := db.db.Query("SELECT tag FROM tags WHERE usn = -1 ORDER BY tag")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = rows.Close() }()
+		for rows.Next() {
+			var tag string
+			_ = rows.Scan(&tag)
+			tags = append(tags, tag)
+		}
+		return tags
+	}
+	var tagsJSON string
+	_ = db.db.QueryRow("SELECT tags FROM col").Scan(&tagsJSON)
+	var registered map[string]int
+	if err := json.Unmarshal([]byte(tagsJSON), &registered); err != nil {
+		t.Fatal(err)
+	}
+	for tag := range registered {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	return tags
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	ankiConnectURL = "http://localhost:8765"
+	ankiAPIURL     = "http://localhost:27702"
+	defaultDeck    = "Default"
+)
+
+var (
+	// keep-sorted start
+	allowDuplicate bool
+	ankiBackend    string
+	ankiDeck       string
+	ankiNoteType   string
+	ankiTags       []string
+	ankiURL        string
+	// keep-sorted end
+
+	// ankiClient is the backend built from the flags.
+	ankiClient AnkiBackend
+)
+
+// AnkiNote is a card addressed to a deck, with the note type and tags to
+// create it with. The card's front and back fill the note type's first two
+// fields.
+type AnkiNote struct {
+	Deck     string
+	NoteType string
+	Tags     []string
+	Card     Card
+}
+
+// AnkiBackend adds notes to an Anki collection.
+type AnkiBackend interface {
+	Name() string
+	// Duplicates returns the IDs of notes in the deck that already hold
+	// the card.
+	Duplicates(note AnkiNote) ([]int64, error)
+	AddNote(note AnkiNote) (int64, error)
+}
+
+// newAnkiBackend returns the named backend: "ankiconnect" (the default) for
+// the Anki desktop add-on, or "api" for an anki-api server. An empty URL
+// picks the backend's usual local address.
+func newAnkiBackend(name, baseURL string) (AnkiBackend, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch name {
+	case "", "ankiconnect":
+		if baseURL == "" {
+			baseURL = ankiConnectURL
+		}
+		return &ankiConnect{url: baseURL, client: client}, nil
+	case "api":
+		if baseURL == "" {
+			baseURL = ankiAPIURL
+		}
+		return &ankiAPI{url: strings.TrimSuffix(baseURL, "/"), key: getEnvOrSecret("ANKI_API_KEY", "anki-api-key"), client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown Anki backend %q (want ankiconnect or api)", name)
+}
+
+// ankiTarget is the note the current flags and environment address the
+// card to.
+func ankiTarget(card Card) AnkiNote {
+	deck := ankiDeck
+	if deck == "" {
+		deck = os.Getenv("ANKIGEN_DECK")
+	}
+	if deck == "" {
+		deck = defaultDeck
+	}
+	return AnkiNote{Deck: deck, NoteType: noteTypeFor(card.Kind), Tags: ankiTags, Card: card}
+}
+
+// addCard adds the note unless force is false and the deck already holds
+// it, in which case it returns the duplicates' IDs instead.
+func addCard(b AnkiBackend, note AnkiNote, force bool) (id int64, dupes []int64, err error) {
+	if !force {
+		dupes, err = b.Duplicates(note)
+		if err != nil {
+			return 0, nil, fmt.Errorf("checking for duplicates: %w", err)
+		}
+		if len(dupes) > 0 {
+			return 0, dupes, nil
+		}
+	}
+	id, err = b.AddNote(note)
+	return id, nil, err
+}
+
+// ankiAddedMsg reports adding the card at index in the card history.
+type ankiAddedMsg struct {
+	index int
+	note  AnkiNote
+	id    int64
+	dupes []int64
+	err   error
+}
+
+func runAddCard(b AnkiBackend, note AnkiNote, index int, force bool) tea.Cmd {
+	return func() tea.Msg {
+		id, dupes, err := addCard(b, note, force)
+		return ankiAddedMsg{index: index, note: note, id: id, dupes: dupes, err: err}
+	}
+}
+
+// addedCardCurrent reports whether the card msg added, or found
+// duplicates of, is still the selected card at the index it was added
+// from.
+func (ctx *PipelineContext) addedCardCurrent(msg ankiAddedMsg) bool {
+	cards := ctx.CardHistory
+	if ctx.Cards != nil {
+		cards = ctx.Cards
+	}
+	if msg.index != ctx.selectedIndex() || msg.index >= len(cards) {
+		return false
+	}
+	return sameCard(cards[msg.index], msg.note.Card)
+}
+
+// sameCard reports whether a and b hold the same card, whatever their
+// note IDs.
+func sameCard(a, b Card) bool {
+	return a.Front == b.Front && a.Back == b.Back && a.Kind == b.Kind
+}
+
+// recordNoteID marks the card at index in the card history, and the card
+// shown if it is that one, as added to Anki. A card that is no longer the
+// one note was made from is left unmarked.
+func recordNoteID(ctx *PipelineContext, index int, note AnkiNote, backend string, id int64) {
+	cards := ctx.CardHistory
+	if ctx.Cards != nil {
+		cards = ctx.Cards
+	}
+	if index < len(cards) && sameCard(cards[index], note.Card) {
+		cards[index].NoteID = id
+	}
+	if index == ctx.selectedIndex() && sameCard(ctx.Card, note.Card) {
+		ctx.Card.NoteID = id
+	}
+	ctx.History.AddEvent("anki_add", map[string]any{
+		"backend":  backend,
+		"deck":     note.Deck,
+		"noteType": note.NoteType,
+		"noteId":   id,
+		"card":     index,
+	})
+}
+
+func formatNoteIDs(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ", ")
+}
+
+// --- AnkiConnect ---
+
+type ankiConnect struct {
+	url    string
+	client *http.Client
+}
+
+func (*ankiConnect) Name() string { return "ankiconnect" }
+
+func (a *ankiConnect) call(action string, params, result any) error {
+	body, err := json.Marshal(map[string]any{"action": action, "version": 6, "params": params})
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("AnkiConnect unreachable (is Anki running?): %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+		Error  *string         `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("AnkiConnect %s: %s", action, resp.Status)
+	}
+	if out.Error != nil {
+		return fmt.Errorf("AnkiConnect %s: %s", action, *out.Error)
+	}
+	return json.Unmarshal(out.Result, result)
+}
+
+func (a *ankiConnect) fieldNames(noteType string) ([]string, error) {
+	var names []string
+	if err := a.call("modelFieldNames", map[string]string{"modelName": noteType}, &names); err != nil {
+		return nil, err
+	}
+	if len(names) < 2 {
+		return nil, fmt.Errorf("note type %q has fewer than two fields", noteType)
+	}
+	return names, nil
+}
+
+// ankiQuote quotes s as a single Anki search term, escaping the wildcards
+// so that it matches literally.
+func ankiQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `_`, `\_`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func (a *ankiConnect) Duplicates(note AnkiNote) ([]int64, error) {
+	names, err := a.fieldNames(note.NoteType)
+	if err != nil {
+		return nil, err
+	}
+	query := ankiQuote("deck:"+note.Deck) + " " + ankiQuote(names[0]+":"+note.Card.Front)
+	var ids []int64
+	if err := a.call("findNotes", map[string]string{"query": query}, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (a *ankiConnect) AddNote(note AnkiNote) (int64, error) {
+	names, err := a.fieldNames(note.NoteType)
+	if err != nil {
+		return 0, err
+	}
+	params := map[string]any{"note": map[string]any{
+		"deckName":  note.Deck,
+		"modelName": note.NoteType,
+		"fields":    map[string]string{names[0]: note.Card.Front, names[1]: note.Card.Back},
+		"tags":      note.Tags,
+		// Duplicates were checked beforehand, and adding anyway is the
+		// user's call.
+		"options": map[string]any{"allowDuplicate": true},
+	}}
+	var id int64
+	if err := a.call("addNote", params, &id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// --- anki-api ---
+
+type ankiAPI struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (*ankiAPI) Name() string { return "api" }
+
+func (a *ankiAPI) do(method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.key != "" {
+		req.Header.Set("X-API-Key", a.key)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("anki-api unreachable: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("anki-api: %s", e.Error.Message)
+		}
+		return fmt.Errorf("anki-api: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (a *ankiAPI) Duplicates(note AnkiNote) ([]int64, error) {
+	q := url.Values{"front": {note.Card.Front}, "back": {note.Card.Back}, "deck": {note.Deck}}
+	var dupes []struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.do(http.MethodGet, "/api/notes/duplicates?"+q.Encode(), nil, &dupes); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(dupes))
+	for i, d := range dupes {
+		ids[i] = d.ID
+	}
+	return ids, nil
+}
+
+func (a *ankiAPI) AddNote(note AnkiNote) (int64, error) {
+	var models []struct {
+		Name   string   `json:"name"`
+		Fields []string `json:"fields"`
+	}
+	if err := a.do(http.MethodGet, "/api/models", nil, &models); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, m := range models {
+		if m.Name == note.NoteType {
+			names = m.Fields
+		}
+	}
+	if len(names) < 2 {
+		return 0, fmt.Errorf("note type %q not found or has fewer than two fields", note.NoteType)
+	}
+
+	tags := strings.Join(note.Tags, " ")
+	in := map[string]any{
+		"deck":   note.Deck,
+		"model":  note.NoteType,
+		"fields": map[string]string{names[0]: note.Card.Front, names[1]: note.Card.Back},
+		"tags":   tags,
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.do(http.MethodPost, "/api/notes", in, &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
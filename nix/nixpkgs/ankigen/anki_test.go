@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type fakeBackend struct {
+	dupes []int64
+	added []AnkiNote
+}
+
+func (*fakeBackend) Name() string { return "fake" }
+
+func (f *fakeBackend) Duplicates(AnkiNote) ([]int64, error) { return f.dupes, nil }
+
+func (f *fakeBackend) AddNote(note AnkiNote) (int64, error) {
+	f.added = append(f.added, note)
+	return 1000 + int64(len(f.added)), nil
+}
+
+func TestAnkiConnect(t *testing.T) {
+	var added map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Action  string
+			Version int
+			Params  map[string]any
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var result any
+		switch req.Action {
+		case "modelFieldNames":
+			if req.Params["modelName"] != "Basic" {
+				_ = json.NewEncoder(w).Encode(map[string]any{"result": nil, "error": "model was not found"})
+				return
+			}
+			result = []string{"Question", "Answer"}
+		case "findNotes":
+			result = []int64{}
+			if req.Params["query"] == `"deck:Lang::Go" "Question:What is a \*chan\*?"` {
+				result = []int64{7}
+			}
+		case "addNote":
+			added = req.Params["note"].(map[string]any)
+			result = 1234
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"result": result, "error": nil})
+	}))
+	defer server.Close()
+
+	b, err := newAnkiBackend("ankiconnect", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := AnkiNote{Deck: "Lang::Go", NoteType: "Basic", Tags: []string{"ankigen"}, Card: Card{Front: "What is a *chan*?", Back: "A pipe"}}
+
+	if id, dupes, err := addCard(b, note, false); err != nil || id != 0 || !slices.Equal(dupes, []int64{7}) {
+		t.Errorf("addCard() = %d, %v, %v, want duplicate 7", id, dupes, err)
+	}
+	id, _, err := addCard(b, note, true)
+	if err != nil || id != 1234 {
+		t.Fatalf("addCard(force) = %d, %v", id, err)
+	}
+	fields, _ := added["fields"].(map[string]any)
+	if added["deckName"] != "Lang::Go" || fields["Question"] != "What is a *chan*?" || fields["Answer"] != "A pipe" {
+		t.Errorf("added note = %v", added)
+	}
+
+	note.Card.Front = "What is a goroutine?"
+	if id, dupes, err := addCard(b, note, false); err != nil || id != 1234 || dupes != nil {
+		t.Errorf("addCard(new) = %d, %v, %v", id, dupes, err)
+	}
+	note.NoteType = "Cloze"
+	if _, _, err := addCard(b, note, false); err == nil || !strings.Contains(err.Error(), "model was not found") {
+		t.Errorf("unknown note type: error = %v", err)
+	}
+}
+
+func TestAnkiAPI(t *testing.T) {
+	t.Setenv("ANKI_API_KEY", "secret")
+	var created map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": {"code": "unauthorized", "message": "missing or invalid API key"}}`))
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/notes/duplicates":
+			q := r.URL.Query()
+			if q.Get("deck") == "Nope" {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error": {"code": "deck_not_found", "message": "deck \"Nope\" not found"}}`))
+				return
+			}
+			if strings.Contains(q.Get("front"), "channel") && q.Get("back") != "" {
+				_, _ = w.Write([]byte(`[{"id": 100, "score": 0.9}, {"id": 101, "score": 0.8}]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[]`))
+		case "GET /api/models":
+			_, _ = w.Write([]byte(`[{"id": 1, "name": "Basic", "fields": ["Front", "Back"]}]`))
+		case "POST /api/notes":
+			_ = json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id": 555, "model": "Basic"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	b, err := newAnkiBackend("api", server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := AnkiNote{Deck: "Default", NoteType: "Basic", Tags: []string{"ankigen", "go"}, Card: Card{Front: "What is a channel?", Back: "A pipe"}}
+
+	if _, dupes, err := addCard(b, note, false); err != nil || !slices.Equal(dupes, []int64{100, 101}) {
+		t.Errorf("addCard() dupes = %v, %v", dupes, err)
+	}
+	note.Card.Front = "What is a goroutine?"
+	id, _, err := addCard(b, note, false)
+	if err != nil || id != 555 {
+		t.Fatalf("addCard(new) = %d, %v", id, err)
+	}
+	fields, _ := created["fields"].(map[string]any)
+	if created["deck"] != "Default" || created["tags"] != "ankigen go" || fields["Front"] != "What is a goroutine?" {
+		t.Errorf("created note = %v", created)
+	}
+
+	note.Deck = "Nope"
+	if _, _, err := addCard(b, note, false); err == nil || !strings.Contains(err.Error(), `deck "Nope" not found`) {
+		t.Errorf("unknown deck: error = %v", err)
+	}
+	note.NoteType = "Cloze"
+	if _, _, err := addCard(b, note, true); err == nil || !strings.Contains(err.Error(), "Cloze") {
+		t.Errorf("unknown note type: error = %v", err)
+	}
+	if _, err := newAnkiBackend("mnemosyne", ""); err == nil {
+		t.Error("newAnkiBackend(unknown): want error")
+	}
+}
+
+func TestUpdate_KeyPress_AddToAnki(t *testing.T) {
+	fake := &fakeBackend{dupes: []int64{42}}
+	ankiClient, ankiDeck = fake, "Lang::Go"
+	defer func() { ankiClient, ankiDeck = nil, "" }()
+
+	m := newTestModel()
+	m, cmd := sendKey(m, "a")
+	if !m.adding || cmd == nil {
+		t.Fatalf("after a: adding = %v, cmd = %v", m.adding, cmd)
+	}
+	m, _ = sendMsg(m, cmd())
+	if len(fake.added) != 0 || !slices.Equal(m.ankiDupes, []int64{42}) || !strings.Contains(m.warning, "42") {
+		t.Fatalf("duplicate: added %v, dupes %v, warning %q", fake.added, m.ankiDupes, m.warning)
+	}
+
+	// Adding anyway skips the check.
+	m, cmd = sendKey(m, "a")
+	m, _ = sendMsg(m, cmd())
+	if len(fake.added) != 1 || fake.added[0].Deck != "Lang::Go" || fake.added[0].Card.Front != "Q" {
+		t.Fatalf("added = %+v", fake.added)
+	}
+	if m.context.Card.NoteID != 1001 || m.context.CardHistory[0].NoteID != 1001 || m.warning != "" {
+		t.Errorf("after add: card %+v, history %+v, warning %q", m.context.Card, m.context.CardHistory, m.warning)
+	}
+	if events := m.context.History.Events; len(events) == 0 || events[len(events)-1].Type != "anki_add" {
+		t.Errorf("history events = %+v, want anki_add last", events)
+	}
+
+	if _, cmd := sendKey(m, "a"); cmd != nil {
+		t.Error("a on a card already in Anki: want no command")
+	}
+}
+
+func TestUpdate_AddToAnki_CardChanges(t *testing.T) {
+	fake := &fakeBackend{dupes: []int64{42}}
+	ankiClient = fake
+	defer func() { ankiClient = nil }()
+
+	m := newTestModel()
+	m.context.CardHistory = append(m.context.CardHistory, Card{Front: "Q2", Back: "A2"})
+	m, cmd := sendKey(m, "a")
+	for _, key := range []string{"l", "r", "i"} {
+		if m, _ = sendKey(m, key); m.context.HistoryIndex != 0 || !m.done || m.iterating {
+			t.Fatalf("%s while adding: history %d, done %v, iterating %v", key, m.context.HistoryIndex, m.done, m.iterating)
+		}
+	}
+
+	// A result for a card no longer selected is dropped, so a second a
+	// does not force-add the card now shown.
+	msg := cmd().(ankiAddedMsg)
+	m.adding = false
+	m, _ = sendKey(m, "l")
+	m, _ = sendMsg(m, msg)
+	if m.ankiDupes != nil || m.warning != "" {
+		t.Fatalf("stale result: dupes %v, warning %q", m.ankiDupes, m.warning)
+	}
+	m, cmd = sendKey(m, "a")
+	m, _ = sendMsg(m, cmd())
+	if len(fake.added) != 0 || !slices.Equal(m.ankiDupes, []int64{42}) {
+		t.Errorf("add after stale result: added %+v, dupes %v", fake.added, m.ankiDupes)
+	}
+}
+
+func TestRecordNoteID_CardReplaced(t *testing.T) {
+	ctx := newTestContext()
+	note := ankiTarget(ctx.Card)
+	ctx.Card = Card{Front: "Q'", Back: "A'"}
+	ctx.CardHistory[0] = ctx.Card
+
+	recordNoteID(ctx, 0, note, "fake", 7)
+	if ctx.Card.NoteID != 0 || ctx.CardHistory[0].NoteID != 0 {
+		t.Errorf("replaced card marked: card %d, history %d", ctx.Card.NoteID, ctx.CardHistory[0].NoteID)
+	}
+
+	recordNoteID(ctx, 0, ankiTarget(ctx.Card), "fake", 8)
+	if ctx.Card.NoteID != 8 || ctx.CardHistory[0].NoteID != 8 {
+		t.Errorf("current card: card %d, history %d, want 8", ctx.Card.NoteID, ctx.CardHistory[0].NoteID)
+	}
+}
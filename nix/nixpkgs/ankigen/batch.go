@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// keep-sorted start
+	batchFormat string
+	batchFresh  bool
+	batchJobs   int
+	batchOutput string
+	batchRPM    int
+	// keep-sorted end
+)
+
+// providerRPM is the default request rate limit per provider, in requests
+// a minute; 0 is unlimited.
+var providerRPM = map[string]int{
+	"claude":   50,
+	"chatgpt":  60,
+	"gemini":   60,
+	"local":    0,
+	"herakles": 0,
+}
+
+func newBatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "batch [provider] [file]",
+		Short: "Generate a card for each question in a file",
+		Long: `Generate a card for each question in a file (or stdin, or "-").
+
+Plain text files hold one question per line. Markdown outlines (.md, or any
+input with list items) take each leaf list item as a question, with the
+headings and parent items above it as its topic.
+
+Progress is kept as cards complete; rerunning the same input resumes where
+an interrupted run stopped. Failed questions are retried on the next run.
+
+Examples:
+  ankigen batch questions.txt -o cards.tsv
+  ankigen batch claude -j 8 notes.md -o cards.json
+  cat questions.txt | ankigen batch --format csv > cards.csv`,
+		Args: cobra.MaximumNArgs(2),
+		Run:  runBatch,
+	}
+	// keep-sorted start
+	cmd.Flags().BoolVar(&batchFresh, "fresh", false, "Ignore progress from an earlier run of the same input")
+	cmd.Flags().IntVar(&batchRPM, "rpm", 0, "Max LLM requests per minute, 0 for no limit (default: per provider)")
+	cmd.Flags().IntVarP(&batchJobs, "jobs", "j", 4, "Questions to generate concurrently")
+	cmd.Flags().StringVar(&batchFormat, "format", "", "Output format: json, csv or tsv (default: from --output extension, else json)")
+	cmd.Flags().StringVarP(&batchOutput, "output", "o", "", "Output file (default: stdout)")
+	// keep-sorted end
+	return cmd
+}
+
+// batchQuestion is one question from the input, with the headings and
+// parent list items it sits under in an outline.
+type batchQuestion struct {
+	Text  string
+	Topic []string
+}
+
+// prompt is the question as put to the pipeline, led by its topic.
+func (q batchQuestion) prompt() string {
+	if len(q.Topic) == 0 {
+		return q.Text
+	}
+	return strings.Join(q.Topic, " > ") + ": " + q.Text
+}
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	listItemRe = regexp.MustCompile(`^(\s*)(?:[-*+]|\d+[.)])\s+(.*)$`)
+)
+
+// isOutline reports whether input reads as a markdown outline rather than
+// one question per line.
+func isOutline(input string) bool {
+	for _, line := range strings.Split(input, "\n") {
+		if listItemRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseQuestions reads one question per non-blank line, or with outline,
+// each leaf list item of a markdown outline.
+func parseQuestions(input string, outline bool) []batchQuestion {
+	var questions []batchQuestion
+	if !outline {
+		for _, line := range strings.Split(input, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				questions = append(questions, batchQuestion{Text: line})
+			}
+		}
+		return questions
+	}
+
+	type level struct {
+		heading int // 1-6 for headings, 0 for list items
+		indent  int
+		text    string
+	}
+	var stack []level
+	// pending is the last list item, a question unless the next item
+	// nests under it.
+	var pending *level
+	topic := func() []string {
+		var t []string
+		for _, l := range stack {
+			t = append(t, l.text)
+		}
+		return t
+	}
+	flush := func() {
+		if pending != nil {
+			questions = append(questions, batchQuestion{Text: pending.text, Topic: topic()})
+			pending = nil
+		}
+	}
+
+	for _, line := range strings.Split(input, "\n") {
+		if m := headingRe.FindStringSubmatch(line); m != nil {
+			flush()
+			depth := len(m[1])
+			for len(stack) > 0 && (stack[len(stack)-1].heading == 0 || stack[len(stack)-1].heading >= depth) {
+				stack = stack[:len(stack)-1]
+			}
+			stack = append(stack, level{heading: depth, text: strings.TrimSpace(m[2])})
+			continue
+		}
+		m := listItemRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent := len(strings.ReplaceAll(m[1], "\t", "    "))
+		if pending != nil && indent > pending.indent {
+			stack = append(stack, *pending)
+			pending = nil
+		}
+		flush()
+		for len(stack) > 0 && stack[len(stack)-1].heading == 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		pending = &level{indent: indent, text: strings.TrimSpace(m[2])}
+	}
+	flush()
+	return questions
+}
+
+// rateLimiter spaces calls evenly to at most a number a minute. A nil
+// limiter does not limit.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Wait blocks until the caller may make its call.
+func (l *rateLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// llmLimiter, when set, paces every LLM request.
+var llmLimiter *rateLimiter
+
+// batchResult is the outcome for one question, as written to the progress
+// journal and the JSON output.
+type batchResult struct {
+	Question  string `json:"question"`
+	Card      Card   `json:"card"`
+	HistoryID string `json:"historyId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchRunner generates cards for questions concurrently, appending each
+// success to a journal so an interrupted run can resume.
+type batchRunner struct {
+	jobs     int
+	journal  string
+	progress io.Writer
+	generate func(ctx context.Context, q batchQuestion, n int) batchResult
+}
+
+// loadJournal returns the results of an earlier run, by question prompt.
+func loadJournal(path string) map[string]batchResult {
+	done := map[string]batchResult{}
+	f, err := os.Open(path)
+	if err != nil {
+		return done
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var r batchResult
+		// A line cut short by an interrupt is skipped, and its question
+		// generated again.
+		if json.Unmarshal(scanner.Bytes(), &r) == nil && r.Error == "" {
+			done[r.Question] = r
+		}
+	}
+	return done
+}
+
+// run returns a result for each question in order. If ctx is cancelled it
+// stops starting questions, waits for those in flight to give up, and
+// returns ctx's error, leaving finished ones in the journal.
+func (b *batchRunner) run(ctx context.Context, questions []batchQuestion) ([]batchResult, error) {
+	results := make([]batchResult, len(questions))
+	done := loadJournal(b.journal)
+	var todo []int
+	for i, q := range questions {
+		if r, ok := done[q.prompt()]; ok {
+			results[i] = r
+		} else {
+			todo = append(todo, i)
+		}
+	}
+	if skipped := len(questions) - len(todo); skipped > 0 {
+		fmt.Fprintf(b.progress, "Resuming: %d/%d already generated\n", skipped, len(questions))
+	}
+	if len(todo) == 0 {
+		return results, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.journal), 0o755); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(b.journal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = journal.Close() }()
+
+	var (
+		mu       sync.Mutex
+		finished = len(questions) - len(todo)
+		wg       sync.WaitGroup
+		queue    = make(chan int)
+	)
+	for range max(b.jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				start := time.Now()
+				r := b.generate(ctx, questions[i], i+1)
+				if ctx.Err() != nil {
+					// Interrupted part way; the next run generates it again.
+					continue
+				}
+				r.Question = questions[i].prompt()
+				results[i] = r
+
+				mu.Lock()
+				finished++
+				if r.Error == "" {
+					line, _ := json.Marshal(r)
+					_, _ = journal.Write(append(line, '\n'))
+					fmt.Fprintf(b.progress, "[%d/%d] ✓ %s (%.1fs)\n", finished, len(questions), r.Question, time.Since(start).Seconds())
+				} else {
+					fmt.Fprintf(b.progress, "[%d/%d] ✗ %s: %s\n", finished, len(questions), r.Question, r.Error)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, i := range todo {
+		if ctx.Err() == nil {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+			}
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// generateBatchCard runs the pipeline for one question the way --raw does,
+// saving it to history. n numbers the record, since a batch starts many
+// in the same second. Cancelling run stops the request in flight and the
+// stages after it.
+func generateBatchCard(run context.Context, q batchQuestion, n int) batchResult {
+	ctx := &PipelineContext{Question: q.prompt(), run: run}
+	ctx.History = newHistoryRecord(ctx.Question, provider)
+	ctx.History.ID += fmt.Sprintf("-%03d", n)
+	result := batchResult{HistoryID: ctx.History.ID}
+
+	ctx.Error = func() error {
+		if webMode {
+			for stage := Stage(searchTermsStage{}); stage != nil; stage = stage.Next() {
+				if _, ok := stage.(generateStage); ok {
+					break
+				}
+				if err := run.Err(); err != nil {
+					return err
+				}
+				if err := stage.Execute(ctx); err != nil {
+					return err
+				}
+				if err := stage.Validate(ctx); err != nil {
+					return err
+				}
+				recordStageEvent(ctx, stage)
+			}
+		}
+		card, err := generateCard(run, ctx.Question, ctx.Summary, nil)
+		if err != nil {
+			return err
+		}
+		if card.Error != "" {
+			return errors.New(card.Error)
+		}
+		ctx.Card = card
+		ctx.CardHistory = append(ctx.CardHistory, card)
+		return nil
+	}()
+	saveHistoryFunc(ctx)
+
+	result.Card = ctx.Card
+	if ctx.Error != nil {
+		result.Error = ctx.Error.Error()
+	}
+	return result
+}
+
+// batchJournalPath is where progress on an input is kept, keyed by the
+// input's content and the provider.
+func batchJournalPath(input string) string {
+	home, _ := os.UserHomeDir()
+	sum := sha256.Sum256([]byte(provider + "\x00" + input))
+	return filepath.Join(home, ".ankigen", "batch", hex.EncodeToString(sum[:8])+".jsonl")
+}
+
+// writeBatch writes the cards in format: a JSON array of every result, or
+// for csv and tsv, an Anki import file of the cards that succeeded with
+// front, back and tags columns.
+func writeBatch(w io.Writer, format string, results []batchResult) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv", "tsv":
+		separator, comma := "Comma", ','
+		if format == "tsv" {
+			separator, comma = "Tab", '\t'
+		}
+		fmt.Fprintf(w, "#separator:%s\n#html:true\n#tags column:3\n", separator)
+		cw := csv.NewWriter(w)
+		cw.Comma = comma
+		for _, r := range results {
+			if r.Error != "" {
+				continue
+			}
+			_ = cw.Write([]string{r.Card.Front, r.Card.Back, strings.Join(ankiTags, " ")})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q (want json, csv or tsv)", format)
+}
+
+func runBatch(cmd *cobra.Command, args []string) {
+	args = resolveProvider(args)
+
+	var (
+		data []byte
+		err  error
+		name string
+	)
+	if len(args) == 0 || args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		name = args[0]
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	input := string(data)
+	ext := strings.ToLower(filepath.Ext(name))
+	questions := parseQuestions(input, ext == ".md" || ext == ".markdown" || isOutline(input))
+	if len(questions) == 0 {
+		fmt.Fprintf(os.Stderr, "No questions found\n")
+		os.Exit(1)
+	}
+
+	format := batchFormat
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(batchOutput)), ".")
+		if format != "csv" && format != "tsv" {
+			format = "json"
+		}
+	}
+	if err := writeBatch(io.Discard, format, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Detect local models and load keys once, before the workers race to.
+	switch provider {
+	case "local":
+		err = detectLocalModel()
+	case "herakles":
+		err = detectHeraklesLLMServerModel()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if webMode && !useExa {
+		_ = detectHeraklesLLMServerModel()
+	}
+	if webMode && useExa && exaAPIKey == "" {
+		exaAPIKey, _ = getAPIKey("EXA_API_KEY")
+	}
+
+	rpm := batchRPM
+	if !cmd.Flags().Changed("rpm") {
+		rpm = providerRPM[provider]
+	}
+	llmLimiter = newRateLimiter(rpm)
+
+	journal := batchJournalPath(input)
+	if batchFresh {
+		_ = os.Remove(journal)
+	}
+	label, modelName := resolveModel(provider, !deepThink)
+	fmt.Fprintf(os.Stderr, "Generating %d cards with %s (%s), %d at a time\n", len(questions), label, modelName, batchJobs)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	runner := &batchRunner{jobs: batchJobs, journal: journal, progress: os.Stderr, generate: generateBatchCard}
+	results, err := runner.run(ctx, questions)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Interrupted; rerun the same command to resume\n")
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if batchOutput != "" {
+		if out, err = os.Create(batchOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer func() { _ = out.Close() }()
+	}
+	if err := writeBatch(out, format, results); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var failed int
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d/%d questions failed; rerun the same command to retry them\n", failed, len(results))
+		os.Exit(1)
+	}
+	_ = os.Remove(journal)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseQuestions(t *testing.T) {
+	plain := "What is Go?\n\n  What is a goroutine?  \n"
+	if got := parseQuestions(plain, isOutline(plain)); !reflect.DeepEqual(got, []batchQuestion{{Text: "What is Go?"}, {Text: "What is a goroutine?"}}) {
+		t.Errorf("plain = %+v", got)
+	}
+
+	outline := `# Go
+Some prose that is not a question.
+
+## Concurrency
+- What is a channel?
+- Goroutines
+  - How are they scheduled?
+  * How big is their stack?
+1. What does select do?
+
+# Rust
+- What is a borrow?
+`
+	if !isOutline(outline) {
+		t.Fatal("isOutline() = false")
+	}
+	want := []string{
+		"Go > Concurrency: What is a channel?",
+		"Go > Concurrency > Goroutines: How are they scheduled?",
+		"Go > Concurrency > Goroutines: How big is their stack?",
+		"Go > Concurrency: What does select do?",
+		"Rust: What is a borrow?",
+	}
+	var got []string
+	for _, q := range parseQuestions(outline, true) {
+		got = append(got, q.prompt())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outline prompts:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestBatchRunner_Resumes(t *testing.T) {
+	questions := parseQuestions("q1\nq2\nfails\nq4", false)
+	var calls atomic.Int32
+	failing := true
+	runner := &batchRunner{
+		jobs:     2,
+		journal:  filepath.Join(t.TempDir(), "batch", "progress.jsonl"),
+		progress: io.Discard,
+		generate: func(ctx context.Context, q batchQuestion, n int) batchResult {
+			calls.Add(1)
+			if q.Text == "fails" && failing {
+				return batchResult{Error: "provider down"}
+			}
+			return batchResult{Card: Card{Front: q.Text, Back: strings.ToUpper(q.Text)}}
+		},
+	}
+
+	results, err := runner.run(context.Background(), questions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[1].Card.Back != "Q2" || results[1].Question != "q2" || results[2].Error == "" {
+		t.Fatalf("results = %+v", results)
+	}
+
+	// The second run generates only the question that failed.
+	failing = false
+	calls.Store(0)
+	results, err = runner.run(context.Background(), questions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 || results[2].Error != "" || results[2].Card.Front != "fails" || results[3].Card.Front != "q4" {
+		t.Errorf("resumed: %d calls, results = %+v", calls.Load(), results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runner.journal = filepath.Join(t.TempDir(), "fresh.jsonl")
+	if _, err := runner.run(ctx, questions); err != context.Canceled {
+		t.Errorf("cancelled run: error = %v", err)
+	}
+
+	// Cancelling part way stops the questions in flight, and run returns
+	// only once they have.
+	ctx, cancel = context.WithCancel(context.Background())
+	var started, stopped atomic.Int32
+	runner.journal = filepath.Join(t.TempDir(), "cancel.jsonl")
+	runner.generate = func(ctx context.Context, q batchQuestion, n int) batchResult {
+		if started.Add(1) == 2 {
+			cancel()
+		}
+		<-ctx.Done()
+		stopped.Add(1)
+		return batchResult{Error: ctx.Err().Error()}
+	}
+	if _, err := runner.run(ctx, questions); err != context.Canceled {
+		t.Errorf("interrupted run: error = %v", err)
+	}
+	if started.Load() != 2 || stopped.Load() != started.Load() {
+		t.Errorf("interrupted run returned with %d of %d questions still running", started.Load()-stopped.Load(), started.Load())
+	}
+	if done := loadJournal(runner.journal); len(done) != 0 {
+		t.Errorf("journal = %+v, want no interrupted questions", done)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	ankiTags = []string{"ankigen", "go"}
+	defer func() { ankiTags = nil }()
+	results := []batchResult{
+		{Question: "q1", Card: Card{Front: "What is a <b>chan</b>?", Back: "A pipe,\ttyped"}},
+		{Question: "q2", Error: "failed"},
+	}
+
+	var tsv strings.Builder
+	if err := writeBatch(&tsv, "tsv", results); err != nil {
+		t.Fatal(err)
+	}
+	want := "#separator:Tab\n#html:true\n#tags column:3\nWhat is a <b>chan</b>?\t\"A pipe,\ttyped\"\tankigen go\n"
+	if tsv.String() != want {
+		t.Errorf("tsv:\n got %q\nwant %q", tsv.String(), want)
+	}
+
+	var js strings.Builder
+	if err := writeBatch(&js, "json", results); err != nil || !strings.Contains(js.String(), `"error": "failed"`) {
+		t.Errorf("json = %s, %v", js.String(), err)
+	}
+	if err := writeBatch(io.Discard, "xml", results); err == nil {
+		t.Error("unknown format: want error")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Card kinds in a multi-card set; the zero value is a basic card.
+const (
+	kindBasic   = "basic"
+	kindReverse = "reverse"
+	kindCloze   = "cloze"
+)
+
+// multiCardPrompt asks the agent for a set of cards rather than one.
+const multiCardPrompt = `Generate a small set of cards (2-6) covering the question rather than a single card, without overlap between them:
+- "basic" cards, one per sub-concept worth learning on its own;
+- "reverse" cards where recalling the front from the back is as useful as the other way round;
+- "cloze" cards for facts best learned in context. A cloze card's front is the full text with deletions marked {{c1::like this}}; its back holds any extra notes and may be empty.`
+
+// cardSetTool replaces the generate tool in multi-card mode.
+var cardSetTool = Tool{Name: "generate", Description: "Return the finished set of flashcards.", Parameters: map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"cards": map[string]any{
+			"type": "array",
+			"items": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"front": map[string]string{"type": "string"},
+					"back":  map[string]string{"type": "string"},
+					"kind":  map[string]any{"type": "string", "enum": []string{kindBasic, kindReverse, kindCloze}},
+				},
+				"required": []string{"front", "back", "kind"},
+			},
+		},
+	},
+	"required": []string{"cards"},
+}}
+
+// agentToolsFor is the agent's tools, generating a set in multi-card mode.
+func agentToolsFor(ctx *PipelineContext) []Tool {
+	if !ctx.Multi {
+		return agentTools
+	}
+	tools := slices.Clone(agentTools)
+	tools[0] = cardSetTool
+	return tools
+}
+
+// cardComplete reports whether a card has both sides; a cloze card's back
+// is optional.
+func cardComplete(c Card) bool {
+	if strings.TrimSpace(c.Front) == "" {
+		return false
+	}
+	return c.Kind == kindCloze || strings.TrimSpace(c.Back) != ""
+}
+
+// noteTypeFor is the Anki note type for a card of the given kind.
+func noteTypeFor(kind string) string {
+	switch kind {
+	case kindCloze:
+		return "Cloze"
+	case kindReverse:
+		return "Basic (and reversed card)"
+	}
+	return ankiNoteType
+}
+
+// placeCards puts generated cards in the set: in place of the selected
+// card when iterating on it, else as a new set.
+func (ctx *PipelineContext) placeCards(cards []Card) {
+	if ctx.IterateCurrentCard != nil && ctx.CardIndex < len(ctx.Cards) {
+		ctx.Cards = slices.Replace(ctx.Cards, ctx.CardIndex, ctx.CardIndex+1, cards...)
+	} else {
+		ctx.Cards, ctx.CardIndex = cards, 0
+	}
+	ctx.Card = ctx.Cards[ctx.CardIndex]
+}
+
+// selectedIndex is the selected card's index: in the set, or in the card
+// history when there is no set.
+func (ctx *PipelineContext) selectedIndex() int {
+	if ctx.Cards != nil {
+		return ctx.CardIndex
+	}
+	return ctx.HistoryIndex
+}
+
+func (ctx *PipelineContext) selectCard(i int) bool {
+	if i < 0 || i >= len(ctx.Cards) {
+		return false
+	}
+	ctx.CardIndex = i
+	ctx.Card = ctx.Cards[i]
+	return true
+}
+
+// moveCard swaps the selected card with its neighbour, keeping it
+// selected.
+func (ctx *PipelineContext) moveCard(delta int) bool {
+	to := ctx.CardIndex + delta
+	if to < 0 || to >= len(ctx.Cards) {
+		return false
+	}
+	ctx.Cards[ctx.CardIndex], ctx.Cards[to] = ctx.Cards[to], ctx.Cards[ctx.CardIndex]
+	ctx.CardIndex = to
+	return true
+}
+
+// discardCard removes the selected card from the set, selecting the next
+// one. The last card is kept.
+func (ctx *PipelineContext) discardCard() bool {
+	if len(ctx.Cards) < 2 {
+		return false
+	}
+	ctx.Cards = slices.Delete(ctx.Cards, ctx.CardIndex, ctx.CardIndex+1)
+	ctx.selectCard(min(ctx.CardIndex, len(ctx.Cards)-1))
+	return true
+}
+
+// editCard replaces the selected card with the user's edit, as a new
+// version in the card history.
+func (ctx *PipelineContext) editCard(card Card) {
+	ctx.Card = card
+	if ctx.Cards != nil {
+		ctx.Cards[ctx.CardIndex] = card
+	}
+	ctx.CardHistory = append(ctx.CardHistory, card)
+	ctx.HistoryIndex = len(ctx.CardHistory) - 1
+}
+
+// generateCards makes a set of cards in one request, for --raw --multi.
+func generateCards(question, summary string, additional []string) ([]Card, error) {
+	systemPrompt := systemPromptContent + `
+
+` + multiCardPrompt + `
+
+Return your final response as a RAW JSON array, with no markdown or code fences:
+[{"front": "...", "back": "...", "kind": "basic"}, ...]`
+
+	userPrompt := fmt.Sprintf("Question: %s", question)
+	if summary != "" {
+		userPrompt += fmt.Sprintf("\n\nContext from web research:\n%s", summary)
+	}
+	if ac := formatAdditionalContext(additional); ac != "" {
+		userPrompt += fmt.Sprintf("\n\nAdditional context from user:\n%s", ac)
+	}
+
+	response, err := callLLMWithSystem(systemPrompt, userPrompt, !deepThink)
+	if err != nil {
+		return nil, err
+	}
+	cards, err := extractJSONArray[Card](response)
+	if err != nil {
+		return nil, err
+	}
+	cards = slices.DeleteFunc(cards, func(c Card) bool { return !cardComplete(c) })
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("no complete cards in response")
+	}
+	return cards, nil
+}
+
+// --- Card editor ---
+
+func (m model) startEdit() (model, tea.Cmd) {
+	m.editing = true
+	m.editField = 0
+	m.editFront = newTextarea("Front", 70, 5, 0)
+	m.editFront.SetValue(m.context.Card.Front)
+	m.editFront.Focus()
+	m.editBack = newTextarea("Back", 70, 5, 0)
+	m.editBack.SetValue(m.context.Card.Back)
+	return m, textarea.Blink
+}
+
+func (m model) updateEdit(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if key, ok := msg.(tea.KeyMsg); ok {
+		switch key.String() {
+		case "esc":
+			m.editing = false
+			return m, nil
+		case "tab", "shift+tab":
+			m.editField = 1 - m.editField
+			if m.editField == 0 {
+				m.editBack.Blur()
+				m.editFront.Focus()
+			} else {
+				m.editFront.Blur()
+				m.editBack.Focus()
+			}
+			return m, textarea.Blink
+		case "ctrl+d":
+			card := Card{
+				Front: strings.TrimSpace(m.editFront.Value()),
+				Back:  strings.TrimSpace(m.editBack.Value()),
+				Kind:  m.context.Card.Kind,
+				// Still the card added to Anki, though the note there
+				// keeps the old text.
+				NoteID: m.context.Card.NoteID,
+			}
+			if !cardComplete(card) {
+				return m, nil
+			}
+			m.editing = false
+			if card.Front == m.context.Card.Front && card.Back == m.context.Card.Back {
+				return m, nil
+			}
+			m.context.editCard(card)
+			m.context.History.AddEvent("card_edited", map[string]any{"card": card})
+			saveHistoryFunc(m.context)
+			m.warning = ""
+			if card.NoteID != 0 {
+				m.warning = fmt.Sprintf("Edit not synced: Anki note %d keeps the old text", card.NoteID)
+			}
+			m.ankiDupes = nil
+			m.copied = true
+			m.substage = "edited card"
+			return m, nil
+		}
+	}
+	var cmd tea.Cmd
+	if m.editField == 0 {
+		m.editFront, cmd = m.editFront.Update(msg)
+	} else {
+		m.editBack, cmd = m.editBack.Update(msg)
+	}
+	return m, cmd
+}
+
+func (m model) editView() string {
+	var b strings.Builder
+	b.WriteString("\n")
+	b.WriteString(titleStyle.Render("Edit card"))
+	b.WriteString("\n\n")
+	b.WriteString(labelStyle.Render("FRONT"))
+	b.WriteString("\n")
+	b.WriteString(m.editFront.View())
+	b.WriteString("\n\n")
+	b.WriteString(labelStyle.Render("BACK"))
+	b.WriteString("\n")
+	b.WriteString(m.editBack.View())
+	b.WriteString("\n\n")
+	b.WriteString(dimStyle.Render("Tab to switch side, Ctrl+D to save, Esc to cancel"))
+	b.WriteString("\n")
+	return b.String()
+}
+
+// updateSet handles the keys for reviewing a set: selecting, moving and
+// discarding cards.
+func (m model) updateSet(key string) model {
+	ctx := m.context
+	if ctx.Cards == nil || m.adding {
+		return m
+	}
+	var changed bool
+	switch key {
+	case "h":
+		ctx.selectCard(ctx.CardIndex - 1)
+	case "l":
+		ctx.selectCard(ctx.CardIndex + 1)
+	case "H", "L":
+		delta := -1
+		if key == "L" {
+			delta = 1
+		}
+		if changed = ctx.moveCard(delta); changed {
+			m.substage = fmt.Sprintf("moved card to %d", ctx.CardIndex+1)
+		}
+	case "x":
+		discarded := ctx.Card
+		if changed = ctx.discardCard(); changed {
+			ctx.History.AddEvent("card_discarded", map[string]any{"card": discarded})
+			m.substage = fmt.Sprintf("discarded card, %d left", len(ctx.Cards))
+		}
+	}
+	m.warning = ""
+	m.ankiDupes = nil
+	m.copied = changed
+	if changed {
+		saveHistoryFunc(ctx)
+	}
+	return m
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAgentTurn_GeneratesSet(t *testing.T) {
+	var tools []json.RawMessage
+	reply := `{"cards": [
+		{"front": "What is a channel?", "back": "A typed conduit", "kind": "basic"},
+		{"front": "A {{c1::channel}} connects goroutines.", "back": "", "kind": "cloze"},
+		{"front": "Unbuffered channel", "back": "Blocks until both sides are ready", "kind": "reverse"}
+	]}`
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Tools []json.RawMessage }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		tools = req.Tools
+		toolReply(w, "generate", reply)
+	})
+	savedTries := maxTries
+	maxTries = 3
+	defer func() { maxTries = savedTries }()
+
+	ctx := &PipelineContext{Question: "What is a channel?", Multi: true}
+	msg := runAgentTurn(ctx)().(agentTurnMsg)
+	if msg.action != "generate" || len(ctx.Cards) != 3 || ctx.Card != ctx.Cards[0] {
+		t.Fatalf("action %s, cards = %+v", msg.action, ctx.Cards)
+	}
+	if len(tools) == 0 || !strings.Contains(string(tools[0]), `"cards"`) {
+		t.Errorf("generate tool = %s, want the card set schema", tools[0])
+	}
+
+	// Iterating on a card can split it in place.
+	reply = `{"cards": [{"front": "Cloze A", "back": "", "kind": "cloze"}, {"front": "Cloze B", "back": "", "kind": "cloze"}]}`
+	ctx.selectCard(1)
+	ctx.IterateInstructions = "split it"
+	ctx.IterateCurrentCard = &Card{Front: ctx.Card.Front, Kind: ctx.Card.Kind}
+	runAgentTurn(ctx)()
+	if got := setFronts(ctx); got != "What is a channel?|Cloze A|Cloze B|Unbuffered channel" || ctx.Card.Front != "Cloze A" {
+		t.Errorf("after split: cards %s, selected %q", got, ctx.Card.Front)
+	}
+}
+
+func newSetModel() model {
+	m := newTestModel()
+	m.context.Multi = true
+	m.context.placeCards([]Card{
+		{Front: "one", Back: "1", Kind: kindBasic},
+		{Front: "two {{c1::2}}", Kind: kindCloze},
+		{Front: "three", Back: "3", Kind: kindReverse},
+	})
+	return m
+}
+
+func setFronts(ctx *PipelineContext) string {
+	var fronts []string
+	for _, c := range ctx.Cards {
+		fronts = append(fronts, c.Front)
+	}
+	return strings.Join(fronts, "|")
+}
+
+func TestUpdate_ReviewSet(t *testing.T) {
+	m := newSetModel()
+
+	m, _ = sendKey(m, "l")
+	if m.context.CardIndex != 1 || !strings.Contains(m.View(), "CARD 2/3") {
+		t.Fatalf("after l: index %d\n%s", m.context.CardIndex, m.View())
+	}
+	m, _ = sendKey(m, "L")
+	if setFronts(m.context) != "one|three|two {{c1::2}}" || m.context.CardIndex != 2 || m.context.Card.Kind != kindCloze {
+		t.Errorf("after L: %s, index %d", setFronts(m.context), m.context.CardIndex)
+	}
+	m, _ = sendKey(m, "h")
+	m, _ = sendKey(m, "x")
+	if setFronts(m.context) != "one|two {{c1::2}}" || m.context.Card.Front != "two {{c1::2}}" {
+		t.Errorf("after x: %s, selected %q", setFronts(m.context), m.context.Card.Front)
+	}
+	m, _ = sendKey(m, "x")
+	if m, _ = sendKey(m, "x"); len(m.context.Cards) != 1 {
+		t.Errorf("discarding the last card: %d cards left", len(m.context.Cards))
+	}
+
+	m, _ = sendKey(m, "e")
+	if !m.editing {
+		t.Fatal("after e: editing = false")
+	}
+	m.editFront.SetValue("edited")
+	m, _ = sendKey(m, "ctrl+d")
+	last := m.context.CardHistory[len(m.context.CardHistory)-1]
+	if m.editing || m.context.Cards[0].Front != "edited" || m.context.Card.Kind != kindBasic || last.Front != "edited" {
+		t.Errorf("after edit: set %+v, history %+v", m.context.Cards, m.context.CardHistory)
+	}
+}
+
+func TestUpdate_AddSetCardToAnki(t *testing.T) {
+	fake := &fakeBackend{}
+	ankiClient = fake
+	defer func() { ankiClient = nil }()
+
+	m := newSetModel()
+	m, _ = sendKey(m, "l")
+	m, cmd := sendKey(m, "a")
+	m, _ = sendMsg(m, cmd())
+	if len(fake.added) != 1 || fake.added[0].NoteType != "Cloze" {
+		t.Fatalf("added = %+v, want one Cloze note", fake.added)
+	}
+	if m.context.Cards[1].NoteID != 1001 || m.context.Card.NoteID != 1001 || m.context.Cards[0].NoteID != 0 {
+		t.Errorf("note IDs: set %+v, selected %d", m.context.Cards, m.context.Card.NoteID)
+	}
+
+	// An edit keeps the card marked as added, with a warning that Anki's
+	// copy is unchanged.
+	m, _ = sendKey(m, "e")
+	m.editFront.SetValue("edited")
+	m, _ = sendKey(m, "ctrl+d")
+	if m.context.Card.NoteID != 1001 || m.context.Cards[1].NoteID != 1001 || !strings.Contains(m.warning, "note 1001") {
+		t.Errorf("after edit: note %d, warning %q", m.context.Card.NoteID, m.warning)
+	}
+
+	m.context.History.SetResult(m.context)
+	restored := historyToContext(m.context.History)
+	if !restored.Multi || setFronts(restored) != setFronts(m.context) || restored.Card.Front != "one" {
+		t.Errorf("restored set = %s, selected %q", setFronts(restored), restored.Card.Front)
+	}
+}
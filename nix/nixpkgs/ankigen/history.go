@@ -42,6 +42,7 @@ type HistoryEvent struct {
 
 type HistoryResult struct {
 	Cards         []Card `json:"cards"`
+	Set           []Card `json:"set,omitempty"` // multi-card mode's reviewed set
 	Refused       bool   `json:"refused,omitempty"`
 	RefusalReason string `json:"refusalReason,omitempty"`
 	Error         string `json:"error,omitempty"`
@@ -91,6 +92,7 @@ func (h *HistoryRecord) SetResult(ctx *PipelineContext) {
 	}
 	h.Result = HistoryResult{
 		Cards:         ctx.CardHistory,
+		Set:           ctx.Cards,
 		Refused:       ctx.Refused,
 		RefusalReason: ctx.RefusalReason,
 	}
@@ -165,6 +167,11 @@ func historyToContext(record *HistoryRecord) *PipelineContext {
 		ctx.HistoryIndex = len(ctx.CardHistory) - 1
 		ctx.Card = ctx.CardHistory[ctx.HistoryIndex]
 	}
+	if len(record.Result.Set) > 0 {
+		ctx.Multi = true
+		ctx.Cards = record.Result.Set
+		ctx.Card = ctx.Cards[0]
+	}
 
 	for _, ev := range record.Events {
 		switch ev.Type {
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provider failures, by whether retrying can help. Errors from Complete
+// wrap one of these.
+var (
+	ErrLLMAuth        = errors.New("authentication failed")
+	ErrLLMRejected    = errors.New("request rejected")
+	ErrLLMRateLimited = errors.New("rate limited")
+	ErrLLMUnavailable = errors.New("provider unavailable")
+	ErrLLMEmpty       = errors.New("no content in response")
+)
+
+const maxLLMAttempts = 3
+
+// llmBackoff is the wait before the first retry; it doubles after each.
+var llmBackoff = 2 * time.Second
+
+// LLMRequest is one prompt to a model.
+type LLMRequest struct {
+	System    string
+	Prompt    string
+	Fast      bool
+	MaxTokens int
+	// OnDelta, if set, streams the response, receiving each piece of text
+	// or tool arguments as it arrives.
+	OnDelta func(string)
+}
+
+// LLMProvider is a model API ankigen can generate with.
+type LLMProvider interface {
+	Label() string
+	// Model is the model a request goes to, or "(autodetect)" for a local
+	// server not yet asked.
+	Model(fast bool) string
+	Complete(ctx context.Context, req LLMRequest) (string, error)
+}
+
+// Tool is a function a model may call, with a JSON Schema for its
+// arguments.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+}
+
+// ToolCall is the tool a model chose and the arguments it gave, as a JSON
+// object.
+type ToolCall struct {
+	Name      string
+	Arguments json.RawMessage
+}
+
+// ToolCaller is a provider with native tool calling. The model is required
+// to call one of the tools, but a reply in text instead is returned as is.
+type ToolCaller interface {
+	CompleteTools(ctx context.Context, req LLMRequest, tools []Tool) (*ToolCall, string, error)
+}
+
+// completeText and completeTools adapt a provider's send, which may return
+// text or a tool call, to Complete and CompleteTools.
+func completeText(text string, _ *ToolCall, err error) (string, error) {
+	if err == nil && text == "" {
+		err = ErrLLMEmpty
+	}
+	return text, err
+}
+
+func completeTools(text string, call *ToolCall, err error) (*ToolCall, string, error) {
+	if err == nil && call == nil && text == "" {
+		err = ErrLLMEmpty
+	}
+	return call, text, err
+}
+
+// toolArguments unwraps arguments that arrive as a JSON string holding the
+// object, as OpenAI sends them, rather than the object itself.
+func toolArguments(raw json.RawMessage) json.RawMessage {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return json.RawMessage(s)
+	}
+	return raw
+}
+
+// providerInfo registers a provider under its command-line names.
+type providerInfo struct {
+	Name  string
+	Alias string
+	// Picker is the model picker's entries for the provider: its default
+	// then its fast model, or one entry if it has no fast model.
+	Picker   []string
+	Provider LLMProvider
+}
+
+// registry lists the providers in the order the model picker shows them.
+var registry = []*providerInfo{
+	{Name: "claude", Alias: "c", Picker: []string{"Claude (opus)", "Claude (haiku, fast)"}, Provider: &anthropicProvider{
+		url: "https://api.anthropic.com/v1/messages", keyEnv: "ANTHROPIC_API_KEY",
+		models: modelTable{deep: claudeOpus, fast: claudeHaiku},
+	}},
+	{Name: "chatgpt", Picker: []string{"ChatGPT (gpt-4.1)", "ChatGPT (o4-mini, fast)"}, Provider: &openAIProvider{
+		url: "https://api.openai.com/v1/responses", keyEnv: "OPENAI_API_KEY",
+		models: modelTable{deep: gpt4, fast: gptMini},
+	}},
+	{Name: "gemini", Alias: "g", Picker: []string{"Gemini (2.5 Pro)", "Gemini (2.5 Flash, fast)"}, Provider: &geminiProvider{
+		url: "https://generativelanguage.googleapis.com/v1beta/models", keyEnv: "GEMINI_API_KEY",
+		models: modelTable{deep: geminiPro, fast: geminiFlash},
+	}},
+	{Name: "local", Alias: "l", Picker: []string{"Local (Ollama)"}, Provider: &chatCompletionsProvider{
+		label: "Local", model: &localModel, noThink: true, timeout: 300 * time.Second,
+		detect: func() (string, error) { return ollamaURL + "/v1", detectLocalModel() },
+	}},
+	{Name: "herakles", Picker: []string{"Herakles (vLLM)"}, Provider: &chatCompletionsProvider{
+		label: "Herakles", model: &remoteModel, noThink: true, timeout: 300 * time.Second,
+		detect: func() (string, error) {
+			// Detection picks remoteURL, so it is read only afterwards.
+			if err := detectHeraklesLLMServerModel(); err != nil {
+				return "", err
+			}
+			return remoteURL, nil
+		},
+	}},
+}
+
+// currentProvider is the selected provider, or local if none is.
+func currentProvider() LLMProvider {
+	if p := lookupProvider(provider); p != nil {
+		return p.Provider
+	}
+	return lookupProvider("local").Provider
+}
+
+// lookupProvider finds a registered provider by name or alias.
+func lookupProvider(name string) *providerInfo {
+	for _, p := range registry {
+		if name == p.Name || (p.Alias != "" && name == p.Alias) {
+			return p
+		}
+	}
+	return nil
+}
+
+// modelTable is a provider's default and fast model.
+type modelTable struct {
+	deep, fast string
+}
+
+func (t modelTable) pick(fast bool) string {
+	if fast {
+		return t.fast
+	}
+	return t.deep
+}
+
+// llmError is a failed provider request.
+type llmError struct {
+	provider string
+	class    error
+	detail   string
+}
+
+func (e *llmError) Error() string {
+	return fmt.Sprintf("%s API error (%v): %s", e.provider, e.class, e.detail)
+}
+
+func (e *llmError) Unwrap() error { return e.class }
+
+// classifyStatus sorts an error response by whether retrying can help.
+// Some servers answer an overloaded moment with a 4xx asking to try again.
+func classifyStatus(status int, body []byte) error {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrLLMAuth
+	case status == http.StatusTooManyRequests:
+		return ErrLLMRateLimited
+	case status >= 500, strings.Contains(strings.ToLower(string(body)), "try again"):
+		return ErrLLMUnavailable
+	}
+	return ErrLLMRejected
+}
+
+// retryAfter reads a Retry-After header in seconds, or returns 0.
+func retryAfter(h http.Header) time.Duration {
+	secs, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return min(time.Duration(secs)*time.Second, time.Minute)
+}
+
+// postJSON posts payload to url and decodes the response into out,
+// retrying with exponential backoff while the provider is rate limiting or
+// unavailable.
+func postJSON(ctx context.Context, name, url string, header http.Header, timeout time.Duration, payload, out any) error {
+	return post(ctx, name, url, header, timeout, payload, func(body io.Reader) error {
+		respBody, err := io.ReadAll(body)
+		if err != nil {
+			return &llmError{name, ErrLLMUnavailable, err.Error()}
+		}
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("%s: decoding response: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// postSSE posts payload to url and passes the data of each server-sent
+// event to onEvent. Only the request is retried: once events have been
+// passed on, a failure is returned as is.
+func postSSE(ctx context.Context, name, url string, header http.Header, timeout time.Duration, payload any, onEvent func(data []byte) error) error {
+	return post(ctx, name, url, header, timeout, payload, func(body io.Reader) error {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data:")
+			data = strings.TrimSpace(data)
+			if !ok || data == "" || data == "[DONE]" {
+				continue
+			}
+			if err := onEvent([]byte(data)); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &llmError{name, ErrLLMUnavailable, err.Error()}
+		}
+		return nil
+	})
+}
+
+// post sends payload to url, retrying with exponential backoff while the
+// provider is rate limiting or unavailable, and hands a 200 response's body
+// to read.
+func post(ctx context.Context, name, url string, header http.Header, timeout time.Duration, payload any, read func(io.Reader) error) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	var lastErr error
+	wait := llmBackoff
+	for attempt := range maxLLMAttempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wait *= 2
+		}
+		llmLimiter.Wait()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lastErr = &llmError{name, ErrLLMUnavailable, err.Error()}
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			err := read(resp.Body)
+			_ = resp.Body.Close()
+			return err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			lastErr = &llmError{name, ErrLLMUnavailable, err.Error()}
+			continue
+		}
+
+		class := classifyStatus(resp.StatusCode, respBody)
+		lastErr = &llmError{name, class, strings.TrimSpace(string(respBody))}
+		if class != ErrLLMRateLimited && class != ErrLLMUnavailable {
+			return lastErr
+		}
+		wait = max(wait, retryAfter(resp.Header))
+	}
+	return lastErr
+}
+
+// streamResult collects a streamed reply, passing each piece on as it
+// arrives.
+type streamResult struct {
+	onDelta func(string)
+	text    strings.Builder
+	call    *ToolCall
+	args    strings.Builder
+}
+
+func (r *streamResult) addText(s string) {
+	if s == "" {
+		return
+	}
+	r.text.WriteString(s)
+	r.onDelta(s)
+}
+
+// startCall begins the tool call; models are asked for exactly one, so any
+// later calls are dropped.
+func (r *streamResult) startCall(name string) bool {
+	if r.call != nil {
+		return false
+	}
+	r.call = &ToolCall{Name: name}
+	return true
+}
+
+func (r *streamResult) addArgs(s string) {
+	if r.call == nil || s == "" {
+		return
+	}
+	r.args.WriteString(s)
+	r.onDelta(s)
+}
+
+func (r *streamResult) result() (string, *ToolCall, error) {
+	if r.call != nil {
+		r.call.Arguments = json.RawMessage(r.args.String())
+		if r.args.Len() == 0 {
+			r.call.Arguments = json.RawMessage("{}")
+		}
+		return "", r.call, nil
+	}
+	return r.text.String(), nil, nil
+}
+
+// --- Anthropic ---
+
+type anthropicProvider struct {
+	url    string
+	keyEnv string
+	models modelTable
+}
+
+func (*anthropicProvider) Label() string            { return "Claude" }
+func (p *anthropicProvider) Model(fast bool) string { return p.models.pick(fast) }
+
+func (p *anthropicProvider) Complete(ctx context.Context, req LLMRequest) (string, error) {
+	return completeText(p.send(ctx, req, nil))
+}
+
+func (p *anthropicProvider) CompleteTools(ctx context.Context, req LLMRequest, tools []Tool) (*ToolCall, string, error) {
+	return completeTools(p.send(ctx, req, tools))
+}
+
+func (p *anthropicProvider) send(ctx context.Context, req LLMRequest, tools []Tool) (string, *ToolCall, error) {
+	apiKey, err := getAPIKey(p.keyEnv)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := map[string]any{
+		"model":       p.Model(req.Fast),
+		"max_tokens":  req.MaxTokens,
+		"temperature": 0.3,
+		"messages": []map[string]string{
+			{"role": "user", "content": req.Prompt},
+		},
+	}
+	if req.System != "" {
+		payload["system"] = req.System
+	}
+	if len(tools) > 0 {
+		var defs []map[string]any
+		for _, t := range tools {
+			defs = append(defs, map[string]any{"name": t.Name, "description": t.Description, "input_schema": t.Parameters})
+		}
+		payload["tools"] = defs
+		payload["tool_choice"] = map[string]string{"type": "any"}
+	}
+	header := http.Header{}
+	header.Set("x-api-key", apiKey)
+	header.Set("anthropic-version", "2023-06-01")
+
+	var result struct {
+		Content []struct {
+			Type  string          `json:"type"`
+			Text  string          `json:"text"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+	}
+	if req.OnDelta != nil {
+		payload["stream"] = true
+		return p.stream(ctx, header, payload, req.OnDelta)
+	}
+	if err := postJSON(ctx, "claude", p.url, header, 120*time.Second, payload, &result); err != nil {
+		return "", nil, err
+	}
+	var texts []string
+	for _, c := range result.Content {
+		switch c.Type {
+		case "tool_use":
+			return "", &ToolCall{Name: c.Name, Arguments: c.Input}, nil
+		case "text":
+			texts = append(texts, c.Text)
+		}
+	}
+	return strings.Join(texts, "\n\n"), nil, nil
+}
+
+func (p *anthropicProvider) stream(ctx context.Context, header http.Header, payload map[string]any, onDelta func(string)) (string, *ToolCall, error) {
+	r := &streamResult{onDelta: onDelta}
+	inCall := false
+	err := postSSE(ctx, "claude", p.url, header, 120*time.Second, payload, func(data []byte) error {
+		var event struct {
+			Type         string `json:"type"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"content_block"`
+			Delta struct {
+				Type        string `json:"type"`
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("claude: decoding event: %w", err)
+		}
+		switch event.Type {
+		case "content_block_start":
+			inCall = event.ContentBlock.Type == "tool_use" && r.startCall(event.ContentBlock.Name)
+			if event.ContentBlock.Type == "text" && r.text.Len() > 0 {
+				r.addText("\n\n")
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "input_json_delta" && inCall {
+				r.addArgs(event.Delta.PartialJSON)
+			} else if event.Delta.Type == "text_delta" {
+				r.addText(event.Delta.Text)
+			}
+		case "error":
+			return &llmError{"claude", ErrLLMUnavailable, event.Error.Message}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return r.result()
+}
+
+// --- OpenAI (Responses API) ---
+
+type openAIProvider struct {
+	url    string
+	keyEnv string
+	models modelTable
+}
+
+func (*openAIProvider) Label() string            { return "ChatGPT" }
+func (p *openAIProvider) Model(fast bool) string { return p.models.pick(fast) }
+
+func (p *openAIProvider) Complete(ctx context.Context, req LLMRequest) (string, error) {
+	return completeText(p.send(ctx, req, nil))
+}
+
+func (p *openAIProvider) CompleteTools(ctx context.Context, req LLMRequest, tools []Tool) (*ToolCall, string, error) {
+	return completeTools(p.send(ctx, req, tools))
+}
+
+func (p *openAIProvider) send(ctx context.Context, req LLMRequest, tools []Tool) (string, *ToolCall, error) {
+	apiKey, err := getAPIKey(p.keyEnv)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var input []map[string]any
+	if req.System != "" {
+		input = append(input, map[string]any{
+			"role":    "system",
+			"content": []map[string]string{{"type": "input_text", "text": req.System}},
+		})
+	}
+	input = append(input, map[string]any{
+		"role":    "user",
+		"content": []map[string]string{{"type": "input_text", "text": req.Prompt}},
+	})
+	payload := map[string]any{
+		"model":             p.Model(req.Fast),
+		"max_output_tokens": req.MaxTokens,
+		"input":             input,
+	}
+	if len(tools) > 0 {
+		var defs []map[string]any
+		for _, t := range tools {
+			defs = append(defs, map[string]any{"type": "function", "name": t.Name, "description": t.Description, "parameters": t.Parameters})
+		}
+		payload["tools"] = defs
+		payload["tool_choice"] = "required"
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+apiKey)
+
+	var result struct {
+		OutputText string `json:"output_text"`
+		Output     []struct {
+			Type      string          `json:"type"`
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+			Content   []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+	}
+	if req.OnDelta != nil {
+		payload["stream"] = true
+		return p.stream(ctx, header, payload, req.OnDelta)
+	}
+	if err := postJSON(ctx, "openai", p.url, header, 120*time.Second, payload, &result); err != nil {
+		return "", nil, err
+	}
+	text := result.OutputText
+	for _, out := range result.Output {
+		switch out.Type {
+		case "function_call":
+			return "", &ToolCall{Name: out.Name, Arguments: toolArguments(out.Arguments)}, nil
+		case "message":
+			for _, c := range out.Content {
+				if c.Type == "output_text" && c.Text != "" && text == "" {
+					text = c.Text
+				}
+			}
+		}
+	}
+	return text, nil, nil
+}
+
+func (p *openAIProvider) stream(ctx context.Context, header http.Header, payload map[string]any, onDelta func(string)) (string, *ToolCall, error) {
+	r := &streamResult{onDelta: onDelta}
+	inCall := false
+	err := postSSE(ctx, "openai", p.url, header, 120*time.Second, payload, func(data []byte) error {
+		var event struct {
+			Type    string `json:"type"`
+			Delta   string `json:"delta"`
+			Message string `json:"message"`
+			Item    struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"item"`
+			Response struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("openai: decoding event: %w", err)
+		}
+		switch event.Type {
+		case "response.output_text.delta":
+			r.addText(event.Delta)
+		case "response.output_item.added":
+			if event.Item.Type == "function_call" {
+				inCall = r.startCall(event.Item.Name)
+			}
+		case "response.function_call_arguments.delta":
+			if inCall {
+				r.addArgs(event.Delta)
+			}
+		case "response.function_call_arguments.done":
+			inCall = false
+		case "error":
+			return &llmError{"openai", ErrLLMUnavailable, event.Message}
+		case "response.failed":
+			return &llmError{"openai", ErrLLMUnavailable, event.Response.Error.Message}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return r.result()
+}
+
+// --- Gemini ---
+
+type geminiProvider struct {
+	// url is the models endpoint; requests go to url/MODEL:generateContent.
+	url    string
+	keyEnv string
+	models modelTable
+}
+
+func (*geminiProvider) Label() string            { return "Gemini" }
+func (p *geminiProvider) Model(fast bool) string { return p.models.pick(fast) }
+
+func (p *geminiProvider) Complete(ctx context.Context, req LLMRequest) (string, error) {
+	return completeText(p.send(ctx, req, nil))
+}
+
+func (p *geminiProvider) CompleteTools(ctx context.Context, req LLMRequest, tools []Tool) (*ToolCall, string, error) {
+	return completeTools(p.send(ctx, req, tools))
+}
+
+func (p *geminiProvider) send(ctx context.Context, req LLMRequest, tools []Tool) (string, *ToolCall, error) {
+	apiKey, err := getAPIKey(p.keyEnv)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := map[string]any{
+		"contents": []map[string]any{
+			{
+				"role":  "user",
+				"parts": []map[string]string{{"text": req.Prompt}},
+			},
+		},
+		"generationConfig": map[string]any{
+			"maxOutputTokens": req.MaxTokens,
+			"temperature":     0.3,
+		},
+	}
+	if req.System != "" {
+		payload["system_instruction"] = map[string]any{
+			"parts": []map[string]string{{"text": req.System}},
+		}
+	}
+	if len(tools) > 0 {
+		var defs []map[string]any
+		for _, t := range tools {
+			defs = append(defs, map[string]any{"name": t.Name, "description": t.Description, "parameters": t.Parameters})
+		}
+		payload["tools"] = []map[string]any{{"functionDeclarations": defs}}
+		payload["toolConfig"] = map[string]any{"functionCallingConfig": map[string]string{"mode": "ANY"}}
+	}
+	// A header rather than the key query parameter keeps the key out of
+	// error messages that quote the URL.
+	header := http.Header{}
+	header.Set("x-goog-api-key", apiKey)
+
+	var result struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text         string `json:"text"`
+					FunctionCall *struct {
+						Name string          `json:"name"`
+						Args json.RawMessage `json:"args"`
+					} `json:"functionCall"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	if req.OnDelta != nil {
+		// Each event is a complete response holding the next parts.
+		r := &streamResult{onDelta: req.OnDelta}
+		err := postSSE(ctx, "gemini", p.url+"/"+p.Model(req.Fast)+":streamGenerateContent?alt=sse", header, 120*time.Second, payload, func(data []byte) error {
+			result.Candidates = nil
+			if err := json.Unmarshal(data, &result); err != nil {
+				return fmt.Errorf("gemini: decoding event: %w", err)
+			}
+			for _, c := range result.Candidates {
+				for _, part := range c.Content.Parts {
+					if part.FunctionCall != nil && r.startCall(part.FunctionCall.Name) {
+						r.addArgs(string(part.FunctionCall.Args))
+					}
+					r.addText(part.Text)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		return r.result()
+	}
+	if err := postJSON(ctx, "gemini", p.url+"/"+p.Model(req.Fast)+":generateContent", header, 120*time.Second, payload, &result); err != nil {
+		return "", nil, err
+	}
+	var texts []string
+	for _, c := range result.Candidates {
+		for _, part := range c.Content.Parts {
+			if part.FunctionCall != nil {
+				return "", &ToolCall{Name: part.FunctionCall.Name, Arguments: part.FunctionCall.Args}, nil
+			}
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+	}
+	return strings.Join(texts, "\n\n"), nil, nil
+}
+
+// --- OpenAI-compatible chat completions (Ollama, vLLM) ---
+
+type chatCompletionsProvider struct {
+	label string
+	// model points at the served model's name, set by detect.
+	model *string
+	// detect finds the server, returning its API base URL.
+	detect func() (string, error)
+	// noThink asks Qwen-style models to skip their reasoning.
+	noThink bool
+	timeout time.Duration
+}
+
+func (p *chatCompletionsProvider) Label() string { return p.label }
+
+func (p *chatCompletionsProvider) Model(bool) string {
+	if *p.model == "" {
+		return "(autodetect)"
+	}
+	return *p.model
+}
+
+func (p *chatCompletionsProvider) Complete(ctx context.Context, req LLMRequest) (string, error) {
+	return completeText(p.send(ctx, req, nil))
+}
+
+func (p *chatCompletionsProvider) CompleteTools(ctx context.Context, req LLMRequest, tools []Tool) (*ToolCall, string, error) {
+	return completeTools(p.send(ctx, req, tools))
+}
+
+func (p *chatCompletionsProvider) send(ctx context.Context, req LLMRequest, tools []Tool) (string, *ToolCall, error) {
+	baseURL, err := p.detect()
+	if err != nil {
+		return "", nil, err
+	}
+
+	prompt := req.Prompt
+	if p.noThink {
+		prompt = "/no_think " + prompt
+	}
+	var messages []map[string]string
+	if req.System != "" {
+		messages = append(messages, map[string]string{"role": "system", "content": req.System})
+	}
+	messages = append(messages, map[string]string{"role": "user", "content": prompt})
+	payload := map[string]any{
+		"model":    *p.model,
+		"messages": messages,
+		"stream":   req.OnDelta != nil,
+	}
+	if len(tools) > 0 {
+		var defs []map[string]any
+		for _, t := range tools {
+			defs = append(defs, map[string]any{"type": "function", "function": map[string]any{
+				"name": t.Name, "description": t.Description, "parameters": t.Parameters,
+			}})
+		}
+		payload["tools"] = defs
+		payload["tool_choice"] = "required"
+	}
+
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					Function struct {
+						Name      string          `json:"name"`
+						Arguments json.RawMessage `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	url := strings.TrimSuffix(baseURL, "/") + "/chat/completions"
+	if req.OnDelta != nil {
+		return p.stream(ctx, url, payload, req.OnDelta)
+	}
+	if err := postJSON(ctx, strings.ToLower(p.label), url, nil, p.timeout, payload, &result); err != nil {
+		return "", nil, err
+	}
+	if len(result.Choices) == 0 {
+		return "", nil, nil
+	}
+	msg := result.Choices[0].Message
+	if len(msg.ToolCalls) > 0 {
+		f := msg.ToolCalls[0].Function
+		return "", &ToolCall{Name: f.Name, Arguments: toolArguments(f.Arguments)}, nil
+	}
+	return msg.Content, nil, nil
+}
+
+func (p *chatCompletionsProvider) stream(ctx context.Context, url string, payload map[string]any, onDelta func(string)) (string, *ToolCall, error) {
+	r := &streamResult{onDelta: onDelta}
+	inCall := false
+	err := postSSE(ctx, strings.ToLower(p.label), url, nil, p.timeout, payload, func(data []byte) error {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Index    int `json:"index"`
+						Function struct {
+							Name      string          `json:"name"`
+							Arguments json.RawMessage `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("%s: decoding event: %w", strings.ToLower(p.label), err)
+		}
+		for _, c := range chunk.Choices {
+			r.addText(c.Delta.Content)
+			for _, tc := range c.Delta.ToolCalls {
+				if tc.Function.Name != "" {
+					inCall = tc.Index == 0 && r.startCall(tc.Function.Name)
+				}
+				if inCall && tc.Index == 0 && len(tc.Function.Arguments) > 0 {
+					r.addArgs(string(toolArguments(tc.Function.Arguments)))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return r.result()
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/spinner"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// useFakeProvider registers an OpenAI-compatible provider served by
+// handler and selects it for the test.
+func useFakeProvider(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	model := "fake-model"
+	saved, savedProvider, savedBackoff := registry, provider, llmBackoff
+	registry = append(registry[:len(registry):len(registry)], &providerInfo{
+		Name:   "fake",
+		Picker: []string{"Fake"},
+		Provider: &chatCompletionsProvider{
+			label: "Fake", model: &model, timeout: 5 * time.Second,
+			detect: func() (string, error) { return server.URL + "/v1", nil },
+		},
+	})
+	provider, llmBackoff = "fake", time.Millisecond
+	t.Cleanup(func() {
+		server.Close()
+		registry, provider, llmBackoff = saved, savedProvider, savedBackoff
+	})
+}
+
+func chatReply(w http.ResponseWriter, content string) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": content}}},
+	})
+}
+
+// toolReply answers a chat completion with a call to name.
+func toolReply(w http.ResponseWriter, name, args string) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"choices": []map[string]any{{"message": map[string]any{
+			"role": "assistant",
+			"tool_calls": []map[string]any{{
+				"type":     "function",
+				"function": map[string]string{"name": name, "arguments": args},
+			}},
+		}}},
+	})
+}
+
+func TestProviders(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "ak")
+	t.Setenv("OPENAI_API_KEY", "ok")
+	t.Setenv("GEMINI_API_KEY", "gk")
+
+	var got struct {
+		path, auth string
+		body       map[string]any
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.path = r.URL.Path
+		got.auth = r.Header.Get("x-api-key") + r.Header.Get("Authorization") + r.Header.Get("x-goog-api-key")
+		_ = json.NewDecoder(r.Body).Decode(&got.body)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/anthropic"):
+			_, _ = w.Write([]byte(`{"content": [{"type": "text", "text": "from claude"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/openai"):
+			_, _ = w.Write([]byte(`{"output": [{"type": "reasoning"}, {"type": "message", "content": [{"type": "output_text", "text": "from openai"}]}]}`))
+		case strings.HasPrefix(r.URL.Path, "/gemini"):
+			_, _ = w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "from"}, {"text": "gemini"}]}}]}`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		provider LLMProvider
+		path     string
+		auth     string
+		want     string
+	}{
+		{&anthropicProvider{url: server.URL + "/anthropic", keyEnv: "ANTHROPIC_API_KEY", models: modelTable{"big", "small"}}, "/anthropic", "ak", "from claude"},
+		{&openAIProvider{url: server.URL + "/openai", keyEnv: "OPENAI_API_KEY", models: modelTable{"big", "small"}}, "/openai", "Bearer ok", "from openai"},
+		{&geminiProvider{url: server.URL + "/gemini", keyEnv: "GEMINI_API_KEY", models: modelTable{"big", "small"}}, "/gemini/small:generateContent", "gk", "from\n\ngemini"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider.Label(), func(t *testing.T) {
+			text, err := tt.provider.Complete(context.Background(), LLMRequest{System: "sys", Prompt: "hi", Fast: true, MaxTokens: 10})
+			if err != nil || text != tt.want {
+				t.Fatalf("Complete() = %q, %v, want %q", text, err, tt.want)
+			}
+			if got.path != tt.path || got.auth != tt.auth {
+				t.Errorf("request to %s with key %q", got.path, got.auth)
+			}
+			if m, _ := got.body["model"].(string); m != "small" && tt.provider.Label() != "Gemini" {
+				t.Errorf("model = %v, want small", got.body["model"])
+			}
+		})
+	}
+}
+
+func TestProviders_ToolCalls(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "ak")
+	t.Setenv("OPENAI_API_KEY", "ok")
+	t.Setenv("GEMINI_API_KEY", "gk")
+
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/anthropic"):
+			_, _ = w.Write([]byte(`{"content": [{"type": "text", "text": "thinking"}, {"type": "tool_use", "name": "ask", "input": {"question": "Which?"}}]}`))
+		case strings.HasPrefix(r.URL.Path, "/openai"):
+			_, _ = w.Write([]byte(`{"output": [{"type": "function_call", "name": "ask", "arguments": "{\"question\": \"Which?\"}"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/gemini"):
+			_, _ = w.Write([]byte(`{"candidates": [{"content": {"parts": [{"functionCall": {"name": "ask", "args": {"question": "Which?"}}}]}}]}`))
+		case strings.HasPrefix(r.URL.Path, "/chat"):
+			toolReply(w, "ask", `{"question": "Which?"}`)
+		}
+	}))
+	defer server.Close()
+
+	model := "m"
+	tests := []struct {
+		provider ToolCaller
+		toolsKey string
+	}{
+		{&anthropicProvider{url: server.URL + "/anthropic", keyEnv: "ANTHROPIC_API_KEY"}, "tool_choice"},
+		{&openAIProvider{url: server.URL + "/openai", keyEnv: "OPENAI_API_KEY"}, "tool_choice"},
+		{&geminiProvider{url: server.URL + "/gemini", keyEnv: "GEMINI_API_KEY"}, "toolConfig"},
+		{&chatCompletionsProvider{label: "Chat", model: &model, timeout: time.Second, detect: func() (string, error) { return server.URL + "/chat", nil }}, "tool_choice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider.(LLMProvider).Label(), func(t *testing.T) {
+			call, _, err := tt.provider.CompleteTools(context.Background(), LLMRequest{Prompt: "hi", MaxTokens: 10}, agentTools)
+			if err != nil || call == nil {
+				t.Fatalf("CompleteTools() = %v, %v", call, err)
+			}
+			var args struct{ Question string }
+			if call.Name != "ask" || json.Unmarshal(call.Arguments, &args) != nil || args.Question != "Which?" {
+				t.Errorf("call = %s(%s)", call.Name, call.Arguments)
+			}
+			if body["tools"] == nil || body[tt.toolsKey] == nil {
+				t.Errorf("request = %v, want tools and %s", body, tt.toolsKey)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	if p := lookupProvider("c"); p == nil || p.Name != "claude" {
+		t.Errorf("lookupProvider(c) = %+v", p)
+	}
+	if lookupProvider("") != nil || lookupProvider("mistral") != nil {
+		t.Error("lookupProvider matched an unknown name")
+	}
+	if label, name := resolveModel("gemini", true); label != "Gemini" || name != geminiFlash {
+		t.Errorf("resolveModel(gemini, fast) = %s, %s", label, name)
+	}
+	// Every picker entry resolves to a model.
+	for _, c := range providerChoices() {
+		if c.Description() == "" {
+			t.Errorf("%s: no model", c.label)
+		}
+	}
+}
+
+func TestPostJSON_Retries(t *testing.T) {
+	var calls atomic.Int32
+	statuses := []int{}
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		if n < len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[n])
+			_, _ = w.Write([]byte(`{"error": "nope"}`))
+			return
+		}
+		chatReply(w, "<think>hmm</think>ok")
+	})
+
+	tests := []struct {
+		statuses []int
+		want     error
+		calls    int32
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, nil, 3},
+		{[]int{http.StatusUnauthorized}, ErrLLMAuth, 1},
+		{[]int{http.StatusBadRequest}, ErrLLMRejected, 1},
+		{[]int{502, 502, 502}, ErrLLMUnavailable, 3},
+	}
+	for _, tt := range tests {
+		statuses = tt.statuses
+		calls.Store(0)
+		text, err := callLLM("hello", true)
+		if !errors.Is(err, tt.want) || calls.Load() != tt.calls {
+			t.Errorf("statuses %v: error = %v after %d calls, want %v after %d", tt.statuses, err, calls.Load(), tt.want, tt.calls)
+		}
+		if err == nil && text != "ok" {
+			t.Errorf("text = %q, want think tags stripped", text)
+		}
+	}
+}
+
+// TestPipeline_EndToEnd runs the TUI from question to card against a fake
+// provider and search API.
+func TestPipeline_EndToEnd(t *testing.T) {
+	var prompts []string
+	streamed := 0
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct{ Content string }
+			Tools    []any
+			Stream   bool
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		prompt := req.Messages[len(req.Messages)-1].Content
+		prompts = append(prompts, prompt)
+		if req.Stream {
+			streamed++
+		}
+		switch {
+		case len(req.Tools) > 0 && strings.Contains(prompt, "typed conduits"):
+			toolStream(w, "generate", `{"front": "What is a Go channel?", "back": "A typed conduit"}`)
+		case strings.Contains(prompt, "web search queries"):
+			chatReply(w, `["go channels"]`)
+		case strings.Contains(prompt, "Summarise these search results"):
+			chatStream(w, "Channels are typed conduits.")
+		case strings.Contains(prompt, "Valid actions") && strings.Contains(prompt, "typed conduits"):
+			chatReply(w, `{"action": "generate", "card": {"front": "What is a Go channel?", "back": "A typed conduit"}}`)
+		default:
+			chatReply(w, `{"action": "refuse", "reason": "unexpected prompt"}`)
+		}
+	})
+	exa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"results": [{"title": "Channels", "text": "Channels connect goroutines."}]}`))
+	}))
+	defer exa.Close()
+	savedExa, savedKey, savedURL, savedTries := useExa, exaAPIKey, exaSearchURL, maxTries
+	useExa, exaAPIKey, exaSearchURL, maxTries = true, "key", exa.URL, 3
+	defer func() { useExa, exaAPIKey, exaSearchURL, maxTries = savedExa, savedKey, savedURL, savedTries }()
+
+	m := initialModel("What is a channel?", true)
+	queue := []tea.Cmd{m.Init()}
+	for len(queue) > 0 && !m.done {
+		cmd := queue[0]
+		queue = queue[1:]
+		if cmd == nil {
+			continue
+		}
+		switch msg := cmd().(type) {
+		case tea.BatchMsg:
+			queue = append(queue, msg...)
+		case spinner.TickMsg:
+		default:
+			var next tea.Cmd
+			m, next = sendMsg(m, msg)
+			queue = append(queue, next)
+		}
+	}
+
+	if !m.done || m.err != nil || m.context.Card.Front != "What is a Go channel?" {
+		t.Fatalf("done = %v, err = %v, card = %+v\nprompts: %q", m.done, m.err, m.context.Card, prompts)
+	}
+	if len(prompts) != 3 || !strings.Contains(m.context.SearchResult, "connect goroutines") {
+		t.Errorf("prompts = %q, search result = %q", prompts, m.context.SearchResult)
+	}
+	if streamed != 2 || m.context.Summary != "Channels are typed conduits." {
+		t.Errorf("%d streamed requests, summary = %q; want summary and agent streamed", streamed, m.context.Summary)
+	}
+	var events []string
+	for _, e := range m.context.History.Events {
+		events = append(events, e.Type)
+	}
+	if got := strings.Join(events, ","); got != "search_terms,web_search,summary,agent_turn" {
+		t.Errorf("history events = %s", got)
+	}
+}
+
+// TestAgent_ToolFallback checks a server without tool support drops the
+// agent back to JSON actions for the rest of the run.
+func TestAgent_ToolFallback(t *testing.T) {
+	var withTools, withoutTools int
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Tools []any }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Tools) > 0 {
+			withTools++
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "model does not support tools"}`))
+			return
+		}
+		withoutTools++
+		chatReply(w, `{"action": "ask", "question": "Which language?"}`)
+	})
+
+	ctx := &PipelineContext{Question: "What is a channel?"}
+	for turn := 1; turn <= 2; turn++ {
+		resp, debug, err := callAgenticLLM(ctx, turn)
+		if err != nil || resp.Action != "ask" || resp.Question != "Which language?" {
+			t.Fatalf("turn %d: %+v, %v", turn, resp, err)
+		}
+		if !strings.Contains(debug.Prompt, "Valid actions") {
+			t.Errorf("turn %d: prompt is not the JSON actions prompt", turn)
+		}
+	}
+	if withTools != 1 || withoutTools != 2 || !ctx.NoNativeTools {
+		t.Errorf("requests with tools = %d, without = %d", withTools, withoutTools)
+	}
+}
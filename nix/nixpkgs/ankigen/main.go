@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -38,6 +42,7 @@ var (
 	maxSearches    int
 	maxTokens      int
 	maxTries       int
+	multiCard      bool
 	provider       string
 	question       string
 	rawOutput      bool
@@ -65,47 +70,25 @@ var (
 	localModel  string
 	remoteURL   string
 	remoteModel string
+
+	exaSearchURL = "https://api.exa.ai/search"
 )
 
-// resolveModel must stay in lockstep with callClaude/callOpenAI/callGemini so
-// the front-page status line cannot drift from what is actually sent.
+// resolveModel names the provider and the model a request would go to.
 func resolveModel(prov string, useFast bool) (label, modelName string) {
-	switch prov {
-	case "claude":
-		if useFast {
-			return "Claude", claudeHaiku
-		}
-		return "Claude", claudeOpus
-	case "chatgpt":
-		if useFast {
-			return "ChatGPT", gptMini
-		}
-		return "ChatGPT", gpt4
-	case "gemini":
-		if useFast {
-			return "Gemini", geminiFlash
-		}
-		return "Gemini", geminiPro
-	case "local":
-		name := localModel
-		if name == "" {
-			name = "(autodetect)"
-		}
-		return "Local", name
-	case "herakles":
-		name := remoteModel
-		if name == "" {
-			name = "(autodetect)"
-		}
-		return "Herakles", name
+	p := lookupProvider(prov)
+	if p == nil {
+		return prov, ""
 	}
-	return prov, ""
+	return p.Provider.Label(), p.Provider.Model(useFast)
 }
 
 type Card struct {
 	Front       string `json:"front"`
 	Back        string `json:"back"`
 	Error       string `json:"error,omitempty"`
+	NoteID      int64  `json:"noteId,omitempty"`
+	Kind        string `json:"kind,omitempty"` // basic, reverse or cloze, in a multi-card set
 	RawResponse string `json:"-"`
 }
 
@@ -115,6 +98,7 @@ type AgentResponse struct {
 	Question   string `json:"question,omitempty"`
 	SearchTerm string `json:"search_term,omitempty"`
 	Card       *Card  `json:"card,omitempty"`
+	Cards      []Card `json:"cards,omitempty"`
 }
 
 type DebugTurn struct {
@@ -143,8 +127,13 @@ func (searchTermsStage) Name() string { return "Generating search terms" }
 func (searchTermsStage) Next() Stage  { return semanticSearchStage{} }
 
 func (searchTermsStage) Execute(ctx *PipelineContext) error {
+	run := ctx.runContext()
 	ctx.Logf("Generating search terms for: %s", ctx.Question)
-	terms, err := generateSearchTerms(ctx.Question)
+	terms, err := generateSearchTerms(run, ctx.Question)
+	if err := run.Err(); err != nil {
+		// A stopped run has handed ctx back to the TUI.
+		return err
+	}
 	if err != nil {
 		ctx.Logf("Error: %v", err)
 		return err
@@ -183,8 +172,12 @@ func (semanticSearchStage) Validate(ctx *PipelineContext) error {
 }
 
 func performExaSearch(ctx *PipelineContext) error {
+	run := ctx.runContext()
 	ctx.Logf("Searching with Exa (%d terms)", len(ctx.SearchTerms))
 	result, err := performWebSearch(ctx.SearchTerms)
+	if err := run.Err(); err != nil {
+		return err
+	}
 	if err != nil {
 		ctx.Logf("Error: %v", err)
 		return err
@@ -195,6 +188,7 @@ func performExaSearch(ctx *PipelineContext) error {
 }
 
 func performSemanticGoogleSearch(ctx *PipelineContext) error {
+	run := ctx.runContext()
 	allTerms := ctx.SearchTerms
 
 	cfg := semsearch.Config{
@@ -204,20 +198,30 @@ func performSemanticGoogleSearch(ctx *PipelineContext) error {
 		EmbedModel:   "qwen-embed",
 		Threshold:    focusThreshold,
 		NumResults:   5,
+		ChatURL:      remoteURL,
+		ChatModel:    remoteModel,
+		// Expansion needs no reasoning; skipping it keeps the search fast.
+		ChatPromptPrefix: "/no_think ",
+		Expansions:       3,
 	}
 
 	if semsearch.IsEmbedServerAvailable(cfg) {
-		creativeTerms, err := generateCreativeSearchTerms(ctx.Question)
+		creativeTerms, err := semsearch.ExpandQueries(ctx.Question, cfg, pipelineLogger{ctx, run})
+		if err := run.Err(); err != nil {
+			return err
+		}
 		if err != nil {
 			ctx.Logf("Creative term generation failed: %v", err)
-		} else if len(creativeTerms) > 0 {
-			ctx.Logf("Generated %d creative search terms", len(creativeTerms))
+		} else {
 			allTerms = append(allTerms, creativeTerms...)
 		}
 	}
 
 	ctx.Logf("Searching Google with %d terms", len(allTerms))
 	result, err := semsearch.SearchRaw(allTerms, cfg)
+	if err := run.Err(); err != nil {
+		return err
+	}
 	if err != nil {
 		ctx.Logf("Error: %v", err)
 		return err
@@ -231,7 +235,10 @@ func performSemanticGoogleSearch(ctx *PipelineContext) error {
 	}
 
 	ctx.Logf("Filtering results with threshold %.2f", focusThreshold)
-	focused, err := semsearch.FilterRaw(ctx.Question, ctx.SearchResult, cfg, pipelineLogger{ctx})
+	focused, err := semsearch.FilterRaw(ctx.Question, ctx.SearchResult, cfg, pipelineLogger{ctx, run})
+	if err := run.Err(); err != nil {
+		return err
+	}
 	if err != nil {
 		ctx.Logf("Filtering failed, using original results: %v", err)
 		return nil
@@ -240,11 +247,17 @@ func performSemanticGoogleSearch(ctx *PipelineContext) error {
 	return nil
 }
 
+// pipelineLogger logs semsearch progress to the context until the run
+// is stopped.
 type pipelineLogger struct {
 	ctx *PipelineContext
+	run context.Context
 }
 
 func (l pipelineLogger) Logf(format string, args ...any) {
+	if l.run.Err() != nil {
+		return
+	}
 	l.ctx.Logf(format, args...)
 }
 
@@ -257,7 +270,10 @@ func (summariseStage) Next() Stage  { return generateStage{} }
 
 func (summariseStage) Execute(ctx *PipelineContext) error {
 	ctx.Logf("Summarising %d bytes of search results", len(ctx.SearchResult))
-	summary, err := summariseResults(ctx.Question, ctx.SearchResult)
+	summary, err := ctx.streamLLM("", summarisePrompt(ctx.Question, ctx.SearchResult), true)
+	if err := ctx.runContext().Err(); err != nil {
+		return err
+	}
 	if err != nil {
 		ctx.Logf("Error: %v", err)
 		return err
@@ -289,6 +305,7 @@ func (generateStage) Execute(ctx *PipelineContext) error {
 }
 
 func runAgentTurn(ctx *PipelineContext) tea.Cmd {
+	run := ctx.runContext()
 	return func() tea.Msg {
 		ctx.AgentTurn++
 		if ctx.AgentTurn > maxTries {
@@ -308,6 +325,9 @@ func runAgentTurn(ctx *PipelineContext) tea.Cmd {
 		ctx.Logf("Agent turn %d/%d (searches used: %d)", ctx.AgentTurn, maxTries, ctx.SearchCount)
 
 		resp, debug, err := callAgenticLLM(ctx, ctx.AgentTurn)
+		if run.Err() != nil {
+			return nil
+		}
 		ctx.DebugHistory = append(ctx.DebugHistory, debug)
 		if err != nil {
 			ctx.Logf("Agent turn %d failed: %v", ctx.AgentTurn, err)
@@ -315,7 +335,11 @@ func runAgentTurn(ctx *PipelineContext) tea.Cmd {
 			if len(rawSnippet) > 200 {
 				rawSnippet = rawSnippet[:200]
 			}
-			ctx.FailedAttempts = append(ctx.FailedAttempts, fmt.Sprintf("Turn %d: failed to parse your response as JSON. You must respond with raw JSON only, no markdown or code fences. Your response was: %s", ctx.AgentTurn, rawSnippet))
+			if _, ok := nativeTools(ctx); ok {
+				ctx.FailedAttempts = append(ctx.FailedAttempts, fmt.Sprintf("Turn %d: you did not call a tool. You must call exactly one of generate, refuse, search or ask. Your response was: %s", ctx.AgentTurn, rawSnippet))
+			} else {
+				ctx.FailedAttempts = append(ctx.FailedAttempts, fmt.Sprintf("Turn %d: failed to parse your response as JSON. You must respond with raw JSON only, no markdown or code fences. Your response was: %s", ctx.AgentTurn, rawSnippet))
+			}
 			return agentTurnMsg{turn: ctx.AgentTurn, action: "error", detail: err.Error(), ctx: ctx}
 		}
 
@@ -323,13 +347,25 @@ func runAgentTurn(ctx *PipelineContext) tea.Cmd {
 
 		switch resp.Action {
 		case "generate":
-			if resp.Card == nil || strings.TrimSpace(resp.Card.Front) == "" || strings.TrimSpace(resp.Card.Back) == "" {
+			cards := resp.Cards
+			if resp.Card != nil {
+				cards = []Card{*resp.Card}
+			}
+			if !ctx.Multi && len(cards) > 1 {
+				cards = cards[:1]
+			}
+			if len(cards) == 0 || slices.ContainsFunc(cards, func(c Card) bool { return !cardComplete(c) }) {
 				ctx.Logf("Turn %d: invalid card in generate response", ctx.AgentTurn)
 				ctx.FailedAttempts = append(ctx.FailedAttempts, fmt.Sprintf("Turn %d: invalid card", ctx.AgentTurn))
 				return agentTurnMsg{turn: ctx.AgentTurn, action: "invalid", detail: "empty card", ctx: ctx}
 			}
-			ctx.Logf("Card generated successfully")
-			ctx.Card = *resp.Card
+			if ctx.Multi {
+				ctx.Logf("Generated %d cards", len(cards))
+				ctx.placeCards(cards)
+			} else {
+				ctx.Logf("Card generated successfully")
+				ctx.Card = cards[0]
+			}
 			return agentTurnMsg{turn: ctx.AgentTurn, action: "generate", done: true, ctx: ctx}
 
 		case "refuse":
@@ -347,6 +383,9 @@ func runAgentTurn(ctx *PipelineContext) tea.Cmd {
 			ctx.SearchCount++
 			ctx.Logf("Agent requested search: %s", resp.SearchTerm)
 			result, searchErr := performAdditionalSearch(resp.SearchTerm)
+			if run.Err() != nil {
+				return nil
+			}
 			ctx.DebugHistory = append(ctx.DebugHistory, DebugTurn{
 				Turn: ctx.AgentTurn, Round: ctx.DebugRound,
 				RoundLabel: roundLabelForCtx(ctx), Kind: "tool_result",
@@ -389,13 +428,16 @@ func (generateStage) Validate(ctx *PipelineContext) error {
 }
 
 type PipelineContext struct {
-	Question            string
-	SearchTerms         []string
-	SearchResult        string
-	Summary             string
-	Card                Card
-	Error               error
-	FailedAttempts      []string
+	Question       string
+	SearchTerms    []string
+	SearchResult   string
+	Summary        string
+	Card           Card
+	Error          error
+	FailedAttempts []string
+	// NoNativeTools is set once the provider rejects tool calling, so
+	// later turns go straight to JSON actions.
+	NoNativeTools       bool
 	CardHistory         []Card
 	HistoryIndex        int
 	Logs                strings.Builder
@@ -412,6 +454,20 @@ type PipelineContext struct {
 	IterateInstructions string
 	IterateCurrentCard  *Card
 	History             *HistoryRecord
+
+	// Multi asks the agent for a set of cards. Cards is the set, in review
+	// order, and Card the selected one, at CardIndex.
+	Multi     bool
+	Cards     []Card
+	CardIndex int
+
+	// run is the TUI's generation in progress, cancelled when the user
+	// stops it; draft is the output streamed so far by its request in
+	// flight. mu guards all three.
+	mu     sync.Mutex
+	run    context.Context
+	cancel context.CancelFunc
+	draft  strings.Builder
 }
 
 type frontMode int
@@ -445,6 +501,13 @@ type model struct {
 	extraInputs []string
 	modelPicker *modelPickerState
 	addingInput *addInputModel
+	adding      bool
+	ankiDupes   []int64
+	warning     string
+	editing     bool
+	editFront   textarea.Model
+	editBack    textarea.Model
+	editField   int
 }
 
 type debugModel struct {
@@ -677,16 +740,18 @@ func (c providerChoice) Description() string {
 func (c providerChoice) FilterValue() string { return c.label }
 
 func providerChoices() []providerChoice {
-	return []providerChoice{
-		{label: "Claude (opus)", provider: "claude", useFast: false, hasFast: true},
-		{label: "Claude (haiku, fast)", provider: "claude", useFast: true, hasFast: true},
-		{label: "ChatGPT (gpt-4.1)", provider: "chatgpt", useFast: false, hasFast: true},
-		{label: "ChatGPT (o4-mini, fast)", provider: "chatgpt", useFast: true, hasFast: true},
-		{label: "Gemini (2.5 Pro)", provider: "gemini", useFast: false, hasFast: true},
-		{label: "Gemini (2.5 Flash, fast)", provider: "gemini", useFast: true, hasFast: true},
-		{label: "Local (Ollama)", provider: "local", useFast: true},
-		{label: "Herakles (vLLM)", provider: "herakles", useFast: true},
+	var choices []providerChoice
+	for _, p := range registry {
+		for i, label := range p.Picker {
+			choices = append(choices, providerChoice{
+				label:    label,
+				provider: p.Name,
+				useFast:  i == 1 || len(p.Picker) == 1,
+				hasFast:  len(p.Picker) > 1,
+			})
+		}
 	}
+	return choices
 }
 
 type modelPickerState struct {
@@ -892,7 +957,7 @@ func initialModel(question string, webMode bool) model {
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(nord8)
 
-	ctx := &PipelineContext{Question: question}
+	ctx := &PipelineContext{Question: question, Multi: multiCard}
 	ctx.History = newHistoryRecord(question, provider)
 
 	var startStage Stage = searchTermsStage{}
@@ -943,6 +1008,7 @@ func (m model) Init() tea.Cmd {
 	if m.inputting {
 		return textarea.Blink
 	}
+	m.context.startRun()
 	return tea.Batch(
 		m.spinner.Tick,
 		runStage(m.stage, m.context),
@@ -961,6 +1027,7 @@ func (m model) submitFront() (tea.Model, tea.Cmd) {
 		m.context.AdditionalContext = append(m.context.AdditionalContext, m.extraInputs...)
 		m.context.History.AddEvent("add_input", map[string]any{"inputs": m.extraInputs})
 	}
+	m.context.startRun()
 	return m, tea.Batch(m.spinner.Tick, runStage(m.stage, m.context))
 }
 
@@ -1105,6 +1172,10 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, cmd
 	}
 
+	if m.editing {
+		return m.updateEdit(msg)
+	}
+
 	if m.iterating {
 		switch msg := msg.(type) {
 		case tea.KeyMsg:
@@ -1134,7 +1205,19 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
-		case "q", "ctrl+c":
+		case "q":
+			if !m.done {
+				// Stop generating but stay, to keep what has been found.
+				m.context.cancelRun()
+				m.context.Logf("Generation cancelled")
+				m.context.History.AddEvent("cancelled", map[string]any{"stage": m.stage.Name()})
+				m.substage = ""
+				return m.finishOnTab(errCancelled, 0)
+			}
+			m.quitting = true
+			return m, tea.Quit
+		case "ctrl+c":
+			m.context.cancelRun()
 			m.quitting = true
 			return m, tea.Quit
 		case "esc":
@@ -1143,10 +1226,12 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, tea.Quit
 			}
 		case "r":
-			if m.done {
+			if m.done && !m.adding {
 				m.stage = generateStage{}
 				m.done = false
 				m.copied = false
+				m.warning = ""
+				m.ankiDupes = nil
 				m.substage = "thinking..."
 				m.context.Refused = false
 				m.context.RefusalReason = ""
@@ -1161,26 +1246,43 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				})
 				m.context.AgentTurn = 0
 				m.context.SearchCount = 0
+				m.context.startRun()
 				return m, runAgentTurn(m.context)
 			}
+		case "e":
+			if m.done && !m.adding && m.context.Card.Front != "" && !m.context.Refused {
+				return m.startEdit()
+			}
 		case "i":
-			if m.done && m.context.Card.Front != "" {
+			if m.done && !m.adding && m.context.Card.Front != "" {
 				m.iterating = true
 				m.iterInput.Focus()
 				return m, textarea.Blink
 			}
+		case "H", "L", "x":
+			if m.done {
+				m = m.updateSet(msg.String())
+			}
 		case "h":
-			if m.done && m.context.HistoryIndex > 0 {
+			if m.done && m.context.Cards != nil {
+				m = m.updateSet("h")
+			} else if m.done && !m.adding && m.context.HistoryIndex > 0 {
 				m.context.HistoryIndex--
 				m.context.Card = m.context.CardHistory[m.context.HistoryIndex]
 				m.copied = false
+				m.warning = ""
+				m.ankiDupes = nil
 				m.substage = fmt.Sprintf("history %d/%d", m.context.HistoryIndex+1, len(m.context.CardHistory))
 			}
 		case "l":
-			if m.done && m.context.HistoryIndex < len(m.context.CardHistory)-1 {
+			if m.done && m.context.Cards != nil {
+				m = m.updateSet("l")
+			} else if m.done && !m.adding && m.context.HistoryIndex < len(m.context.CardHistory)-1 {
 				m.context.HistoryIndex++
 				m.context.Card = m.context.CardHistory[m.context.HistoryIndex]
 				m.copied = false
+				m.warning = ""
+				m.ankiDupes = nil
 				m.substage = fmt.Sprintf("history %d/%d", m.context.HistoryIndex+1, len(m.context.CardHistory))
 			}
 		case "c":
@@ -1205,6 +1307,16 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.substage = "copied back"
 				}
 			}
+		case "a":
+			if m.done && !m.adding && m.context.Card.Front != "" && m.context.Card.NoteID == 0 {
+				// A second press after a duplicate warning adds anyway.
+				force := m.ankiDupes != nil
+				m.adding = true
+				m.ankiDupes = nil
+				m.warning = ""
+				m.substage = "adding to Anki..."
+				return m, runAddCard(ankiClient, ankiTarget(m.context.Card), m.context.selectedIndex(), force)
+			}
 		case "1", "2", "3", "4", "5", "6":
 			if m.done && m.tabView != nil {
 				tab := int(msg.String()[0] - '1')
@@ -1309,6 +1421,27 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, runAgentTurn(m.context)
 		}
 
+	case ankiAddedMsg:
+		m.adding = false
+		if !m.context.addedCardCurrent(msg) {
+			// The card changed under the add; its result no longer applies.
+			return m, nil
+		}
+		m.copied = false
+		switch {
+		case msg.err != nil:
+			m.warning = "add to Anki failed: " + msg.err.Error()
+		case len(msg.dupes) > 0:
+			m.ankiDupes = msg.dupes
+			m.warning = fmt.Sprintf("%s already has note(s) %s · [a] Add anyway", msg.note.Deck, formatNoteIDs(msg.dupes))
+		default:
+			recordNoteID(m.context, msg.index, msg.note, ankiClient.Name(), msg.id)
+			saveHistoryFunc(m.context)
+			m.copied = true
+			m.substage = fmt.Sprintf("added to %s (note %d)", msg.note.Deck, msg.id)
+		}
+		return m, nil
+
 	case errorMsg:
 		m.context.Error = msg.err
 		return m.finishOnTab(msg.err, 5)
@@ -1396,6 +1529,10 @@ func (m model) View() string {
 		return b.String()
 	}
 
+	if m.editing {
+		return m.editView()
+	}
+
 	if m.iterating {
 		width := min(m.width-4, 100)
 		if m.width == 0 {
@@ -1492,6 +1629,15 @@ func (m model) View() string {
 			}
 			b.WriteString("\n")
 		}
+
+		if draft := m.draftView(); draft != "" {
+			b.WriteString("\n")
+			b.WriteString(draft)
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+		b.WriteString(helpStyle.Render("[q] Stop  [ctrl+c] Quit"))
+		b.WriteString("\n")
 	} else {
 		width := m.width
 		if width == 0 {
@@ -1545,6 +1691,11 @@ func (m model) View() string {
 				b.WriteString(helpStyle.Render("[r] Retry  [q] Quit  [2-5] View context"))
 				b.WriteString("\n")
 			} else {
+				if m.context.Cards != nil {
+					b.WriteString(labelStyle.Render(fmt.Sprintf("CARD %d/%d", m.context.CardIndex+1, len(m.context.Cards))))
+					b.WriteString(dimStyle.Render(" · " + cmp.Or(m.context.Card.Kind, kindBasic)))
+					b.WriteString("\n\n")
+				}
 				b.WriteString(boxStyle.Width(width).Render(
 					labelStyle.Render("FRONT") + "\n\n" + wordWrap(m.context.Card.Front, width-4),
 				))
@@ -1556,14 +1707,24 @@ func (m model) View() string {
 				b.WriteString(dimStyle.Render(strings.Repeat("─", width)))
 				b.WriteString("\n")
 
-				if m.copied || (m.substage != "" && strings.HasPrefix(m.substage, "history")) {
+				if m.warning != "" {
+					b.WriteString(errorStyle.Render("✗ " + m.warning))
+				} else if m.adding {
+					b.WriteString(dimStyle.Render(m.substage))
+				} else if m.copied || (m.substage != "" && strings.HasPrefix(m.substage, "history")) {
 					b.WriteString(successStyle.Render("✓ " + m.substage))
 				} else {
 					historyHint := ""
-					if len(m.context.CardHistory) > 1 {
+					if m.context.Cards != nil {
+						historyHint = "  [h/l] Card  [H/L] Move  [x] Discard"
+					} else if len(m.context.CardHistory) > 1 {
 						historyHint = fmt.Sprintf("  [←→] History (%d/%d)", m.context.HistoryIndex+1, len(m.context.CardHistory))
 					}
-					b.WriteString(helpStyle.Render("[r] Regen  [i] Iterate  [c] Copy  [f] Front  [b] Back  [q] Quit" + historyHint))
+					ankiHint := "  [a] Add to Anki"
+					if m.context.Card.NoteID != 0 {
+						ankiHint = fmt.Sprintf("  (in Anki: note %d)", m.context.Card.NoteID)
+					}
+					b.WriteString(helpStyle.Render("[r] Regen  [i] Iterate  [e] Edit  [c] Copy  [f] Front  [b] Back" + ankiHint + "  [q] Quit" + historyHint))
 				}
 				b.WriteString("\n")
 			}
@@ -1582,9 +1743,50 @@ func (m model) View() string {
 	return b.String()
 }
 
+// draftView renders the output streamed so far: the summary as it is
+// written, or the card as the agent drafts it.
+func (m model) draftView() string {
+	draft := previewText(m.context.Draft())
+	if draft == "" {
+		return ""
+	}
+	width := min(m.width-4, 100)
+	if m.width == 0 {
+		width = 80
+	}
+	lines := 12
+	if m.height > 0 {
+		lines = max(m.height-20, 4)
+	}
+
+	if _, ok := m.stage.(summariseStage); ok {
+		return boxStyle.Width(width).Render(
+			labelStyle.Render("SUMMARY") + "\n\n" + tailLines(wordWrap(draft, width-4), lines),
+		)
+	}
+	front, ok := draftField(draft, "front")
+	if !ok {
+		return dimStyle.Render(tailLines(wordWrap(draft, width), lines))
+	}
+	back, _ := draftField(draft, "back")
+	frontBox := boxStyle.Width(width).Render(
+		labelStyle.Render("FRONT") + "\n\n" + tailLines(wordWrap(front, width-4), lines/2),
+	)
+	backBox := boxStyle.Width(width).Render(
+		labelStyle.Render("BACK") + "\n\n" + tailLines(wordWrap(back, width-4), lines/2),
+	)
+	return frontBox + "\n\n" + backBox
+}
+
 func runStage(stage Stage, ctx *PipelineContext) tea.Cmd {
+	run := ctx.runContext()
 	return func() tea.Msg {
-		if err := stage.Execute(ctx); err != nil {
+		err := stage.Execute(ctx)
+		if run.Err() != nil {
+			// The user stopped the run; the TUI has already moved on.
+			return nil
+		}
+		if err != nil {
 			return errorMsg{err: err}
 		}
 		if err := stage.Validate(ctx); err != nil {
@@ -1603,9 +1805,10 @@ func runIterate(ctx *PipelineContext, instructions string) tea.Cmd {
 			Prompt: fmt.Sprintf("Iteration instructions: %s", instructions)},
 	)
 	ctx.IterateInstructions = instructions
-	ctx.IterateCurrentCard = &Card{Front: ctx.Card.Front, Back: ctx.Card.Back}
+	ctx.IterateCurrentCard = &Card{Front: ctx.Card.Front, Back: ctx.Card.Back, Kind: ctx.Card.Kind}
 	ctx.AgentTurn = 0
 	ctx.FailedAttempts = nil
+	ctx.startRun()
 	return runAgentTurn(ctx)
 }
 
@@ -1622,14 +1825,14 @@ func (m model) completedStages() []Stage {
 	return stages
 }
 
-func generateSearchTerms(question string) ([]string, error) {
+func generateSearchTerms(run context.Context, question string) ([]string, error) {
 	prompt := fmt.Sprintf(`Generate 1-5 web search queries to find accurate information for answering this question. Return ONLY a JSON array of strings, nothing else.
 
 Question: %s
 
 Example output: ["query 1", "query 2", "query 3"]`, question)
 
-	response, err := callLLM(prompt, true)
+	response, err := callLLMStream(run, nil, "", prompt, true)
 	if err != nil {
 		return nil, fmt.Errorf("search term generation failed: %w", err)
 	}
@@ -1641,69 +1844,6 @@ Example output: ["query 1", "query 2", "query 3"]`, question)
 	return terms, nil
 }
 
-func generateCreativeSearchTerms(question string) ([]string, error) {
-	prompt := fmt.Sprintf(`Generate 2-3 creative, lateral-thinking web search queries to find unexpected but relevant information for this question. Think of related concepts, analogies, or alternative framings. Return ONLY a JSON array of strings.
-
-Question: %s
-
-Example: For "Why is the sky blue?" you might generate:
-["Rayleigh scattering atmosphere", "wavelength light dispersion physics", "why sunset orange red"]`, question)
-
-	payload := map[string]any{
-		"model": remoteModel,
-		"messages": []map[string]string{
-			{"role": "user", "content": "/no_think " + prompt},
-		},
-		"temperature": 0.8,
-		"stream":      false,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-
-	req, err := http.NewRequest("POST", remoteURL+"/chat/completions", bytes.NewReader(body))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("herakles error: %s", string(respBody))
-	}
-
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return nil, err
-	}
-
-	if len(result.Choices) == 0 {
-		return nil, fmt.Errorf("no response from herakles")
-	}
-
-	return extractJSONArray[string](result.Choices[0].Message.Content)
-}
-
 func performWebSearch(terms []string) (string, error) {
 	if exaAPIKey == "" {
 		exaAPIKey = os.Getenv("EXA_API_KEY")
@@ -1772,7 +1912,7 @@ func searchExa(query string) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.exa.ai/search", bytes.NewReader(body))
+	req, err := http.NewRequest("POST", exaSearchURL, bytes.NewReader(body))
 	if err != nil {
 		return "", err
 	}
@@ -1817,7 +1957,11 @@ func searchExa(query string) (string, error) {
 }
 
 func summariseResults(question, results string) (string, error) {
-	prompt := fmt.Sprintf(`Summarise these search results to help answer the following question. Keep only the most relevant information.
+	return callLLM(summarisePrompt(question, results), true)
+}
+
+func summarisePrompt(question, results string) string {
+	return fmt.Sprintf(`Summarise these search results to help answer the following question. Keep only the most relevant information.
 
 Question: %s
 
@@ -1825,8 +1969,6 @@ Search Results:
 %s
 
 Provide a concise summary (300-500 words) of the key information relevant to answering the question.`, question, results)
-
-	return callLLM(prompt, true)
 }
 
 func formatAdditionalContext(additional []string) string {
@@ -1842,7 +1984,8 @@ func formatAdditionalContext(additional []string) string {
 	return b.String()
 }
 
-func generateCard(question, summary string, additional []string) (Card, error) {
+// generateCard asks for a card in one request, which ctx can cancel.
+func generateCard(ctx context.Context, question, summary string, additional []string) (Card, error) {
 	systemPrompt := fetchSystemPrompt()
 
 	userPrompt := fmt.Sprintf("Question: %s", question)
@@ -1853,7 +1996,7 @@ func generateCard(question, summary string, additional []string) (Card, error) {
 		userPrompt += fmt.Sprintf("\n\nAdditional context from user:\n%s", ac)
 	}
 
-	response, err := callLLMWithSystem(systemPrompt, userPrompt, !deepThink)
+	response, err := callLLMStream(ctx, nil, systemPrompt, userPrompt, !deepThink)
 	if err != nil {
 		return Card{}, err
 	}
@@ -1899,13 +2042,47 @@ func generateCard(question, summary string, additional []string) (Card, error) {
 	}, nil
 }
 
+// agentTools are the agent's actions as tools, for providers with native
+// tool calling.
+var agentTools = []Tool{
+	{Name: "generate", Description: "Return the finished flashcard.", Parameters: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"front": map[string]string{"type": "string", "description": "The question side of the card"},
+			"back":  map[string]string{"type": "string", "description": "The answer side of the card"},
+		},
+		"required": []string{"front", "back"},
+	}},
+	{Name: "search", Description: "Search the web for more information before answering.", Parameters: map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"search_term": map[string]string{"type": "string"}},
+		"required":   []string{"search_term"},
+	}},
+	{Name: "ask", Description: "Ask the user a clarifying question.", Parameters: map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"question": map[string]string{"type": "string"}},
+		"required":   []string{"question"},
+	}},
+	{Name: "refuse", Description: "Decline to make a card, giving the reason.", Parameters: map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"reason": map[string]string{"type": "string"}},
+		"required":   []string{"reason"},
+	}},
+}
+
+// nativeTools returns the provider's tool calling, unless it is
+// unsupported or has already been rejected this run.
+func nativeTools(ctx *PipelineContext) (ToolCaller, bool) {
+	if ctx.NoNativeTools {
+		return nil, false
+	}
+	tc, ok := currentProvider().(ToolCaller)
+	return tc, ok
+}
+
 func callAgenticLLM(ctx *PipelineContext, turn int) (AgentResponse, DebugTurn, error) {
 	debug := DebugTurn{Turn: turn, Round: ctx.DebugRound, RoundLabel: roundLabelForCtx(ctx), Kind: "agent"}
 
-	systemPrompt := fetchSystemPrompt() + `
-
-You are an agentic card generator. You must respond with exactly one raw JSON object — no markdown, no code fences, no backticks, no other text. The valid actions and their exact formats will be specified in the user prompt.`
-
 	searchesRemaining := "unlimited"
 	if maxSearches != -1 {
 		remaining := maxSearches - ctx.SearchCount
@@ -1915,58 +2092,143 @@ You are an agentic card generator. You must respond with exactly one raw JSON ob
 		searchesRemaining = fmt.Sprintf("%d", remaining)
 	}
 
+	if tc, ok := nativeTools(ctx); ok {
+		resp, debug, err := callAgentTools(ctx, tc, debug, searchesRemaining)
+		if !errors.Is(err, ErrLLMRejected) {
+			return resp, debug, err
+		}
+		// Some local models are served without tool support; the server
+		// rejects the request rather than ignoring the tools.
+		ctx.Logf("Native tool calling rejected, falling back to JSON actions: %v", err)
+		ctx.NoNativeTools = true
+		debug.Error = nil
+	}
+
+	systemPrompt := fetchSystemPrompt() + `
+
+You are an agentic card generator. You must respond with exactly one raw JSON object — no markdown, no code fences, no backticks, no other text. The valid actions and their exact formats will be specified in the user prompt.`
+
+	generateAction := `{"action": "generate", "card": {"front": "...", "back": "..."}}`
+	if ctx.Multi {
+		generateAction = `{"action": "generate", "cards": [{"front": "...", "back": "...", "kind": "basic|reverse|cloze"}, ...]}`
+	}
+
 	var userPrompt strings.Builder
 	fmt.Fprintf(&userPrompt, `You MUST respond with exactly one raw JSON object (no markdown, no code fences). Every response MUST include an "action" field. Valid actions:
-{"action": "generate", "card": {"front": "...", "back": "..."}}
+%s
 {"action": "refuse", "reason": "..."}
 {"action": "search", "search_term": "..."} (%s searches remaining)
 {"action": "ask", "question": "..."}
 
-`, searchesRemaining)
-	fmt.Fprintf(&userPrompt, "Question: %s\n\n", ctx.Question)
+`, generateAction, searchesRemaining)
+	writeAgentContext(&userPrompt, ctx)
+	debug.Prompt = userPrompt.String()
+
+	response, err := ctx.streamLLM(systemPrompt, userPrompt.String(), !deepThink)
+	if err != nil {
+		debug.Error = err
+		return AgentResponse{}, debug, err
+	}
+
+	debug.RawResponse = response
+	return parseAgentResponse(response, debug)
+}
+
+// callAgentTools runs an agent turn with the actions offered as tools. A
+// model that answers in text instead is parsed as a JSON action.
+func callAgentTools(ctx *PipelineContext, tc ToolCaller, debug DebugTurn, searchesRemaining string) (AgentResponse, DebugTurn, error) {
+	systemPrompt := systemPromptContent + `
+
+You are an agentic card generator. Respond by calling exactly one of the tools: generate, search, ask or refuse. Omit drafts, or if included, wrap them in <drafts></drafts> tags.`
+
+	var userPrompt strings.Builder
+	fmt.Fprintf(&userPrompt, "Call exactly one tool: generate, refuse, search (%s searches remaining) or ask.\n\n", searchesRemaining)
+	writeAgentContext(&userPrompt, ctx)
+	debug.Prompt = userPrompt.String()
+
+	run, onDelta := ctx.request()
+	call, text, err := tc.CompleteTools(run, LLMRequest{
+		System:    systemPrompt,
+		Prompt:    userPrompt.String(),
+		Fast:      !deepThink,
+		MaxTokens: maxTokens,
+		OnDelta:   onDelta,
+	}, agentToolsFor(ctx))
+	if err != nil {
+		debug.Error = err
+		return AgentResponse{}, debug, err
+	}
+	if call == nil {
+		debug.RawResponse = stripTags(text, "think", "drafts")
+		return parseAgentResponse(debug.RawResponse, debug)
+	}
+
+	debug.RawResponse = fmt.Sprintf("%s(%s)", call.Name, call.Arguments)
+	var resp AgentResponse
+	err = json.Unmarshal(call.Arguments, &resp)
+	if err == nil && call.Name == "generate" && len(resp.Cards) == 0 {
+		resp.Card = &Card{}
+		err = json.Unmarshal(call.Arguments, resp.Card)
+	}
+	resp.Action = call.Name
+	if err != nil {
+		err = fmt.Errorf("failed to parse %s arguments: %s", call.Name, call.Arguments)
+		debug.Error = err
+		return AgentResponse{}, debug, err
+	}
+	debug.Parsed = &resp
+	return resp, debug, nil
+}
+
+func parseAgentResponse(response string, debug DebugTurn) (AgentResponse, DebugTurn, error) {
+	resp, parseErr := extractJSON[AgentResponse](response)
+	if parseErr != nil {
+		parseErr = fmt.Errorf("failed to parse agent response: %s", response)
+		debug.Error = parseErr
+		return AgentResponse{}, debug, parseErr
+	}
+	debug.Parsed = &resp
+	return resp, debug, nil
+}
+
+// writeAgentContext writes what the agent knows so far: the question,
+// research, the user's input and earlier mistakes.
+func writeAgentContext(userPrompt *strings.Builder, ctx *PipelineContext) {
+	fmt.Fprintf(userPrompt, "Question: %s\n\n", ctx.Question)
 	if ctx.Summary != "" {
-		fmt.Fprintf(&userPrompt, "Research context:\n%s\n\n", ctx.Summary)
+		fmt.Fprintf(userPrompt, "Research context:\n%s\n\n", ctx.Summary)
 	}
 	if ac := formatAdditionalContext(ctx.AdditionalContext); ac != "" {
-		fmt.Fprintf(&userPrompt, "Additional context from user:\n%s\n\n", ac)
+		fmt.Fprintf(userPrompt, "Additional context from user:\n%s\n\n", ac)
 	}
 	if len(ctx.UserResponses) > 0 {
 		userPrompt.WriteString("User responses to your questions:\n")
 		for _, r := range ctx.UserResponses {
-			fmt.Fprintf(&userPrompt, "- %s\n", r)
+			fmt.Fprintf(userPrompt, "- %s\n", r)
 		}
 		userPrompt.WriteString("\n")
 	}
 	if len(ctx.FailedAttempts) > 0 {
 		userPrompt.WriteString("Previous errors (do NOT repeat these mistakes):\n")
 		for _, f := range ctx.FailedAttempts {
-			fmt.Fprintf(&userPrompt, "- %s\n", f)
+			fmt.Fprintf(userPrompt, "- %s\n", f)
 		}
 		userPrompt.WriteString("\n")
 	}
 	if ctx.IterateInstructions != "" && ctx.IterateCurrentCard != nil {
-		fmt.Fprintf(&userPrompt, "Current card to modify:\nFront: %s\nBack: %s\n\n",
+		fmt.Fprintf(userPrompt, "Current card to modify:\nFront: %s\nBack: %s\n",
 			ctx.IterateCurrentCard.Front, ctx.IterateCurrentCard.Back)
-		fmt.Fprintf(&userPrompt, "Modification instructions: %s\n\n", ctx.IterateInstructions)
+		if ctx.IterateCurrentCard.Kind != "" {
+			fmt.Fprintf(userPrompt, "Kind: %s\n", ctx.IterateCurrentCard.Kind)
+		}
+		fmt.Fprintf(userPrompt, "\nModification instructions: %s\n\n", ctx.IterateInstructions)
 		userPrompt.WriteString("Return the modified card using the 'generate' action. Use 'search' if you need more information.\n\n")
+		if ctx.Multi {
+			userPrompt.WriteString("The card is one of a set; return several cards only if the instructions ask for it to be split.\n\n")
+		}
+	} else if ctx.Multi {
+		userPrompt.WriteString(multiCardPrompt + "\n\n")
 	}
-	debug.Prompt = userPrompt.String()
-
-	response, err := callLLMWithSystem(systemPrompt, userPrompt.String(), !deepThink)
-	if err != nil {
-		debug.Error = err
-		return AgentResponse{}, debug, err
-	}
-
-	debug.RawResponse = response
-	resp, parseErr := extractJSON[AgentResponse](response)
-	if parseErr != nil {
-		parseErr = fmt.Errorf("failed to parse agent response: %s", response)
-		debug.Error = parseErr
-		return AgentResponse{}, debug, parseErr
-	}
-	debug.Parsed = &resp
-	return resp, debug, nil
 }
 
 func performAdditionalSearch(term string) (string, error) {
@@ -2005,20 +2267,23 @@ func callLLM(prompt string, useFast bool) (string, error) {
 }
 
 func callLLMWithSystem(systemPrompt, userPrompt string, useFast bool) (string, error) {
-	switch provider {
-	case "local":
-		return callLocal(systemPrompt, userPrompt, useFast)
-	case "herakles":
-		return callRemote(systemPrompt, userPrompt, useFast)
-	case "claude":
-		return callClaude(systemPrompt, userPrompt, useFast)
-	case "chatgpt":
-		return callOpenAI(systemPrompt, userPrompt, useFast)
-	case "gemini":
-		return callGemini(systemPrompt, userPrompt, useFast)
-	default:
-		return callLocal(systemPrompt, userPrompt, useFast)
+	return callLLMStream(context.Background(), nil, systemPrompt, userPrompt, useFast)
+}
+
+// callLLMStream makes a cancellable request, streaming the response to
+// onDelta if it is set.
+func callLLMStream(ctx context.Context, onDelta func(string), systemPrompt, userPrompt string, useFast bool) (string, error) {
+	response, err := currentProvider().Complete(ctx, LLMRequest{
+		System:    systemPrompt,
+		Prompt:    userPrompt,
+		Fast:      useFast,
+		MaxTokens: maxTokens,
+		OnDelta:   onDelta,
+	})
+	if err != nil {
+		return "", err
 	}
+	return stripTags(response, "think", "drafts"), nil
 }
 
 func getAPIKey(name string) (string, error) {
@@ -2051,247 +2316,6 @@ func getEnvOrSecret(envName, defaultSecret string) string {
 	return strings.TrimSpace(string(out))
 }
 
-func callClaude(systemPrompt, userPrompt string, useFast bool) (string, error) {
-	apiKey, err := getAPIKey("ANTHROPIC_API_KEY")
-	if err != nil {
-		return "", err
-	}
-
-	_, model := resolveModel("claude", useFast)
-
-	payload := map[string]any{
-		"model":       model,
-		"max_tokens":  maxTokens,
-		"temperature": 0.3,
-		"messages": []map[string]string{
-			{"role": "user", "content": userPrompt},
-		},
-	}
-
-	if systemPrompt != "" {
-		payload["system"] = systemPrompt
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("claude API error: %s", string(respBody))
-	}
-
-	var result struct {
-		Content []struct {
-			Text string `json:"text"`
-		} `json:"content"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", err
-	}
-
-	if len(result.Content) == 0 {
-		return "", fmt.Errorf("no content in response")
-	}
-
-	return stripTags(result.Content[0].Text, "drafts"), nil
-}
-
-func callOpenAI(systemPrompt, userPrompt string, useFast bool) (string, error) {
-	apiKey, err := getAPIKey("OPENAI_API_KEY")
-	if err != nil {
-		return "", err
-	}
-
-	_, model := resolveModel("chatgpt", useFast)
-
-	var input []map[string]any
-	if systemPrompt != "" {
-		input = append(input, map[string]any{
-			"role":    "system",
-			"content": []map[string]string{{"type": "input_text", "text": systemPrompt}},
-		})
-	}
-	input = append(input, map[string]any{
-		"role":    "user",
-		"content": []map[string]string{{"type": "input_text", "text": userPrompt}},
-	})
-
-	payload := map[string]any{
-		"model":             model,
-		"max_output_tokens": maxTokens,
-		"input":             input,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/responses", bytes.NewReader(body))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("openai API error: %s", string(respBody))
-	}
-
-	var result struct {
-		OutputText string `json:"output_text"`
-		Output     []struct {
-			Type    string `json:"type"`
-			Content []struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			} `json:"content"`
-		} `json:"output"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", err
-	}
-
-	if result.OutputText != "" {
-		return stripTags(result.OutputText, "drafts"), nil
-	}
-
-	for _, out := range result.Output {
-		if out.Type == "message" {
-			for _, c := range out.Content {
-				if c.Type == "output_text" && c.Text != "" {
-					return stripTags(c.Text, "drafts"), nil
-				}
-			}
-		}
-	}
-
-	return "", fmt.Errorf("no content in response")
-}
-
-func callGemini(systemPrompt, userPrompt string, useFast bool) (string, error) {
-	apiKey, err := getAPIKey("GEMINI_API_KEY")
-	if err != nil {
-		return "", err
-	}
-
-	_, model := resolveModel("gemini", useFast)
-
-	payload := map[string]any{
-		"contents": []map[string]any{
-			{
-				"role":  "user",
-				"parts": []map[string]string{{"text": userPrompt}},
-			},
-		},
-		"generationConfig": map[string]any{
-			"maxOutputTokens": maxTokens,
-			"temperature":     0.3,
-		},
-	}
-
-	if systemPrompt != "" {
-		payload["system_instruction"] = map[string]any{
-			"parts": []map[string]string{{"text": systemPrompt}},
-		}
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
-	}
-
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", model, apiKey)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 120 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("gemini API error: %s", string(respBody))
-	}
-
-	var result struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-			} `json:"content"`
-		} `json:"candidates"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", err
-	}
-
-	if len(result.Candidates) == 0 {
-		return "", fmt.Errorf("no candidates in response")
-	}
-
-	var texts []string
-	for _, c := range result.Candidates {
-		for _, p := range c.Content.Parts {
-			if p.Text != "" {
-				texts = append(texts, p.Text)
-			}
-		}
-	}
-
-	return stripTags(strings.Join(texts, "\n\n"), "drafts"), nil
-}
-
 func detectLocalModel() error {
 	if localModel != "" {
 		return nil
@@ -2321,71 +2345,6 @@ func detectLocalModel() error {
 	return nil
 }
 
-func callLocal(systemPrompt, userPrompt string, _ bool) (string, error) {
-	if err := detectLocalModel(); err != nil {
-		return "", err
-	}
-
-	userPrompt = "/no_think " + userPrompt
-
-	var messages []map[string]string
-	if systemPrompt != "" {
-		messages = append(messages, map[string]string{"role": "system", "content": systemPrompt})
-	}
-	messages = append(messages, map[string]string{"role": "user", "content": userPrompt})
-
-	payload := map[string]any{
-		"model":    localModel,
-		"messages": messages,
-		"stream":   false,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("POST", ollamaURL+"/api/chat", bytes.NewReader(body))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("local LLM unavailable: %w", err)
-	}
-	defer func() { _ = resp.Body.Close() }()
-
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("local LLM error: %s", string(respBody))
-	}
-
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", err
-	}
-
-	if len(result.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
-	}
-
-	return stripTags(result.Choices[0].Message.Content, "think", "drafts"), nil
-}
-
 func detectHeraklesLLMServer() error {
 	if remoteURL != "" {
 		return nil
@@ -2439,92 +2398,6 @@ func detectHeraklesLLMServerModel() error {
 	return nil
 }
 
-func callRemote(systemPrompt, userPrompt string, _ bool) (string, error) {
-	if err := detectHeraklesLLMServerModel(); err != nil {
-		return "", err
-	}
-
-	userPrompt = "/no_think " + userPrompt
-
-	var messages []map[string]string
-	if systemPrompt != "" {
-		messages = append(messages, map[string]string{"role": "system", "content": systemPrompt})
-	}
-	messages = append(messages, map[string]string{"role": "user", "content": userPrompt})
-
-	payload := map[string]any{
-		"model":    remoteModel,
-		"messages": messages,
-		"stream":   false,
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
-	}
-
-	client := &http.Client{Timeout: 300 * time.Second}
-	var respBody []byte
-	var lastErr error
-
-	for attempt := range 3 {
-		if attempt > 0 {
-			time.Sleep(time.Duration(attempt*2) * time.Second)
-		}
-
-		req, err := http.NewRequest("POST", remoteURL+"/chat/completions", bytes.NewReader(body))
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
-		if err != nil {
-			lastErr = fmt.Errorf("remote LLM unavailable: %w", err)
-			continue
-		}
-
-		respBody, err = io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
-		if err != nil {
-			lastErr = err
-			continue
-		}
-
-		if resp.StatusCode == 200 {
-			lastErr = nil
-			break
-		}
-
-		lastErr = fmt.Errorf("remote LLM error: %s", string(respBody))
-		if resp.StatusCode < 500 && !strings.Contains(string(respBody), "try again") {
-			return "", lastErr
-		}
-	}
-
-	if lastErr != nil {
-		return "", lastErr
-	}
-
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return "", err
-	}
-
-	if len(result.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
-	}
-
-	return stripTags(result.Choices[0].Message.Content, "think", "drafts"), nil
-}
-
 func isHeraklesLLMServerAvailable() bool {
 	return detectHeraklesLLMServer() == nil
 }
@@ -2641,7 +2514,8 @@ Examples:
   ankigen "What is Docker?"
   ankigen herakles "What is Docker?"
   ankigen c -d "Deep question"
-  ankigen --no-web "Simple definition"`,
+  ankigen --no-web "Simple definition"
+  ankigen batch questions.txt -o cards.tsv`,
 		Args: cobra.ArbitraryArgs,
 		Run:  run,
 	}
@@ -2649,20 +2523,32 @@ Examples:
 	var noWeb bool
 	// keep-sorted start
 	rootCmd.Flags().BoolVar(&addInput, "add-input", false, "Add additional context before generation")
-	rootCmd.Flags().BoolVar(&noWeb, "no-web", false, "Disable web search pipeline")
+	rootCmd.Flags().BoolVar(&allowDuplicate, "allow-duplicate", false, "With --raw --deck, add the card even if the deck already has it")
+	rootCmd.Flags().BoolVar(&multiCard, "multi", false, "Generate a set of cards (basic, reverse, cloze) for the question")
 	rootCmd.Flags().BoolVar(&restoreMode, "restore", false, "Browse and restore from history")
-	rootCmd.Flags().BoolVar(&useExa, "exa", false, "Use Exa API for search (default: DuckDuckGo)")
-	rootCmd.Flags().BoolVarP(&deepThink, "deep-think", "d", false, "Use slower, more capable model")
 	rootCmd.Flags().BoolVarP(&rawOutput, "raw", "r", false, "Output raw response")
-	rootCmd.Flags().Float64Var(&focusThreshold, "focus-threshold", 0.7, "Minimum similarity for focused results (0-1)")
 	rootCmd.Flags().IntVar(&maxSearches, "max-searches", 3, "Max additional searches agent can request (-1 = unlimited)")
-	rootCmd.Flags().IntVarP(&maxTokens, "tokens", "t", 2000, "Max tokens")
 	rootCmd.Flags().IntVarP(&maxTries, "max-tries", "m", 3, "Max generation attempts on parse failure")
+	rootCmd.Flags().StringVar(&ankiBackend, "anki", "", "Anki backend: ankiconnect or api (default: $ANKIGEN_ANKI_BACKEND or ankiconnect)")
+	rootCmd.Flags().StringVar(&ankiDeck, "deck", "", "Deck to add cards to (default: $ANKIGEN_DECK or Default); with --raw, adds the card")
+	rootCmd.Flags().StringVar(&ankiNoteType, "note-type", "Basic", "Note type for cards added to Anki")
+	rootCmd.Flags().StringVar(&ankiURL, "anki-url", "", "Anki backend URL (default: $ANKIGEN_ANKI_URL or the backend's local address)")
 	// keep-sorted end
 
-	rootCmd.PreRun = func(cmd *cobra.Command, args []string) {
+	// Shared with subcommands.
+	// keep-sorted start
+	rootCmd.PersistentFlags().BoolVar(&noWeb, "no-web", false, "Disable web search pipeline")
+	rootCmd.PersistentFlags().BoolVar(&useExa, "exa", false, "Use Exa API for search (default: DuckDuckGo)")
+	rootCmd.PersistentFlags().BoolVarP(&deepThink, "deep-think", "d", false, "Use slower, more capable model")
+	rootCmd.PersistentFlags().Float64Var(&focusThreshold, "focus-threshold", 0.7, "Minimum similarity for focused results (0-1)")
+	rootCmd.PersistentFlags().IntVarP(&maxTokens, "tokens", "t", 2000, "Max tokens")
+	rootCmd.PersistentFlags().StringSliceVar(&ankiTags, "tag", []string{"ankigen"}, "Tags for cards added to or exported for Anki (repeatable)")
+	// keep-sorted end
+
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		webMode = !noWeb
 	}
+	rootCmd.AddCommand(newBatchCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -2679,14 +2565,15 @@ func isLocalAvailable() bool {
 	return resp.StatusCode == 200
 }
 
-func run(cmd *cobra.Command, args []string) {
-	providers := map[string]bool{"local": true, "herakles": true, "claude": true, "chatgpt": true, "gemini": true, "l": true, "g": true, "c": true}
-
-	if len(args) > 0 && providers[args[0]] {
-		provider = args[0]
+// resolveProvider sets provider from a leading provider name in args,
+// falling back to $ANKIGEN_DEFAULT_PROVIDER and then whichever server is
+// reachable, and returns the remaining args.
+func resolveProvider(args []string) []string {
+	if p := lookupProvider(firstArg(args)); p != nil {
+		provider = p.Name
 		args = args[1:]
-	} else if envProvider := os.Getenv("ANKIGEN_DEFAULT_PROVIDER"); envProvider != "" && providers[envProvider] {
-		provider = envProvider
+	} else if p := lookupProvider(os.Getenv("ANKIGEN_DEFAULT_PROVIDER")); p != nil {
+		provider = p.Name
 	} else if isHeraklesLLMServerAvailable() {
 		provider = "herakles"
 	} else if isLocalAvailable() {
@@ -2694,14 +2581,29 @@ func run(cmd *cobra.Command, args []string) {
 	} else {
 		provider = "gemini"
 	}
+	return args
+}
 
-	switch provider {
-	case "l":
-		provider = "local"
-	case "g":
-		provider = "gemini"
-	case "c":
-		provider = "claude"
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func run(cmd *cobra.Command, args []string) {
+	args = resolveProvider(args)
+
+	if ankiBackend == "" {
+		ankiBackend = os.Getenv("ANKIGEN_ANKI_BACKEND")
+	}
+	if ankiURL == "" {
+		ankiURL = os.Getenv("ANKIGEN_ANKI_URL")
+	}
+	var err error
+	if ankiClient, err = newAnkiBackend(ankiBackend, ankiURL); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
 	if restoreMode {
@@ -2758,15 +2660,14 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	if rawOutput {
-		ctx := &PipelineContext{Question: question, AdditionalContext: additionalInputs}
+		ctx := &PipelineContext{Question: question, AdditionalContext: additionalInputs, Multi: multiCard}
 		ctx.History = newHistoryRecord(question, provider)
 		if len(additionalInputs) > 0 {
 			ctx.History.AddEvent("add_input", map[string]any{"inputs": additionalInputs})
 		}
 
-		var err error
 		if webMode {
-			ctx.SearchTerms, err = generateSearchTerms(ctx.Question)
+			ctx.SearchTerms, err = generateSearchTerms(context.Background(), ctx.Question)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
@@ -2788,16 +2689,52 @@ func run(cmd *cobra.Command, args []string) {
 			ctx.History.AddEvent("summary", map[string]any{"summary": ctx.Summary})
 		}
 
-		ctx.Card, err = generateCard(ctx.Question, ctx.Summary, ctx.AdditionalContext)
+		if ctx.Multi {
+			ctx.Cards, err = generateCards(ctx.Question, ctx.Summary, ctx.AdditionalContext)
+			if err == nil {
+				ctx.Card = ctx.Cards[0]
+			}
+		} else {
+			ctx.Card, err = generateCard(context.Background(), ctx.Question, ctx.Summary, ctx.AdditionalContext)
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
 		ctx.CardHistory = append(ctx.CardHistory, ctx.Card)
+
+		var addErrs []error
+		if ankiDeck != "" {
+			cards := ctx.Cards
+			if !ctx.Multi {
+				cards = []Card{ctx.Card}
+			}
+			for i, card := range cards {
+				note := ankiTarget(card)
+				id, dupes, err := addCard(ankiClient, note, allowDuplicate)
+				switch {
+				case err != nil:
+					addErrs = append(addErrs, fmt.Errorf("adding to Anki: %w", err))
+				case len(dupes) > 0:
+					addErrs = append(addErrs, fmt.Errorf("%s already has note(s) %s; use --allow-duplicate to add anyway", note.Deck, formatNoteIDs(dupes)))
+				default:
+					recordNoteID(ctx, i, note, ankiClient.Name(), id)
+				}
+			}
+		}
 		saveHistoryFunc(ctx)
 
-		output, _ := json.MarshalIndent(ctx.Card, "", "  ")
+		var output []byte
+		if ctx.Multi {
+			output, _ = json.MarshalIndent(ctx.Cards, "", "  ")
+		} else {
+			output, _ = json.MarshalIndent(ctx.Card, "", "  ")
+		}
 		fmt.Println(string(output))
+		if len(addErrs) > 0 {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", errors.Join(addErrs...))
+			os.Exit(1)
+		}
 		return
 	}
 
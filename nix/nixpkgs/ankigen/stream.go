@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errCancelled = errors.New("generation cancelled")
+
+// startRun begins a cancellable generation run in the TUI. Requests made
+// during it stream their output into the context's draft.
+func (ctx *PipelineContext) startRun() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+	ctx.run, ctx.cancel = context.WithCancel(context.Background())
+	ctx.draft.Reset()
+}
+
+// cancelRun stops the run, aborting the request in flight.
+func (ctx *PipelineContext) cancelRun() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.cancel != nil {
+		ctx.cancel()
+	}
+}
+
+// runContext is the run's context, or the background context outside the
+// TUI.
+func (ctx *PipelineContext) runContext() context.Context {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.run == nil {
+		return context.Background()
+	}
+	return ctx.run
+}
+
+// request clears the draft for a new request, returning the context it
+// runs in and where to stream its output; onDelta is nil outside a run.
+func (ctx *PipelineContext) request() (context.Context, func(string)) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.draft.Reset()
+	if ctx.run == nil {
+		return context.Background(), nil
+	}
+	return ctx.run, ctx.appendDraft
+}
+
+func (ctx *PipelineContext) appendDraft(s string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.draft.WriteString(s)
+}
+
+// Draft is the output streamed so far by the request in flight.
+func (ctx *PipelineContext) Draft() string {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.draft.String()
+}
+
+// streamLLM is callLLMWithSystem within the context's run.
+func (ctx *PipelineContext) streamLLM(systemPrompt, userPrompt string, useFast bool) (string, error) {
+	run, onDelta := ctx.request()
+	return callLLMStream(run, onDelta, systemPrompt, userPrompt, useFast)
+}
+
+// previewText drops reasoning and drafts from partial output, including a
+// block still being written.
+func previewText(s string) string {
+	s = stripTags(s, "think", "drafts")
+	for _, open := range []string{"<think>", "<drafts>"} {
+		if i := strings.Index(s, open); i != -1 {
+			s = s[:i]
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// draftField reads a string field from JSON that may be cut off part way,
+// returning what has arrived of its value.
+func draftField(s, key string) (string, bool) {
+	i := strings.Index(s, `"`+key+`"`)
+	if i == -1 {
+		return "", false
+	}
+	rest := strings.TrimLeft(s[i+len(key)+2:], " \t\r\n")
+	rest, ok := strings.CutPrefix(rest, ":")
+	if !ok {
+		return "", false
+	}
+	rest, ok = strings.CutPrefix(strings.TrimLeft(rest, " \t\r\n"), `"`)
+	if !ok {
+		return "", false
+	}
+
+	end := len(rest)
+	for j := 0; j < len(rest); j++ {
+		if rest[j] == '\\' {
+			j++
+			continue
+		}
+		if rest[j] == '"' {
+			end = j
+			break
+		}
+	}
+	// A value cut off mid escape decodes once the partial escape is dropped.
+	raw := rest[:end]
+	for trim := 0; trim <= 6 && trim <= len(raw); trim++ {
+		var value string
+		if json.Unmarshal([]byte(`"`+raw[:len(raw)-trim]+`"`), &value) == nil {
+			return value, true
+		}
+	}
+	return raw, true
+}
+
+// tailLines keeps the last n lines of s, so a growing draft scrolls.
+func tailLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(lines[len(lines)-n:], "\n")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSSE writes each event as a server-sent event, flushing as it goes.
+func writeSSE(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, e := range events {
+		_, _ = fmt.Fprintf(w, "data: %s\n\n", e)
+		w.(http.Flusher).Flush()
+	}
+}
+
+// chatStream answers a chat completion as a stream, a word at a time.
+func chatStream(w http.ResponseWriter, content string) {
+	var events []string
+	for _, word := range strings.SplitAfter(content, " ") {
+		chunk, _ := json.Marshal(map[string]any{"choices": []map[string]any{{"delta": map[string]string{"content": word}}}})
+		events = append(events, string(chunk))
+	}
+	writeSSE(w, append(events, "[DONE]")...)
+}
+
+// toolStream answers a chat completion with a call to name, streaming its
+// arguments in two halves.
+func toolStream(w http.ResponseWriter, name, args string) {
+	event := func(function map[string]string) string {
+		chunk, _ := json.Marshal(map[string]any{"choices": []map[string]any{{"delta": map[string]any{
+			"tool_calls": []map[string]any{{"index": 0, "function": function}},
+		}}}})
+		return string(chunk)
+	}
+	half := len(args) / 2
+	writeSSE(w,
+		event(map[string]string{"name": name, "arguments": ""}),
+		event(map[string]string{"arguments": args[:half]}),
+		event(map[string]string{"arguments": args[half:]}),
+		"[DONE]",
+	)
+}
+
+func TestProviders_Stream(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "ak")
+	t.Setenv("OPENAI_API_KEY", "ok")
+	t.Setenv("GEMINI_API_KEY", "gk")
+
+	var path string
+	var body map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, body = r.URL.RequestURI(), nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		tools := body["tools"] != nil
+		switch {
+		case strings.HasPrefix(path, "/anthropic") && tools:
+			writeSSE(w,
+				`{"type": "message_start"}`,
+				`{"type": "content_block_start", "index": 0, "content_block": {"type": "tool_use", "name": "ask", "input": {}}}`,
+				`{"type": "content_block_delta", "index": 0, "delta": {"type": "input_json_delta", "partial_json": "{\"question\": "}}`,
+				`{"type": "content_block_delta", "index": 0, "delta": {"type": "input_json_delta", "partial_json": "\"Which?\"}"}}`,
+				`{"type": "message_stop"}`)
+		case strings.HasPrefix(path, "/anthropic"):
+			writeSSE(w,
+				`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+				`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "from "}}`,
+				`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "claude"}}`)
+		case strings.HasPrefix(path, "/openai") && tools:
+			writeSSE(w,
+				`{"type": "response.output_item.added", "item": {"type": "function_call", "name": "ask"}}`,
+				`{"type": "response.function_call_arguments.delta", "delta": "{\"question\": "}`,
+				`{"type": "response.function_call_arguments.delta", "delta": "\"Which?\"}"}`,
+				`{"type": "response.completed"}`)
+		case strings.HasPrefix(path, "/openai"):
+			writeSSE(w,
+				`{"type": "response.output_text.delta", "delta": "from "}`,
+				`{"type": "response.output_text.delta", "delta": "openai"}`)
+		case strings.HasPrefix(path, "/gemini") && tools:
+			writeSSE(w, `{"candidates": [{"content": {"parts": [{"functionCall": {"name": "ask", "args": {"question": "Which?"}}}]}}]}`)
+		case strings.HasPrefix(path, "/gemini"):
+			writeSSE(w,
+				`{"candidates": [{"content": {"parts": [{"text": "from "}]}}]}`,
+				`{"candidates": [{"content": {"parts": [{"text": "gemini"}]}}]}`)
+		case strings.HasPrefix(path, "/chat") && tools:
+			toolStream(w, "ask", `{"question": "Which?"}`)
+		case strings.HasPrefix(path, "/chat"):
+			chatStream(w, "from chat")
+		}
+	}))
+	defer server.Close()
+
+	model := "m"
+	tests := []struct {
+		provider LLMProvider
+		path     string
+		want     string
+	}{
+		{&anthropicProvider{url: server.URL + "/anthropic", keyEnv: "ANTHROPIC_API_KEY"}, "/anthropic", "from claude"},
+		{&openAIProvider{url: server.URL + "/openai", keyEnv: "OPENAI_API_KEY"}, "/openai", "from openai"},
+		{&geminiProvider{url: server.URL + "/gemini", keyEnv: "GEMINI_API_KEY", models: modelTable{"big", "small"}}, "/gemini/big:streamGenerateContent?alt=sse", "from gemini"},
+		{&chatCompletionsProvider{label: "Chat", model: &model, timeout: time.Second, detect: func() (string, error) { return server.URL + "/chat", nil }}, "/chat/chat/completions", "from chat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider.Label(), func(t *testing.T) {
+			var deltas strings.Builder
+			req := LLMRequest{Prompt: "hi", MaxTokens: 10, OnDelta: func(s string) { deltas.WriteString(s) }}
+
+			text, err := tt.provider.Complete(context.Background(), req)
+			if err != nil || text != tt.want || deltas.String() != tt.want {
+				t.Fatalf("Complete() = %q, %v with deltas %q, want %q", text, err, deltas.String(), tt.want)
+			}
+			if path != tt.path || (body["stream"] != true && tt.provider.Label() != "Gemini") {
+				t.Errorf("request to %s with stream = %v", path, body["stream"])
+			}
+
+			deltas.Reset()
+			call, _, err := tt.provider.(ToolCaller).CompleteTools(context.Background(), req, agentTools)
+			if err != nil || call == nil {
+				t.Fatalf("CompleteTools() = %v, %v", call, err)
+			}
+			var args struct{ Question string }
+			if call.Name != "ask" || json.Unmarshal(call.Arguments, &args) != nil || args.Question != "Which?" {
+				t.Errorf("call = %s(%s)", call.Name, call.Arguments)
+			}
+			if !strings.Contains(deltas.String(), "Which?") {
+				t.Errorf("deltas = %q, want the arguments", deltas.String())
+			}
+		})
+	}
+}
+
+func TestDraftField(t *testing.T) {
+	tests := []struct {
+		draft, key, want string
+		ok               bool
+	}{
+		{`{"front": "What is a chan`, "front", "What is a chan", true},
+		{`{"front":"Q \"x\"", "back": "line\nbre`, "back", "line\nbre", true},
+		{`{"front": "cut \`, "front", "cut ", true},
+		{`{"front": "caf\u00`, "front", "caf", true},
+		{`{"front": "Q", "ba`, "back", "", false},
+		{`<think>hmm`, "front", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := draftField(tt.draft, tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("draftField(%q, %s) = %q, %v, want %q, %v", tt.draft, tt.key, got, ok, tt.want, tt.ok)
+		}
+	}
+	if got := previewText("<think>a</think>Channels are <drafts>x"); got != "Channels are" {
+		t.Errorf("previewText() = %q", got)
+	}
+}
+
+// TestUpdate_KeyPress_StopGeneration checks q mid-generation shows the
+// streamed draft, then aborts the request and keeps the TUI open.
+func TestUpdate_KeyPress_StopGeneration(t *testing.T) {
+	started := make(chan struct{})
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, `{"choices": [{"delta": {"tool_calls": [{"index": 0, "function": {"name": "generate", "arguments": "{\"front\": \"What is a Go"}}]}}]}`)
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	savedTries := maxTries
+	maxTries = 3
+	defer func() { maxTries = savedTries }()
+
+	m := initialModel("What is a channel?", false)
+	m.Init()
+	m, cmd := sendMsg(m, stageCompleteMsg{stage: generateStage{}, ctx: m.context})
+	result := make(chan any, 1)
+	go func() { result <- cmd() }()
+
+	select {
+	case <-started:
+	case msg := <-result:
+		t.Fatalf("agent turn returned %+v before streaming", msg)
+	}
+	for deadline := time.Now().Add(time.Second); !strings.Contains(m.View(), "What is a Go"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("draft not shown:\n%s", m.View())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	m, _ = sendKey(m, "q")
+	if m.quitting || !m.done || m.err != errCancelled {
+		t.Fatalf("after q: quitting = %v, done = %v, err = %v", m.quitting, m.done, m.err)
+	}
+	select {
+	case msg := <-result:
+		if msg != nil {
+			t.Errorf("cancelled turn returned %T, want nothing", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not cancelled")
+	}
+	if events := m.context.History.Events; events[len(events)-1].Type != "cancelled" {
+		t.Errorf("history events = %+v, want cancelled last", events)
+	}
+
+	if m, _ = sendKey(m, "q"); !m.quitting {
+		t.Error("second q: quitting = false, want true")
+	}
+}
+
+// TestRunStage_StopSearchTerms checks stopping the run aborts the search
+// term request and leaves the context untouched.
+func TestRunStage_StopSearchTerms(t *testing.T) {
+	started := make(chan struct{})
+	useFakeProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			chatReply(w, `["late term"]`)
+		}
+	})
+
+	ctx := &PipelineContext{Question: "What is a channel?"}
+	ctx.startRun()
+	cmd := runStage(searchTermsStage{}, ctx)
+	result := make(chan any, 1)
+	go func() { result <- cmd() }()
+
+	<-started
+	ctx.cancelRun()
+	select {
+	case msg := <-result:
+		if msg != nil {
+			t.Errorf("stopped stage returned %T, want nothing", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("search term request not cancelled")
+	}
+	if ctx.SearchTerms != nil {
+		t.Errorf("SearchTerms = %v, want unset", ctx.SearchTerms)
+	}
+}
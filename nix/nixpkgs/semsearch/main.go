@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -14,15 +15,29 @@ import (
 )
 
 var (
-	threshold  float64
-	numResults int
-	embedURL   string
-	embedModel string
-	skipEmbed  bool
-	jsonOutput bool
-	quiet      bool
-	noPager    bool
-	readable   bool
+	threshold        float64
+	numResults       int
+	chunkTokens      int
+	chunkOverlap     int
+	embedURL         string
+	embedModel       string
+	embedBatch       int
+	embedBatchTokens int
+	embedConcurrency int
+	skipEmbed        bool
+	jsonOutput       bool
+	quiet            bool
+	noPager          bool
+	readable         bool
+	answer           bool
+	chatURL          string
+	chatModel        string
+	format           string
+	templateText     string
+	stream           bool
+	expand           int
+	mmrTopK          int
+	mmrLambda        float64
 )
 
 type cliLogger struct{}
@@ -43,7 +58,14 @@ filters results using semantic embeddings to find the most relevant content.
 Credentials are fetched via 'secrets get custom-search-api-key' and
 'secrets get custom-search-api-id' by default. Override with env vars
 SEMSEARCH_GOOGLE_API_KEY/SEMSEARCH_GOOGLE_CX or *_SECRET_NAME variants.
-Results are formatted as markdown and piped to $PAGER when output is a terminal.`,
+Results are formatted as markdown and piped to $PAGER when output is a terminal.
+Use --format to choose text, markdown, json, jsonl, org, html or template; the
+template format executes --template (a Go text/template, or @file) once per
+result with .Title, .URL, .Text, .Score, .Excerpts and .Index. With --stream,
+results are written as each query completes instead of after all queries.
+
+With --answer, the filtered results are sent to an OpenAI-compatible chat
+endpoint which returns a concise answer citing the results by number.`,
 		Args: cobra.MinimumNArgs(0),
 		RunE: runSearch,
 	}
@@ -51,12 +73,26 @@ Results are formatted as markdown and piped to $PAGER when output is a terminal.
 	rootCmd.Flags().Float64VarP(&threshold, "threshold", "t", 0.7, "Similarity threshold for filtering (0-1)")
 	rootCmd.Flags().IntVarP(&numResults, "num-results", "n", 5, "Max results per search term")
 	rootCmd.Flags().StringVarP(&embedURL, "embed-url", "e", "http://herakles.home:4000/v1", "Embedding API URL")
-	rootCmd.Flags().StringVarP(&embedModel, "model", "m", "qwen-embed", "Embedding model name")
+	rootCmd.Flags().StringVarP(&embedModel, "model", "m", "", "Embedding model name (default: first served model with \"embed\" in its name)")
+	rootCmd.Flags().IntVar(&embedBatch, "embed-batch", semsearch.DefaultEmbedBatchSize, "Max texts per embeddings request")
+	rootCmd.Flags().IntVar(&embedBatchTokens, "embed-batch-tokens", semsearch.DefaultEmbedBatchTokens, "Max estimated tokens per embeddings request")
+	rootCmd.Flags().IntVar(&embedConcurrency, "embed-concurrency", semsearch.DefaultEmbedConcurrency, "Max embeddings requests in flight")
+	rootCmd.Flags().IntVar(&chunkTokens, "chunk-tokens", semsearch.DefaultChunkTokens, "Max estimated tokens per chunk when filtering")
+	rootCmd.Flags().IntVar(&chunkOverlap, "chunk-overlap", semsearch.DefaultChunkOverlap, "Estimated tokens of overlap between consecutive chunks")
+	rootCmd.Flags().IntVarP(&expand, "expand", "x", 0, "Add this many LLM-generated lateral queries (uses --chat-url)")
+	rootCmd.Flags().IntVar(&mmrTopK, "mmr-k", 0, "Keep at most this many chunks, chosen by maximal marginal relevance (0 = off)")
+	rootCmd.Flags().Float64Var(&mmrLambda, "mmr-lambda", semsearch.DefaultMMRLambda, "MMR trade-off between relevance (1) and diversity (0)")
 	rootCmd.Flags().BoolVar(&skipEmbed, "skip-embed", false, "Skip semantic filtering")
-	rootCmd.Flags().BoolVarP(&jsonOutput, "json", "j", false, "Output as JSON")
+	rootCmd.Flags().BoolVarP(&jsonOutput, "json", "j", false, "Output as JSON (same as --format json)")
 	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Suppress progress output")
 	rootCmd.Flags().BoolVar(&noPager, "no-pager", false, "Disable pager output")
 	rootCmd.Flags().BoolVar(&readable, "readable", false, "Wrap text at 80 chars (default when using pager)")
+	rootCmd.Flags().StringVarP(&format, "format", "f", "", "Output format: "+strings.Join(semsearch.FormatNames(), ", "))
+	rootCmd.Flags().StringVar(&templateText, "template", "", "Go text/template executed per result (prefix with @ to read a file)")
+	rootCmd.Flags().BoolVarP(&stream, "stream", "s", false, "Write results as each query completes (disables pager)")
+	rootCmd.Flags().BoolVarP(&answer, "answer", "a", false, "Synthesise a cited answer from the results")
+	rootCmd.Flags().StringVar(&chatURL, "chat-url", "http://herakles.home:4000/v1", "Chat completions API URL for --answer and --expand")
+	rootCmd.Flags().StringVar(&chatModel, "chat-model", "", "Chat model for --answer and --expand (default: first served model without \"embed\" in its name)")
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -85,16 +121,59 @@ func runSearch(cmd *cobra.Command, args []string) error {
 	}
 
 	cfg := semsearch.Config{
-		GoogleAPIKey: getEnvOrSecret("SEMSEARCH_GOOGLE_API_KEY", "custom-search-api-key"),
-		GoogleCX:     getEnvOrSecret("SEMSEARCH_GOOGLE_CX", "custom-search-api-id"),
-		EmbedURL:     embedURL,
-		EmbedModel:   embedModel,
-		Threshold:    threshold,
-		NumResults:   numResults,
+		GoogleAPIKey:     getEnvOrSecret("SEMSEARCH_GOOGLE_API_KEY", "custom-search-api-key"),
+		GoogleCX:         getEnvOrSecret("SEMSEARCH_GOOGLE_CX", "custom-search-api-id"),
+		EmbedURL:         embedURL,
+		EmbedModel:       embedModel,
+		EmbedBatchSize:   embedBatch,
+		EmbedBatchTokens: embedBatchTokens,
+		EmbedConcurrency: embedConcurrency,
+		Threshold:        threshold,
+		NumResults:       numResults,
+		ChunkTokens:      chunkTokens,
+		ChunkOverlap:     chunkOverlap,
+		ChatURL:          chatURL,
+		ChatModel:        chatModel,
+		Expansions:       expand,
+		MMRTopK:          mmrTopK,
+		MMRLambda:        mmrLambda,
 	}
 
 	log := cliLogger{}
+	question := strings.Join(queries, " ")
+
+	if expand > 0 {
+		extra, err := semsearch.ExpandQueries(question, cfg, log)
+		if err != nil {
+			log.Logf("Query expansion failed: %v, skipping", err)
+		}
+		queries = append(queries, extra...)
+	}
 	log.Logf("Searching for: %s", strings.Join(queries, ", "))
+	useEmbed := false
+	if !skipEmbed {
+		model, err := semsearch.ResolveEmbedModel(cfg)
+		switch {
+		case err == nil:
+			cfg.EmbedModel = model
+			useEmbed = true
+		case errors.Is(err, semsearch.ErrModelNotServed):
+			return err
+		default:
+			log.Logf("Embedding server unavailable, skipping filter: %v", err)
+		}
+	}
+
+	if stream {
+		if answer {
+			return fmt.Errorf("--stream cannot be combined with --answer")
+		}
+		f, err := newFormatter()
+		if err != nil {
+			return err
+		}
+		return streamResults(queries, question, cfg, f, useEmbed, log)
+	}
 
 	results, err := semsearch.SearchMultiple(queries, cfg)
 	if err != nil {
@@ -102,37 +181,105 @@ func runSearch(cmd *cobra.Command, args []string) error {
 	}
 	log.Logf("Found %d results", len(results))
 
-	if !skipEmbed && semsearch.IsEmbedServerAvailable(cfg) {
-		log.Logf("Filtering with threshold %.2f", threshold)
-		filtered, err := semsearch.Filter(strings.Join(queries, " "), results, cfg, log)
-		if err != nil {
-			log.Logf("Filtering failed: %v, skipping", err)
-		} else {
-			results = filtered
-		}
-	} else if !skipEmbed {
-		log.Logf("Embedding server unavailable, skipping filter")
+	if useEmbed {
+		results = filterResults(question, results, cfg, log)
 	}
 
-	var output string
-	if jsonOutput {
-		data, err := json.MarshalIndent(results, "", "  ")
+	if answer {
+		a, err := semsearch.Synthesise(question, results, cfg, log)
 		if err != nil {
 			return err
 		}
-		output = string(data)
-	} else {
-		useReadable := readable || (!noPager && isatty.IsTerminal(os.Stdout.Fd()))
-		if useReadable {
-			output = formatReadable(results)
-		} else {
-			output = semsearch.FormatResults(results)
+		if jsonOutput || format == "json" {
+			data, err := json.MarshalIndent(a, "", "  ")
+			if err != nil {
+				return err
+			}
+			return outputWithPager(string(data) + "\n")
 		}
+		return outputWithPager(semsearch.FormatAnswer(a))
 	}
 
+	f, err := newFormatter()
+	if err != nil {
+		return err
+	}
+	output, err := semsearch.FormatAll(f, results)
+	if err != nil {
+		return err
+	}
 	return outputWithPager(output)
 }
 
+// streamResults writes each query's results as soon as they have been
+// searched and filtered, skipping URLs already written for earlier queries.
+func streamResults(queries []string, question string, cfg semsearch.Config, f semsearch.Formatter, useEmbed bool, log cliLogger) error {
+	if err := f.Begin(os.Stdout); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	err := semsearch.SearchEach(queries, cfg, func(query string, results []semsearch.Result) error {
+		log.Logf("Found %d results for: %s", len(results), query)
+		var fresh []semsearch.Result
+		for _, r := range results {
+			if r.URL == "" || !seen[r.URL] {
+				seen[r.URL] = true
+				fresh = append(fresh, r)
+			}
+		}
+		if useEmbed && len(fresh) > 0 {
+			fresh = filterResults(question, fresh, cfg, log)
+		}
+		for _, r := range fresh {
+			if err := f.Write(os.Stdout, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.End(os.Stdout)
+}
+
+func filterResults(question string, results []semsearch.Result, cfg semsearch.Config, log cliLogger) []semsearch.Result {
+	log.Logf("Filtering with threshold %.2f", cfg.Threshold)
+	filtered, err := semsearch.Filter(question, results, cfg, log)
+	if err != nil {
+		log.Logf("Filtering failed: %v, skipping", err)
+		return results
+	}
+	return filtered
+}
+
+// newFormatter resolves --format, falling back to the legacy --json and
+// --readable flags, then to markdown on a terminal and labelled text otherwise.
+func newFormatter() (semsearch.Formatter, error) {
+	name := format
+	switch {
+	case name != "":
+	case templateText != "":
+		name = "template"
+	case jsonOutput:
+		name = "json"
+	case readable || (!noPager && isatty.IsTerminal(os.Stdout.Fd())):
+		name = "markdown"
+	default:
+		name = "text"
+	}
+
+	tmpl := templateText
+	if path, ok := strings.CutPrefix(tmpl, "@"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading template: %w", err)
+		}
+		tmpl = string(data)
+	}
+	return semsearch.NewFormatter(name, tmpl)
+}
+
 func outputWithPager(content string) error {
 	if noPager || !isatty.IsTerminal(os.Stdout.Fd()) {
 		fmt.Print(content)
@@ -151,25 +298,6 @@ func outputWithPager(content string) error {
 	return cmd.Run()
 }
 
-func formatReadable(results []semsearch.Result) string {
-	var b strings.Builder
-	for i, r := range results {
-		if i > 0 {
-			b.WriteString("\n---\n\n")
-		}
-		if r.Title != "" {
-			b.WriteString("## " + r.Title + "\n")
-		}
-		if r.URL != "" {
-			b.WriteString(r.URL + "\n")
-		}
-		if r.Text != "" {
-			b.WriteString("\n" + wrapText(r.Text, 80) + "\n")
-		}
-	}
-	return b.String()
-}
-
 func getEnvOrSecret(envName, defaultSecret string) string {
 	if val := os.Getenv(envName); val != "" {
 		return val
@@ -187,30 +315,3 @@ func getEnvOrSecret(envName, defaultSecret string) string {
 	}
 	return strings.TrimSpace(string(out))
 }
-
-func wrapText(text string, width int) string {
-	var result strings.Builder
-	for _, line := range strings.Split(text, "\n") {
-		if len(line) <= width {
-			result.WriteString(line + "\n")
-			continue
-		}
-		words := strings.Fields(line)
-		var current strings.Builder
-		for _, word := range words {
-			if current.Len() == 0 {
-				current.WriteString(word)
-			} else if current.Len()+1+len(word) <= width {
-				current.WriteString(" " + word)
-			} else {
-				result.WriteString(current.String() + "\n")
-				current.Reset()
-				current.WriteString(word)
-			}
-		}
-		if current.Len() > 0 {
-			result.WriteString(current.String() + "\n")
-		}
-	}
-	return strings.TrimRight(result.String(), "\n")
-}
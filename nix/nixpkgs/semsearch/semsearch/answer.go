@@ -0,0 +1,249 @@
+package semsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Answer is a concise response to a question synthesised from search results.
+// Text cites sources inline as [n], where n is a Citation.Number.
+type Answer struct {
+	Question  string     `json:"question"`
+	Text      string     `json:"answer"`
+	Citations []Citation `json:"citations"`
+}
+
+// Citation is a numbered source referenced from Answer.Text, together with
+// the chunks of that source the model relied on.
+type Citation struct {
+	Number int          `json:"number"`
+	Title  string       `json:"title"`
+	URL    string       `json:"url"`
+	Chunks []CitedChunk `json:"chunks"`
+}
+
+// CitedChunk is a chunk of a result that the model cited. ID is the chunk's
+// number in the prompt sent to the model.
+type CitedChunk struct {
+	ID      int    `json:"id"`
+	Heading string `json:"heading,omitempty"`
+	Text    string `json:"text"`
+}
+
+type answerSource struct {
+	resultIdx int
+	chunk     CitedChunk
+}
+
+const answerSystemPrompt = `You answer questions using only the numbered sources provided.
+Cite every claim inline with the number of the source that supports it in square brackets, e.g. [2] or [1][3].
+Be concise: a few sentences or a short list. If the sources do not answer the question, say so plainly.`
+
+var (
+	citationRe   = regexp.MustCompile(`\s*(?:\[\d+(?:\s*,\s*\d+)*\])+`)
+	citationIDRe = regexp.MustCompile(`\d+`)
+)
+
+// Synthesise asks the chat model in cfg to answer question from the given
+// results. Results that have been through Filter contribute their excerpts;
+// others are chunked in full.
+func Synthesise(question string, results []Result, cfg Config, log Logger) (*Answer, error) {
+	if log == nil {
+		log = NoopLogger()
+	}
+
+	sources := answerSources(results, cfg)
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources to answer from")
+	}
+
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Question: %s\n\nSources:\n", question)
+	for _, s := range sources {
+		r := results[s.resultIdx]
+		fmt.Fprintf(&prompt, "\n[%d] %s (%s)\n", s.chunk.ID, r.Title, r.URL)
+		if s.chunk.Heading != "" {
+			fmt.Fprintf(&prompt, "Section: %s\n", s.chunk.Heading)
+		}
+		prompt.WriteString(s.chunk.Text + "\n")
+	}
+
+	log.Logf("Synthesising answer from %d chunks", len(sources))
+	text, err := chatComplete(answerSystemPrompt, prompt.String(), 0.2, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := resolveCitations(text, results, sources)
+	answer.Question = question
+	log.Logf("Answer cites %d sources", len(answer.Citations))
+	return answer, nil
+}
+
+func answerSources(results []Result, cfg Config) []answerSource {
+	var sources []answerSource
+	for i, r := range results {
+		if len(r.Excerpts) > 0 {
+			for _, e := range r.Excerpts {
+				sources = append(sources, answerSource{i, CitedChunk{Heading: e.Heading, Text: e.Text}})
+			}
+			continue
+		}
+		for _, c := range ChunkText(r.Text, cfg.chunkOptions()) {
+			sources = append(sources, answerSource{i, CitedChunk{Heading: c.Heading, Text: c.Text}})
+		}
+	}
+	for i := range sources {
+		sources[i].chunk.ID = i + 1
+	}
+	return sources
+}
+
+// resolveCitations renumbers chunk citations in text so that each cited
+// result gets a single number, in order of first appearance.
+func resolveCitations(text string, results []Result, sources []answerSource) *Answer {
+	answer := &Answer{Citations: []Citation{}}
+	byResult := map[int]int{}
+	seenChunk := map[int]bool{}
+
+	cite := func(chunkID int) (int, bool) {
+		if chunkID < 1 || chunkID > len(sources) {
+			return 0, false
+		}
+		s := sources[chunkID-1]
+		idx, ok := byResult[s.resultIdx]
+		if !ok {
+			r := results[s.resultIdx]
+			answer.Citations = append(answer.Citations, Citation{Number: len(answer.Citations) + 1, Title: r.Title, URL: r.URL})
+			idx = len(answer.Citations) - 1
+			byResult[s.resultIdx] = idx
+		}
+		if !seenChunk[chunkID] {
+			seenChunk[chunkID] = true
+			answer.Citations[idx].Chunks = append(answer.Citations[idx].Chunks, s.chunk)
+		}
+		return answer.Citations[idx].Number, true
+	}
+
+	answer.Text = citationRe.ReplaceAllStringFunc(text, func(marker string) string {
+		var numbers []int
+		for _, part := range citationIDRe.FindAllString(marker, -1) {
+			id, err := strconv.Atoi(part)
+			if err != nil {
+				continue
+			}
+			if n, ok := cite(id); ok && !slices.Contains(numbers, n) {
+				numbers = append(numbers, n)
+			}
+		}
+		if len(numbers) == 0 {
+			// Drop the space before an invalid marker along with it.
+			return ""
+		}
+		slices.Sort(numbers)
+		var b strings.Builder
+		b.WriteString(marker[:len(marker)-len(strings.TrimLeftFunc(marker, unicode.IsSpace))])
+		for _, n := range numbers {
+			fmt.Fprintf(&b, "[%d]", n)
+		}
+		return b.String()
+	})
+	answer.Text = strings.TrimSpace(answer.Text)
+	return answer
+}
+
+// FormatAnswer formats an answer followed by its numbered source list.
+func FormatAnswer(a *Answer) string {
+	var b strings.Builder
+	b.WriteString(a.Text + "\n")
+	if len(a.Citations) > 0 {
+		b.WriteString("\nSources:\n")
+		for _, c := range a.Citations {
+			fmt.Fprintf(&b, "[%d] %s\n    %s\n", c.Number, c.Title, c.URL)
+		}
+	}
+	return b.String()
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+// ResolveChatModel returns cfg.ChatModel or, when it is empty, the first
+// model served by cfg.ChatURL without "embed" in its name, since embedding
+// models are often served alongside chat models and reject chat requests.
+func ResolveChatModel(cfg Config) (string, error) {
+	if cfg.ChatModel != "" {
+		return cfg.ChatModel, nil
+	}
+	models, err := ListModels(cfg.ChatURL)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range models {
+		if !strings.Contains(strings.ToLower(m), "embed") {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no chat model at %s (available: %s)",
+		ErrModelNotServed, cfg.ChatURL, strings.Join(models, ", "))
+}
+
+var thinkRe = regexp.MustCompile(`(?s)<think>.*?</think>`)
+
+// chatComplete sends a single-turn request to the OpenAI-compatible chat
+// endpoint at cfg.ChatURL.
+func chatComplete(systemPrompt, userPrompt string, temperature float64, cfg Config) (string, error) {
+	model, err := ResolveChatModel(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	payload := map[string]any{
+		"model": model,
+		"messages": []map[string]string{
+			{"role": "system", "content": systemPrompt},
+			{"role": "user", "content": cfg.ChatPromptPrefix + userPrompt},
+		},
+		"temperature": temperature,
+		"stream":      false,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Post(cfg.ChatURL+"/chat/completions", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("chat API error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result chatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("chat API returned no choices")
+	}
+	return strings.TrimSpace(thinkRe.ReplaceAllString(result.Choices[0].Message.Content, "")), nil
+}
@@ -0,0 +1,93 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveCitations(t *testing.T) {
+	results := []Result{
+		{Title: "A", URL: "https://a.example"},
+		{Title: "B", URL: "https://b.example"},
+	}
+	sources := []answerSource{
+		{0, CitedChunk{ID: 1, Text: "a1"}},
+		{1, CitedChunk{ID: 2, Text: "b1"}},
+		{0, CitedChunk{ID: 3, Text: "a2"}},
+	}
+
+	got := resolveCitations("B says so [2]. A agrees [1][3], twice [3, 1]. Bogus [9].", results, sources)
+
+	if want := "B says so [1]. A agrees [2], twice [2]. Bogus."; got.Text != want {
+		t.Errorf("Text = %q, want %q", got.Text, want)
+	}
+	if len(got.Citations) != 2 {
+		t.Fatalf("got %d citations, want 2", len(got.Citations))
+	}
+	if c := got.Citations[0]; c.Number != 1 || c.URL != "https://b.example" || len(c.Chunks) != 1 {
+		t.Errorf("citation 1 = %+v, want B with one chunk", c)
+	}
+	if c := got.Citations[1]; c.Number != 2 || c.URL != "https://a.example" || len(c.Chunks) != 2 {
+		t.Errorf("citation 2 = %+v, want A with two chunks", c)
+	}
+}
+
+func TestSynthesise(t *testing.T) {
+	var gotPrompt string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "chat" {
+			t.Errorf("model = %q, want %q", req.Model, "chat")
+		}
+		gotPrompt = req.Messages[len(req.Messages)-1].Content
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"<think>hmm</think>Go is compiled [1]."}}]}`))
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.ChatURL = srv.URL
+	cfg.ChatModel = "chat"
+	results := []Result{{
+		Title:    "Go",
+		URL:      "https://go.dev",
+		Excerpts: []Excerpt{{Text: "Go is a compiled language.", Heading: "About"}},
+	}}
+
+	a, err := Synthesise("Is Go compiled?", results, cfg, nil)
+	if err != nil {
+		t.Fatalf("Synthesise() error = %v", err)
+	}
+	if a.Text != "Go is compiled [1]." {
+		t.Errorf("Text = %q", a.Text)
+	}
+	if len(a.Citations) != 1 || a.Citations[0].Chunks[0].Heading != "About" {
+		t.Errorf("Citations = %+v", a.Citations)
+	}
+	if !strings.Contains(gotPrompt, "[1] Go (https://go.dev)") {
+		t.Errorf("prompt missing numbered source: %q", gotPrompt)
+	}
+}
+
+func TestResolveChatModel(t *testing.T) {
+	srv, _ := newEmbedServer(t, []string{"qwen-embed", "qwen-chat"}, func(string) int { return 1 })
+
+	if got, err := ResolveChatModel(Config{ChatURL: srv.URL}); err != nil || got != "qwen-chat" {
+		t.Errorf("auto: got %q, %v; want qwen-chat", got, err)
+	}
+	if got, _ := ResolveChatModel(Config{ChatURL: srv.URL, ChatModel: "other"}); got != "other" {
+		t.Errorf("explicit: got %q", got)
+	}
+}
@@ -0,0 +1,355 @@
+package semsearch
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunk is a token-bounded span of a document used as the unit of embedding.
+// Start and End are byte offsets into the original text; Text is the span with
+// markup removed.
+type Chunk struct {
+	Text    string `json:"text"`
+	Heading string `json:"heading,omitempty"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+}
+
+// EmbedText returns the chunk text prefixed with its heading path so that the
+// embedding carries the section context.
+func (c Chunk) EmbedText() string {
+	if c.Heading == "" {
+		return c.Text
+	}
+	return c.Heading + "\n\n" + c.Text
+}
+
+// ChunkOptions bounds chunk size, both measured in estimated tokens.
+type ChunkOptions struct {
+	MaxTokens     int
+	OverlapTokens int
+}
+
+// Chunk size defaults, in estimated tokens.
+const (
+	DefaultChunkTokens  = 256
+	DefaultChunkOverlap = 32
+)
+
+func (o ChunkOptions) withDefaults() ChunkOptions {
+	if o.MaxTokens <= 0 {
+		o.MaxTokens = DefaultChunkTokens
+	}
+	if o.OverlapTokens < 0 || o.OverlapTokens >= o.MaxTokens {
+		o.OverlapTokens = 0
+	}
+	return o
+}
+
+type blockKind int
+
+const (
+	blockParagraph blockKind = iota
+	blockHeading
+	blockCode
+	blockList
+)
+
+type block struct {
+	kind  blockKind
+	level int
+	start int
+	end   int
+}
+
+type section struct {
+	heading string
+	pieces  []block
+}
+
+var (
+	mdHeadingRe   = regexp.MustCompile(`^(#{1,6})\s+`)
+	htmlHeadingRe = regexp.MustCompile(`(?i)^<h([1-6])[^>]*>`)
+	listItemRe    = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)])\s+|(?i)^\s*<li[\s>]`)
+	htmlBreakRe   = regexp.MustCompile(`(?i)</(p|div|li|h[1-6]|pre|ul|ol|tr|blockquote)>|<br\s*/?>`)
+	htmlTagRe     = regexp.MustCompile(`<[^>]+>`)
+	sentenceEndRe = regexp.MustCompile(`[.!?]["')\]]?\s+`)
+)
+
+// ChunkText splits markdown or HTML into overlapping chunks. Headings are not
+// emitted as chunks; instead each chunk carries the path of headings above it.
+// Code blocks and lists are kept whole unless they exceed the token limit, in
+// which case they are split on line boundaries.
+func ChunkText(text string, opts ChunkOptions) []Chunk {
+	opts = opts.withDefaults()
+
+	var chunks []Chunk
+	for _, s := range splitSections(text, opts.MaxTokens) {
+		chunks = append(chunks, packSection(text, s, opts)...)
+	}
+	return chunks
+}
+
+// estimateTokens approximates a BPE token count at four characters per token.
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+func splitSections(text string, maxTokens int) []section {
+	var (
+		sections []section
+		headings []string
+		levels   []int
+		current  section
+	)
+	flush := func() {
+		if len(current.pieces) > 0 {
+			sections = append(sections, current)
+		}
+		current = section{heading: strings.Join(headings, " > ")}
+	}
+	flush()
+
+	for _, b := range splitBlocks(text) {
+		if b.kind == blockHeading {
+			flush()
+			for len(levels) > 0 && levels[len(levels)-1] >= b.level {
+				levels = levels[:len(levels)-1]
+				headings = headings[:len(headings)-1]
+			}
+			if title := cleanText(text[b.start:b.end]); title != "" {
+				levels = append(levels, b.level)
+				headings = append(headings, title)
+			}
+			current.heading = strings.Join(headings, " > ")
+			continue
+		}
+		current.pieces = append(current.pieces, splitOversized(text, b, maxTokens)...)
+	}
+	flush()
+	return sections
+}
+
+// splitBlocks segments text into blocks on blank lines, markdown structure and
+// HTML block-level tags.
+func splitBlocks(text string) []block {
+	var (
+		blocks []block
+		open   *block
+		fence  string
+	)
+	closeOpen := func() {
+		if open != nil && strings.TrimSpace(text[open.start:open.end]) != "" {
+			blocks = append(blocks, *open)
+		}
+		open = nil
+	}
+
+	for _, ln := range splitLines(text) {
+		line := text[ln.start:ln.end]
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			open.end = ln.end
+			if strings.HasPrefix(trimmed, fence) || (fence == "<pre" && strings.Contains(strings.ToLower(trimmed), "</pre>")) {
+				fence = ""
+				closeOpen()
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			closeOpen()
+
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			closeOpen()
+			fence = trimmed[:3]
+			open = &block{kind: blockCode, start: ln.start, end: ln.end}
+
+		case strings.HasPrefix(strings.ToLower(trimmed), "<pre"):
+			closeOpen()
+			open = &block{kind: blockCode, start: ln.start, end: ln.end}
+			if strings.Contains(strings.ToLower(trimmed), "</pre>") {
+				closeOpen()
+			} else {
+				fence = "<pre"
+			}
+
+		case mdHeadingRe.MatchString(trimmed):
+			closeOpen()
+			m := mdHeadingRe.FindStringSubmatch(trimmed)
+			offset := ln.start + strings.Index(line, m[0]) + len(m[0])
+			blocks = append(blocks, block{kind: blockHeading, level: len(m[1]), start: offset, end: ln.end})
+
+		case htmlHeadingRe.MatchString(trimmed):
+			closeOpen()
+			m := htmlHeadingRe.FindStringSubmatch(trimmed)
+			blocks = append(blocks, block{kind: blockHeading, level: int(m[1][0] - '0'), start: ln.start, end: ln.end})
+
+		case listItemRe.MatchString(line):
+			if open == nil || open.kind != blockList {
+				closeOpen()
+				open = &block{kind: blockList, start: ln.start}
+			}
+			open.end = ln.end
+
+		default:
+			if open != nil && open.kind == blockList && (line[0] == ' ' || line[0] == '\t') {
+				open.end = ln.end
+				continue
+			}
+			if open == nil || open.kind != blockParagraph {
+				closeOpen()
+				open = &block{kind: blockParagraph, start: ln.start}
+			}
+			open.end = ln.end
+		}
+	}
+	closeOpen()
+	return blocks
+}
+
+type span struct{ start, end int }
+
+// splitLines returns line spans, additionally breaking after HTML block-level
+// closing tags so that single-line HTML documents still have structure.
+func splitLines(text string) []span {
+	var lines []span
+	start := 0
+	for start <= len(text) {
+		end := strings.IndexByte(text[start:], '\n')
+		if end == -1 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		lineStart := start
+		for _, loc := range htmlBreakRe.FindAllStringIndex(text[start:end], -1) {
+			cut := start + loc[1]
+			if cut < end {
+				lines = append(lines, span{lineStart, cut})
+				lines = append(lines, span{cut, cut})
+				lineStart = cut
+			}
+		}
+		lines = append(lines, span{lineStart, end})
+		start = end + 1
+	}
+	return lines
+}
+
+// splitOversized breaks a block larger than maxTokens into pieces on sentence
+// boundaries for prose and line boundaries otherwise, falling back to words.
+func splitOversized(text string, b block, maxTokens int) []block {
+	if estimateTokens(text[b.start:b.end]) <= maxTokens {
+		return []block{b}
+	}
+
+	var cuts []int
+	if b.kind == blockParagraph {
+		for _, loc := range sentenceEndRe.FindAllStringIndex(text[b.start:b.end], -1) {
+			cuts = append(cuts, b.start+loc[1])
+		}
+	} else {
+		for i := b.start; i < b.end; i++ {
+			if text[i] == '\n' {
+				cuts = append(cuts, i+1)
+			}
+		}
+	}
+	cuts = append(cuts, b.end)
+
+	var pieces []block
+	pieceStart, last := b.start, b.start
+	for _, cut := range cuts {
+		if cut > pieceStart && last > pieceStart && estimateTokens(text[pieceStart:cut]) > maxTokens {
+			pieces = append(pieces, splitWords(text, block{kind: b.kind, start: pieceStart, end: last}, maxTokens)...)
+			pieceStart = last
+		}
+		last = cut
+	}
+	if pieceStart < b.end {
+		pieces = append(pieces, splitWords(text, block{kind: b.kind, start: pieceStart, end: b.end}, maxTokens)...)
+	}
+	return pieces
+}
+
+func splitWords(text string, b block, maxTokens int) []block {
+	if estimateTokens(text[b.start:b.end]) <= maxTokens {
+		return []block{b}
+	}
+	var pieces []block
+	pieceStart := b.start
+	for i := b.start; i < b.end; i++ {
+		if (text[i] == ' ' || text[i] == '\n') && estimateTokens(text[pieceStart:i]) >= maxTokens {
+			pieces = append(pieces, block{kind: b.kind, start: pieceStart, end: i})
+			pieceStart = i + 1
+		}
+	}
+	if pieceStart < b.end {
+		pieces = append(pieces, block{kind: b.kind, start: pieceStart, end: b.end})
+	}
+	return pieces
+}
+
+// packSection greedily packs consecutive pieces into chunks of at most
+// MaxTokens, starting each subsequent chunk with up to OverlapTokens of
+// trailing pieces from the previous one.
+func packSection(text string, s section, opts ChunkOptions) []Chunk {
+	tokens := make([]int, len(s.pieces))
+	for i, p := range s.pieces {
+		tokens[i] = estimateTokens(text[p.start:p.end])
+	}
+
+	var chunks []Chunk
+	first := 0
+	for first < len(s.pieces) {
+		last, total := first, tokens[first]
+		for last+1 < len(s.pieces) && total+tokens[last+1] <= opts.MaxTokens {
+			last++
+			total += tokens[last]
+		}
+
+		start, end := s.pieces[first].start, s.pieces[last].end
+		if body := cleanText(text[start:end]); body != "" {
+			chunks = append(chunks, Chunk{Text: body, Heading: s.heading, Start: start, End: end})
+		}
+		if last == len(s.pieces)-1 {
+			break
+		}
+
+		next, overlap := last+1, 0
+		for next-1 > first && overlap+tokens[next-1] <= opts.OverlapTokens {
+			next--
+			overlap += tokens[next]
+		}
+		first = next
+	}
+	return chunks
+}
+
+// cleanText strips HTML tags and collapses runs of blank lines while keeping
+// line structure intact for code and lists.
+func cleanText(s string) string {
+	s = htmlBreakRe.ReplaceAllStringFunc(s, func(tag string) string { return tag + "\n" })
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'", "&nbsp;", " ").Replace(s)
+
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,143 @@
+package semsearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChunkText_HeadingContext(t *testing.T) {
+	text := "# Install\n\nIntro paragraph.\n\n## Linux\n\nUse the package manager.\n\n## macOS\n\nUse Homebrew."
+	chunks := ChunkText(text, ChunkOptions{MaxTokens: 256})
+
+	want := []struct{ heading, text string }{
+		{"Install", "Intro paragraph."},
+		{"Install > Linux", "Use the package manager."},
+		{"Install > macOS", "Use Homebrew."},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d: %+v", len(chunks), len(want), chunks)
+	}
+	for i, w := range want {
+		if chunks[i].Heading != w.heading || chunks[i].Text != w.text {
+			t.Errorf("chunk %d = {%q, %q}, want {%q, %q}", i, chunks[i].Heading, chunks[i].Text, w.heading, w.text)
+		}
+	}
+}
+
+func TestChunkText_KeepsShortBlocks(t *testing.T) {
+	chunks := ChunkText("Short.", ChunkOptions{})
+	if len(chunks) != 1 || chunks[0].Text != "Short." {
+		t.Errorf("got %+v, want single chunk %q", chunks, "Short.")
+	}
+}
+
+func TestChunkText_CodeBlockIntact(t *testing.T) {
+	text := "Before.\n\n```go\nfunc main() {\n\n\tfmt.Println()\n}\n```\n\nAfter."
+	chunks := ChunkText(text, ChunkOptions{MaxTokens: 256})
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	if !strings.Contains(chunks[0].Text, "func main() {\n\n\tfmt.Println()\n}") {
+		t.Errorf("code block mangled: %q", chunks[0].Text)
+	}
+}
+
+func TestChunkText_Offsets(t *testing.T) {
+	text := "# Title\n\nFirst paragraph here.\n\nSecond paragraph here."
+	for _, c := range ChunkText(text, ChunkOptions{MaxTokens: 6}) {
+		if got := cleanText(text[c.Start:c.End]); got != c.Text {
+			t.Errorf("text[%d:%d] = %q, want %q", c.Start, c.End, got, c.Text)
+		}
+	}
+}
+
+func TestChunkText_Overlap(t *testing.T) {
+	var paras []string
+	for _, w := range []string{"alpha", "bravo", "delta", "hotel", "kilos"} {
+		paras = append(paras, strings.Repeat(w+" ", 7))
+	}
+	chunks := ChunkText(strings.Join(paras, "\n\n"), ChunkOptions{MaxTokens: 24, OverlapTokens: 12})
+
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want several", len(chunks))
+	}
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].Start >= chunks[i-1].End {
+			t.Errorf("chunk %d starts at %d, does not overlap previous ending at %d", i, chunks[i].Start, chunks[i-1].End)
+		}
+		if chunks[i].Start <= chunks[i-1].Start {
+			t.Errorf("chunk %d does not advance: start %d <= %d", i, chunks[i].Start, chunks[i-1].Start)
+		}
+	}
+	if !strings.Contains(chunks[len(chunks)-1].Text, "kilos") {
+		t.Errorf("last chunk missing trailing content: %q", chunks[len(chunks)-1].Text)
+	}
+}
+
+func TestChunkText_OversizedParagraph(t *testing.T) {
+	text := strings.Repeat("This is a sentence. ", 100)
+	chunks := ChunkText(text, ChunkOptions{MaxTokens: 50})
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want oversized paragraph split", len(chunks))
+	}
+	for i, c := range chunks {
+		if n := estimateTokens(c.Text); n > 50 {
+			t.Errorf("chunk %d has %d tokens, want <= 50", i, n)
+		}
+	}
+}
+
+func TestChunkText_HTML(t *testing.T) {
+	text := "<h2>Setup</h2><p>Install the <b>tool</b>.</p><ul><li>one</li><li>two</li></ul>"
+	chunks := ChunkText(text, ChunkOptions{MaxTokens: 256})
+	if len(chunks) == 0 {
+		t.Fatal("got no chunks")
+	}
+	for _, c := range chunks {
+		if c.Heading != "Setup" {
+			t.Errorf("heading = %q, want %q", c.Heading, "Setup")
+		}
+		if strings.ContainsAny(c.Text, "<>") {
+			t.Errorf("tags not stripped: %q", c.Text)
+		}
+	}
+	if !strings.Contains(chunks[0].Text, "Install the tool.") {
+		t.Errorf("got %q, want paragraph text", chunks[0].Text)
+	}
+}
+
+func TestChunkText_List(t *testing.T) {
+	text := "Steps:\n\n- first\n- second\n  continued\n- third\n\nDone."
+	chunks := ChunkText(text, ChunkOptions{MaxTokens: 256})
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	if !strings.Contains(chunks[0].Text, "- second\n  continued\n- third") {
+		t.Errorf("list mangled: %q", chunks[0].Text)
+	}
+}
+
+func TestMergeExcerpts(t *testing.T) {
+	source := "aaaa bbbb cccc dddd"
+	got := mergeExcerpts(source, []Excerpt{
+		{Text: "aaaa bbbb", Start: 0, End: 9, Score: 0.8},
+		{Text: "bbbb cccc", Start: 5, End: 14, Score: 0.9},
+		{Text: "dddd", Start: 15, End: 19, Score: 0.7},
+	})
+	if len(got) != 2 {
+		t.Fatalf("got %d excerpts, want 2: %+v", len(got), got)
+	}
+	if got[0].Text != "aaaa bbbb cccc" || got[0].Score != 0.9 {
+		t.Errorf("merged = %+v, want text %q score 0.9", got[0], "aaaa bbbb cccc")
+	}
+}
+
+func TestJoinExcerpts_Offsets(t *testing.T) {
+	excerpts := []Excerpt{{Text: "First kept span.", Start: 40, End: 56}, {Text: "Second.", Start: 300, End: 307}}
+	text := joinExcerpts(excerpts)
+	for _, e := range excerpts {
+		if got := text[e.Start:e.End]; got != e.Text {
+			t.Errorf("text[%d:%d] = %q, want %q", e.Start, e.End, got, e.Text)
+		}
+	}
+}
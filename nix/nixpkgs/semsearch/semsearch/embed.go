@@ -3,15 +3,109 @@ package semsearch
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
-// GetEmbeddings returns embeddings for the given texts.
+// ErrDimensionMismatch is returned when the embedding server returns vectors
+// of differing lengths, which makes similarity scores meaningless.
+var ErrDimensionMismatch = errors.New("embedding dimension mismatch")
+
+// ErrModelNotServed is returned by ResolveEmbedModel when the server is up but
+// does not serve the requested model, or any embedding model.
+var ErrModelNotServed = errors.New("embedding model not served")
+
+// Embeddings request defaults: texts and estimated tokens per request, and
+// requests in flight.
+const (
+	DefaultEmbedBatchSize   = 64
+	DefaultEmbedBatchTokens = 8192
+	DefaultEmbedConcurrency = 4
+)
+
+// GetEmbeddings returns embeddings for the given texts. Texts are sent in
+// batches bounded by cfg.EmbedBatchSize and cfg.EmbedBatchTokens, with up to
+// cfg.EmbedConcurrency batches in flight.
 func GetEmbeddings(texts []string, cfg Config) ([][]float64, error) {
+	concurrency := cfg.EmbedConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultEmbedConcurrency
+	}
+
+	embeddings := make([][]float64, len(texts))
+	batches := makeBatches(texts, cfg.EmbedBatchSize, cfg.EmbedBatchTokens)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+	)
+	for _, b := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(start, end int) {
+			defer func() { <-sem; wg.Done() }()
+			vecs, err := embedBatch(texts[start:end], cfg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("embedding batch %d-%d: %w", start, end-1, err)
+				}
+				return
+			}
+			copy(embeddings[start:end], vecs)
+		}(b.start, b.end)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	for i, e := range embeddings {
+		if len(e) != len(embeddings[0]) {
+			return nil, fmt.Errorf("%w: text %d has %d dimensions, text 0 has %d (model %q)",
+				ErrDimensionMismatch, i, len(e), len(embeddings[0]), cfg.EmbedModel)
+		}
+	}
+	return embeddings, nil
+}
+
+// makeBatches splits texts into contiguous spans holding at most maxSize texts
+// and, where more than one text is present, at most maxTokens estimated tokens.
+func makeBatches(texts []string, maxSize, maxTokens int) []span {
+	if maxSize <= 0 {
+		maxSize = DefaultEmbedBatchSize
+	}
+	if maxTokens <= 0 {
+		maxTokens = DefaultEmbedBatchTokens
+	}
+
+	var batches []span
+	start, tokens := 0, 0
+	for i, t := range texts {
+		n := estimateTokens(t)
+		if i > start && (i-start >= maxSize || tokens+n > maxTokens) {
+			batches = append(batches, span{start, i})
+			start, tokens = i, 0
+		}
+		tokens += n
+	}
+	if start < len(texts) {
+		batches = append(batches, span{start, len(texts)})
+	}
+	return batches
+}
+
+func embedBatch(texts []string, cfg Config) ([][]float64, error) {
 	payload := map[string]any{
 		"model": cfg.EmbedModel,
 		"input": texts,
@@ -40,20 +134,71 @@ func GetEmbeddings(texts []string, cfg Config) ([][]float64, error) {
 
 	embeddings := make([][]float64, len(texts))
 	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding API returned index %d for %d inputs", d.Index, len(texts))
+		}
 		embeddings[d.Index] = d.Embedding
 	}
+	for i, e := range embeddings {
+		if len(e) == 0 {
+			return nil, fmt.Errorf("embedding API returned no embedding for input %d", i)
+		}
+	}
 	return embeddings, nil
 }
 
-// IsEmbedServerAvailable checks if the embedding server is up.
-func IsEmbedServerAvailable(cfg Config) bool {
+// ListModels returns the IDs of the models served by an OpenAI-compatible API.
+func ListModels(baseURL string) ([]string, error) {
 	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(cfg.EmbedURL + "/models")
+	resp, err := client.Get(baseURL + "/models")
 	if err != nil {
-		return false
+		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
-	return resp.StatusCode == 200
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("models API error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result modelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("parsing models list: %w", err)
+	}
+	ids := make([]string, len(result.Data))
+	for i, m := range result.Data {
+		ids[i] = m.ID
+	}
+	return ids, nil
+}
+
+// ResolveEmbedModel checks that cfg.EmbedModel is served by cfg.EmbedURL, or,
+// when it is empty, selects the first served model with "embed" in its name.
+func ResolveEmbedModel(cfg Config) (string, error) {
+	models, err := ListModels(cfg.EmbedURL)
+	if err != nil {
+		return "", err
+	}
+	if cfg.EmbedModel != "" {
+		if slices.Contains(models, cfg.EmbedModel) {
+			return cfg.EmbedModel, nil
+		}
+		return "", fmt.Errorf("%w: %q not in %s/models (available: %s)",
+			ErrModelNotServed, cfg.EmbedModel, cfg.EmbedURL, strings.Join(models, ", "))
+	}
+	for _, m := range models {
+		if strings.Contains(strings.ToLower(m), "embed") {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("%w: no model with \"embed\" in its name at %s (available: %s)",
+		ErrModelNotServed, cfg.EmbedURL, strings.Join(models, ", "))
+}
+
+// IsEmbedServerAvailable checks if the embedding server is up.
+func IsEmbedServerAvailable(cfg Config) bool {
+	_, err := ListModels(cfg.EmbedURL)
+	return err == nil
 }
 
 // CosineSimilarity computes similarity between two vectors.
@@ -0,0 +1,121 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newEmbedServer serves /models and an /embeddings endpoint whose vectors
+// encode each input's length, so tests can check ordering across batches.
+func newEmbedServer(t *testing.T, models []string, dims func(input string) int) (*httptest.Server, *[]int) {
+	t.Helper()
+	var (
+		mu         sync.Mutex
+		batchSizes []int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/models":
+			var data []map[string]string
+			for _, m := range models {
+				data = append(data, map[string]string{"id": m})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+		case "/embeddings":
+			var req struct {
+				Input []string `json:"input"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			mu.Lock()
+			batchSizes = append(batchSizes, len(req.Input))
+			mu.Unlock()
+			var data []map[string]any
+			for i, in := range req.Input {
+				vec := make([]float64, dims(in))
+				if len(vec) > 0 {
+					vec[0] = float64(len(in))
+				}
+				data = append(data, map[string]any{"index": i, "embedding": vec})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &batchSizes
+}
+
+func TestGetEmbeddings_Batches(t *testing.T) {
+	srv, batchSizes := newEmbedServer(t, nil, func(string) int { return 3 })
+	texts := make([]string, 10)
+	for i := range texts {
+		texts[i] = strings.Repeat("x", i+1)
+	}
+
+	cfg := Config{EmbedURL: srv.URL, EmbedBatchSize: 3, EmbedConcurrency: 2}
+	got, err := GetEmbeddings(texts, cfg)
+	if err != nil {
+		t.Fatalf("GetEmbeddings() error = %v", err)
+	}
+	if len(*batchSizes) != 4 {
+		t.Errorf("got %d requests, want 4 (batch size 3 over 10 texts)", len(*batchSizes))
+	}
+	for i, vec := range got {
+		if vec[0] != float64(i+1) {
+			t.Errorf("embedding %d = %v, want it to belong to text %d", i, vec, i)
+		}
+	}
+}
+
+func TestMakeBatches_TokenLimit(t *testing.T) {
+	texts := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 400)}
+	got := makeBatches(texts, 10, 20)
+	want := []span{{0, 2}, {2, 3}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("makeBatches() = %v, want %v", got, want)
+	}
+}
+
+func TestGetEmbeddings_DimensionMismatch(t *testing.T) {
+	srv, _ := newEmbedServer(t, nil, func(in string) int { return 2 + len(in)%2 })
+	_, err := GetEmbeddings([]string{"a", "bb"}, Config{EmbedURL: srv.URL})
+	if !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("err = %v, want ErrDimensionMismatch", err)
+	}
+}
+
+func TestResolveEmbedModel(t *testing.T) {
+	srv, _ := newEmbedServer(t, []string{"qwen-chat", "qwen-embed"}, func(string) int { return 1 })
+
+	tests := []struct {
+		name    string
+		model   string
+		want    string
+		wantErr bool
+	}{
+		{"auto", "", "qwen-embed", false},
+		{"explicit", "qwen-chat", "qwen-chat", false},
+		{"missing", "nomic-embed", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveEmbedModel(Config{EmbedURL: srv.URL, EmbedModel: tt.model})
+			if tt.wantErr {
+				if !errors.Is(err, ErrModelNotServed) {
+					t.Errorf("err = %v, want ErrModelNotServed", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
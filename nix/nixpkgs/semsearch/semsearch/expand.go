@@ -0,0 +1,92 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const expandSystemPrompt = `You generate creative, lateral-thinking web search queries that find unexpected but relevant information.
+Think of related concepts, analogies, or alternative framings. Return ONLY a JSON array of strings.`
+
+// ExpandQueries asks the chat model in cfg for up to cfg.Expansions
+// additional search queries that approach question from other angles.
+func ExpandQueries(question string, cfg Config, log Logger) ([]string, error) {
+	if log == nil {
+		log = NoopLogger()
+	}
+	if cfg.Expansions <= 0 {
+		return nil, nil
+	}
+
+	prompt := fmt.Sprintf(`Generate %d search queries for this question.
+
+Question: %s
+
+Example: for "Why is the sky blue?" you might generate:
+["Rayleigh scattering atmosphere", "wavelength light dispersion physics", "why sunset orange red"]`, cfg.Expansions, question)
+
+	response, err := chatComplete(expandSystemPrompt, prompt, 0.8, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("query expansion: %w", err)
+	}
+
+	start, end := strings.Index(response, "["), strings.LastIndex(response, "]")
+	if start == -1 || end <= start {
+		return nil, fmt.Errorf("query expansion: no JSON array in response: %s", response)
+	}
+	var queries []string
+	if err := json.Unmarshal([]byte(response[start:end+1]), &queries); err != nil {
+		return nil, fmt.Errorf("query expansion: %w", err)
+	}
+
+	var expanded []string
+	for _, q := range queries {
+		if q = strings.TrimSpace(q); q != "" && len(expanded) < cfg.Expansions {
+			expanded = append(expanded, q)
+		}
+	}
+	log.Logf("Expanded query into %d additional queries", len(expanded))
+	return expanded, nil
+}
+
+// DefaultMMRLambda weighs relevance over diversity in SelectMMR.
+const DefaultMMRLambda = 0.7
+
+// SelectMMR picks up to k candidates by maximal marginal relevance, trading
+// similarity to the query against similarity to already-selected candidates.
+// lambda of 1 ranks purely by relevance; 0 purely by diversity. It returns
+// candidate indices in selection order.
+func SelectMMR(query []float64, candidates [][]float64, k int, lambda float64) []int {
+	k = min(k, len(candidates))
+	relevance := make([]float64, len(candidates))
+	for i, c := range candidates {
+		relevance[i] = CosineSimilarity(query, c)
+	}
+
+	// redundancy[i] tracks the max similarity of candidate i to the selection.
+	redundancy := make([]float64, len(candidates))
+	taken := make([]bool, len(candidates))
+	selected := make([]int, 0, k)
+	for len(selected) < k {
+		best, bestScore := -1, math.Inf(-1)
+		for i := range candidates {
+			if taken[i] {
+				continue
+			}
+			score := lambda*relevance[i] - (1-lambda)*redundancy[i]
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		taken[best] = true
+		selected = append(selected, best)
+		for i := range candidates {
+			if !taken[i] {
+				redundancy[i] = max(redundancy[i], CosineSimilarity(candidates[i], candidates[best]))
+			}
+		}
+	}
+	return selected
+}
@@ -0,0 +1,59 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSelectMMR(t *testing.T) {
+	query := []float64{1, 0}
+	candidates := [][]float64{
+		{1, 0},       // most relevant
+		{0.99, 0.01}, // near-duplicate of 0
+		{0.7, 0.7},   // less relevant but different
+	}
+
+	if got := SelectMMR(query, candidates, 2, 1); !slices.Equal(got, []int{0, 1}) {
+		t.Errorf("lambda=1: got %v, want [0 1] (pure relevance)", got)
+	}
+	if got := SelectMMR(query, candidates, 2, 0.3); !slices.Equal(got, []int{0, 2}) {
+		t.Errorf("lambda=0.3: got %v, want [0 2] (skip near-duplicate)", got)
+	}
+	if got := SelectMMR(query, candidates, 10, 0.5); len(got) != 3 {
+		t.Errorf("k > len: got %d, want 3", len(got))
+	}
+}
+
+func TestExpandQueries(t *testing.T) {
+	var prompt string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct{ Content string }
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		prompt = req.Messages[len(req.Messages)-1].Content
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"Sure:\n[\"one\", \" \", \"two\", \"three\"]"}}]}`))
+	}))
+	defer srv.Close()
+
+	cfg := Config{ChatURL: srv.URL, ChatModel: "m", ChatPromptPrefix: "/no_think ", Expansions: 2}
+	got, err := ExpandQueries("q", cfg, nil)
+	if err != nil {
+		t.Fatalf("ExpandQueries() error = %v", err)
+	}
+	if !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("got %v, want [one two]", got)
+	}
+	if !strings.HasPrefix(prompt, "/no_think Generate 2") {
+		t.Errorf("prompt = %q, want the prefix", prompt)
+	}
+
+	cfg.Expansions = 0
+	if got, _ := ExpandQueries("q", cfg, nil); got != nil {
+		t.Errorf("Expansions=0: got %v, want nil", got)
+	}
+}
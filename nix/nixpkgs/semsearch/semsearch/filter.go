@@ -1,8 +1,13 @@
 package semsearch
 
-import "strings"
-
-// Filter removes results below the similarity threshold.
+import (
+	"slices"
+	"strings"
+)
+
+// Filter keeps only the chunks of each result whose similarity to the question
+// meets the threshold. Kept chunks are merged into excerpts, and the result's
+// Text is replaced with those excerpts.
 func Filter(question string, results []Result, cfg Config, log Logger) ([]Result, error) {
 	if log == nil {
 		log = NoopLogger()
@@ -14,31 +19,30 @@ func Filter(question string, results []Result, cfg Config, log Logger) ([]Result
 	}
 	log.Logf("Filtering %d results by semantic relevance", len(results))
 
-	type paragraphInfo struct {
+	type chunkInfo struct {
 		resultIdx int
-		paraIdx   int
-		text      string
+		chunk     Chunk
 	}
-	var allParagraphs []paragraphInfo
-	resultParagraphs := make([][]string, len(results))
+	var allChunks []chunkInfo
+	resultChunks := make([]int, len(results))
 
 	for i, r := range results {
-		paras := splitIntoParagraphs(r.Text)
-		resultParagraphs[i] = paras
-		for j, p := range paras {
-			allParagraphs = append(allParagraphs, paragraphInfo{i, j, p})
+		chunks := ChunkText(r.Text, cfg.chunkOptions())
+		resultChunks[i] = len(chunks)
+		for _, c := range chunks {
+			allChunks = append(allChunks, chunkInfo{i, c})
 		}
 	}
 
-	if len(allParagraphs) == 0 {
-		log.Logf("No paragraphs found")
+	if len(allChunks) == 0 {
+		log.Logf("No chunks found")
 		return results, nil
 	}
 
-	texts := make([]string, len(allParagraphs)+1)
+	texts := make([]string, len(allChunks)+1)
 	texts[0] = question
-	for i, p := range allParagraphs {
-		texts[i+1] = p.text
+	for i, c := range allChunks {
+		texts[i+1] = c.chunk.EmbedText()
 	}
 
 	embeddings, err := GetEmbeddings(texts, cfg)
@@ -48,32 +52,58 @@ func Filter(question string, results []Result, cfg Config, log Logger) ([]Result
 
 	questionEmb := embeddings[0]
 
-	keptParagraphs := make([][]string, len(results))
-	for i := range keptParagraphs {
-		keptParagraphs[i] = []string{}
+	scores := make([]float64, len(allChunks))
+	var relevant []int
+	for i := range allChunks {
+		scores[i] = CosineSimilarity(questionEmb, embeddings[i+1])
+		if scores[i] >= cfg.Threshold {
+			relevant = append(relevant, i)
+		}
 	}
 
-	for i, p := range allParagraphs {
-		similarity := CosineSimilarity(questionEmb, embeddings[i+1])
-		if similarity >= cfg.Threshold {
-			keptParagraphs[p.resultIdx] = append(keptParagraphs[p.resultIdx], p.text)
+	if cfg.MMRTopK > 0 && len(relevant) > cfg.MMRTopK {
+		candidates := make([][]float64, len(relevant))
+		for j, i := range relevant {
+			candidates[j] = embeddings[i+1]
+		}
+		var selected []int
+		for _, j := range SelectMMR(questionEmb, candidates, cfg.MMRTopK, cfg.MMRLambda) {
+			selected = append(selected, relevant[j])
 		}
+		slices.Sort(selected)
+		log.Logf("Selected %d/%d relevant chunks by MMR (lambda %.2f)", len(selected), len(relevant), cfg.MMRLambda)
+		relevant = selected
+	}
+
+	kept := make([][]Excerpt, len(results))
+	for _, i := range relevant {
+		c := allChunks[i]
+		kept[c.resultIdx] = append(kept[c.resultIdx], Excerpt{
+			Text:    c.chunk.Text,
+			Heading: c.chunk.Heading,
+			Start:   c.chunk.Start,
+			End:     c.chunk.End,
+			Score:   scores[i],
+		})
 	}
 
 	var focused []Result
 	for i, r := range results {
-		kept := keptParagraphs[i]
-		total := len(resultParagraphs[i])
-		if len(kept) > 0 {
-			log.Logf("  [%d/%d paras] %s", len(kept), total, r.Title)
-			r.Text = strings.Join(kept, "\n\n")
-			focused = append(focused, r)
-		} else {
-			log.Logf("  [0/%d paras] %s (dropped)", total, r.Title)
+		total := resultChunks[i]
+		if len(kept[i]) == 0 {
+			log.Logf("  [0/%d chunks] %s (dropped)", total, r.Title)
+			continue
 		}
+		log.Logf("  [%d/%d chunks] %s", len(kept[i]), total, r.Title)
+		r.Excerpts = mergeExcerpts(r.Text, kept[i])
+		r.Text = joinExcerpts(r.Excerpts)
+		for _, e := range r.Excerpts {
+			r.Score = max(r.Score, e.Score)
+		}
+		focused = append(focused, r)
 	}
 
-	log.Logf("Kept %d/%d results with relevant paragraphs", len(focused), len(results))
+	log.Logf("Kept %d/%d results with relevant chunks", len(focused), len(results))
 	if len(focused) == 0 {
 		log.Logf("No results above threshold, keeping all")
 		return results, nil
@@ -81,6 +111,41 @@ func Filter(question string, results []Result, cfg Config, log Logger) ([]Result
 	return focused, nil
 }
 
+// mergeExcerpts coalesces overlapping or adjacent excerpts, which arise from
+// chunk overlap, re-deriving the text of merged spans from the source.
+func mergeExcerpts(source string, excerpts []Excerpt) []Excerpt {
+	var merged []Excerpt
+	for _, e := range excerpts {
+		if n := len(merged); n > 0 && e.Start <= merged[n-1].End && e.Heading == merged[n-1].Heading {
+			last := &merged[n-1]
+			if e.End > last.End {
+				last.End = e.End
+				last.Text = cleanText(source[last.Start:last.End])
+			}
+			last.Score = max(last.Score, e.Score)
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// joinExcerpts returns the excerpts' text separated by blank lines, which
+// replaces the result's Text, and moves each excerpt's offsets to its place
+// in it.
+func joinExcerpts(excerpts []Excerpt) string {
+	var b strings.Builder
+	for i := range excerpts {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		excerpts[i].Start = b.Len()
+		b.WriteString(excerpts[i].Text)
+		excerpts[i].End = b.Len()
+	}
+	return b.String()
+}
+
 // FilterRaw filters markdown results.
 func FilterRaw(question, rawResults string, cfg Config, log Logger) (string, error) {
 	results := ParseResults(rawResults)
@@ -116,38 +181,3 @@ func ParseResults(raw string) []Result {
 	}
 	return results
 }
-
-// FormatResults formats results as labelled text.
-func FormatResults(results []Result) string {
-	var b strings.Builder
-	for i, r := range results {
-		if i > 0 {
-			b.WriteString("\n")
-		}
-		if r.Title != "" {
-			b.WriteString("Title: " + r.Title + "\n")
-		}
-		if r.URL != "" {
-			b.WriteString("URL: " + r.URL + "\n")
-		}
-		if r.Text != "" {
-			b.WriteString("Text: " + r.Text + "\n")
-		}
-	}
-	return b.String()
-}
-
-func splitIntoParagraphs(text string) []string {
-	raw := strings.Split(text, "\n\n")
-	var paragraphs []string
-	for _, p := range raw {
-		p = strings.TrimSpace(p)
-		if len(p) > 50 {
-			paragraphs = append(paragraphs, p)
-		}
-	}
-	if len(paragraphs) == 0 && len(strings.TrimSpace(text)) > 0 {
-		paragraphs = []string{strings.TrimSpace(text)}
-	}
-	return paragraphs
-}
@@ -0,0 +1,293 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Formatter writes results one at a time so output can be streamed as each
+// query completes. Begin and End frame the whole output.
+type Formatter interface {
+	Begin(w io.Writer) error
+	Write(w io.Writer, r Result) error
+	End(w io.Writer) error
+}
+
+// TemplateData is the value passed to user templates: the result plus its
+// zero-based position in the output.
+type TemplateData struct {
+	Result
+	Index int
+}
+
+var formatters = map[string]func() Formatter{
+	"text":     func() Formatter { return &labelledFormatter{} },
+	"markdown": func() Formatter { return &markdownFormatter{width: 80} },
+	"json":     func() Formatter { return &jsonFormatter{} },
+	"jsonl":    func() Formatter { return &jsonlFormatter{} },
+	"org":      func() Formatter { return &orgFormatter{} },
+	"html":     func() Formatter { return &htmlFormatter{} },
+}
+
+// FormatNames lists the accepted format names, including "template".
+func FormatNames() []string {
+	names := make([]string, 0, len(formatters)+1)
+	for name := range formatters {
+		names = append(names, name)
+	}
+	names = append(names, "template")
+	sort.Strings(names)
+	return names
+}
+
+// NewFormatter returns the named formatter. The "template" format executes
+// tmpl, a text/template, once per result with TemplateData.
+func NewFormatter(name, tmpl string) (Formatter, error) {
+	if name == "template" {
+		if tmpl == "" {
+			return nil, fmt.Errorf("template format requires a template")
+		}
+		t, err := template.New("result").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template: %w", err)
+		}
+		return &templateFormatter{tmpl: t}, nil
+	}
+	newFormatter, ok := formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (want one of %s)", name, strings.Join(FormatNames(), ", "))
+	}
+	return newFormatter(), nil
+}
+
+// FormatAll renders a complete result set with f.
+func FormatAll(f Formatter, results []Result) (string, error) {
+	var b strings.Builder
+	if err := f.Begin(&b); err != nil {
+		return "", err
+	}
+	for _, r := range results {
+		if err := f.Write(&b, r); err != nil {
+			return "", err
+		}
+	}
+	if err := f.End(&b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// FormatResults formats results as labelled text.
+func FormatResults(results []Result) string {
+	out, _ := FormatAll(&labelledFormatter{}, results)
+	return out
+}
+
+type labelledFormatter struct{ count int }
+
+func (f *labelledFormatter) Begin(io.Writer) error { return nil }
+func (f *labelledFormatter) End(io.Writer) error   { return nil }
+
+func (f *labelledFormatter) Write(w io.Writer, r Result) error {
+	var b strings.Builder
+	if f.count > 0 {
+		b.WriteString("\n")
+	}
+	f.count++
+	if r.Title != "" {
+		b.WriteString("Title: " + r.Title + "\n")
+	}
+	if r.URL != "" {
+		b.WriteString("URL: " + r.URL + "\n")
+	}
+	if r.Text != "" {
+		b.WriteString("Text: " + r.Text + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type markdownFormatter struct {
+	width int
+	count int
+}
+
+func (f *markdownFormatter) Begin(io.Writer) error { return nil }
+func (f *markdownFormatter) End(io.Writer) error   { return nil }
+
+func (f *markdownFormatter) Write(w io.Writer, r Result) error {
+	var b strings.Builder
+	if f.count > 0 {
+		b.WriteString("\n---\n\n")
+	}
+	f.count++
+	if r.Title != "" {
+		b.WriteString("## " + r.Title + "\n")
+	}
+	if r.URL != "" {
+		b.WriteString(r.URL + "\n")
+	}
+	if r.Text != "" {
+		b.WriteString("\n" + wrapText(r.Text, f.width) + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type jsonFormatter struct{ count int }
+
+func (f *jsonFormatter) Begin(w io.Writer) error {
+	_, err := io.WriteString(w, "[")
+	return err
+}
+
+func (f *jsonFormatter) Write(w io.Writer, r Result) error {
+	data, err := json.MarshalIndent(r, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := "\n  "
+	if f.count > 0 {
+		sep = ",\n  "
+	}
+	f.count++
+	_, err = io.WriteString(w, sep+string(data))
+	return err
+}
+
+func (f *jsonFormatter) End(w io.Writer) error {
+	if f.count == 0 {
+		_, err := io.WriteString(w, "]\n")
+		return err
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+type jsonlFormatter struct{}
+
+func (jsonlFormatter) Begin(io.Writer) error { return nil }
+func (jsonlFormatter) End(io.Writer) error   { return nil }
+
+func (jsonlFormatter) Write(w io.Writer, r Result) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+type orgFormatter struct{}
+
+func (orgFormatter) Begin(io.Writer) error { return nil }
+func (orgFormatter) End(io.Writer) error   { return nil }
+
+func (orgFormatter) Write(w io.Writer, r Result) error {
+	var b strings.Builder
+	title := strings.NewReplacer("[", "(", "]", ")").Replace(r.Title)
+	if r.URL != "" {
+		fmt.Fprintf(&b, "* [[%s][%s]]\n", r.URL, title)
+	} else {
+		fmt.Fprintf(&b, "* %s\n", title)
+	}
+	if r.Score > 0 {
+		fmt.Fprintf(&b, ":PROPERTIES:\n:SCORE: %.3f\n:END:\n", r.Score)
+	}
+	if r.Text != "" {
+		// Leading asterisks would start a new heading.
+		for _, line := range strings.Split(r.Text, "\n") {
+			if strings.HasPrefix(line, "*") {
+				line = "," + line
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type htmlFormatter struct{}
+
+func (htmlFormatter) Begin(w io.Writer) error {
+	_, err := io.WriteString(w, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>semsearch</title></head>\n<body>\n")
+	return err
+}
+
+func (htmlFormatter) Write(w io.Writer, r Result) error {
+	var b strings.Builder
+	b.WriteString("<article>\n")
+	if r.URL != "" {
+		fmt.Fprintf(&b, "<h2><a href=\"%s\">%s</a></h2>\n", html.EscapeString(r.URL), html.EscapeString(r.Title))
+	} else {
+		fmt.Fprintf(&b, "<h2>%s</h2>\n", html.EscapeString(r.Title))
+	}
+	for _, para := range strings.Split(r.Text, "\n\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			fmt.Fprintf(&b, "<p>%s</p>\n", strings.ReplaceAll(html.EscapeString(para), "\n", "<br>\n"))
+		}
+	}
+	b.WriteString("</article>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (htmlFormatter) End(w io.Writer) error {
+	_, err := io.WriteString(w, "</body>\n</html>\n")
+	return err
+}
+
+type templateFormatter struct {
+	tmpl  *template.Template
+	count int
+}
+
+func (f *templateFormatter) Begin(io.Writer) error { return nil }
+func (f *templateFormatter) End(io.Writer) error   { return nil }
+
+func (f *templateFormatter) Write(w io.Writer, r Result) error {
+	var b strings.Builder
+	if err := f.tmpl.Execute(&b, TemplateData{Result: r, Index: f.count}); err != nil {
+		return err
+	}
+	f.count++
+	out := b.String()
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+func wrapText(text string, width int) string {
+	var result strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if len(line) <= width {
+			result.WriteString(line + "\n")
+			continue
+		}
+		words := strings.Fields(line)
+		var current strings.Builder
+		for _, word := range words {
+			if current.Len() == 0 {
+				current.WriteString(word)
+			} else if current.Len()+1+len(word) <= width {
+				current.WriteString(" " + word)
+			} else {
+				result.WriteString(current.String() + "\n")
+				current.Reset()
+				current.WriteString(word)
+			}
+		}
+		if current.Len() > 0 {
+			result.WriteString(current.String() + "\n")
+		}
+	}
+	return strings.TrimRight(result.String(), "\n")
+}
@@ -0,0 +1,107 @@
+package semsearch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var formatTestResults = []Result{
+	{Title: "First", URL: "https://one.example", Text: "alpha"},
+	{Title: "Second [draft]", URL: "https://two.example", Text: "* bravo\n\ncharlie", Score: 0.9},
+}
+
+func TestFormatResults_Labelled(t *testing.T) {
+	got := FormatResults(formatTestResults[:1])
+	want := "Title: First\nURL: https://one.example\nText: alpha\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if parsed := ParseResults(got); len(parsed) != 1 || parsed[0].Title != "First" || parsed[0].Text != "alpha" {
+		t.Errorf("round trip = %+v", parsed)
+	}
+}
+
+func TestFormatAll(t *testing.T) {
+	tests := []struct {
+		format string
+		checks []string
+	}{
+		{"markdown", []string{"## First\nhttps://one.example\n\nalpha\n", "\n---\n\n## Second"}},
+		{"org", []string{"* [[https://one.example][First]]", "* [[https://two.example][Second (draft)]]", ":SCORE: 0.900", ",* bravo"}},
+		{"html", []string{"<!DOCTYPE html>", `<a href="https://one.example">First</a>`, "<p>charlie</p>", "</html>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f, err := NewFormatter(tt.format, "")
+			if err != nil {
+				t.Fatalf("NewFormatter() error = %v", err)
+			}
+			got, err := FormatAll(f, formatTestResults)
+			if err != nil {
+				t.Fatalf("FormatAll() error = %v", err)
+			}
+			for _, want := range tt.checks {
+				if !strings.Contains(got, want) {
+					t.Errorf("output missing %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatAll_JSON(t *testing.T) {
+	for _, results := range [][]Result{nil, formatTestResults} {
+		f, _ := NewFormatter("json", "")
+		got, err := FormatAll(f, results)
+		if err != nil {
+			t.Fatalf("FormatAll() error = %v", err)
+		}
+		var decoded []Result
+		if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+			t.Fatalf("invalid JSON %q: %v", got, err)
+		}
+		if len(decoded) != len(results) {
+			t.Errorf("decoded %d results, want %d", len(decoded), len(results))
+		}
+	}
+}
+
+func TestFormatAll_JSONLines(t *testing.T) {
+	f, _ := NewFormatter("jsonl", "")
+	got, _ := FormatAll(f, formatTestResults)
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		var r Result
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Errorf("invalid JSON line %q: %v", line, err)
+		}
+	}
+}
+
+func TestFormatAll_Template(t *testing.T) {
+	f, err := NewFormatter("template", "{{.Index}}: {{.Title}} <{{.URL}}>")
+	if err != nil {
+		t.Fatalf("NewFormatter() error = %v", err)
+	}
+	got, _ := FormatAll(f, formatTestResults)
+	want := "0: First <https://one.example>\n1: Second [draft] <https://two.example>\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewFormatter_Errors(t *testing.T) {
+	if _, err := NewFormatter("yaml", ""); err == nil {
+		t.Error("unknown format: want error")
+	}
+	if _, err := NewFormatter("template", ""); err == nil {
+		t.Error("empty template: want error")
+	}
+	if _, err := NewFormatter("template", "{{.Title"); err == nil {
+		t.Error("malformed template: want error")
+	}
+}
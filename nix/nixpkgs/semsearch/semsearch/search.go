@@ -17,14 +17,26 @@ func Search(query string, cfg Config) ([]Result, error) {
 // SearchMultiple performs a web search for multiple queries.
 func SearchMultiple(queries []string, cfg Config) ([]Result, error) {
 	var results []Result
+	err := SearchEach(queries, cfg, func(_ string, r []Result) error {
+		results = append(results, r...)
+		return nil
+	})
+	return results, err
+}
+
+// SearchEach searches each query in turn, calling fn with its results as soon
+// as they arrive. An error from fn stops the remaining searches.
+func SearchEach(queries []string, cfg Config, fn func(query string, results []Result) error) error {
 	for _, query := range queries {
 		r, err := googleSearch(query, cfg)
 		if err != nil {
-			return nil, fmt.Errorf("query %q: %w", query, err)
+			return fmt.Errorf("query %q: %w", query, err)
+		}
+		if err := fn(query, r); err != nil {
+			return err
 		}
-		results = append(results, r...)
 	}
-	return results, nil
+	return nil
 }
 
 // SearchRaw performs a web search returning markdown.
@@ -6,26 +6,67 @@ type Config struct {
 	GoogleCX     string
 	EmbedURL     string
 	EmbedModel   string
-	Threshold    float64
-	NumResults   int
+	// EmbedBatchSize and EmbedBatchTokens bound each embeddings request;
+	// EmbedConcurrency bounds how many are in flight. Zero selects a default.
+	EmbedBatchSize   int
+	EmbedBatchTokens int
+	EmbedConcurrency int
+	Threshold        float64
+	NumResults       int
+	ChunkTokens      int
+	ChunkOverlap     int
+	ChatURL          string
+	ChatModel        string
+	// ChatPromptPrefix is prepended to every user prompt sent to the chat
+	// model, e.g. "/no_think " to skip Qwen's reasoning pass.
+	ChatPromptPrefix string
+	// Expansions is how many LLM-generated queries ExpandQueries adds.
+	Expansions int
+	// MMRTopK, when positive, limits Filter to that many chunks chosen by
+	// maximal marginal relevance with weight MMRLambda.
+	MMRTopK   int
+	MMRLambda float64
 }
 
 // DefaultConfig returns sensible defaults.
 func DefaultConfig() Config {
 	return Config{
-		EmbedURL:   "http://herakles.home:4000/v1",
-		EmbedModel: "qwen-embed",
-		Threshold:  0.7,
-		NumResults: 5,
+		EmbedURL:         "http://herakles.home:4000/v1",
+		EmbedModel:       "qwen-embed",
+		Threshold:        0.7,
+		NumResults:       5,
+		ChunkTokens:      DefaultChunkTokens,
+		ChunkOverlap:     DefaultChunkOverlap,
+		EmbedBatchSize:   DefaultEmbedBatchSize,
+		EmbedBatchTokens: DefaultEmbedBatchTokens,
+		EmbedConcurrency: DefaultEmbedConcurrency,
+		ChatURL:          "http://herakles.home:4000/v1",
+		MMRLambda:        DefaultMMRLambda,
 	}
 }
 
+func (c Config) chunkOptions() ChunkOptions {
+	return ChunkOptions{MaxTokens: c.ChunkTokens, OverlapTokens: c.ChunkOverlap}
+}
+
 // Result is a search result.
 type Result struct {
-	Title string  `json:"title"`
-	URL   string  `json:"url"`
-	Text  string  `json:"text"`
-	Score float64 `json:"score,omitempty"`
+	Title    string    `json:"title"`
+	URL      string    `json:"url"`
+	Text     string    `json:"text"`
+	Score    float64   `json:"score,omitempty"`
+	Excerpts []Excerpt `json:"excerpts,omitempty"`
+}
+
+// Excerpt is a relevant span of a result's original text, as kept by Filter.
+// Start and End are byte offsets into the filtered Text, which joins the
+// excerpts.
+type Excerpt struct {
+	Text    string  `json:"text"`
+	Heading string  `json:"heading,omitempty"`
+	Start   int     `json:"start"`
+	End     int     `json:"end"`
+	Score   float64 `json:"score"`
 }
 
 type embeddingResponse struct {
@@ -35,6 +76,12 @@ type embeddingResponse struct {
 	} `json:"data"`
 }
 
+type modelsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
 type googleSearchResponse struct {
 	Items []struct {
 		Title   string `json:"title"`